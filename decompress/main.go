@@ -1,32 +1,272 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
+	"cloud.google.com/go/storage"
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+	"google.golang.org/api/option"
 )
 
+// 圧縮形式ごとのマジックバイトと拡張子
+type compressionFormat struct {
+	Name      string
+	Magic     []byte
+	Extension string
+}
+
+var compressionFormats = []compressionFormat{
+	{Name: "snappy", Magic: []byte("\xff\x06\x00\x00sNaPpY"), Extension: ".sz"},
+	{Name: "gzip", Magic: []byte{0x1f, 0x8b}, Extension: ".gz"},
+	{Name: "zstd", Magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, Extension: ".zst"},
+}
+
 func main() {
-	// 引数のパスのファイルを読み込む
-	file, err := os.Open(os.Args[1])
+	if len(os.Args) < 2 {
+		log.Fatal("Usage: decompress <file, directory or gs://bucket/key>")
+	}
+
+	// GCSのオブジェクトを直接解凍
+	if strings.HasPrefix(os.Args[1], "gs://") {
+		if err := decompressGCSObject(os.Args[1]); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	srcPath := filepath.Clean(os.Args[1])
+
+	info, err := os.Stat(srcPath)
 	if err != nil {
 		panic(err)
 	}
 
-	// 解凍先のファイルを作成
-	newFileName := filepath.Base(os.Args[1]) + "_decompressed"
-	newFile, err := os.Create(newFileName)
+	// ファイルの場合はそのまま解凍
+	if !info.IsDir() {
+		newFileName := filepath.Base(srcPath) + "_decompressed"
+		format, err := decompressFile(srcPath, newFileName)
+		if err != nil {
+			panic(err)
+		}
+		if format == nil {
+			log.Fatalf("Error: Unknown compression format: %v", srcPath)
+		}
+		return
+	}
+
+	// ディレクトリの場合は再帰的に解凍し、相対パスを保ってディレクトリと同じ階層の<ディレクトリ名>_decompressedに書き出す
+	// 作業ディレクトリからの相対パスにすると、"."を指定した場合に書き出したものを再び解凍してしまう
+	srcPath, err = filepath.Abs(srcPath)
 	if err != nil {
 		panic(err)
 	}
-	defer newFile.Close()
+	dstDir := srcPath + "_decompressed"
+	totalFiles := 0
+	skippedFiles := 0
+	totalErrors := 0
+	err = filepath.WalkDir(srcPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// ルートを指定した場合など、書き出し先が中にある場合も書き出したものは読まない
+			if filePath == dstDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		totalFiles++
 
-	// snappyで解凍
-	snappyReader := snappy.NewReader(file)
-	_, err = io.Copy(newFile, snappyReader)
+		relPath, err := filepath.Rel(srcPath, filePath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dstDir, relPath)
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+			return err
+		}
+
+		format, err := decompressFile(filePath, dstPath)
+		if err != nil {
+			log.Printf("Error: Failed to decompress %v: %v", filePath, err)
+			totalErrors++
+			return nil
+		}
+		if format == nil {
+			fmt.Printf(" - %v (Unknown format, skipped)\n", relPath)
+			skippedFiles++
+			return nil
+		}
+
+		// 拡張子が圧縮形式のものなら取り除く
+		if strings.HasSuffix(dstPath, format.Extension) {
+			if err := os.Rename(dstPath, strings.TrimSuffix(dstPath, format.Extension)); err != nil {
+				return err
+			}
+		}
+		fmt.Printf(" - %v (%v)\n", relPath, format.Name)
+		return nil
+	})
 	if err != nil {
 		panic(err)
 	}
+
+	fmt.Printf("Decompress completed: %d files, %d skipped, %d errors\n", totalFiles, skippedFiles, totalErrors)
+}
+
+// GCSのオブジェクトを取得し、保存されているメタデータを表示して解凍する
+// 認証情報はGOOGLE_CREDENTIALS_JSON、またはGOOGLE_APPLICATION_CREDENTIALSから読み込む
+func decompressGCSObject(uri string) error {
+	bucketName, key, found := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	if !found || bucketName == "" || key == "" {
+		return fmt.Errorf("invalid GCS URI: %v", uri)
+	}
+
+	ctx := context.Background()
+	var gcsOptions []option.ClientOption
+	if credentialsJSON := os.Getenv("GOOGLE_CREDENTIALS_JSON"); credentialsJSON != "" {
+		gcsOptions = append(gcsOptions, option.WithCredentialsJSON([]byte(credentialsJSON)))
+	}
+	gcsClient, err := storage.NewClient(ctx, gcsOptions...)
+	if err != nil {
+		return err
+	}
+	defer gcsClient.Close()
+
+	gcsObject := gcsClient.Bucket(bucketName).Object(key)
+	attrs, err := gcsObject.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+
+	// メタデータの表示
+	fmt.Printf("Object: %v\n", uri)
+	fmt.Printf(" - Size: %d\n", attrs.Size)
+	fmt.Printf(" - Updated: %v\n", attrs.Updated.Format("2006/01/02 15:04:05"))
+	fmt.Printf(" - ContentType: %v\n", attrs.ContentType)
+	fmt.Printf(" - ContentEncoding: %v\n", attrs.ContentEncoding)
+	fmt.Printf(" - ContentDisposition: %v\n", attrs.ContentDisposition)
+	fmt.Printf(" - ContentLanguage: %v\n", attrs.ContentLanguage)
+	fmt.Printf(" - CacheControl: %v\n", attrs.CacheControl)
+	for metaKey, value := range attrs.Metadata {
+		fmt.Printf(" - Metadata %v: %v\n", metaKey, value)
+	}
+
+	// GCS_TRANSCODINGでContent-Encoding: gzipを付けたものも、GCSに解凍させずに保存したデータをそのまま読む
+	gcsObjectReader, err := gcsObject.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer gcsObjectReader.Close()
+
+	newFileName := path.Base(key) + "_decompressed"
+
+	// 圧縮せずにバックアップしたもの（COMPRESSION=none）はそのまま書き出す
+	if attrs.Metadata[backupformat.MetadataCompression] == "none" {
+		if err := writeFile(gcsObjectReader, newFileName); err != nil {
+			return err
+		}
+		fmt.Printf("Not compressed, written to %v\n", newFileName)
+		return nil
+	}
+
+	bufReader := bufio.NewReader(gcsObjectReader)
+	format, err := detectFormat(bufReader)
+	if err != nil {
+		return err
+	}
+	if format == nil {
+		return fmt.Errorf("unknown compression format: %v", uri)
+	}
+
+	if err := decompressTo(bufReader, format, newFileName); err != nil {
+		return err
+	}
+	fmt.Printf("Decompressed (%v) to %v\n", format.Name, newFileName)
+	return nil
+}
+
+// マジックバイトから圧縮形式を判定する
+// 判定できなかった場合はnilを返す
+func detectFormat(reader *bufio.Reader) (*compressionFormat, error) {
+	for i := range compressionFormats {
+		format := &compressionFormats[i]
+		header, err := reader.Peek(len(format.Magic))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if bytes.Equal(header, format.Magic) {
+			return format, nil
+		}
+	}
+	return nil, nil
+}
+
+// 圧縮形式を判定してファイルを解凍する
+// 形式が判定できなかった場合は何も書き出さずnilを返す
+func decompressFile(srcPath string, dstPath string) (*compressionFormat, error) {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bufReader := bufio.NewReader(file)
+	format, err := detectFormat(bufReader)
+	if err != nil || format == nil {
+		return nil, err
+	}
+	return format, decompressTo(bufReader, format, dstPath)
+}
+
+// 指定された形式で解凍してファイルに書き出す
+func decompressTo(src io.Reader, format *compressionFormat, dstPath string) error {
+	var reader io.Reader
+	switch format.Name {
+	case "snappy":
+		reader = snappy.NewReader(src)
+	case "gzip":
+		gzipReader, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "zstd":
+		zstdReader, err := zstd.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	}
+
+	return writeFile(reader, dstPath)
+}
+
+// ファイルを作成して書き出す
+func writeFile(reader io.Reader, dstPath string) error {
+	newFile, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
+
+	if _, err := io.Copy(newFile, reader); err != nil {
+		return err
+	}
+	return newFile.Close()
 }
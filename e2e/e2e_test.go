@@ -0,0 +1,254 @@
+//go:build e2e
+
+// MinIOとfake-gcs-serverに対して、バックアップ・検証・復元を通して実行する
+// 実行方法はREADMEの「E2Eテスト」を参照
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/traPtitech/s3-backup-helper/pkg/backup"
+	"github.com/traPtitech/s3-backup-helper/pkg/restore"
+)
+
+const bucketNameSuffix = "-backup"
+
+// テスト用に生成するオブジェクト
+type testObject struct {
+	key          string
+	body         []byte
+	contentType  string
+	cacheControl string
+	metadata     map[string]string
+}
+
+func generateObjects() []testObject {
+	random := rand.New(rand.NewPCG(1, 2))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(random.UintN(256))
+		}
+		return b
+	}
+	return []testObject{
+		{key: "empty"},
+		{key: "text/hello.txt", body: []byte("hello, world\n"), contentType: "text/plain", metadata: map[string]string{"owner": "e2e"}},
+		{key: "random/small", body: randomBytes(64 * 1024), contentType: "application/octet-stream"},
+		{key: "random/large", body: randomBytes(6 * 1024 * 1024), contentType: "application/octet-stream"},
+		{key: "compressible/log.txt", body: []byte(strings.Repeat("2024-01-01T00:00:00Z INFO s3-backup-helper e2e\n", 50000)), contentType: "text/plain"},
+		{key: "dir with space/日本語.json", body: []byte(`{"name":"traP"}`), contentType: "application/json", cacheControl: "max-age=3600", metadata: map[string]string{"stamp-id": "0123"}},
+	}
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+
+	s3Endpoint := getenv("S3_ENDPOINT", "http://127.0.0.1:9000")
+	s3AccessKey := getenv("S3_ACCESS_KEY", "ROOT")
+	s3SecretKey := getenv("S3_SECRET_KEY", "PASSWORD")
+	t.Setenv("S3_ENDPOINT", s3Endpoint)
+	t.Setenv("S3_REGION", "us-east-1")
+	t.Setenv("S3_ACCESS_KEY", s3AccessKey)
+	t.Setenv("S3_SECRET_KEY", s3SecretKey)
+	t.Setenv("S3_FORCE_PATH_STYLE", "true")
+	t.Setenv("STORAGE_EMULATOR_HOST", getenv("STORAGE_EMULATOR_HOST", "localhost:4443"))
+	t.Setenv("GCP_PROJECT_ID", "e2e")
+	t.Setenv("GCS_REGION", "US")
+	t.Setenv("GCS_BUCKET_NAME_SUFFIX", bucketNameSuffix)
+	// エミュレーターはライフサイクルなどを完全には再現しないため、バケットの設定は確認しない
+	t.Setenv("GCS_BUCKET_CHECK", "ignore")
+	t.Setenv("VERIFY_UPLOADS", "full")
+	backup.LoadConfigFromEnv()
+
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(s3AccessKey, s3SecretKey, "")),
+		config.WithRegion("us-east-1"),
+	)
+	if err != nil {
+		t.Fatalf("failed to load S3 config: %v", err)
+	}
+	s3Client := s3.NewFromConfig(cfg, func(opt *s3.Options) {
+		opt.UsePathStyle = true
+		opt.BaseEndpoint = aws.String(s3Endpoint)
+	})
+	gcsClient, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("failed to create GCS client: %v", err)
+	}
+	defer gcsClient.Close()
+
+	objects := generateObjects()
+	runID := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, compression := range []string{"snappy", "gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			sourceBucket := fmt.Sprintf("e2e-%v-%v", compression, runID)
+			restoredBucket := sourceBucket + "-restored"
+			putObjects(ctx, t, s3Client, sourceBucket, objects)
+
+			// 1回目はすべてアップロードする
+			runner, err := backup.NewRunner(backup.Options{S3Bucket: sourceBucket, Compression: compression, Quiet: true})
+			if err != nil {
+				t.Fatalf("NewRunner returned error: %v", err)
+			}
+			result, err := runner.Run(ctx)
+			if err != nil {
+				t.Fatalf("backup returned error: %v", err)
+			}
+			if result.Errors != 0 || result.TotalObjects != int64(len(objects)) || result.SkippedObjects != 0 {
+				t.Fatalf("first backup: total %d, skipped %d, errors %d (%v), want total %d", result.TotalObjects, result.SkippedObjects, result.Errors, result.FailedObjects, len(objects))
+			}
+
+			verifyBackup(ctx, t, gcsClient.Bucket(sourceBucket+bucketNameSuffix), compression, objects)
+
+			// 2回目は記録したメタデータからすべてスキップする
+			result, err = runner.Run(ctx)
+			if err != nil {
+				t.Fatalf("backup returned error: %v", err)
+			}
+			if result.Errors != 0 || result.SkippedObjects != int64(len(objects)) {
+				t.Fatalf("second backup: skipped %d, errors %d, want skipped %d", result.SkippedObjects, result.Errors, len(objects))
+			}
+
+			restoreResult, err := restore.NewRunner(restore.Options{
+				S3Endpoint:   s3Endpoint,
+				S3Region:     "us-east-1",
+				S3AccessKey:  s3AccessKey,
+				S3SecretKey:  s3SecretKey,
+				Buckets:      []restore.BucketMapping{{GCSBucket: sourceBucket + bucketNameSuffix, S3Bucket: restoredBucket}},
+				CreateBucket: true,
+			}).Run(ctx)
+			if err != nil {
+				t.Fatalf("restore returned error: %v", err)
+			}
+			if restoreResult.Errors != 0 || restoreResult.TotalObjects != len(objects) {
+				t.Fatalf("restore: total %d, errors %d, want total %d", restoreResult.TotalObjects, restoreResult.Errors, len(objects))
+			}
+
+			verifyRestored(ctx, t, s3Client, restoredBucket, objects)
+		})
+	}
+}
+
+func putObjects(ctx context.Context, t *testing.T, s3Client *s3.Client, bucket string, objects []testObject) {
+	t.Helper()
+	if _, err := s3Client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("failed to create bucket %v: %v", bucket, err)
+	}
+	for _, object := range objects {
+		input := &s3.PutObjectInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(object.key),
+			Body:     bytes.NewReader(object.body),
+			Metadata: object.metadata,
+		}
+		if object.contentType != "" {
+			input.ContentType = aws.String(object.contentType)
+		}
+		if object.cacheControl != "" {
+			input.CacheControl = aws.String(object.cacheControl)
+		}
+		if _, err := s3Client.PutObject(ctx, input); err != nil {
+			t.Fatalf("failed to put %v: %v", object.key, err)
+		}
+	}
+}
+
+// バックアップしたオブジェクトに、圧縮形式と元のデータのハッシュとサイズが記録されているか確認する
+func verifyBackup(ctx context.Context, t *testing.T, bucket *storage.BucketHandle, compression string, objects []testObject) {
+	t.Helper()
+	for _, object := range objects {
+		attrs, err := bucket.Object(object.key).Attrs(ctx)
+		if err != nil {
+			t.Errorf("backup of %v: %v", object.key, err)
+			continue
+		}
+		hash := md5.Sum(object.body)
+		want := map[string]string{
+			"x-backup-compression":   compression,
+			"x-backup-original-md5":  hex.EncodeToString(hash[:]),
+			"x-backup-original-size": strconv.Itoa(len(object.body)),
+		}
+		for key, value := range want {
+			if attrs.Metadata[key] != value {
+				t.Errorf("backup of %v: metadata %v = %q, want %q", object.key, key, attrs.Metadata[key], value)
+			}
+		}
+		for key, value := range object.metadata {
+			if attrs.Metadata[key] != value {
+				t.Errorf("backup of %v: metadata %v = %q, want %q", object.key, key, attrs.Metadata[key], value)
+			}
+		}
+		if object.contentType != "" && attrs.ContentType != object.contentType {
+			t.Errorf("backup of %v: content type %q, want %q", object.key, attrs.ContentType, object.contentType)
+		}
+	}
+}
+
+// 復元したオブジェクトの内容、ヘッダー、メタデータが元と同じか確認する
+func verifyRestored(ctx context.Context, t *testing.T, s3Client *s3.Client, bucket string, objects []testObject) {
+	t.Helper()
+	for _, object := range objects {
+		output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(object.key)})
+		if err != nil {
+			t.Errorf("restored %v: %v", object.key, err)
+			continue
+		}
+		body, err := io.ReadAll(output.Body)
+		output.Body.Close()
+		if err != nil {
+			t.Errorf("restored %v: %v", object.key, err)
+			continue
+		}
+		if !bytes.Equal(body, object.body) {
+			t.Errorf("restored %v: body differs (%d bytes, want %d bytes)", object.key, len(body), len(object.body))
+		}
+		if object.contentType != "" && aws.ToString(output.ContentType) != object.contentType {
+			t.Errorf("restored %v: content type %q, want %q", object.key, aws.ToString(output.ContentType), object.contentType)
+		}
+		if aws.ToString(output.CacheControl) != object.cacheControl {
+			t.Errorf("restored %v: cache control %q, want %q", object.key, aws.ToString(output.CacheControl), object.cacheControl)
+		}
+		// バックアップ用のメタデータは復元しない
+		if !maps.Equal(output.Metadata, object.metadata) {
+			t.Errorf("restored %v: metadata %v, want %v", object.key, output.Metadata, object.metadata)
+		}
+	}
+
+	// バックアップのみにある管理用のオブジェクトは復元しない
+	output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+	if err != nil {
+		t.Fatalf("failed to list %v: %v", bucket, err)
+	}
+	if len(output.Contents) != len(objects) {
+		var keys []string
+		for _, content := range output.Contents {
+			keys = append(keys, aws.ToString(content.Key))
+		}
+		t.Errorf("restored bucket has %d objects, want %d: %v", len(output.Contents), len(objects), keys)
+	}
+}
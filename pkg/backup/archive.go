@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// アーカイブ層（Glacier Flexible Retrieval、Deep Archive、Intelligent-Tieringのアーカイブ層）にあり、復元しないと読めないオブジェクトの扱い
+const (
+	// スキップして報告する
+	archivedSkip = "skip"
+	// 復元をリクエストしてスキップし、報告する（復元が終わった後の実行でバックアップされる）
+	archivedRestore = "restore"
+	// エラーとする
+	archivedFail = "fail"
+)
+
+// オブジェクトがアーカイブ層にあって読めない場合のエラー
+var errObjectArchived = errors.New("object is in an archive tier and has not been restored")
+
+// GetObjectのエラーがアーカイブ層にあるオブジェクトによるものか判定する
+func isArchivedObjectError(err error) bool {
+	return isS3ErrorCode(err, "InvalidObjectState")
+}
+
+// アーカイブ層からの復元をリクエストできるバックアップ元
+type archiveRestorer interface {
+	RestoreArchived(ctx context.Context, key string) error
+}
+
+// アーカイブ層にあって読めないオブジェクトを、ARCHIVED_OBJECTSに従って処理する
+// 復元をリクエストした場合もerrObjectArchivedを返し、呼び出し側でスキップとして報告する（リクエストに失敗した場合はそのエラーを返す）
+func (c *backupConfig) handleArchivedObject(ctx context.Context, source ObjectSource, key string) error {
+	if restorer, ok := source.(archiveRestorer); ok && c.archivedObjectPolicy == archivedRestore {
+		if err := restorer.RestoreArchived(ctx, key); err != nil {
+			return err
+		}
+	}
+	return errObjectArchived
+}
+
+// アーカイブ層のオブジェクトの復元をリクエストする（復元中の場合は何もしない）
+func (c *backupConfig) requestArchiveRestore(ctx context.Context, s3Client *s3.Client, key string) error {
+	headOutput, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(c.s3Config.Bucket),
+		Key:          aws.String(key),
+		RequestPayer: c.s3RequestPayer(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get object: %w", err)
+	}
+	if strings.Contains(aws.ToString(headOutput.Restore), `ongoing-request="true"`) {
+		return nil
+	}
+
+	restoreRequest := &types.RestoreRequest{}
+	// Intelligent-Tieringのアーカイブ層は、日数と速さを指定せずに復元する（復元後は高頻度アクセス層に戻る）
+	if headOutput.StorageClass != types.StorageClassIntelligentTiering {
+		restoreRequest.Days = aws.Int32(c.archivedRestoreDays)
+		restoreRequest.GlacierJobParameters = &types.GlacierJobParameters{Tier: c.archivedRestoreTier}
+	}
+	_, err = s3Client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket:         aws.String(c.s3Config.Bucket),
+		Key:            aws.String(key),
+		RestoreRequest: restoreRequest,
+		RequestPayer:   c.s3RequestPayer(),
+	})
+	if err != nil && !isS3ErrorCode(err, "RestoreAlreadyInProgress") {
+		return fmt.Errorf("failed to request restore: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+// 監査記録をアップロードするGCSバケット内のプレフィックス
+// 既存の記録を上書きしないように書き込むため、バケットの保持ポリシーと合わせると追記のみの記録になる
+const auditObjectPrefix = backupformat.AuditPrefix
+
+// 誰が、いつ、何をコピーしたかの監査記録
+type auditRecord struct {
+	RunID  string `json:"runId"`
+	Action string `json:"action"`
+	// 実行したOSのユーザーとホスト、GCSへのアクセスに使ったサービスアカウント
+	User           string    `json:"user"`
+	Host           string    `json:"host"`
+	ServiceAccount string    `json:"serviceAccount,omitempty"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+	Source         string    `json:"source"`
+	Destination    string    `json:"destination"`
+	// 認証情報を除いた設定のJSONのSHA-256（設定が実行ごとに変わっていないか確かめるため）
+	ConfigHash     string `json:"configHash"`
+	TotalObjects   int64  `json:"totalObjects"`
+	TotalBytes     int64  `json:"totalBytes"`
+	SkippedObjects int64  `json:"skippedObjects"`
+	Errors         int64  `json:"errors"`
+	Result         string `json:"result"`
+	Error          string `json:"error,omitempty"`
+}
+
+// バックアップの実行結果から監査記録を作る
+func (r *backupRun) newBackupAuditRecord(startTime time.Time, destination string, summary *backupSummary, runErr error) auditRecord {
+	record := auditRecord{
+		RunID:          r.runID,
+		Action:         "backup",
+		ServiceAccount: r.gcsServiceAccount(),
+		StartTime:      startTime,
+		EndTime:        time.Now(),
+		Source:         r.s3Config.Bucket,
+		Destination:    destination,
+		ConfigHash:     configHash(r.currentConfigSnapshot()),
+		Result:         "succeeded",
+	}
+	record.User, record.Host = auditActor()
+	if summary != nil {
+		record.TotalObjects = summary.TotalObjects
+		record.TotalBytes = summary.TotalBytes
+		record.SkippedObjects = summary.SkippedObjects
+		record.Errors = summary.Errors
+		if summary.Errors > 0 {
+			record.Result = "failed"
+		}
+	}
+	if runErr != nil {
+		record.Result = "failed"
+		record.Error = runErr.Error()
+	}
+	return record
+}
+
+// 監査記録を.s3-backup-helper/audit/<実行ID>.jsonとしてアップロードする
+// 同じ名前の記録が既にある場合は上書きせずにエラーにする
+func (c *backupConfig) writeAuditRecord(ctx context.Context, gcsBucket *storage.BucketHandle, record auditRecord) error {
+	recordJSON, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	writer := gcsBucket.Object(c.managedObjectName(auditObjectPrefix + record.RunID + ".json")).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(recordJSON); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload audit record: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload audit record: %w", err)
+	}
+	return nil
+}
+
+// 実行したOSのユーザー名とホスト名
+func auditActor() (string, string) {
+	userName := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		userName = current.Username
+	}
+	host, _ := os.Hostname()
+	return userName, host
+}
+
+// GCSへのアクセスに使うサービスアカウント（権限を借用する場合はそのアカウント、分からない場合は空）
+func (c *backupConfig) gcsServiceAccount() string {
+	if c.gcpConfig.ImpersonateServiceAccount != "" {
+		return c.gcpConfig.ImpersonateServiceAccount
+	}
+	credentialsJSON := c.gcpConfig.CredentialsJSON
+	if credentialsJSON == nil && c.gcpConfig.CredentialsPath != "" {
+		var err error
+		credentialsJSON, err = os.ReadFile(c.gcpConfig.CredentialsPath)
+		if err != nil {
+			return ""
+		}
+	}
+	var credentials struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if json.Unmarshal(credentialsJSON, &credentials) != nil {
+		return ""
+	}
+	return credentials.ClientEmail
+}
+
+// 設定のJSONのSHA-256
+func configHash(config any) string {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(configJSON)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,395 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/golang/snappy"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// バックアップしたオブジェクトに付けるメタデータのキー（意味はbackupformatを参照）
+const (
+	metadataOriginalMD5           = backupformat.MetadataOriginalMD5
+	metadataOriginalCRC32C        = backupformat.MetadataOriginalCRC32C
+	metadataOriginalSize          = backupformat.MetadataOriginalSize
+	metadataCompression           = backupformat.MetadataCompression
+	metadataBackupTime            = backupformat.MetadataBackupTime
+	metadataSourceETag            = backupformat.MetadataSourceETag
+	metadataSourceLastModified    = backupformat.MetadataSourceLastModified
+	metadataSourceContentEncoding = backupformat.MetadataSourceContentEncoding
+	metadataGCSTranscoding        = backupformat.MetadataGCSTranscoding
+)
+
+// 1回の読み込みでバックアップする場合に、書き込みを始める前にメモリに読み込む大きさ（GCSの書き込みのチャンクサイズのデフォルトと同じ）
+const singlePassBufferSize = 16 << 20
+
+// 1つのオブジェクトをバックアップする
+// sizeは一覧で得たサイズ（分からない場合は-1）
+// バックアップ先と内容が同じでスキップした場合はtrueを返す
+func (r *backupRun) backupObject(ctx context.Context, source ObjectSource, destination ObjectDestination, exporter *localExporter, key string, size int64) (skipped bool, err error) {
+	ctx, span := tracer.Start(ctx, "backupObject", trace.WithAttributes(attribute.String("s3.key", key)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("backup.skipped", skipped))
+		endSpan(span, err)
+	}()
+
+	// 転送が止まったまま戻らなくなるのを防ぐ
+	if r.objectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.objectTimeout)
+		defer cancel()
+	}
+
+	// バックアップ先のキー（KEY_PREFIX_MAPで書き換え、バックアップ先のプレフィックスを付ける）
+	mappedKey := mapKeyPrefix(key, r.keyPrefixMap)
+	if mappedKey == "" {
+		return false, errors.New("key is empty after KEY_PREFIX_MAP is applied")
+	}
+	// GCSのオブジェクト名として使えないキーはエスケープし、元のキーをメタデータに記録する（ローカルエクスポートは除く）
+	destinationKey, escaped := mappedKey, false
+	if exporter == nil {
+		destinationKey, escaped = escapeObjectName(r.destinationPrefix(), mappedKey)
+		if escaped {
+			r.logDebugf("Escaped %q to %v", key, destinationKey)
+		}
+	}
+	destinationKey = r.destinationPrefix() + destinationKey
+
+	// フルバックアップでない場合、バックアップ先のオブジェクトの情報を取得して比較に使う
+	// 重複排除とローカルエクスポートはそれぞれで比較する
+	var backupInfo *ObjectInfo
+	if !r.fullBackup && exporter == nil && !r.dedupEnabled {
+		// オブジェクトが存在しない場合などはnilのまま
+		if info, err := destination.Head(ctx, destinationKey); err == nil {
+			backupInfo = info
+		}
+	}
+
+	// ダウンロードとアップロードの同時実行数を分ける場合は、ダウンロードの枠が空くまで待つ
+	// 圧縮したデータを一時ファイルに書き終わったら枠を返し、アップロードの枠を待つ
+	releaseDownload, err := acquireSlot(ctx, r.downloadSlots)
+	if err != nil {
+		return false, err
+	}
+	defer releaseDownload()
+
+	// 本体をダウンロードする前に、HeadObjectのサイズとETagを記録したものと比較する
+	// 変更の無いオブジェクトはメタデータのリクエスト1回でスキップできる
+	// 条件付きのGetObjectを使う場合は、GetObjectの1回で同じことができるため行わない
+	var head *ObjectInfo
+	if backupInfo != nil && !r.s3Config.ConditionalGet && canSkipByHead(backupInfo) {
+		head, err = source.Head(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if sameAsBackup(head, backupInfo) {
+			r.logDebugf("Skipped %v: size and ETag match the backup", key)
+			return true, nil
+		}
+	}
+
+	// 大きいオブジェクトはパートに分けて並列にアップロードする
+	// パートごとに範囲を指定してダウンロードするため、本体全体をダウンロードする前に分ける
+	if r.compositeUploadThreshold > 0 && exporter == nil && !r.dedupEnabled && (size < 0 || size >= r.compositeUploadThreshold) {
+		if head == nil {
+			head, err = source.Head(ctx, key)
+			if err != nil {
+				return false, err
+			}
+		}
+		if head.Size >= r.compositeUploadThreshold {
+			// 本体を1度に読まないため、ハッシュによる比較は行わず、記録したサイズとETagのみで比較する（条件付きのGetObjectを使う場合も同じ）
+			if backupInfo != nil && sameAsBackup(head, backupInfo) {
+				r.logDebugf("Skipped %v: size and ETag match the backup", key)
+				return true, nil
+			}
+			if escaped {
+				recordOriginalKey(head, mappedKey)
+			}
+			err := r.backupObjectComposite(ctx, source, destination, head, key, destinationKey)
+			if errors.Is(err, errObjectArchived) {
+				return false, r.handleArchivedObject(ctx, source, key)
+			}
+			return false, err
+		}
+	}
+
+	// バックアップ元のオブジェクトのダウンロード
+	getOptions := GetOptions{Checksum: r.changeDetection == changeDetectionCRC32C}
+	// 記録したETagと同じ場合は304 Not Modifiedが返り、本体は転送されない
+	if r.s3Config.ConditionalGet && backupInfo != nil {
+		getOptions.IfNoneMatch = backupInfo.Metadata[metadataSourceETag]
+	}
+	info, body, err := source.Get(ctx, key, getOptions)
+	if err != nil {
+		if errors.Is(err, ErrNotModified) {
+			r.logDebugf("Skipped %v: not modified since the backup (If-None-Match)", key)
+			return true, nil
+		}
+		if errors.Is(err, errObjectArchived) {
+			return false, r.handleArchivedObject(ctx, source, key)
+		}
+		return false, err
+	}
+	defer body.Close()
+	if escaped {
+		recordOriginalKey(info, mappedKey)
+	}
+
+	// ローカルエクスポート
+	if exporter != nil {
+		return false, exporter.Export(destinationKey, info, body)
+	}
+
+	// 重複排除する場合
+	if r.dedupEnabled {
+		return r.backupObjectDeduplicated(ctx, destination, info, body, destinationKey)
+	}
+
+	// 圧縮してアップロードしながら、元のデータのMD5とサイズ、検証用に圧縮したデータのCRC32Cも同時に求める
+	originalHash := md5.New()
+	originalCRC32C := crc32.New(crc32cTable)
+	compressedHash := crc32.New(crc32cTable)
+	originalWriters := []io.Writer{originalHash, originalCRC32C}
+
+	// バックアップ先のオブジェクトと内容が同じかどうか（元のデータを読み終わってから判定する）
+	// バックアップ元のオブジェクトの本体は1度しか読めないため、比較のためだけに全体を先に読むことはしない
+	var unchanged func() bool
+
+	// バックアップ先のオブジェクトが存在する場合、ハッシュを比較
+	if backupInfo != nil {
+		originalCRC32CValue, hasOriginalCRC32C := backupInfo.Metadata[metadataOriginalCRC32C]
+
+		// 両方にCRC32Cがある場合は、本体を読まずに比較する
+		if r.changeDetection == changeDetectionCRC32C && info.ChecksumCRC32C != "" && hasOriginalCRC32C {
+			if info.ChecksumCRC32C == originalCRC32CValue {
+				r.logDebugf("Skipped %v: CRC32C matches the backup", key)
+				return true, nil
+			}
+		} else if originalMD5, ok := backupInfo.Metadata[metadataOriginalMD5]; ok {
+			// 圧縮前のMD5が記録されている場合は、圧縮形式によらず元のデータのハッシュを比較する
+			unchanged = func() bool {
+				return originalMD5 == hex.EncodeToString(originalHash.Sum(nil))
+			}
+		} else {
+			// 古いバックアップはsnappyで圧縮したデータのMD5と比較する
+			legacyHash := md5.New()
+			hashWriter := snappy.NewBufferedWriter(legacyHash)
+			defer hashWriter.Close()
+			originalWriters = append(originalWriters, hashWriter)
+			unchanged = func() bool {
+				hashWriter.Flush()
+				return bytes.Equal(backupInfo.MD5, legacyHash.Sum(nil))
+			}
+		}
+	}
+
+	// 1チャンク分までは、書き込みを始める前にメモリに読み込む
+	// 最後まで読めた場合は、アップロードを始めずにハッシュを比較でき、元のデータのハッシュとサイズも書き込むメタデータに含められる
+	originalReader := io.TeeReader(body, io.MultiWriter(originalWriters...))
+	var buffered bytes.Buffer
+	_, err = io.CopyN(&buffered, originalReader, singlePassBufferSize)
+	bodyRead := errors.Is(err, io.EOF)
+	if err != nil && !bodyRead {
+		return false, err
+	}
+	if bodyRead {
+		if unchanged != nil && unchanged() {
+			r.logDebugf("Skipped %v: content hash matches the backup", key)
+			return true, nil
+		}
+		unchanged = nil
+	} else if unchanged != nil && canSkipByHead(backupInfo) {
+		// 1チャンクより大きい場合はアップロードし終わるまでハッシュを比較できないため、HeadObjectか条件付きのGetObjectで変更があったと判断したものはそのままアップロードする
+		// 記録したETagと比べられないもの（ETagを記録していない古いバックアップ）も、1度アップロードし直せば次からはETagで比較できる
+		unchanged = nil
+	}
+
+	// 書き込み用オブジェクト作成
+	// 内容が同じだった場合や失敗した場合は、アップロードを取り消す
+	writeInfo := backupObjectInfo(info)
+	writeInfo.Metadata[metadataCompression] = r.compression
+	writeInfo.Metadata[metadataBackupTime] = time.Now().UTC().Format(time.RFC3339)
+	if info.ETag != "" {
+		writeInfo.Metadata[metadataSourceETag] = info.ETag
+	}
+	if bodyRead {
+		setOriginalHash(writeInfo.Metadata, originalHash.Sum(nil), originalCRC32C.Sum32(), int64(buffered.Len()))
+	}
+	var writer ObjectWriter
+	committed := false
+	defer func() {
+		if writer != nil && !committed {
+			writer.Abort()
+		}
+	}()
+
+	// ダウンロードとアップロードを分ける場合は一時ファイルに、そうでなければバックアップ先に直接書き込む
+	var compressTarget io.Writer
+	var spool *os.File
+	if r.uploadSlots != nil {
+		spool, err = r.createSpoolFile()
+		if err != nil {
+			return false, err
+		}
+		defer r.removeSpoolFile(spool)
+		compressTarget = spool
+	} else {
+		writer = destination.NewWriter(ctx, destinationKey, writeInfo)
+		compressTarget = writer
+	}
+
+	compressWriter, err := r.newCompressWriter(io.MultiWriter(compressTarget, compressedHash), r.compression)
+	if err != nil {
+		return false, err
+	}
+	defer compressWriter.Close()
+	// ダウンロード、圧縮、アップロードは並行して進むため、まとめて1つのスパンにする
+	_, transferSpan := tracer.Start(ctx, "transfer", trace.WithAttributes(attribute.String("backup.compression", r.compression)))
+	originalSize, err := pooledCopy(compressWriter, io.MultiReader(&buffered, originalReader))
+	if err == nil {
+		err = compressWriter.Close()
+	}
+	transferSpan.SetAttributes(attribute.Int64("backup.original_bytes", originalSize))
+	endSpan(transferSpan, err)
+	if err != nil {
+		return false, err
+	}
+
+	// ハッシュを比較し、同じだったらアップロードを取り消してスキップ
+	if unchanged != nil && unchanged() {
+		r.logDebugf("Skipped %v: content hash matches the backup", key)
+		return true, nil
+	}
+
+	// 一時ファイルに書き終わったら、アップロードの枠を待ってからアップロードする
+	// 元のデータのハッシュとサイズは分かっているため、書き込むメタデータに含める
+	if spool != nil {
+		body.Close()
+		releaseDownload()
+		releaseUpload, err := acquireSlot(ctx, r.uploadSlots)
+		if err != nil {
+			return false, err
+		}
+		defer releaseUpload()
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return false, fmt.Errorf("failed to read spool file: %w", err)
+		}
+		setOriginalHash(writeInfo.Metadata, originalHash.Sum(nil), originalCRC32C.Sum32(), originalSize)
+		writer = destination.NewWriter(ctx, destinationKey, writeInfo)
+		_, uploadSpan := tracer.Start(ctx, "upload")
+		_, err = pooledCopy(writer, spool)
+		endSpan(uploadSpan, err)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// 残りのデータを送り、アップロードを完了する
+	_, finalizeSpan := tracer.Start(ctx, "finalizeUpload")
+	committed = true
+	written, err := writer.Commit()
+	endSpan(finalizeSpan, err)
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.verifyUpload(ctx, destination, destinationKey, written, compressedHash.Sum32(), originalHash.Sum(nil)); err != nil {
+		return false, err
+	}
+	// 読み終わる前に書き込みを始めた場合のみ、アップロード後にメタデータに追加する
+	if !bodyRead && spool == nil {
+		if err := recordOriginalHash(ctx, destination, destinationKey, written, originalHash.Sum(nil), originalCRC32C.Sum32(), originalSize); err != nil {
+			return false, err
+		}
+	}
+
+	switch {
+	case r.fullBackup:
+		r.logDebugf("Uploaded %v: FULL_BACKUP is enabled", key)
+	case backupInfo == nil:
+		r.logDebugf("Uploaded %v: not in the backup", key)
+	default:
+		r.logDebugf("Uploaded %v: changed since the backup", key)
+	}
+
+	return false, nil
+}
+
+// S3のETagから前後の"を除く
+func trimETag(etag *string) string {
+	return strings.Trim(aws.ToString(etag), `"`)
+}
+
+// 条件付きのGetObjectで、オブジェクトが変更されていなかった（304 Not Modified）か判定する
+func isNotModified(err error) bool {
+	var responseErr *smithyhttp.ResponseError
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotModified
+}
+
+// 記録したメタデータから、HeadObjectのみで変更が無いと判断できるかどうか
+func canSkipByHead(backup *ObjectInfo) bool {
+	if _, ok := backup.Metadata[metadataOriginalSize]; !ok {
+		return false
+	}
+	_, hasETag := backup.Metadata[metadataSourceETag]
+	_, hasMD5 := backup.Metadata[metadataOriginalMD5]
+	return hasETag || hasMD5
+}
+
+// HeadObjectで得たサイズとETagが、バックアップ時に記録したものと同じかどうか
+// 同じと判断できない場合（古いバックアップでETagがMD5でない場合など）はfalseを返し、本体を比較する
+func sameAsBackup(head *ObjectInfo, backup *ObjectInfo) bool {
+	if backup.Metadata[metadataOriginalSize] != strconv.FormatInt(head.Size, 10) {
+		return false
+	}
+	etag := head.ETag
+	if etag == "" {
+		return false
+	}
+	if recorded, ok := backup.Metadata[metadataSourceETag]; ok {
+		return etag == recorded
+	}
+	// ETagを記録していないバックアップは、マルチパートアップロードでないオブジェクトのETag（MD5）と比較する
+	if recorded, ok := backup.Metadata[metadataOriginalMD5]; ok && !strings.Contains(etag, "-") {
+		return etag == recorded
+	}
+	return false
+}
+
+// 元のデータのハッシュとサイズをメタデータに記録する
+func setOriginalHash(metadata map[string]string, originalMD5 []byte, originalCRC32C uint32, originalSize int64) {
+	metadata[metadataOriginalMD5] = hex.EncodeToString(originalMD5)
+	metadata[metadataOriginalCRC32C] = encodeCRC32C(originalCRC32C)
+	metadata[metadataOriginalSize] = strconv.FormatInt(originalSize, 10)
+}
+
+// 書き込みを始めた後に読み終わった場合は、元のデータのハッシュとサイズをアップロード後にメタデータに追加する
+// 書き込んだ世代のみを更新し、同時に書き込まれた別の世代は変更しない
+func recordOriginalHash(ctx context.Context, destination ObjectDestination, key string, written *ObjectInfo, originalMD5 []byte, originalCRC32C uint32, originalSize int64) error {
+	metadata := make(map[string]string, len(written.Metadata)+3)
+	for metaKey, value := range written.Metadata {
+		metadata[metaKey] = value
+	}
+	setOriginalHash(metadata, originalMD5, originalCRC32C, originalSize)
+	if err := destination.UpdateMetadata(ctx, key, written.Generation, metadata); err != nil {
+		return fmt.Errorf("failed to update backup metadata: %w", err)
+	}
+	return nil
+}
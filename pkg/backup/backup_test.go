@@ -0,0 +1,300 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// デフォルトの設定でのテスト用の実行
+func newTestRun() *backupRun {
+	return newBackupRun(newBackupConfig(), "test", io.Discard, os.Stderr)
+}
+
+func md5Hex(body string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(body)))
+}
+
+func TestBackupObject(t *testing.T) {
+	ctx := context.Background()
+	const key = "a.txt"
+	// テストケースごとに作り直す（setupで設定を変更する）
+	var r *backupRun
+	// 1回バックアップしておく
+	backupOnce := func(t *testing.T, source *memorySource, destination *memoryDestination) {
+		t.Helper()
+		if _, err := r.backupObject(ctx, source, destination, nil, key, -1); err != nil {
+			t.Fatalf("backupObject returned error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, source *memorySource, destination *memoryDestination)
+		wantSkipped bool
+		wantErr     error
+		// バックアップ先に残るべき元のデータ（空の場合は確認しない）
+		wantBody string
+		check    func(t *testing.T, source *memorySource, destination *memoryDestination)
+	}{
+		{
+			name: "new object is uploaded",
+			setup: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				source.add(key, "hello", ObjectInfo{ContentType: "text/plain", Metadata: map[string]string{"owner": "traP"}})
+			},
+			wantBody: "hello",
+			check: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				metadata := destination.objects[key].info.Metadata
+				want := map[string]string{
+					"owner":                "traP",
+					metadataOriginalMD5:    md5Hex("hello"),
+					metadataOriginalSize:   "5",
+					metadataOriginalCRC32C: encodeCRC32C(crc32.Checksum([]byte("hello"), crc32cTable)),
+					metadataCompression:    compressionSnappy,
+					metadataSourceETag:     md5Hex("hello"),
+				}
+				for metaKey, value := range want {
+					if metadata[metaKey] != value {
+						t.Errorf("metadata %v = %q, want %q", metaKey, metadata[metaKey], value)
+					}
+				}
+				if got := destination.objects[key].info.ContentType; got != "text/plain" {
+					t.Errorf("content type = %q, want %q", got, "text/plain")
+				}
+				// 小さいオブジェクトはハッシュを書き込むメタデータに含め、アップロード後に更新しない
+				if destination.updates != 0 {
+					t.Errorf("metadata updated %d times, want 0", destination.updates)
+				}
+			},
+		},
+		{
+			name: "unchanged object is skipped by head",
+			setup: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				source.add(key, "hello", ObjectInfo{})
+				backupOnce(t, source, destination)
+			},
+			wantSkipped: true,
+			check: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				if source.gets != 1 {
+					t.Errorf("source.Get called %d times, want 1 (only the first backup)", source.gets)
+				}
+			},
+		},
+		{
+			name: "changed object is uploaded",
+			setup: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				source.add(key, "hello", ObjectInfo{})
+				backupOnce(t, source, destination)
+				source.add(key, "world", ObjectInfo{})
+			},
+			wantBody: "world",
+		},
+		{
+			name: "conditional get skips without head",
+			setup: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				r.s3Config.ConditionalGet = true
+				source.add(key, "hello", ObjectInfo{})
+				backupOnce(t, source, destination)
+			},
+			wantSkipped: true,
+			check: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				if source.heads != 0 {
+					t.Errorf("source.Head called %d times, want 0", source.heads)
+				}
+			},
+		},
+		{
+			name: "crc32c matches without reading the body",
+			setup: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				r.changeDetection = changeDetectionCRC32C
+				checksum := encodeCRC32C(crc32.Checksum([]byte("hello"), crc32cTable))
+				source.add(key, "hello", ObjectInfo{ChecksumCRC32C: checksum})
+				backupOnce(t, source, destination)
+				// 同じ内容をマルチパートアップロードし直してETagだけが変わった場合
+				source.add(key, "hello", ObjectInfo{ChecksumCRC32C: checksum, ETag: "0123456789abcdef-2"})
+			},
+			wantSkipped: true,
+			check: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				if destination.aborted != 0 {
+					t.Errorf("upload started %d times, want 0", destination.aborted)
+				}
+			},
+		},
+		{
+			name: "legacy backup is compared by content hash",
+			setup: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				source.add(key, "hello", ObjectInfo{})
+				// サイズを記録していない古いバックアップ
+				destination.objects[key] = &memoryObject{info: ObjectInfo{Key: key, Generation: 1, Metadata: map[string]string{metadataOriginalMD5: md5Hex("hello")}}}
+			},
+			wantSkipped: true,
+			check: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				// 1チャンクに収まるため、アップロードを始める前に比較する
+				if destination.aborted != 0 {
+					t.Errorf("upload started %d times, want 0", destination.aborted)
+				}
+			},
+		},
+		{
+			name: "full backup uploads unchanged object",
+			setup: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				source.add(key, "hello", ObjectInfo{})
+				backupOnce(t, source, destination)
+				r.fullBackup = true
+			},
+			wantBody: "hello",
+			check: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				if destination.generation != 2 {
+					t.Errorf("destination has %d generations, want 2", destination.generation)
+				}
+			},
+		},
+		{
+			name: "archived object is reported",
+			setup: func(t *testing.T, source *memorySource, destination *memoryDestination) {
+				source.add(key, "hello", ObjectInfo{})
+				source.getErrors[key] = fmt.Errorf("%w: InvalidObjectState", errObjectArchived)
+			},
+			wantErr: errObjectArchived,
+		},
+		{
+			name:    "missing source object is an error",
+			setup:   func(t *testing.T, source *memorySource, destination *memoryDestination) {},
+			wantErr: ErrObjectNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r = newTestRun()
+			r.verifyUploads = verifyFull
+			source, destination := newMemorySource(), newMemoryDestination()
+			tt.setup(t, source, destination)
+
+			skipped, err := r.backupObject(ctx, source, destination, nil, key, -1)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("backupObject returned error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backupObject returned error: %v", err)
+			}
+			if skipped != tt.wantSkipped {
+				t.Errorf("backupObject skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+			if tt.wantBody != "" {
+				object := destination.objects[key]
+				reader, err := newDecompressReader(bytes.NewReader(object.body), objectCompression(object.info.Metadata))
+				if err != nil {
+					t.Fatalf("newDecompressReader returned error: %v", err)
+				}
+				body, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("failed to decompress backup: %v", err)
+				}
+				if string(body) != tt.wantBody {
+					t.Errorf("backup body = %q, want %q", body, tt.wantBody)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, source, destination)
+			}
+		})
+	}
+}
+
+func TestRunnerWithInjectedClients(t *testing.T) {
+	source, destination := newMemorySource(), newMemoryDestination()
+	for i := range 3 {
+		source.add(fmt.Sprintf("objects/%d", i), fmt.Sprintf("body %d", i), ObjectInfo{})
+	}
+	runner, err := NewRunner(Options{Source: source, Destination: destination, Quiet: true})
+	if err != nil {
+		t.Fatalf("NewRunner returned error: %v", err)
+	}
+
+	result, err := runner.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if result.TotalObjects != 3 || result.SkippedObjects != 0 || result.Errors != 0 {
+		t.Errorf("first run: total %d, skipped %d, errors %d, want 3, 0, 0", result.TotalObjects, result.SkippedObjects, result.Errors)
+	}
+	if len(destination.objects) != 3 {
+		t.Errorf("destination has %d objects, want 3", len(destination.objects))
+	}
+
+	result, err = runner.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if result.SkippedObjects != 3 || result.Errors != 0 {
+		t.Errorf("second run: skipped %d, errors %d, want 3, 0", result.SkippedObjects, result.Errors)
+	}
+}
+
+func TestRunnerCancelled(t *testing.T) {
+	source := newMemorySource()
+	source.add("a.txt", "hello", ObjectInfo{})
+	runner, err := NewRunner(Options{Source: source, Destination: newMemoryDestination(), Quiet: true})
+	if err != nil {
+		t.Fatalf("NewRunner returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := runner.Run(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned error %v, want context.Canceled", err)
+	}
+	if result == nil || result.AbortReason != "実行がキャンセルされました" {
+		t.Errorf("Run returned result %+v, want the cancelled abort reason", result)
+	}
+}
+
+func TestRunnerRejectsResumeWithoutGCS(t *testing.T) {
+	// 停止した位置を保存できないため、先頭から上限まで毎回転送し直さないように実行しない
+	r := newTestRun()
+	r.clientOverrides.Source, r.clientOverrides.Destination = newMemorySource(), newMemoryDestination()
+	r.maxBytesPerRun = 1
+	if _, err := r.runBackup(context.Background()); !errors.Is(err, errInvalidConfig) {
+		t.Errorf("runBackup() with MAX_BYTES_PER_RUN and Options.Destination returned %v, want errInvalidConfig", err)
+	}
+}
+
+func TestRunnersRunConcurrently(t *testing.T) {
+	// 設定は実行ごとに複製されるため、別々の設定で同時に実行できる
+	compressions := []string{compressionGzip, compressionZstd}
+	destinations := make([]*memoryDestination, len(compressions))
+	var group errgroup.Group
+	for i, compression := range compressions {
+		source, destination := newMemorySource(), newMemoryDestination()
+		source.add("a.txt", "hello", ObjectInfo{})
+		destinations[i] = destination
+		runner, err := NewRunner(Options{Source: source, Destination: destination, Compression: compression, Quiet: true})
+		if err != nil {
+			t.Fatalf("NewRunner returned error: %v", err)
+		}
+		group.Go(func() error {
+			_, err := runner.Run(context.Background())
+			return err
+		})
+	}
+	if err := group.Wait(); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	for i, destination := range destinations {
+		if got := objectCompression(destination.objects["a.txt"].info.Metadata); got != compressions[i] {
+			t.Errorf("run %d compressed with %v, want %v", i, got, compressions[i])
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+// S3バケットの設定を保存するGCSバケット内のオブジェクト名
+const bucketConfigObjectName = backupformat.BucketConfigObjectName
+
+// S3バケットの設定
+// バケットを作り直すにはオブジェクトだけでなく設定も必要なため、オブジェクトと同じバケットに保存する
+type s3BucketConfig struct {
+	Bucket     string    `json:"bucket"`
+	CapturedAt time.Time `json:"capturedAt"`
+	// バケットポリシー（JSON文字列、設定されていない場合は空）
+	Policy         string                `json:"policy,omitempty"`
+	CORSRules      []types.CORSRule      `json:"corsRules,omitempty"`
+	LifecycleRules []types.LifecycleRule `json:"lifecycleRules,omitempty"`
+	// バージョニングの状態（Enabled、Suspended、一度も有効にしていない場合は空）
+	Versioning string `json:"versioning,omitempty"`
+}
+
+// S3バケットの設定を取得する
+// 設定されていない項目は空にする
+func (c *backupConfig) captureBucketConfig(ctx context.Context, s3Client *s3.Client) (*s3BucketConfig, error) {
+	bucketConfig := &s3BucketConfig{Bucket: c.s3Config.Bucket, CapturedAt: time.Now().UTC()}
+
+	policyOutput, err := s3Client.GetBucketPolicy(ctx, &s3.GetBucketPolicyInput{Bucket: aws.String(c.s3Config.Bucket)})
+	if err == nil {
+		bucketConfig.Policy = aws.ToString(policyOutput.Policy)
+	} else if !isS3ErrorCode(err, "NoSuchBucketPolicy") {
+		return nil, fmt.Errorf("failed to get bucket policy: %w", err)
+	}
+
+	corsOutput, err := s3Client.GetBucketCors(ctx, &s3.GetBucketCorsInput{Bucket: aws.String(c.s3Config.Bucket)})
+	if err == nil {
+		bucketConfig.CORSRules = corsOutput.CORSRules
+	} else if !isS3ErrorCode(err, "NoSuchCORSConfiguration") {
+		return nil, fmt.Errorf("failed to get CORS configuration: %w", err)
+	}
+
+	lifecycleOutput, err := s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(c.s3Config.Bucket)})
+	if err == nil {
+		bucketConfig.LifecycleRules = lifecycleOutput.Rules
+	} else if !isS3ErrorCode(err, "NoSuchLifecycleConfiguration") {
+		return nil, fmt.Errorf("failed to get lifecycle configuration: %w", err)
+	}
+
+	versioningOutput, err := s3Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: aws.String(c.s3Config.Bucket)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get versioning status: %w", err)
+	}
+	bucketConfig.Versioning = string(versioningOutput.Status)
+
+	return bucketConfig, nil
+}
+
+// S3バケットの設定を取得してGCSに保存する
+func (c *backupConfig) backupBucketConfig(ctx context.Context, s3Client *s3.Client, gcsBucket *storage.BucketHandle) error {
+	bucketConfig, err := c.captureBucketConfig(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+	configJSON, err := json.MarshalIndent(bucketConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	writer := gcsBucket.Object(c.managedObjectName(bucketConfigObjectName)).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(configJSON); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload bucket config: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload bucket config: %w", err)
+	}
+	return nil
+}
+
+// S3のエラーが指定したエラーコードか判定する
+func isS3ErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
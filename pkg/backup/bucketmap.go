@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/traPtitech/s3-backup-helper/pkg/keyencoding"
+)
+
+// S3バケットごとのバックアップ先
+type bucketMapping struct {
+	S3Bucket  string
+	GCSBucket string
+	// GCSバケット内のプレフィックス（空または/で終わる）
+	Prefix string
+}
+
+// "<S3バケット名>=<GCSバケット名>[/<プレフィックス>]"をカンマ区切りで並べた対応表を読み込む
+func parseBucketMap(value string) ([]bucketMapping, error) {
+	var mappings []bucketMapping
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		s3Bucket, destination, found := strings.Cut(entry, "=")
+		s3Bucket, destination = strings.TrimSpace(s3Bucket), strings.TrimSpace(destination)
+		gcsBucket, prefix, _ := strings.Cut(destination, "/")
+		if !found || s3Bucket == "" || gcsBucket == "" {
+			return nil, fmt.Errorf("invalid bucket mapping: %q", entry)
+		}
+		if err := validateGCSBucketName(gcsBucket); err != nil {
+			return nil, err
+		}
+		prefix = normalizeDestinationPrefix(prefix)
+		if len(prefix) > keyencoding.MaxPrefixLength {
+			return nil, fmt.Errorf("prefix of %v must be at most %d bytes", s3Bucket, keyencoding.MaxPrefixLength)
+		}
+		mappings = append(mappings, bucketMapping{S3Bucket: s3Bucket, GCSBucket: gcsBucket, Prefix: prefix})
+	}
+	return mappings, nil
+}
+
+// プレフィックスを/で終わるようにする（空の場合は空のまま）
+func normalizeDestinationPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// GCS_BUCKET_MAPでバックアップ先を指定したS3バケットか
+func (c *backupConfig) hasBucketMapping(s3Bucket string) bool {
+	for _, mapping := range c.bucketMap {
+		if mapping.S3Bucket == s3Bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// 現在のS3バケットのバックアップ先のGCSバケット名とプレフィックス
+// GCS_BUCKET_MAPに無い場合はGCS_BUCKETとGCS_PREFIX、GCS_BUCKETも無い場合は<S3バケット名> + GCS_BUCKET_NAME_SUFFIX（GCSで使えない場合は正規化する）
+func (c *backupConfig) gcsDestinationOf(s3Bucket string) (string, string) {
+	for _, mapping := range c.bucketMap {
+		if mapping.S3Bucket == s3Bucket {
+			return mapping.GCSBucket, mapping.Prefix
+		}
+	}
+	if c.gcpConfig.Bucket != "" {
+		return c.gcpConfig.Bucket, c.gcpConfig.Prefix
+	}
+	return normalizeGCSBucketName(s3Bucket + c.gcpConfig.BucketNameSuffix), c.gcpConfig.Prefix
+}
+
+// バックアップ先のGCSバケット内のプレフィックス（バケット全体を使う場合は空）
+func (c *backupConfig) destinationPrefix() string {
+	_, prefix := c.gcsDestinationOf(c.s3Config.Bucket)
+	return prefix
+}
+
+// 管理用のオブジェクトのバックアップ先のバケットでの名前
+// プレフィックスごとに分け、1つのバケットを共有する別のS3バケットのロックや再開位置と混ざらないようにする
+func (c *backupConfig) managedObjectName(name string) string {
+	return c.destinationPrefix() + name
+}
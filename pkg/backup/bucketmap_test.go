@@ -0,0 +1,38 @@
+package backup
+
+import "testing"
+
+func TestGCSDestinationOf(t *testing.T) {
+	c := newBackupConfig()
+	var err error
+	c.bucketMap, err = parseBucketMap("traq=shared-backup/cluster-a, wiki = wiki-backup")
+	if err != nil {
+		t.Fatalf("parseBucketMap returned error: %v", err)
+	}
+	c.gcpConfig.BucketNameSuffix = "-backup"
+	tests := []struct {
+		s3Bucket   string
+		gcsBucket  string
+		prefix     string
+		configured string
+	}{
+		{s3Bucket: "traq", gcsBucket: "shared-backup", prefix: "cluster-a/"},
+		{s3Bucket: "wiki", gcsBucket: "wiki-backup", prefix: ""},
+		{s3Bucket: "other", gcsBucket: "other-backup", prefix: ""},
+		// GCS_BUCKETを指定した場合はサフィックスを使わない
+		{s3Bucket: "other", gcsBucket: "explicit", prefix: "", configured: "explicit"},
+	}
+	for _, tt := range tests {
+		c.gcpConfig.Bucket = tt.configured
+		gcsBucket, prefix := c.gcsDestinationOf(tt.s3Bucket)
+		if gcsBucket != tt.gcsBucket || prefix != tt.prefix {
+			t.Errorf("gcsDestinationOf(%q) = %q, %q, want %q, %q", tt.s3Bucket, gcsBucket, prefix, tt.gcsBucket, tt.prefix)
+		}
+	}
+
+	for _, value := range []string{"traq", "=shared-backup", "traq=/cluster-a"} {
+		if _, err := parseBucketMap(value); err == nil {
+			t.Errorf("parseBucketMap(%q) returned no error", value)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// バックアップ先のバケットのストレージクラス
+// Autoclassはアクセス頻度に応じてGCSがオブジェクトごとにストレージクラスを切り替える
+const storageClassAutoclass = "AUTOCLASS"
+
+// 既存のバケットの設定が想定と異なる場合の扱い
+const (
+	// エラーにしてバックアップしない
+	bucketCheckEnforce = "enforce"
+	// 警告をログに出してバックアップを続ける
+	bucketCheckWarn = "warn"
+	// 確認しない
+	bucketCheckIgnore = "ignore"
+	// 修復できるもの（ストレージクラス、バージョニング、ライフサイクル）は修復し、できないものはエラーにする
+	bucketCheckRepair = "repair"
+)
+
+// ラベルのキーと値に使える文字
+var labelPattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+
+// "<キー>=<値>"をカンマ区切りで並べたラベルを読み込む
+func parseBucketLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, labelValue, found := strings.Cut(entry, "=")
+		key, labelValue = strings.TrimSpace(key), strings.TrimSpace(labelValue)
+		if !found || key == "" || !labelPattern.MatchString(key) || !labelPattern.MatchString(labelValue) {
+			return nil, fmt.Errorf("invalid label: %q (use lowercase letters, digits, '_' and '-')", entry)
+		}
+		labels[key] = labelValue
+	}
+	return labels, nil
+}
+
+// ラベルの値に使えない文字を"-"に置き換える（バケット名の"."など）
+func sanitizeLabelValue(value string) string {
+	sanitized := []rune(strings.ToLower(value))
+	for i, r := range sanitized {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			sanitized[i] = '-'
+		}
+	}
+	return string(sanitized[:min(len(sanitized), 63)])
+}
+
+// 指定できるストレージクラスか判定する
+func validStorageClass(storageClass string) bool {
+	switch storageClass {
+	case "STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE", storageClassAutoclass:
+		return true
+	default:
+		return false
+	}
+}
+
+// パートやロックなど、すぐに削除する管理用のオブジェクトのストレージクラス
+// COLDLINEなどの最低保存期間があるクラスでは、すぐに削除しても期間分の料金がかかるため、Standardにする
+// Autoclassの場合はStandardから始まり、最低保存期間もないため指定しない
+func (c *backupConfig) temporaryStorageClass() string {
+	if c.gcpConfig.StorageClass == storageClassAutoclass {
+		return ""
+	}
+	return "STANDARD"
+}
+
+// バックアップ先のバケットを作成するときの設定
+func (c *backupConfig) newBucketAttrs() *storage.BucketAttrs {
+	attrs := &storage.BucketAttrs{
+		StorageClass:      c.gcpConfig.StorageClass,
+		Location:          c.gcpConfig.Region,
+		VersioningEnabled: true,
+		Lifecycle:         storage.Lifecycle{Rules: c.bucketLifecycleRules()},
+	}
+	// 費用の集計や棚卸しでバックアップ用のバケットを見つけられるようにラベルを付ける
+	attrs.Labels = map[string]string{
+		"managed-by":    "s3-backup-helper",
+		"source-bucket": sanitizeLabelValue(c.s3Config.Bucket),
+	}
+	// ラベルの値に使えない文字を置き換えたり切り詰めたりした場合は、元のバケット名を見分けられるようハッシュも付ける
+	if sourceLabel := attrs.Labels["source-bucket"]; sourceLabel != c.s3Config.Bucket {
+		attrs.Labels["source-bucket-hash"] = bucketNameHash(c.s3Config.Bucket)
+	}
+	for key, value := range c.bucketLabels {
+		attrs.Labels[key] = value
+	}
+	// 構成可能なデュアルリージョンの場合は、データを置くリージョンを指定する
+	if len(c.gcpConfig.DataLocations) > 0 {
+		attrs.CustomPlacementConfig = &storage.CustomPlacementConfig{DataLocations: c.gcpConfig.DataLocations}
+	}
+	// Autoclassの場合、オブジェクトはSTANDARDから始まり、アクセスされなければARCHIVEまで移動する
+	if c.gcpConfig.StorageClass == storageClassAutoclass {
+		attrs.StorageClass = ""
+		attrs.Autoclass = &storage.Autoclass{Enabled: true, TerminalStorageClass: "ARCHIVE"}
+	}
+	return attrs
+}
+
+// バックアップ先のバケットのライフサイクルルール
+func (c *backupConfig) bucketLifecycleRules() []storage.LifecycleRule {
+	// 90日でデータ削除
+	rules := []storage.LifecycleRule{
+		{
+			Action:    storage.LifecycleAction{Type: "Delete"},
+			Condition: storage.LifecycleCondition{AgeInDays: 90},
+		},
+	}
+	// バージョニングにより上書きのたびに古い世代が残り続けるため、古い世代は早めに削除する
+	if c.noncurrentDeleteDays > 0 {
+		rules = append(rules, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: "Delete"},
+			Condition: storage.LifecycleCondition{DaysSinceNoncurrentTime: c.noncurrentDeleteDays},
+		})
+	}
+	if c.maxNoncurrentVersions > 0 {
+		rules = append(rules, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: "Delete"},
+			Condition: storage.LifecycleCondition{NumNewerVersions: c.maxNoncurrentVersions},
+		})
+	}
+	return rules
+}
+
+// 既存のバケットの設定が想定と異なる点
+type bucketDrift struct {
+	Problem string
+	// 修復する変更を加える（修復できない場合はnil）
+	Repair func(update *storage.BucketAttrsToUpdate)
+}
+
+// 既存のバケットの設定が想定と異なる点を返す
+func (c *backupConfig) checkBucketAttrs(attrs *storage.BucketAttrs) []bucketDrift {
+	var drifts []bucketDrift
+	if c.gcpConfig.StorageClass == storageClassAutoclass {
+		if attrs.Autoclass == nil || !attrs.Autoclass.Enabled {
+			drifts = append(drifts, bucketDrift{
+				Problem: "bucket autoclass is not enabled",
+				Repair: func(update *storage.BucketAttrsToUpdate) {
+					update.Autoclass = &storage.Autoclass{Enabled: true, TerminalStorageClass: "ARCHIVE"}
+				},
+			})
+		}
+	} else if attrs.StorageClass != c.gcpConfig.StorageClass {
+		// 既存のオブジェクトのストレージクラスは変わらず、以降に書き込むオブジェクトに適用される
+		drifts = append(drifts, bucketDrift{
+			Problem: fmt.Sprintf("bucket storage class is not %v: %v", c.gcpConfig.StorageClass, attrs.StorageClass),
+			Repair: func(update *storage.BucketAttrsToUpdate) {
+				update.StorageClass = c.gcpConfig.StorageClass
+			},
+		})
+	}
+	if !attrs.VersioningEnabled {
+		drifts = append(drifts, bucketDrift{
+			Problem: "bucket versioning is not enabled",
+			Repair: func(update *storage.BucketAttrsToUpdate) {
+				update.VersioningEnabled = true
+			},
+		})
+	}
+	// 足りないライフサイクルルールを追加する（想定外のルールはそのまま残す）
+	var missingRules []storage.LifecycleRule
+	for _, rule := range c.bucketLifecycleRules() {
+		if !hasLifecycleRule(attrs.Lifecycle.Rules, rule) {
+			missingRules = append(missingRules, rule)
+		}
+	}
+	if len(missingRules) > 0 {
+		drifts = append(drifts, bucketDrift{
+			Problem: fmt.Sprintf("bucket lifecycle is missing %d rules", len(missingRules)),
+			Repair: func(update *storage.BucketAttrsToUpdate) {
+				update.Lifecycle = &storage.Lifecycle{Rules: append(slices.Clone(attrs.Lifecycle.Rules), missingRules...)}
+			},
+		})
+	}
+	// 保持ポリシーがあると上書きや削除ができず、差分バックアップとライフサイクルが機能しない
+	// 意図して設定されている可能性があるため、修復では外さない
+	if attrs.RetentionPolicy != nil && attrs.RetentionPolicy.RetentionPeriod > 0 {
+		drifts = append(drifts, bucketDrift{Problem: fmt.Sprintf("bucket has a retention policy: %v", attrs.RetentionPolicy.RetentionPeriod)})
+	}
+	// ロケーションはGCSが大文字で返す
+	if c.gcpConfig.Region != "" && !strings.EqualFold(attrs.Location, c.gcpConfig.Region) {
+		drifts = append(drifts, bucketDrift{Problem: fmt.Sprintf("bucket location is not %v: %v", c.gcpConfig.Region, attrs.Location)})
+	}
+	if len(c.gcpConfig.DataLocations) > 0 {
+		var dataLocations []string
+		if attrs.CustomPlacementConfig != nil {
+			dataLocations = attrs.CustomPlacementConfig.DataLocations
+		}
+		if !sameLocations(dataLocations, c.gcpConfig.DataLocations) {
+			drifts = append(drifts, bucketDrift{Problem: fmt.Sprintf("bucket data locations are not %v: %v", c.gcpConfig.DataLocations, dataLocations)})
+		}
+	}
+	return drifts
+}
+
+// 想定と異なる点をGCS_BUCKET_CHECKに従って扱う
+// enforceの場合はエラーを返し、warnの場合はログに出す
+// repairの場合は修復できるものを修復し、修復できないものがあればエラーを返す
+func (r *backupRun) applyBucketCheckPolicy(ctx context.Context, bucket *storage.BucketHandle, attrs *storage.BucketAttrs, drifts []bucketDrift) error {
+	if len(drifts) == 0 || r.bucketCheckPolicy == bucketCheckIgnore {
+		return nil
+	}
+	var problems []string
+	switch r.bucketCheckPolicy {
+	case bucketCheckWarn:
+		for _, drift := range drifts {
+			r.logWarnf("%v", drift.Problem)
+		}
+		return nil
+	case bucketCheckRepair:
+		var update storage.BucketAttrsToUpdate
+		var repaired []string
+		for _, drift := range drifts {
+			if drift.Repair == nil {
+				problems = append(problems, drift.Problem)
+				continue
+			}
+			drift.Repair(&update)
+			repaired = append(repaired, drift.Problem)
+		}
+		if len(repaired) > 0 {
+			// 確認してから別の変更が加えられていた場合は上書きしない
+			if _, err := bucket.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration}).Update(ctx, update); err != nil {
+				return fmt.Errorf("failed to repair bucket (%v): %w", strings.Join(repaired, ", "), err)
+			}
+			for _, problem := range repaired {
+				r.logInfof("Repaired: %v", problem)
+			}
+		}
+	default:
+		for _, drift := range drifts {
+			problems = append(problems, drift.Problem)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// ライフサイクルルールの一覧に、同じ操作と条件のルールがあるか判定する
+func hasLifecycleRule(rules []storage.LifecycleRule, want storage.LifecycleRule) bool {
+	return slices.ContainsFunc(rules, func(rule storage.LifecycleRule) bool {
+		return rule.Action.Type == want.Action.Type &&
+			rule.Condition.AgeInDays == want.Condition.AgeInDays &&
+			rule.Condition.DaysSinceNoncurrentTime == want.Condition.DaysSinceNoncurrentTime &&
+			rule.Condition.NumNewerVersions == want.Condition.NumNewerVersions
+	})
+}
+
+// 2つのロケーションの一覧が順序と大文字小文字によらず同じか判定する
+func sameLocations(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, location := range a {
+		if !slices.ContainsFunc(b, func(other string) bool { return strings.EqualFold(location, other) }) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package backup
+
+import "testing"
+
+func TestParseBucketLabels(t *testing.T) {
+	got, err := parseBucketLabels("team=sysad, environment = production,")
+	if err != nil {
+		t.Fatalf("parseBucketLabels returned error: %v", err)
+	}
+	if len(got) != 2 || got["team"] != "sysad" || got["environment"] != "production" {
+		t.Errorf("parseBucketLabels = %v", got)
+	}
+
+	for _, value := range []string{"Team=sysad", "team", "=sysad", "team=sys.ad"} {
+		if _, err := parseBucketLabels(value); err == nil {
+			t.Errorf("parseBucketLabels(%q) returned no error", value)
+		}
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	if got := sanitizeLabelValue("traQ.bucket.example.org"); got != "traq-bucket-example-org" {
+		t.Errorf("sanitizeLabelValue = %q", got)
+	}
+}
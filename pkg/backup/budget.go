@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+// 1回の実行でアップロードするバイト数の上限に達して停止した位置を保存するオブジェクト名
+const resumePointObjectName = backupformat.ResumePointObjectName
+
+// 上限に達して停止した位置
+type resumePoint struct {
+	// 次の実行はこのキーより後から始める
+	StartAfter string `json:"startAfter"`
+	// S3インベントリから一覧した場合はそのmanifest.json
+	// インベントリはキーの順とは限らないため、一覧の方法が変わった場合は位置を引き継がない
+	InventoryManifest string    `json:"inventoryManifest,omitempty"`
+	RunID             string    `json:"runId"`
+	SavedAt           time.Time `json:"savedAt"`
+}
+
+// 前回の実行が停止した位置を読み込む（無い場合は空）
+func (r *backupRun) loadResumePoint(ctx context.Context, gcsBucket *storage.BucketHandle) (string, error) {
+	reader, err := gcsBucket.Object(r.managedObjectName(resumePointObjectName)).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read resume point: %w", err)
+	}
+	defer reader.Close()
+	var point resumePoint
+	if err := json.NewDecoder(reader).Decode(&point); err != nil {
+		return "", fmt.Errorf("failed to read resume point: %w", err)
+	}
+	if point.InventoryManifest != r.s3InventoryManifest {
+		r.logWarnf("Ignoring resume point %v saved while listing from %v", point.StartAfter, listingSourceName(point.InventoryManifest))
+		return "", nil
+	}
+	return point.StartAfter, nil
+}
+
+// 一覧の方法の説明（ログ用）
+func listingSourceName(inventoryManifest string) string {
+	if inventoryManifest == "" {
+		return "ListObjectsV2"
+	}
+	return "inventory " + inventoryManifest
+}
+
+// 停止した位置を保存する
+func (r *backupRun) saveResumePoint(ctx context.Context, gcsBucket *storage.BucketHandle, startAfter string) error {
+	pointJSON, err := json.Marshal(resumePoint{StartAfter: startAfter, InventoryManifest: r.s3InventoryManifest, RunID: r.runID, SavedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	writer := gcsBucket.Object(r.managedObjectName(resumePointObjectName)).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(pointJSON); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to save resume point: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to save resume point: %w", err)
+	}
+	return nil
+}
+
+// 最後まで処理した場合に、停止した位置を削除する
+func (c *backupConfig) clearResumePoint(ctx context.Context, gcsBucket *storage.BucketHandle) error {
+	err := gcsBucket.Object(c.managedObjectName(resumePointObjectName)).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete resume point: %w", err)
+	}
+	return nil
+}
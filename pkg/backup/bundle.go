@@ -0,0 +1,253 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+	"google.golang.org/api/iterator"
+)
+
+// まとめたアーカイブを置くGCSバケット内のプレフィックス
+// <プレフィックス>/part-00000.tarと、キーとメタデータを記録した<プレフィックス>/index.jsonを置く
+const bundleObjectPrefix = backupformat.BundlePrefix
+
+// アーカイブのインデックスのオブジェクト名
+const bundleIndexName = "index.json"
+
+// 1つのプレフィックス以下の小さいオブジェクトをtarアーカイブにまとめてアップロードする
+// 1オブジェクトずつアップロードするとリクエスト数とCOLDLINEのオブジェクトごとの費用が大きくなるため
+// 実行ごとに全てのオブジェクトをまとめ直し、前回のアーカイブはバージョニングにより古い世代として残る
+type bundler struct {
+	config *backupConfig
+	prefix string
+	dir    string
+	bucket *storage.BucketHandle
+	// アーカイブのアップロードに使うコンテキスト
+	// ワーカーのコンテキストは全てのワーカーが終わるとキャンセルされ、書き込み中のアーカイブが中断されるため使わない
+	ctx context.Context
+
+	mu    sync.Mutex
+	parts int
+	index []exportIndexEntry
+	// 書き込み中のアーカイブ
+	partName  string
+	partBytes int64
+	// 書き込み中のアーカイブのアップロードを中止する
+	cancel         context.CancelFunc
+	writer         *storage.Writer
+	compressWriter io.WriteCloser
+	tarWriter      *tar.Writer
+	// 書き込みに失敗した場合、以降のオブジェクトはアーカイブに加えない
+	err error
+}
+
+// BUNDLE_PREFIXESの各プレフィックスのアーカイブを作成する
+func (c *backupConfig) newBundlers(ctx context.Context, bucket *storage.BucketHandle) []*bundler {
+	bundlers := make([]*bundler, len(c.bundlePrefixes))
+	for i, prefix := range c.bundlePrefixes {
+		bundlers[i] = &bundler{config: c,
+			prefix: prefix,
+			dir:    c.managedObjectName(bundleObjectPrefix + strings.TrimSuffix(prefix, "/") + "/"),
+			bucket: bucket,
+			ctx:    ctx,
+		}
+	}
+	return bundlers
+}
+
+// キーをまとめるアーカイブを返す（まとめない場合はnil）
+func findBundler(bundlers []*bundler, key string) *bundler {
+	for _, b := range bundlers {
+		if strings.HasPrefix(key, b.prefix) {
+			return b
+		}
+	}
+	return nil
+}
+
+// オブジェクトをダウンロードしてアーカイブに加える
+// tarのエントリにはサイズが先に必要なため、本体はメモリに読み込む（まとめるのは小さいオブジェクトを想定している）
+func (b *bundler) Add(ctx context.Context, s3Client *s3.Client, object types.Object) error {
+	key := aws.ToString(object.Key)
+	destinationKey := mapKeyPrefix(key, b.config.keyPrefixMap)
+	s3ObjectOutput, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(b.config.s3Config.Bucket),
+		Key:          aws.String(key),
+		RequestPayer: b.config.s3RequestPayer(),
+	})
+	if err != nil {
+		return err
+	}
+	defer s3ObjectOutput.Body.Close()
+	body, err := io.ReadAll(s3ObjectOutput.Body)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return fmt.Errorf("bundle %v is broken: %w", b.prefix, b.err)
+	}
+
+	// アーカイブが大きくなりすぎたら次のアーカイブに切り替える
+	if b.tarWriter != nil && b.partBytes+int64(len(body)) > b.config.bundleMaxBytes {
+		if err := b.finishPart(); err != nil {
+			b.err = err
+			return err
+		}
+	}
+	if b.tarWriter == nil {
+		if err := b.startPart(); err != nil {
+			b.err = err
+			return err
+		}
+	}
+
+	if err := b.tarWriter.WriteHeader(&tar.Header{
+		Name:    destinationKey,
+		Mode:    0o644,
+		Size:    int64(len(body)),
+		ModTime: aws.ToTime(s3ObjectOutput.LastModified),
+	}); err != nil {
+		b.err = err
+		b.abortPart()
+		return err
+	}
+	if _, err := b.tarWriter.Write(body); err != nil {
+		b.err = err
+		b.abortPart()
+		return err
+	}
+	b.partBytes += int64(len(body))
+
+	entry := exportIndexEntry{
+		Key:                destinationKey,
+		Path:               b.partName,
+		Size:               int64(len(body)),
+		ContentType:        aws.ToString(s3ObjectOutput.ContentType),
+		ContentEncoding:    aws.ToString(s3ObjectOutput.ContentEncoding),
+		ContentDisposition: aws.ToString(s3ObjectOutput.ContentDisposition),
+		ContentLanguage:    aws.ToString(s3ObjectOutput.ContentLanguage),
+		CacheControl:       aws.ToString(s3ObjectOutput.CacheControl),
+		Metadata:           s3ObjectOutput.Metadata,
+		LastModified:       formatLastModified(aws.ToTime(s3ObjectOutput.LastModified)),
+	}
+	b.index = append(b.index, entry)
+	return nil
+}
+
+// 次のアーカイブの書き込みを始める
+func (b *bundler) startPart() error {
+	b.partName = fmt.Sprintf("%vpart-%05d.tar", b.dir, b.parts)
+	b.parts++
+	b.partBytes = 0
+	ctx, cancel := context.WithCancel(b.ctx)
+	b.cancel = cancel
+	b.writer = b.bucket.Object(b.partName).NewWriter(ctx)
+	b.writer.ContentType = "application/x-tar"
+	b.writer.Metadata = map[string]string{metadataCompression: b.config.compression}
+	compressWriter, err := b.config.newCompressWriter(b.writer, b.config.compression)
+	if err != nil {
+		b.abortPart()
+		return err
+	}
+	b.compressWriter = compressWriter
+	b.tarWriter = tar.NewWriter(compressWriter)
+	return nil
+}
+
+// 書き込み中のアーカイブを閉じてアップロードを完了する
+func (b *bundler) finishPart() error {
+	if err := b.tarWriter.Close(); err != nil {
+		b.abortPart()
+		return err
+	}
+	if err := b.compressWriter.Close(); err != nil {
+		b.abortPart()
+		return err
+	}
+	err := b.writer.Close()
+	b.cancel()
+	b.writer, b.compressWriter, b.tarWriter = nil, nil, nil
+	if err != nil {
+		return fmt.Errorf("failed to upload bundle %v: %w", b.partName, err)
+	}
+	return nil
+}
+
+// 書き込み中のアーカイブのアップロードを中止し、途中までのアーカイブを残さない
+func (b *bundler) abortPart() {
+	if b.writer == nil {
+		return
+	}
+	b.cancel()
+	b.writer.Close()
+	b.writer, b.compressWriter, b.tarWriter = nil, nil, nil
+}
+
+// 中断した場合に、書き込み中のアーカイブのアップロードを中止する
+func (b *bundler) Abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.abortPart()
+}
+
+// 最後のアーカイブとインデックスを書き込み、前回の実行で作られた余分なアーカイブを削除する
+func (b *bundler) Close(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return fmt.Errorf("bundle %v is broken: %w", b.prefix, b.err)
+	}
+	if b.tarWriter != nil {
+		if err := b.finishPart(); err != nil {
+			return err
+		}
+	}
+
+	indexJSON, err := json.MarshalIndent(b.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	writer := b.bucket.Object(b.dir + bundleIndexName).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(indexJSON); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload bundle index: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload bundle index: %w", err)
+	}
+
+	// 今回のインデックスから参照されない古いアーカイブを削除する
+	current := make(map[string]bool, b.parts)
+	for i := range b.parts {
+		current[fmt.Sprintf("%vpart-%05d.tar", b.dir, i)] = true
+	}
+	objects := b.bucket.Objects(ctx, &storage.Query{Prefix: b.dir + "part-"})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		if !current[attrs.Name] {
+			if err := b.bucket.Object(attrs.Name).Delete(ctx); err != nil {
+				return fmt.Errorf("failed to delete stale bundle %v: %w", attrs.Name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/traPtitech/s3-backup-helper/pkg/buildinfo"
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+)
+
+// 事前確認の結果
+const (
+	checkPass = "PASS"
+	checkFail = "FAIL"
+	checkWarn = "WARN"
+	checkSkip = "SKIP"
+)
+
+// 事前確認の項目ごとの結果
+type checkResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// バックアップ先のバケットでオブジェクトを書き込むのに必要な権限
+// 上書きや、パート、ロック、再開位置の削除にはstorage.objects.deleteが必要
+var gcsWritePermissions = []string{"storage.objects.create", "storage.objects.delete", "storage.objects.get", "storage.objects.list"}
+
+// バックアップ先のバケットを作成するのに必要なプロジェクトの権限
+var gcsCreateBucketPermissions = []string{"storage.buckets.create"}
+
+// データを転送せずに、設定、S3とGCSの権限、通知先への送信を確認して結果を表にする
+// 設定の誤りや権限の不足は、これまでは実行の途中で初めて分かっていたため
+// 失敗した項目がある場合はexitCodeConfigErrorを返す
+func (r *backupRun) runCheck() int {
+	ctx := context.Background()
+	// 設定の誤りはLoadConfigFromEnvで終了しているため、ここまで来れば読み込めている
+	results := []checkResult{{Name: "config", Status: checkPass, Detail: fmt.Sprintf("s3-backup-helper %v", buildinfo.Get())}}
+	if s3Client, err := r.newS3Client(); err != nil {
+		results = append(results, checkResult{Name: "s3", Status: checkFail, Detail: r.describeError(err)})
+	} else {
+		results = append(results, r.checkS3(ctx, s3Client)...)
+	}
+	results = append(results, r.checkDestination(ctx)...)
+	results = append(results, r.checkNotifiers()...)
+
+	writer := tabwriter.NewWriter(r.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "CHECK\tRESULT\tDETAIL")
+	failed := 0
+	for _, result := range results {
+		fmt.Fprintf(writer, "%v\t%v\t%v\n", result.Name, result.Status, result.Detail)
+		if result.Status == checkFail {
+			failed++
+		}
+	}
+	writer.Flush()
+	if failed > 0 {
+		fmt.Fprintf(r.stdout, "%d checks failed\n", failed)
+		return exitCodeConfigError
+	}
+	return 0
+}
+
+// S3のバケットの一覧と、オブジェクトの読み込みを確認する
+// 読み込みは最初のオブジェクトの先頭1バイトのみ取得する
+func (c *backupConfig) checkS3(ctx context.Context, s3Client *s3.Client) []checkResult {
+	listName := "s3:list " + c.s3Config.Bucket
+	output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:       aws.String(c.s3Config.Bucket),
+		MaxKeys:      aws.Int32(1),
+		RequestPayer: c.s3RequestPayer(),
+	})
+	if err != nil {
+		return []checkResult{
+			{Name: listName, Status: checkFail, Detail: c.describeError(err)},
+			{Name: "s3:get", Status: checkSkip, Detail: "objects could not be listed"},
+		}
+	}
+	results := []checkResult{{Name: listName, Status: checkPass}}
+	if len(output.Contents) == 0 {
+		return append(results, checkResult{Name: "s3:get", Status: checkSkip, Detail: "bucket is empty"})
+	}
+
+	key := aws.ToString(output.Contents[0].Key)
+	getName := "s3:get " + key
+	object, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(c.s3Config.Bucket),
+		Key:          aws.String(key),
+		Range:        aws.String("bytes=0-0"),
+		RequestPayer: c.s3RequestPayer(),
+	})
+	// 空のオブジェクトは範囲を指定するとInvalidRange（416）になるため、範囲を指定せずに読み直す
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+		object, err = s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:       aws.String(c.s3Config.Bucket),
+			Key:          aws.String(key),
+			RequestPayer: c.s3RequestPayer(),
+		})
+	}
+	if err != nil {
+		return append(results, checkResult{Name: getName, Status: checkFail, Detail: c.describeError(err)})
+	}
+	object.Body.Close()
+	return append(results, checkResult{Name: getName, Status: checkPass})
+}
+
+// バックアップ先に書き込めるか確認する
+// GCSのバケットは作成や書き込みをせず、既存のバケットの状態と権限のみ確認する
+func (c *backupConfig) checkDestination(ctx context.Context) []checkResult {
+	if c.exportPath != "" {
+		return []checkResult{c.checkExportPath()}
+	}
+
+	gcsClient, gcsBucketClient, gcsBucketName, err := c.openGCSBucket(ctx)
+	if err != nil {
+		return []checkResult{{Name: "gcs:bucket", Status: checkFail, Detail: c.describeError(err)}}
+	}
+	defer gcsClient.Close()
+
+	bucketName := "gcs:bucket " + gcsBucketName
+	attrs, err := gcsBucketClient.Attrs(ctx)
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		// 保持ポリシーなど取り消せない設定で作成されるため、確認のためには作成せず、プロジェクトの権限を確認する
+		return []checkResult{
+			{Name: bucketName, Status: checkWarn, Detail: fmt.Sprintf("does not exist; it will be created in project %v on the first backup", c.gcpConfig.ProjectID)},
+			c.checkCreateBucketPermission(ctx),
+			{Name: "gcs:write", Status: checkSkip, Detail: "bucket does not exist"},
+		}
+	} else if err != nil {
+		return []checkResult{
+			{Name: bucketName, Status: checkFail, Detail: c.describeError(err)},
+			{Name: "gcs:write", Status: checkSkip, Detail: "bucket could not be read"},
+		}
+	}
+
+	results := []checkResult{{Name: bucketName, Status: checkPass, Detail: "exists"}}
+	// GCS_BUCKET_CHECKがrepairの場合も、確認では修復しない
+	if drifts := c.checkBucketAttrs(attrs); len(drifts) > 0 && c.bucketCheckPolicy != bucketCheckIgnore {
+		problems := make([]string, len(drifts))
+		repairable := true
+		for i, drift := range drifts {
+			problems[i] = drift.Problem
+			repairable = repairable && drift.Repair != nil
+		}
+		// 実行時にエラーになる場合のみ失敗とする
+		status := checkFail
+		if c.bucketCheckPolicy == bucketCheckWarn || c.bucketCheckPolicy == bucketCheckRepair && repairable {
+			status = checkWarn
+		}
+		results[0] = checkResult{Name: bucketName, Status: status, Detail: strings.Join(problems, ", ")}
+	}
+
+	granted, err := gcsBucketClient.IAM().TestPermissions(ctx, gcsWritePermissions)
+	if err != nil {
+		return append(results, checkResult{Name: "gcs:write", Status: checkFail, Detail: c.describeError(err)})
+	}
+	if missing := missingPermissions(gcsWritePermissions, granted); len(missing) > 0 {
+		return append(results, checkResult{Name: "gcs:write", Status: checkFail, Detail: "missing " + strings.Join(missing, ", ")})
+	}
+	return append(results, checkResult{Name: "gcs:write", Status: checkPass})
+}
+
+// バックアップ先のバケットを作成する権限があるか、プロジェクトに対して確認する
+// Resource ManagerのAPIが使えないなど、確認できない場合は警告にする
+func (c *backupConfig) checkCreateBucketPermission(ctx context.Context) checkResult {
+	name := "gcs:create " + c.gcpConfig.ProjectID
+	if c.gcpConfig.ProjectID == "" {
+		return checkResult{Name: "gcs:create", Status: checkFail, Detail: "GCP_PROJECT_ID is not set"}
+	}
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		return checkResult{Name: name, Status: checkSkip, Detail: "emulator does not have IAM"}
+	}
+	options, err := c.googleClientOptions(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
+	if err != nil {
+		return checkResult{Name: name, Status: checkWarn, Detail: "could not be checked: " + c.describeError(err)}
+	}
+	service, err := cloudresourcemanager.NewService(ctx, options...)
+	if err != nil {
+		return checkResult{Name: name, Status: checkWarn, Detail: "could not be checked: " + c.describeError(err)}
+	}
+	response, err := service.Projects.TestIamPermissions(c.gcpConfig.ProjectID, &cloudresourcemanager.TestIamPermissionsRequest{
+		Permissions: gcsCreateBucketPermissions,
+	}).Context(ctx).Do()
+	if err != nil {
+		return checkResult{Name: name, Status: checkWarn, Detail: "could not be checked: " + c.describeError(err)}
+	}
+	if missing := missingPermissions(gcsCreateBucketPermissions, response.Permissions); len(missing) > 0 {
+		return checkResult{Name: name, Status: checkFail, Detail: fmt.Sprintf("missing %v; grant %v on the project", strings.Join(missing, ", "), gcsPermissionRoles["storage.buckets.create"])}
+	}
+	return checkResult{Name: name, Status: checkPass}
+}
+
+// requiredのうちgrantedに含まれない権限
+func missingPermissions(required, granted []string) []string {
+	var missing []string
+	for _, permission := range required {
+		if !slices.Contains(granted, permission) {
+			missing = append(missing, permission)
+		}
+	}
+	return missing
+}
+
+// エクスポート先のディレクトリに書き込めるか確認する
+func (c *backupConfig) checkExportPath() checkResult {
+	name := "export " + c.exportPath
+	if err := os.MkdirAll(c.exportPath, 0o755); err != nil {
+		return checkResult{Name: name, Status: checkFail, Detail: c.describeError(err)}
+	}
+	file, err := os.CreateTemp(c.exportPath, ".s3-backup-helper-check-*")
+	if err != nil {
+		return checkResult{Name: name, Status: checkFail, Detail: c.describeError(err)}
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return checkResult{Name: name, Status: checkPass}
+}
+
+// 通知先に確認用の通知を送る
+func (r *backupRun) checkNotifiers() []checkResult {
+	message := fmt.Sprintf(`### s3-backup-helperの設定確認
+	S3バケット: %s
+	設定確認（check）による通知のテストです
+	`, r.s3Config.Bucket)
+	summary := &backupSummary{RunID: "check", Version: buildinfo.Get(), Bucket: r.s3Config.Bucket, Config: r.currentConfigSnapshot()}
+
+	var results []checkResult
+	if r.webhookUrl != "" {
+		results = append(results, r.notifierCheckResult("webhook traQ", r.postWebhook(message, r.webhookUrl, r.webhookId, r.webhookSecret)))
+	}
+	for _, notifier := range r.notifiers {
+		results = append(results, r.notifierCheckResult("webhook "+notifier.Name, r.sendNotifier(notifier, summary, message)))
+	}
+	if r.webhookFallbackURL != "" {
+		results = append(results, r.notifierCheckResult("webhook fallback", r.postFallbackWebhook(message)))
+	}
+	if r.smtpConfig.Host != "" && len(r.smtpConfig.To) > 0 {
+		results = append(results, r.notifierCheckResult("email", r.sendSMTP(emailSubject(message), message)))
+	}
+	if len(results) == 0 {
+		return []checkResult{{Name: "webhook", Status: checkSkip, Detail: "no notification is configured"}}
+	}
+	return results
+}
+
+func (c *backupConfig) notifierCheckResult(name string, err error) checkResult {
+	if err != nil {
+		return checkResult{Name: name, Status: checkFail, Detail: c.describeError(err)}
+	}
+	return checkResult{Name: name, Status: checkPass, Detail: "sent a test message"}
+}
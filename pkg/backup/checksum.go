@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// 変更を検出する方法
+const (
+	// オブジェクトを読み込んで元のデータのMD5を比較する
+	changeDetectionMD5 = "md5"
+	// S3に記録されたCRC32Cを比較し、一致した場合は本体を読まずにスキップする
+	changeDetectionCRC32C = "crc32c"
+)
+
+// CRC32CをS3のChecksumCRC32Cと同じ形式（ビッグエンディアンのBase64）にする
+func encodeCRC32C(sum uint32) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, sum))
+}
+
+// データAのCRC32CとデータBのCRC32C、Bの長さから、AとBを連結したデータのCRC32Cを求める
+// 並列にアップロードしたパートのCRC32Cから、元のデータ全体のCRC32Cを求めるため（zlibのcrc32_combineと同じ方法）
+func combineCRC32C(crcA, crcB uint32, lengthB int64) uint32 {
+	if lengthB <= 0 {
+		return crcA
+	}
+	// 1ビットの0を加える演算子（GF(2)上の32x32行列）
+	var even, odd [32]uint32
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for i := 1; i < 32; i++ {
+		odd[i] = row
+		row <<= 1
+	}
+	// 2ビット、4ビットの0を加える演算子
+	squareGF2Matrix(&even, &odd)
+	squareGF2Matrix(&odd, &even)
+	// Bの長さのバイト数の0を加える演算子を、2乗しながらcrcAに掛ける
+	for {
+		squareGF2Matrix(&even, &odd)
+		if lengthB&1 != 0 {
+			crcA = multiplyGF2Matrix(&even, crcA)
+		}
+		lengthB >>= 1
+		if lengthB == 0 {
+			break
+		}
+		squareGF2Matrix(&odd, &even)
+		if lengthB&1 != 0 {
+			crcA = multiplyGF2Matrix(&odd, crcA)
+		}
+		lengthB >>= 1
+		if lengthB == 0 {
+			break
+		}
+	}
+	return crcA ^ crcB
+}
+
+func multiplyGF2Matrix(matrix *[32]uint32, vector uint32) uint32 {
+	var sum uint32
+	for i := 0; vector != 0; i, vector = i+1, vector>>1 {
+		if vector&1 != 0 {
+			sum ^= matrix[i]
+		}
+	}
+	return sum
+}
+
+func squareGF2Matrix(square, matrix *[32]uint32) {
+	for i := range matrix {
+		square[i] = multiplyGF2Matrix(matrix, matrix[i])
+	}
+}
@@ -0,0 +1,29 @@
+package backup
+
+import (
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+func TestCombineCRC32C(t *testing.T) {
+	data := []byte(strings.Repeat("s3-backup-helper composite part ", 1000))
+	whole := crc32.Checksum(data, crc32cTable)
+	for _, split := range []int{0, 1, 7, 1024, len(data) - 1, len(data)} {
+		crcA := crc32.Checksum(data[:split], crc32cTable)
+		crcB := crc32.Checksum(data[split:], crc32cTable)
+		if got := combineCRC32C(crcA, crcB, int64(len(data)-split)); got != whole {
+			t.Errorf("combineCRC32C split at %d = %08x, want %08x", split, got, whole)
+		}
+	}
+
+	// 3つ以上のパートを順に連結する
+	var combined uint32
+	for offset := 0; offset < len(data); offset += 4096 {
+		part := data[offset:min(offset+4096, len(data))]
+		combined = combineCRC32C(combined, crc32.Checksum(part, crc32cTable), int64(len(part)))
+	}
+	if combined != whole {
+		t.Errorf("combineCRC32C over parts = %08x, want %08x", combined, whole)
+	}
+}
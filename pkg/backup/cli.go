@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/traPtitech/s3-backup-helper/pkg/buildinfo"
+)
+
+// コマンドラインから実行する
+// 引数がない場合はバケット全体を1回バックアップし（スケジュールが指定されている場合は常駐する）、サブコマンドが指定された場合はそれを実行する
+// 終了コードはexitCode*のとおり
+func Main() {
+	// 設定が無くても表示できるよう、設定を読み込む前に処理する
+	if len(os.Args) > 1 && (os.Args[1] == "--version" || os.Args[1] == "version") {
+		fmt.Printf("s3-backup-helper %v\n", buildinfo.Get())
+		return
+	}
+
+	LoadConfigFromEnv()
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		configFatalf("Error: Failed to initialize tracing: %v", err)
+	}
+	// 送りきれていないスパンを送ってから終了する
+	defer shutdownTracing(context.Background())
+
+	// サブコマンド
+	// 失敗した場合も、バックアップ先を閉じてスパンを送ってから終了する
+	if len(os.Args) > 1 {
+		// 実行IDはロックを取って書き換えるもの（migrate）にのみ付ける
+		id := ""
+		if os.Args[1] == "migrate" {
+			id = newRunID()
+		}
+		run := newBackupRun(defaultConfig, id, os.Stdout, os.Stderr)
+		var err error
+		switch os.Args[1] {
+		case "backup-object":
+			if len(os.Args) < 3 {
+				configFatalf("Usage: s3-backup-helper backup-object <key>")
+			}
+			err = run.runBackupObject(os.Args[2])
+		case "check":
+			exitCode := run.runCheck()
+			shutdownTracing(context.Background())
+			os.Exit(exitCode)
+		case "migrate":
+			err = run.runMigrate()
+		case "orphans":
+			err = run.runOrphanReport()
+		case "diff":
+			err = run.runDiff()
+		case "estimate":
+			err = run.runEstimate()
+		case "du":
+			err = run.runDiskUsage()
+		case "ls":
+			prefix := ""
+			if len(os.Args) > 2 {
+				prefix = os.Args[2]
+			}
+			err = run.runList(prefix)
+		case "find":
+			if len(os.Args) > 3 && os.Args[2] == "-regex" {
+				err = run.runFind(os.Args[3], true)
+			} else if len(os.Args) == 3 {
+				err = run.runFind(os.Args[2], false)
+			} else {
+				configFatalf("Usage: s3-backup-helper find [-regex] <pattern>")
+			}
+		default:
+			configFatalf("Error: Unknown command: %v", os.Args[1])
+		}
+		if err != nil {
+			logErrorf("%v", run.describeError(err))
+			shutdownTracing(context.Background())
+			os.Exit(exitCodeOf(err))
+		}
+		return
+	}
+
+	// 複数のS3が指定されている場合は、それぞれの設定を読み込んでバックアップする
+	if len(sources) > 0 {
+		if backupSchedule != "" || controlAPIAddr != "" {
+			configFatalf("Error: SOURCES cannot be used with BACKUP_SCHEDULE or CONTROL_API_ADDR")
+		}
+		exitCode := runSources(sources, os.Getenv)
+		shutdownTracing(context.Background())
+		os.Exit(exitCode)
+	}
+
+	// バケットを自動で見つける場合は、それぞれをバックアップする
+	if defaultConfig.discoverBuckets {
+		if backupSchedule != "" || controlAPIAddr != "" {
+			configFatalf("Error: DISCOVER_BUCKETS cannot be used with BACKUP_SCHEDULE or CONTROL_API_ADDR")
+		}
+		exitCode := runDiscoveredBuckets(defaultConfig, os.Getenv, os.Stdout, os.Stderr)
+		shutdownTracing(context.Background())
+		os.Exit(exitCode)
+	}
+
+	// スケジュールまたは制御APIが指定されている場合は常駐する
+	if backupSchedule != "" || controlAPIAddr != "" {
+		err := runDaemon(backupSchedule)
+		logErrorf("%v", defaultConfig.describeError(err))
+		shutdownTracing(context.Background())
+		os.Exit(exitCodeOf(err))
+	}
+
+	run := newBackupRun(defaultConfig, newRunID(), os.Stdout, os.Stderr)
+	summary, err := run.runBackup(context.Background())
+	if err != nil {
+		logErrorf("%v", run.describeError(err))
+		shutdownTracing(context.Background())
+		os.Exit(exitCodeAborted)
+	}
+	if summary.Errors > 0 {
+		shutdownTracing(context.Background())
+		os.Exit(exitCodeTransferError)
+	}
+}
@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// 1つのオブジェクトだけをバックアップする
+func (r *backupRun) runBackupObject(key string) error {
+	// エクスポート先は作り直すため、既存のエクスポートを1つのオブジェクトだけで上書きしてしまう
+	if r.exportPath != "" {
+		return fmt.Errorf("%w: backup-object cannot be used with EXPORT_PATH", errInvalidConfig)
+	}
+	s3Client, err := r.newS3Client()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	fmt.Fprintln(r.stdout, "Target buckets:")
+	destination, err := r.prepareDestination(ctx)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+	destinationName := destination.Name
+
+	skipped, err := r.backupObject(ctx, r.newS3Source(s3Client), destination.Objects, nil, key, -1)
+	if err != nil {
+		return fmt.Errorf("%w: failed to backup object %v: %w", errObjectsFailed, key, err)
+	}
+
+	if skipped {
+		fmt.Fprintf(r.stdout, "Skipped %v: already backed up to %v\n", key, destinationName)
+	} else {
+		fmt.Fprintf(r.stdout, "Backed up %v to %v\n", key, destinationName)
+	}
+	return nil
+}
+
+// リクエスタ支払いバケットの場合にS3のリクエストに付けるRequestPayer
+func (c *backupConfig) s3RequestPayer() types.RequestPayer {
+	if c.s3Config.RequesterPays {
+		return types.RequestPayerRequester
+	}
+	return ""
+}
+
+// S3クライアントの作成
+func (r *backupRun) newS3Client() (*s3.Client, error) {
+	s3Credential := credentials.NewStaticCredentialsProvider(r.s3Config.AccessKey, r.s3Config.SecretKey, r.s3Config.SessionToken)
+	httpClient, err := r.newHTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to create HTTP client: %w", errInvalidConfig, err)
+	}
+	options := []func(*config.LoadOptions) error{
+		config.WithCredentialsProvider(s3Credential),
+		config.WithRegion(r.s3Config.Region),
+		config.WithHTTPClient(tracedHTTPClient(httpClient)),
+	}
+	// リトライ設定
+	if r.retryConfig.S3RetryMode != "" {
+		retryMode, err := aws.ParseRetryMode(r.retryConfig.S3RetryMode)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid S3_RETRY_MODE: %w", errInvalidConfig, err)
+		}
+		options = append(options, config.WithRetryMode(retryMode))
+	}
+	if r.retryConfig.S3MaxAttempts > 0 {
+		options = append(options, config.WithRetryMaxAttempts(r.retryConfig.S3MaxAttempts))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	// ロールを引き受ける場合は、上の認証情報で一時的な認証情報を取得して使う
+	if r.s3Config.RoleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), r.s3Config.RoleARN, func(opt *stscreds.AssumeRoleOptions) {
+			opt.RoleSessionName = "s3-backup-helper"
+			if r.s3Config.ExternalID != "" {
+				opt.ExternalID = aws.String(r.s3Config.ExternalID)
+			}
+		}))
+	}
+	return s3.NewFromConfig(cfg, func(opt *s3.Options) {
+		opt.UsePathStyle = r.s3Config.ForcePathStyle
+		opt.BaseEndpoint = aws.String(r.s3Config.EndPoint)
+		opt.APIOptions = append(opt.APIOptions, r.addS3ThrottleObserver)
+	}), nil
+}
+
+// バックアップ先
+// ローカルエクスポートの場合はExporter、それ以外はObjectsを使う（GCSの場合はGCSBucketも使う）
+type backupDestination struct {
+	Name      string
+	Exporter  *localExporter
+	Objects   ObjectDestination
+	GCSClient *storage.Client
+	GCSBucket *storage.BucketHandle
+}
+
+// GCSクライアントを閉じる
+func (d *backupDestination) Close() error {
+	if d.GCSClient != nil {
+		return d.GCSClient.Close()
+	}
+	return nil
+}
+
+// バックアップ先を用意する
+func (r *backupRun) prepareDestination(ctx context.Context) (*backupDestination, error) {
+	if r.exportPath != "" {
+		exporter, err := newLocalExporter(r.exportPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create export destination: %w", err)
+		}
+		fmt.Fprintf(r.stdout, " - %v -> %v(Local export)\n", r.s3Config.Bucket, r.exportPath)
+		return &backupDestination{Name: r.exportPath, Exporter: exporter}, nil
+	}
+	if r.clientOverrides.Destination != nil {
+		name := fmt.Sprintf("%T", r.clientOverrides.Destination)
+		fmt.Fprintf(r.stdout, " - %v -> %v\n", r.s3Config.Bucket, name)
+		return &backupDestination{Name: name, Objects: r.clientOverrides.Destination}, nil
+	}
+
+	return r.prepareGCSBucket(ctx)
+}
+
+// GCSクライアントを作成し、バックアップ先のバケットのハンドルを返す
+// バケットの存在は確認しない
+func (c *backupConfig) openGCSBucket(ctx context.Context) (*storage.Client, *storage.BucketHandle, string, error) {
+	gcsBucketName, _ := c.gcsDestinationOf(c.s3Config.Bucket)
+	// 転送を始める前に、GCSで使えない名前（正規化できないもの）をエラーにする
+	if err := validateGCSBucketName(gcsBucketName); err != nil {
+		return nil, nil, "", fmt.Errorf("%w (specify the destination with GCS_BUCKET or GCS_BUCKET_MAP)", err)
+	}
+
+	// GCSクライアントの作成
+	gcsOptions, err := c.gcsClientOptions(ctx)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to configure GCS client: %w", err)
+	}
+	gcsClient, err := storage.NewClient(ctx, gcsOptions...)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to create GCS client: %w", err)
+	}
+
+	gcsBucketClient := gcsClient.Bucket(gcsBucketName)
+	if c.gcpConfig.UserProject != "" {
+		gcsBucketClient = gcsBucketClient.UserProject(c.gcpConfig.UserProject)
+	}
+	if retryOptions := c.gcsRetryOptions(); len(retryOptions) > 0 {
+		gcsBucketClient = gcsBucketClient.Retryer(retryOptions...)
+	}
+	return gcsClient, gcsBucketClient, gcsBucketName, nil
+}
+
+// GCSクライアントを作成し、バックアップ先のバケットを用意する
+func (r *backupRun) prepareGCSBucket(ctx context.Context) (*backupDestination, error) {
+	gcsClient, gcsBucketClient, gcsBucketName, err := r.openGCSBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// バックアップ用GCSバケット作成
+	gcsBucketAttr, err := gcsBucketClient.Attrs(ctx)
+	// バケットが存在しない場合は作成
+	if err == storage.ErrBucketNotExist {
+		if err := gcsBucketClient.Create(ctx, r.gcpConfig.ProjectID, r.newBucketAttrs()); err != nil {
+			gcsClient.Close()
+			return nil, fmt.Errorf("failed to create GCS bucket: %w", err)
+		} else {
+			fmt.Fprintf(r.stdout, " - %v -> %v(Created)\n", r.s3Config.Bucket, gcsBucketName)
+			if derived := r.s3Config.Bucket + r.gcpConfig.BucketNameSuffix; gcsBucketName != derived && r.gcpConfig.Bucket == "" && !r.hasBucketMapping(r.s3Config.Bucket) {
+				r.logInfof("GCS bucket name %v was normalized from %v", gcsBucketName, derived)
+			}
+		}
+	} else if err != nil {
+		// その他のエラー
+		gcsClient.Close()
+		return nil, fmt.Errorf("failed to get GCS bucket attributes: %w", err)
+	} else {
+		// 既に存在している場合、バケットの状態を確認
+		if err := r.applyBucketCheckPolicy(ctx, gcsBucketClient, gcsBucketAttr, r.checkBucketAttrs(gcsBucketAttr)); err != nil {
+			gcsClient.Close()
+			return nil, err
+		}
+		fmt.Fprintf(r.stdout, " - %v -> %v(Already exists)\n", r.s3Config.Bucket, gcsBucketName)
+	}
+
+	return &backupDestination{Name: gcsBucketName, Objects: r.newGCSDestination(gcsBucketClient), GCSClient: gcsClient, GCSBucket: gcsBucketClient}, nil
+}
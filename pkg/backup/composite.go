@@ -0,0 +1,239 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+// 結合する前のパートを置くGCSバケット内のプレフィックス
+const compositePartPrefix = backupformat.CompositePartPrefix
+
+// パートの位置を記録したインデックスを置くGCSバケット内のプレフィックス
+const compositeIndexPrefix = backupformat.CompositeIndexPrefix
+
+// パートに分けてアップロードしたオブジェクトに記録するパートの数
+const metadataCompositeParts = backupformat.MetadataCompositeParts
+
+// GCSのcomposeで1度に結合できるオブジェクトの数の上限
+const maxComposeSources = 32
+
+// 分けてアップロードしたパートの位置
+// パートはそれぞれ独立に圧縮しており、圧縮後のオフセットから途中のパートだけを解凍できる
+type compositePart struct {
+	Offset           int64  `json:"offset"`
+	Size             int64  `json:"size"`
+	CompressedOffset int64  `json:"compressedOffset"`
+	CompressedSize   int64  `json:"compressedSize"`
+	MD5              string `json:"md5"`
+	CRC32C           string `json:"crc32c"`
+
+	// 元のデータ全体のCRC32Cを求めるためのパートのCRC32C
+	crc32c uint32
+	// 結合したオブジェクトを検証するための圧縮したパートのCRC32C
+	compressedCRC32C uint32
+}
+
+// パートの位置を記録したインデックス（.s3-backup-helper/part-indexes/<キー>.json）
+type compositeIndex struct {
+	Key         string          `json:"key"`
+	Compression string          `json:"compression"`
+	Size        int64           `json:"size"`
+	Parts       []compositePart `json:"parts"`
+}
+
+// 大きいオブジェクトをパートに分け、範囲を指定したGetObjectで並列にダウンロード・圧縮・アップロードしてから、GCSで1つのオブジェクトに結合する
+// 1つのワーカーが1つの大きいオブジェクトに何時間もかかりきりになるのを防ぐ
+// 圧縮したストリームを連結したものは、snappy、gzip、zstdのいずれも1つのストリームとして解凍できるため（圧縮しない場合はそのまま連結したもの）、復元は通常のオブジェクトと変わらない
+// MD5はパートごとにしか求められないため、パートごとのMD5とCRC32Cをインデックスに記録し、
+// 元のデータ全体にはパートのCRC32Cを連結したCRC32Cを記録する（リストアではMD5の代わりにこれで検証する）
+// 結合にGCSのcomposeを使うため、バックアップ先はGCSのみ
+func (r *backupRun) backupObjectComposite(ctx context.Context, source ObjectSource, destination ObjectDestination, info *ObjectInfo, key string, destinationKey string) error {
+	gcsBucketClient, err := gcsBucketOf(destination)
+	if err != nil {
+		return err
+	}
+	size := info.Size
+	// 並列にダウンロードする間に書き換えられた場合に、異なる内容を結合しないようにする
+	etag := info.ETag
+	uploadPrefix := r.managedObjectName(compositePartPrefix + newRunID() + "/")
+
+	var parts []compositePart
+	for offset := int64(0); offset < size; offset += r.compositePartSize {
+		parts = append(parts, compositePart{Offset: offset, Size: min(r.compositePartSize, size-offset)})
+	}
+
+	// 途中で失敗した場合もパートを残さない
+	defer r.deleteCompositeParts(gcsBucketClient, uploadPrefix)
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(r.compositeParallelNum)
+	for i := range parts {
+		group.Go(func() error {
+			return r.uploadCompositePart(groupCtx, source, gcsBucketClient.Object(compositePartName(uploadPrefix, i)), key, etag, &parts[i])
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	var compressedOffset int64
+	var originalCRC32C, compressedCRC32C uint32
+	sources := make([]*storage.ObjectHandle, len(parts))
+	for i := range parts {
+		parts[i].CompressedOffset = compressedOffset
+		compressedOffset += parts[i].CompressedSize
+		originalCRC32C = combineCRC32C(originalCRC32C, parts[i].crc32c, parts[i].Size)
+		compressedCRC32C = combineCRC32C(compressedCRC32C, parts[i].compressedCRC32C, parts[i].CompressedSize)
+		sources[i] = gcsBucketClient.Object(compositePartName(uploadPrefix, i))
+	}
+
+	// 上限を超える数のパートは、途中のオブジェクトに結合してから結合する
+	for level := 0; len(sources) > maxComposeSources; level++ {
+		var composed []*storage.ObjectHandle
+		for start := 0; start < len(sources); start += maxComposeSources {
+			intermediate := gcsBucketClient.Object(fmt.Sprintf("%vcomposed-%d-%05d", uploadPrefix, level, len(composed)))
+			intermediateComposer := intermediate.ComposerFrom(sources[start:min(start+maxComposeSources, len(sources))]...)
+			intermediateComposer.StorageClass = r.temporaryStorageClass()
+			if _, err := intermediateComposer.Run(ctx); err != nil {
+				return fmt.Errorf("failed to compose parts: %w", err)
+			}
+			composed = append(composed, intermediate)
+		}
+		sources = composed
+	}
+
+	composer := gcsBucketClient.Object(destinationKey).ComposerFrom(sources...)
+	writeInfo := backupObjectInfo(info)
+	writeInfo.Metadata[metadataCompression] = r.compression
+	composer.ContentType = writeInfo.ContentType
+	composer.ContentEncoding = r.gcsContentEncodingOf(writeInfo)
+	composer.ContentDisposition = writeInfo.ContentDisposition
+	composer.ContentLanguage = writeInfo.ContentLanguage
+	composer.CacheControl = writeInfo.CacheControl
+	composer.Metadata = r.gcsMetadataOf(writeInfo)
+	composer.Metadata[metadataCompression] = r.compression
+	composer.Metadata[metadataBackupTime] = time.Now().UTC().Format(time.RFC3339)
+	composer.Metadata[metadataOriginalSize] = strconv.FormatInt(size, 10)
+	composer.Metadata[metadataOriginalCRC32C] = encodeCRC32C(originalCRC32C)
+	composer.Metadata[metadataCompositeParts] = strconv.Itoa(len(parts))
+	if etag != "" {
+		composer.Metadata[metadataSourceETag] = etag
+	}
+	attrs, err := composer.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to compose parts: %w", err)
+	}
+	// 結合したオブジェクトも、1回で書き込んだものと同じように検証する
+	if err := r.verifyCompositeUpload(ctx, destination, destinationKey, gcsObjectInfo(attrs), compressedCRC32C, originalCRC32C); err != nil {
+		return err
+	}
+
+	index := compositeIndex{Key: destinationKey, Compression: r.compression, Size: size, Parts: parts}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	indexWriter := gcsBucketClient.Object(r.managedObjectName(compositeIndexPrefix + strings.TrimPrefix(destinationKey, r.destinationPrefix()) + ".json")).NewWriter(ctx)
+	indexWriter.ContentType = "application/json"
+	if _, err := indexWriter.Write(indexJSON); err != nil {
+		indexWriter.Close()
+		return err
+	}
+	if err := indexWriter.Close(); err != nil {
+		return fmt.Errorf("failed to upload part index: %w", err)
+	}
+	return nil
+}
+
+// 1つのパートをダウンロードし、圧縮してアップロードする
+// UPLOAD_PARALLEL_NUMを指定した場合は、パートごとにアップロードの枠を使う
+func (r *backupRun) uploadCompositePart(ctx context.Context, source ObjectSource, object *storage.ObjectHandle, key string, etag string, part *compositePart) (err error) {
+	ctx, span := tracer.Start(ctx, "uploadPart", trace.WithAttributes(attribute.Int64("backup.part_offset", part.Offset), attribute.Int64("backup.part_size", part.Size)))
+	defer func() { endSpan(span, err) }()
+
+	releaseUpload, err := acquireSlot(ctx, r.uploadSlots)
+	if err != nil {
+		return err
+	}
+	defer releaseUpload()
+
+	_, body, err := source.Get(ctx, key, GetOptions{IfMatch: etag, RangeOffset: part.Offset, RangeLength: part.Size})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// 途中で失敗した場合は書き込みを中止する
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := object.NewWriter(ctx)
+	writer.StorageClass = r.temporaryStorageClass()
+	compressedHash := crc32.New(crc32cTable)
+	compressWriter, err := r.newCompressWriter(io.MultiWriter(writer, compressedHash), r.compression)
+	if err != nil {
+		return err
+	}
+	defer compressWriter.Close()
+	partHash := md5.New()
+	partCRC32C := crc32.New(crc32cTable)
+	written, err := pooledCopy(compressWriter, io.TeeReader(body, io.MultiWriter(partHash, partCRC32C)))
+	if err != nil {
+		return err
+	}
+	if written != part.Size {
+		return fmt.Errorf("part at offset %d: read %d bytes, expected %d", part.Offset, written, part.Size)
+	}
+	if err := compressWriter.Close(); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	part.CompressedSize = writer.Attrs().Size
+	part.MD5 = hex.EncodeToString(partHash.Sum(nil))
+	part.crc32c = partCRC32C.Sum32()
+	part.CRC32C = encodeCRC32C(part.crc32c)
+	part.compressedCRC32C = compressedHash.Sum32()
+	return nil
+}
+
+func compositePartName(uploadPrefix string, i int) string {
+	return fmt.Sprintf("%vpart-%05d", uploadPrefix, i)
+}
+
+// アップロードしたパートと途中のオブジェクトを削除する
+// バケットはバージョニングされているため、世代を指定して削除し、古い世代として残さない
+// 削除できなかったものはバケットのライフサイクルで削除される
+func (r *backupRun) deleteCompositeParts(gcsBucketClient *storage.BucketHandle, uploadPrefix string) {
+	// 実行が中断された後も削除できるようにする
+	ctx := context.Background()
+	objects := gcsBucketClient.Objects(ctx, &storage.Query{Prefix: uploadPrefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return
+		} else if err != nil {
+			r.logWarnf("Failed to list parts under %v: %v", uploadPrefix, err)
+			return
+		}
+		if err := gcsBucketClient.Object(attrs.Name).Generation(attrs.Generation).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			r.logWarnf("Failed to delete part %v: %v", attrs.Name, err)
+		}
+	}
+}
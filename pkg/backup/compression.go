@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 圧縮形式
+const (
+	compressionSnappy = "snappy"
+	compressionGzip   = "gzip"
+	compressionZstd   = "zstd"
+	// 圧縮しない（元のオブジェクトと同じバイト列をそのまま保存し、ツールを使わずにGCSから直接ダウンロードできるようにする）
+	compressionNone = "none"
+)
+
+// 圧縮用のWriterは内部のバッファやエンコーダーの作成のコストが大きいため、ワーカー間で使い回す
+// 小さいオブジェクトが大量にある場合に、オブジェクトごとの確保がGCの負荷になるのを防ぐ
+var (
+	snappyWriterPool sync.Pool
+	gzipWriterPool   sync.Pool
+	zstdEncoderPool  sync.Pool
+)
+
+// 出力先を切り替えて使い回せる圧縮用のWriter
+type resettableWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// 圧縮形式の名前が正しいか
+func validCompression(algorithm string) bool {
+	switch algorithm {
+	case compressionSnappy, compressionGzip, compressionZstd, compressionNone:
+		return true
+	}
+	return false
+}
+
+// 指定された形式で圧縮するWriterを作成する
+// Closeは圧縮を終えるのみで、wは閉じない
+func (c *backupConfig) newCompressWriter(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	switch algorithm {
+	case compressionSnappy:
+		if writer, ok := snappyWriterPool.Get().(*snappy.Writer); ok {
+			writer.Reset(w)
+			return &pooledWriter{resettableWriter: writer, pool: &snappyWriterPool}, nil
+		}
+		return &pooledWriter{resettableWriter: snappy.NewBufferedWriter(w), pool: &snappyWriterPool}, nil
+	case compressionGzip:
+		if writer, ok := gzipWriterPool.Get().(*gzip.Writer); ok {
+			writer.Reset(w)
+			return &pooledWriter{resettableWriter: writer, pool: &gzipWriterPool}, nil
+		}
+		level := gzip.DefaultCompression
+		if c.compressionLevel != 0 {
+			level = c.compressionLevel
+		}
+		writer, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return &pooledWriter{resettableWriter: writer, pool: &gzipWriterPool}, nil
+	case compressionZstd:
+		if encoder, ok := zstdEncoderPool.Get().(*zstd.Encoder); ok {
+			encoder.Reset(w)
+			return &pooledWriter{resettableWriter: encoder, pool: &zstdEncoderPool}, nil
+		}
+		options := []zstd.EOption{
+			// ワーカーごとに並列で圧縮するため、1つのエンコーダーの中では並列にしない
+			zstd.WithEncoderConcurrency(1),
+		}
+		if c.compressionLevel != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.compressionLevel)))
+		}
+		encoder, err := zstd.NewWriter(w, options...)
+		if err != nil {
+			return nil, err
+		}
+		return &pooledWriter{resettableWriter: encoder, pool: &zstdEncoderPool}, nil
+	case compressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %v", algorithm)
+	}
+}
+
+// 圧縮せずにそのまま書き込むWriter（Closeは何もしない）
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// 閉じたときにプールに戻す圧縮用のWriter
+type pooledWriter struct {
+	resettableWriter
+	pool   *sync.Pool
+	closed bool
+}
+
+func (w *pooledWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.resettableWriter.Close()
+	// 出力先を参照し続けないようにしてから戻す
+	w.resettableWriter.Reset(nil)
+	w.pool.Put(w.resettableWriter)
+	return err
+}
+
+// io.Copyで使うバッファ
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, 32*1024)
+		return &buffer
+	},
+}
+
+// プールのバッファを使ってコピーする（io.Copyがコピーごとにバッファを確保するのを避ける）
+func pooledCopy(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buffer)
+	return io.CopyBuffer(dst, src, *buffer)
+}
+
+// 圧縮レベルが圧縮形式に対して正しいか
+func validCompressionLevel(algorithm string, level int) bool {
+	switch algorithm {
+	case compressionGzip:
+		return level >= gzip.BestSpeed && level <= gzip.BestCompression
+	case compressionZstd:
+		return level >= 1 && level <= 22
+	}
+	// snappyとnoneには圧縮レベルがない
+	return false
+}
+
+// 指定された形式で解凍するReaderを作成する
+// Closeは解凍に使った資源を解放するのみで、rは閉じない
+func newDecompressReader(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case compressionSnappy:
+		return io.NopCloser(snappy.NewReader(r)), nil
+	case compressionGzip:
+		return gzip.NewReader(r)
+	case compressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case compressionNone:
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %v", algorithm)
+	}
+}
+
+// バックアップしたオブジェクトのメタデータから圧縮形式を求める
+// 圧縮形式が記録される前のバックアップはSnappyで圧縮されている
+func objectCompression(metadata map[string]string) string {
+	if algorithm := metadata[metadataCompression]; algorithm != "" {
+		return algorithm
+	}
+	return compressionSnappy
+}
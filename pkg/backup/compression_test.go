@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	c := newBackupConfig()
+	original := []byte(strings.Repeat("s3-backup-helper ", 1000))
+	tests := []struct {
+		algorithm string
+		level     int
+	}{
+		{algorithm: compressionSnappy},
+		{algorithm: compressionGzip},
+		{algorithm: compressionGzip, level: 9},
+		{algorithm: compressionZstd},
+		{algorithm: compressionZstd, level: 19},
+		// プールから取り出したエンコーダーでも正しく圧縮できる
+		{algorithm: compressionZstd},
+		{algorithm: compressionNone},
+	}
+	for _, tt := range tests {
+		c.compressionLevel = tt.level
+		var compressed bytes.Buffer
+		writer, err := c.newCompressWriter(&compressed, tt.algorithm)
+		if err != nil {
+			t.Fatalf("newCompressWriter(%v) returned error: %v", tt.algorithm, err)
+		}
+		if _, err := writer.Write(original); err != nil {
+			t.Fatalf("%v: Write returned error: %v", tt.algorithm, err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("%v: Close returned error: %v", tt.algorithm, err)
+		}
+
+		reader, err := newDecompressReader(&compressed, tt.algorithm)
+		if err != nil {
+			t.Fatalf("newDecompressReader(%v) returned error: %v", tt.algorithm, err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("%v: ReadAll returned error: %v", tt.algorithm, err)
+		}
+		if !bytes.Equal(got, original) {
+			t.Errorf("%v (level %d): round trip mismatch", tt.algorithm, tt.level)
+		}
+	}
+
+	// 圧縮しない場合は元のデータと同じバイト列を書き込む
+	var stored bytes.Buffer
+	writer, err := c.newCompressWriter(&stored, compressionNone)
+	if err != nil {
+		t.Fatalf("newCompressWriter(%v) returned error: %v", compressionNone, err)
+	}
+	writer.Write(original)
+	writer.Close()
+	if !bytes.Equal(stored.Bytes(), original) {
+		t.Errorf("%v: stored data differs from the original", compressionNone)
+	}
+}
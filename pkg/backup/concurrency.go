@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// 同時に処理する数を見直す間隔
+const adaptiveConcurrencyInterval = 30 * time.Second
+
+// S3のリクエストごと（リトライの各回）にスロットリングを数えるミドルウェアを追加する
+func (r *backupRun) addS3ThrottleObserver(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("S3ThrottleObserver", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+		if isS3Throttle(err) {
+			r.s3ThrottleCount.Add(1)
+		}
+		return out, metadata, err
+	}), middleware.Before)
+}
+
+// S3のエラーがスロットリングか判定する
+func isS3Throttle(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "SlowDown" || apiErr.ErrorCode() == "ServiceUnavailable") {
+		return true
+	}
+	var responseErr *smithyhttp.ResponseError
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == 503
+}
+
+// 同時に処理するオブジェクトの数を、PALALELL_NUMを上限として増減する
+// スロットリングされた場合は半分に減らし、そうでなければ転送量が下がらない限り1つずつ増やす
+type concurrencyController struct {
+	run    *backupRun
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+	max    int
+
+	// 前回見直したときの値
+	lastBytes      int64
+	lastThrottles  int64
+	lastThroughput float64
+	increased      bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// 上限の半分から始める
+func (r *backupRun) newConcurrencyController(maxWorkers int) *concurrencyController {
+	c := &concurrencyController{run: r, limit: max(maxWorkers/2, 1), max: maxWorkers}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// 処理を始める前に呼び、同時に処理する数が上限に達している場合は待つ
+func (c *concurrencyController) Acquire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.active >= c.limit {
+		c.cond.Wait()
+	}
+	c.active++
+}
+
+// 処理が終わったときに呼ぶ
+func (c *concurrencyController) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+	c.cond.Signal()
+}
+
+// 進捗を見て定期的に同時に処理する数を見直す
+func (c *concurrencyController) Start(progress *backupProgress) {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	c.lastThrottles = c.run.s3ThrottleCount.Load()
+	c.run.logInfof("Adaptive concurrency: starting with %d workers (max %d)", c.limit, c.max)
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(adaptiveConcurrencyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.adjust(progress.completedBytes.Load(), c.run.s3ThrottleCount.Load(), adaptiveConcurrencyInterval)
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *concurrencyController) Stop() {
+	close(c.stop)
+	<-c.done
+}
+
+func (c *concurrencyController) adjust(completedBytes int64, throttles int64, interval time.Duration) {
+	throughput := float64(completedBytes-c.lastBytes) / interval.Seconds()
+	throttled := throttles > c.lastThrottles
+	c.lastBytes, c.lastThrottles = completedBytes, throttles
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.limit
+	switch {
+	case throttled:
+		c.limit = max(c.limit/2, 1)
+		c.increased = false
+	case c.increased && throughput < c.lastThroughput*0.95:
+		// 増やしても転送量が上がらなかった場合は戻す
+		c.limit = max(c.limit-1, 1)
+		c.increased = false
+	case c.limit < c.max:
+		c.limit++
+		c.increased = true
+	default:
+		c.increased = false
+	}
+	c.lastThroughput = throughput
+	if c.limit != previous {
+		c.run.logInfof("Adaptive concurrency: %d -> %d workers (%s/s, throttled: %v)", previous, c.limit, formatBytes(int64(throughput)), throttled)
+		c.cond.Broadcast()
+	}
+}
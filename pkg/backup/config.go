@@ -0,0 +1,885 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/joho/godotenv"
+	"github.com/traPtitech/s3-backup-helper/pkg/keyencoding"
+)
+
+// S3設定
+type s3ConfigStruct struct {
+	Region    string
+	EndPoint  string
+	AccessKey string
+	SecretKey string
+	// 一時的な認証情報の場合のセッショントークン
+	SessionToken   string
+	ForcePathStyle bool
+	Bucket         string
+	// リクエスタ支払いバケットの場合true
+	RequesterPays bool
+	// 指定した場合、このロールを引き受けてからS3にアクセスする（クロスアカウントのバケット向け）
+	RoleARN    string
+	ExternalID string
+	// trueの場合、記録したETagを指定した条件付きのGetObject（If-None-Match）で変更を検出する
+	// 対応していないS3互換ストレージでは常に本体が返るため、スキップされない
+	ConditionalGet bool
+}
+
+// GCP設定
+type gcpConfigStruct struct {
+	CredentialsPath string
+	// サービスアカウントのJSON（指定された場合はCredentialsPathより優先する）
+	CredentialsJSON  []byte
+	ProjectID        string
+	Region           string
+	BucketNameSuffix string
+	// バックアップ先のGCSバケット名（指定した場合はBucketNameSuffixを使わない）
+	Bucket string
+	// バックアップ先のGCSバケット内のプレフィックス（空または/で終わる）
+	Prefix string
+	// リクエスタ支払いバケットの場合に課金先とするプロジェクト
+	UserProject string
+	// 指定した場合、このサービスアカウントになりすましてGCSにアクセスする
+	ImpersonateServiceAccount string
+	// 作成するバケットのストレージクラス（STANDARD、NEARLINE、COLDLINE、ARCHIVE、AUTOCLASS）
+	StorageClass string
+	// 構成可能なデュアルリージョンのバケットでデータを置くリージョン（Regionにはマルチリージョンを指定する）
+	DataLocations []string
+}
+
+// バックアップの設定
+// LoadConfigFromEnvやSOURCESの環境変数から読み込み、実行ごとに複製してOptionsなどで上書きする
+type backupConfig struct {
+	s3Config  s3ConfigStruct
+	gcpConfig gcpConfigStruct
+
+	// Webhook設定
+	webhookUrl    string
+	webhookId     string
+	webhookSecret string
+
+	// 並列ダウンロード数
+	palalellNum int64
+
+	// フルバックアップかどうか
+	fullBackup bool
+
+	// ローカルエクスポート先（指定した場合はGCSの代わりに書き出す）
+	exportPath string
+
+	// 転送を始める前にオブジェクト数とバイト数を数えるか
+	// バケットを2回一覧することになるため、指定した場合のみ数える
+	// 数えない場合は一覧の取得に合わせて合計を増やすため、一覧が終わるまで進捗の割合と残り時間は正確でない
+	precountObjects bool
+
+	// 標準出力が端末でない場合に進捗を出力する間隔
+	progressLogInterval time.Duration
+
+	// 途中経過を通知する間隔（0の場合は通知しない）
+	heartbeatInterval time.Duration
+
+	// エラー数の上限（0の場合は無制限）
+	maxErrors int64
+
+	// 1オブジェクトあたりの転送時間の上限（0の場合は無制限）
+	objectTimeout time.Duration
+
+	// 実行全体の時間の上限（0の場合は無制限）
+	runTimeout time.Duration
+
+	// 実行中のロックの有効期限（延長されずにこれを過ぎたロックは他の実行が奪い取る）
+	runLockTTL time.Duration
+
+	// このサイズ（バイト）以上のオブジェクトは大きいオブジェクトとして同時処理数を制限する（0の場合は制限しない）
+	largeObjectThreshold int64
+
+	// バックアップ対象とするオブジェクトサイズの下限・上限（バイト、0の場合は制限なし）
+	minObjectSize int64
+	maxObjectSize int64
+
+	// 一覧をプレフィックスで分割して並列に取得する深さ（0の場合は分割しない）
+	listingShardDepth int
+
+	// 分割に使う区切り文字
+	listingDelimiter string
+
+	// 一覧を並列に取得するシャード数
+	listingParallelNum int
+
+	// 実行結果のJSONを書き出すファイルのパス
+	summaryPath string
+
+	// 実行結果のJSONをGCSバケットにもアップロードするか
+	summaryUpload bool
+
+	// オブジェクトごとの処理結果を書き出すファイルのパス（.csvの場合はCSV、それ以外はJSON Lines）
+	objectReportPath string
+
+	// バックアップ先のキーのプレフィックスの書き換え規則
+	keyPrefixMap []keyPrefixMapping
+
+	// 内容のハッシュで重複排除してバックアップするか
+	dedupEnabled bool
+
+	// 小さいオブジェクトをアーカイブにまとめてバックアップするプレフィックス
+	bundlePrefixes []string
+
+	// 1つのアーカイブに入れる最大のバイト数（超える場合は次のアーカイブに分ける）
+	bundleMaxBytes int64
+
+	archivedObjectPolicy string
+
+	// 復元したオブジェクトを読めるようにしておく日数
+	archivedRestoreDays int32
+
+	// 復元の速さ（Expedited、Standard、Bulk）
+	archivedRestoreTier types.Tier
+
+	// 実行ごとに監査記録をGCSバケットにアップロードするか
+	auditLog bool
+
+	// S3バケットの設定（ポリシー、CORS、ライフサイクル、バージョニング）もバックアップするか
+	bucketConfigBackup bool
+
+	// S3バケットごとのバックアップ先（GCS_BUCKET_MAP）
+	// 複数のS3バケットを1つのGCSバケットの別々のプレフィックスにバックアップする場合などに使う
+	bucketMap []bucketMapping
+
+	// 既存のバケットの設定が想定と異なる場合の扱い
+	bucketCheckPolicy string
+
+	// 古い世代になってから削除するまでの日数（0の場合は古い世代を個別に削除しない）
+	noncurrentDeleteDays int64
+
+	// 残す古い世代の数（0の場合は制限しない）
+	maxNoncurrentVersions int64
+
+	// 作成するバケットに付けるラベル
+	bucketLabels map[string]string
+
+	// 1回の実行でアップロードするバイト数の上限（0の場合は制限しない）
+	// 従量課金の回線で、1回の転送量を抑えて数回の実行に分けるため
+	maxBytesPerRun int64
+
+	// 変更を検出する方法
+	changeDetection string
+
+	// このサイズ（バイト）以上のオブジェクトは、パートに分けて並列にアップロードしてからGCSで結合する（0の場合は分けない）
+	compositeUploadThreshold int64
+
+	// 分割するパートのサイズ（圧縮前、バイト）
+	compositePartSize int64
+
+	// 1つのオブジェクトのパートを同時にアップロードする数
+	compositeParallelNum int
+
+	// アップロード時に使う圧縮形式
+	compression string
+
+	// trueの場合、gzipで圧縮したオブジェクトにGCSのContent-Encoding: gzipを付ける（COMPRESSION=gzipの場合のみ）
+	// GCSの解凍トランスコーディングにより、ブラウザやgsutilで復元ツールを使わずに解凍したものをダウンロードできる
+	gcsTranscoding bool
+
+	// 圧縮レベル（0の場合は形式ごとのデフォルト）
+	// gzipは1〜9、zstdは1〜22（zstdコマンドのレベル）で、大きいほど時間をかけて小さくする
+	compressionLevel int
+
+	// 転送量とスロットリングを見て同時に処理するオブジェクトの数を増減するか
+	adaptiveConcurrency bool
+
+	deleteMarkerPolicy string
+
+	// trueの場合、S3_BUCKETの代わりにアカウントの全てのバケット（DISCOVER_BUCKETS_INCLUDE、DISCOVER_BUCKETS_EXCLUDEで絞り込む）をバックアップする
+	// 新しく作られたバケットも設定を変えずにバックアップされるようにするため
+	discoverBuckets bool
+
+	// バックアップするバケット名のパターン（path.Matchの形式、空の場合は全て）と、除外するバケット名のパターン
+	discoverBucketsInclude, discoverBucketsExclude []string
+
+	smtpConfig smtpConfigStruct
+
+	// 見積もりに使う転送速度（バイト/秒、0の場合は直近の実行結果から求める）
+	estimateThroughput int64
+
+	// 見積もりに使うGCSの保存料金（USD/GB/月、0の場合はストレージクラスごとの既定値）
+	gcsPricePerGB float64
+
+	// 通知に載せる失敗したオブジェクトの数
+	webhookMaxFailedObjects int
+
+	// 実行の開始と終了を知らせる監視サービスのURL（空の場合は知らせない）
+	// Webhookは実行された場合にしか通知されないため、実行されなかったことを監視サービス側で検知する
+	// URLを知っていれば監視を成功にできるため、シークレットと同じく<名前>_FILEやシークレットの参照で指定できる
+	healthcheckURL string
+
+	// trueの場合、成功した時にHEALTHCHECK_URLを呼ぶだけにする
+	// falseの場合はhealthchecks.ioの形式で、開始時に<URL>/start、失敗時に<URL>/failも呼ぶ
+	healthcheckGeneric bool
+
+	httpConfig httpConfigStruct
+
+	// 一覧の代わりに読むS3インベントリのmanifest.json（s3://<バケット>/<キー>、空の場合はListObjectsV2で一覧を取得する）
+	s3InventoryManifest string
+
+	// trueの場合、プログレスバーと進捗のログを出力しない（--quiet）
+	quietMode bool
+
+	// 本体を転送せず、オブジェクトのメタデータのみをマニフェストに記録するか
+	metadataOnly bool
+
+	notifiers []notifierConfig
+
+	retryConfig retryConfigStruct
+
+	// Runnerで差し替えるクライアント（指定されていない場合や、Runnerから実行していない場合はnil）
+	clientOverrides struct {
+		Source      ObjectSource
+		Destination ObjectDestination
+		HTTPClient  *http.Client
+	}
+
+	// S3からのダウンロードとGCSへのアップロードを、それぞれ同時に行う数の上限（0の場合はPALALELL_NUMと同じ）
+	// どちらも指定しない場合は分けずに、ダウンロードしながら圧縮してアップロードする
+	// 両側でスループットやスロットリングの傾向が大きく異なる環境で、それぞれに合わせて調整するため
+	downloadParallelNum, uploadParallelNum int64
+
+	// ダウンロードとアップロードを分ける場合に、アップロードを待つ間に圧縮したデータを置くディレクトリ（空の場合はOSのデフォルト）
+	spoolDir string
+
+	// アップロードの検証方法（空の場合は検証しない）
+	verifyUploads string
+
+	// WEBHOOK_TEMPLATEまたはWEBHOOK_TEMPLATE_PATHから読み込んだ通知のテンプレート（指定されていない場合はnil）
+	webhookTemplate *template.Template
+
+	notifyPolicy notifyPolicyStruct
+
+	// Webhookの送信を試みる回数
+	webhookMaxAttempts int
+
+	// 全ての通知先への送信に失敗した場合に、同じ通知文をPOSTする予備の送信先（空の場合は送らない）
+	webhookFallbackURL string
+
+	// バックアップを実行してよい時間帯（nilの場合は制限しない）
+	// 複数日かかるフルバックアップが日中の通信に影響しないよう、時間帯の外では一時停止する
+	backupWindow *timeWindow
+}
+
+// 実行ごとに上書きするための複製
+// スライスやマップは上書きしないため共有する
+func (c *backupConfig) clone() *backupConfig {
+	copied := *c
+	return &copied
+}
+
+// デフォルトの設定
+func newBackupConfig() *backupConfig {
+	return &backupConfig{
+		gcpConfig:               gcpConfigStruct{StorageClass: "COLDLINE"},
+		palalellNum:             5,
+		progressLogInterval:     time.Minute,
+		runLockTTL:              10 * time.Minute,
+		largeObjectThreshold:    100 * 1024 * 1024,
+		listingDelimiter:        "/",
+		listingParallelNum:      4,
+		bundleMaxBytes:          256 * 1024 * 1024,
+		archivedObjectPolicy:    archivedSkip,
+		archivedRestoreDays:     7,
+		archivedRestoreTier:     types.TierBulk,
+		bucketCheckPolicy:       bucketCheckEnforce,
+		changeDetection:         changeDetectionMD5,
+		compositePartSize:       256 * 1024 * 1024,
+		compositeParallelNum:    4,
+		compression:             compressionSnappy,
+		deleteMarkerPolicy:      deleteMarkersIgnore,
+		webhookMaxFailedObjects: 10,
+		webhookMaxAttempts:      5,
+	}
+}
+
+// LoadConfigFromEnvで読み込んだ設定（読み込んでいない場合はデフォルト）
+// 実行ごとの設定はこれを複製して作る
+var defaultConfig = newBackupConfig()
+
+// 常駐して定期的にバックアップする場合のスケジュール（cron形式）
+var backupSchedule string
+
+// 常駐する場合に制御・状態取得用のHTTPサーバーを待ち受けるアドレス（例: :8080）
+var controlAPIAddr string
+
+// 制御APIのリクエストに必要なBearerトークン（空の場合は認証しない）
+var controlAPIToken string
+
+// 中断の理由
+var (
+	errTooManyErrors = errors.New("error count exceeded MAX_ERRORS")
+	errRunTimeout    = errors.New("run exceeded RUN_TIMEOUT")
+	errRunLockLost   = errors.New("run lock could not be renewed")
+)
+
+// 終了コード（CronJobやCIで失敗を検知できるように、失敗の種類ごとに分ける）
+const (
+	// 最後まで実行したが、失敗したオブジェクトがある
+	exitCodeTransferError = 1
+	// 設定が誤っている
+	exitCodeConfigError = 2
+	// 中断した、または開始できなかった
+	exitCodeAborted = 3
+)
+
+// サブコマンドが返すエラーの種類（終了コードを決めるのに使う）
+var (
+	// 設定や引数が誤っている（exitCodeConfigError）
+	errInvalidConfig = errors.New("invalid configuration")
+	// 最後まで実行したが、失敗したオブジェクトがある（exitCodeTransferError）
+	errObjectsFailed = errors.New("some objects failed")
+)
+
+// サブコマンドが返したエラーの終了コード
+func exitCodeOf(err error) int {
+	switch {
+	case errors.Is(err, errInvalidConfig):
+		return exitCodeConfigError
+	case errors.Is(err, errObjectsFailed):
+		return exitCodeTransferError
+	}
+	return exitCodeAborted
+}
+
+// 設定の誤りをログに出力して終了する
+func configFatalf(format string, v ...any) {
+	log.Printf(format, v...)
+	os.Exit(exitCodeConfigError)
+}
+
+// .envと環境変数から全ての設定を読み込む
+// 設定が誤っている場合はログに出力して終了する（コマンドラインから使う場合向け）
+// 読み込まない場合は、Optionsで指定した設定以外はデフォルトの設定を使う
+func LoadConfigFromEnv() {
+	// 環境変数の読み込み
+	// .envがない場合（Kubernetesなど）は環境変数のみから読み込む
+	err := godotenv.Load(".env")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		configFatalf("Error: Failed to load .env file: %v", err)
+	}
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		logLevel, err = parseLogLevel(value)
+		if err != nil {
+			configFatalf("Error: Invalid LOG_LEVEL: %v", err)
+		}
+	}
+	parseLogFlags()
+	ctx := context.Background()
+	defaultConfig, err = loadConfig(ctx, os.Getenv)
+	if err != nil {
+		configFatalf("Error: %v", err)
+	}
+
+	// 常駐や複数のS3の設定は、プロセス全体で1つ
+	backupSchedule = os.Getenv("BACKUP_SCHEDULE")
+	controlAPIAddr = os.Getenv("CONTROL_API_ADDR")
+	controlAPIToken, err = getenvOrFile(os.Getenv, "CONTROL_API_TOKEN")
+	if err != nil {
+		configFatalf("Error: %v", err)
+	}
+	controlAPIToken, err = defaultConfig.resolveSecret(ctx, controlAPIToken)
+	if err != nil {
+		configFatalf("Error: Failed to resolve CONTROL_API_TOKEN: %v", err)
+	}
+	// 認証しない制御APIは、同じホストやPodの中からのみ使えるようにする
+	if controlAPIAddr != "" && controlAPIToken == "" && !isLoopbackAddr(controlAPIAddr) {
+		configFatalf("Error: CONTROL_API_TOKEN is required when CONTROL_API_ADDR is not a loopback address: %v", controlAPIAddr)
+	}
+	sourcesJSON, err := getenvOrFile(os.Getenv, "SOURCES")
+	if err != nil {
+		configFatalf("Error: %v", err)
+	}
+	sources, err = parseSources(os.Getenv, sourcesJSON, defaultConfig.discoverBuckets)
+	if err != nil {
+		configFatalf("Error: Failed to parse SOURCES: %v", err)
+	}
+	if value := os.Getenv("SOURCES_PARALLEL_NUM"); value != "" {
+		sourcesParallelNum, err = strconv.Atoi(value)
+		if err != nil || sourcesParallelNum <= 0 {
+			configFatalf("Error: SOURCES_PARALLEL_NUM must be a positive integer: %v", value)
+		}
+	}
+}
+
+// 環境変数から実行ごとの設定を読み込む
+// getenvはos.Getenvか、SOURCESのバックアップ元ごとに環境変数を上書きしたもの
+func loadConfig(ctx context.Context, getenv func(string) string) (*backupConfig, error) {
+	c := newBackupConfig()
+	c.quietMode = quietFlag
+	var err error
+	c.s3Config.EndPoint = getenv("S3_ENDPOINT")
+	c.s3Config.Region = getenv("S3_REGION")
+	c.s3Config.ForcePathStyle = getenv("S3_FORCE_PATH_STYLE") == "true"
+	c.s3Config.Bucket = getenv("S3_BUCKET")
+	c.s3Config.RequesterPays = getenv("S3_REQUESTER_PAYS") == "true"
+	c.s3Config.RoleARN = getenv("S3_ROLE_ARN")
+	c.s3Config.ExternalID = getenv("S3_EXTERNAL_ID")
+	c.s3Config.ConditionalGet = getenv("S3_CONDITIONAL_GET") == "true"
+	c.gcpConfig.CredentialsPath = getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if credentialsJSON := getenv("GOOGLE_CREDENTIALS_JSON"); credentialsJSON != "" {
+		c.gcpConfig.CredentialsJSON = []byte(credentialsJSON)
+	}
+	c.gcpConfig.ProjectID = getenv("GCP_PROJECT_ID")
+	c.gcpConfig.Region = getenv("GCS_REGION")
+	c.gcpConfig.BucketNameSuffix = getenv("GCS_BUCKET_NAME_SUFFIX")
+	c.gcpConfig.Bucket = getenv("GCS_BUCKET")
+	if c.gcpConfig.Bucket != "" {
+		if err := validateGCSBucketName(c.gcpConfig.Bucket); err != nil {
+			return nil, fmt.Errorf("Invalid GCS_BUCKET: %v", err)
+		}
+	}
+	c.gcpConfig.Prefix = normalizeDestinationPrefix(getenv("GCS_PREFIX"))
+	if len(c.gcpConfig.Prefix) > keyencoding.MaxPrefixLength {
+		return nil, fmt.Errorf("GCS_PREFIX must be at most %d bytes", keyencoding.MaxPrefixLength)
+	}
+	c.bucketMap, err = parseBucketMap(getenv("GCS_BUCKET_MAP"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse GCS_BUCKET_MAP: %v", err)
+	}
+	c.gcpConfig.UserProject = getenv("GCS_USER_PROJECT")
+	c.gcpConfig.ImpersonateServiceAccount = getenv("GCS_IMPERSONATE_SERVICE_ACCOUNT")
+	if value := getenv("GCS_STORAGE_CLASS"); value != "" {
+		if !validStorageClass(value) {
+			return nil, fmt.Errorf("Invalid GCS_STORAGE_CLASS: %v", value)
+		}
+		c.gcpConfig.StorageClass = value
+	}
+	for _, location := range strings.Split(getenv("GCS_DATA_LOCATIONS"), ",") {
+		if location = strings.TrimSpace(location); location != "" {
+			c.gcpConfig.DataLocations = append(c.gcpConfig.DataLocations, location)
+		}
+	}
+	if len(c.gcpConfig.DataLocations) != 0 && len(c.gcpConfig.DataLocations) != 2 {
+		return nil, fmt.Errorf("GCS_DATA_LOCATIONS must have exactly 2 regions: %v", c.gcpConfig.DataLocations)
+	}
+	if value := getenv("GCS_NONCURRENT_DELETE_DAYS"); value != "" {
+		c.noncurrentDeleteDays, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.noncurrentDeleteDays < 0 {
+			return nil, fmt.Errorf("Failed to convert GCS_NONCURRENT_DELETE_DAYS to int: %v", value)
+		}
+	}
+	if value := getenv("GCS_MAX_NONCURRENT_VERSIONS"); value != "" {
+		c.maxNoncurrentVersions, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.maxNoncurrentVersions < 0 {
+			return nil, fmt.Errorf("Failed to convert GCS_MAX_NONCURRENT_VERSIONS to int: %v", value)
+		}
+	}
+	c.bucketLabels, err = parseBucketLabels(getenv("GCS_BUCKET_LABELS"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse GCS_BUCKET_LABELS: %v", err)
+	}
+	if value := getenv("GCS_BUCKET_CHECK"); value != "" {
+		if value != bucketCheckEnforce && value != bucketCheckWarn && value != bucketCheckIgnore && value != bucketCheckRepair {
+			return nil, fmt.Errorf("Invalid GCS_BUCKET_CHECK: %v", value)
+		}
+		c.bucketCheckPolicy = value
+	}
+	c.httpConfig.ProxyURL = getenv("HTTP_PROXY_URL")
+	c.httpConfig.CABundlePath = getenv("CA_BUNDLE_PATH")
+	c.httpConfig.InsecureSkipVerify = getenv("INSECURE_SKIP_VERIFY") == "true"
+	c.webhookUrl = getenv("WEBHOOK_URL")
+	c.webhookId = getenv("WEBHOOK_ID")
+	if value := getenv("WEBHOOK_MAX_FAILED_OBJECTS"); value != "" {
+		c.webhookMaxFailedObjects, err = strconv.Atoi(value)
+		if err != nil || c.webhookMaxFailedObjects < 0 {
+			return nil, fmt.Errorf("Failed to convert WEBHOOK_MAX_FAILED_OBJECTS to int: %v", value)
+		}
+	}
+	if value := getenv("WEBHOOK_MAX_ATTEMPTS"); value != "" {
+		c.webhookMaxAttempts, err = strconv.Atoi(value)
+		if err != nil || c.webhookMaxAttempts < 1 {
+			return nil, fmt.Errorf("Failed to convert WEBHOOK_MAX_ATTEMPTS to int: %v", value)
+		}
+	}
+	c.healthcheckGeneric = getenv("HEALTHCHECK_GENERIC") == "true"
+	c.smtpConfig.Host = getenv("SMTP_HOST")
+	c.smtpConfig.Username = getenv("SMTP_USERNAME")
+	c.smtpConfig.From = getenv("SMTP_FROM")
+	c.smtpConfig.ImplicitTLS = getenv("SMTP_TLS") == "true"
+	c.smtpConfig.Port = getenv("SMTP_PORT")
+	if c.smtpConfig.Port == "" {
+		c.smtpConfig.Port = "587"
+		if c.smtpConfig.ImplicitTLS {
+			c.smtpConfig.Port = "465"
+		}
+	}
+	for _, to := range strings.Split(getenv("SMTP_TO"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			c.smtpConfig.To = append(c.smtpConfig.To, to)
+		}
+	}
+	if c.smtpConfig.Host != "" && (c.smtpConfig.From == "" || len(c.smtpConfig.To) == 0) {
+		return nil, errors.New("SMTP_FROM and SMTP_TO are required when SMTP_HOST is set")
+	}
+
+	// シークレットの読み込み（<名前>_FILEの場合はファイルから読み込む）と、
+	// シークレットの参照（gcp-secret://、vault://）の解決
+	for name, value := range map[string]*string{
+		"S3_ACCESS_KEY":        &c.s3Config.AccessKey,
+		"S3_SECRET_KEY":        &c.s3Config.SecretKey,
+		"S3_SESSION_TOKEN":     &c.s3Config.SessionToken,
+		"WEBHOOK_SECRET":       &c.webhookSecret,
+		"HEALTHCHECK_URL":      &c.healthcheckURL,
+		"SMTP_PASSWORD":        &c.smtpConfig.Password,
+		"WEBHOOK_FALLBACK_URL": &c.webhookFallbackURL,
+	} {
+		*value, err = getenvOrFile(getenv, name)
+		if err != nil {
+			return nil, err
+		}
+		*value, err = c.resolveSecret(ctx, *value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve %v: %v", name, err)
+		}
+	}
+	notifiersJSON, err := getenvOrFile(getenv, "NOTIFIERS")
+	if err != nil {
+		return nil, err
+	}
+	c.notifiers, err = c.parseNotifiers(ctx, notifiersJSON)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse NOTIFIERS: %v", err)
+	}
+	c.discoverBuckets = getenv("DISCOVER_BUCKETS") == "true"
+	c.discoverBucketsInclude, err = parseBucketPatterns(getenv("DISCOVER_BUCKETS_INCLUDE"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse DISCOVER_BUCKETS_INCLUDE: %v", err)
+	}
+	c.discoverBucketsExclude, err = parseBucketPatterns(getenv("DISCOVER_BUCKETS_EXCLUDE"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse DISCOVER_BUCKETS_EXCLUDE: %v", err)
+	}
+	if credentialsSecret := getenv("GOOGLE_CREDENTIALS_SECRET"); credentialsSecret != "" {
+		credentialsJSON, err := c.resolveSecret(ctx, credentialsSecret)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve GOOGLE_CREDENTIALS_SECRET: %v", err)
+		}
+		c.gcpConfig.CredentialsJSON = []byte(credentialsJSON)
+	}
+
+	c.notifyPolicy.OnlyOnIssues = getenv("NOTIFY_ONLY_ON_ISSUES") == "true"
+	if ratio := getenv("NOTIFY_MIN_SKIP_RATIO"); ratio != "" {
+		c.notifyPolicy.MinSkipRatio, err = strconv.ParseFloat(ratio, 64)
+		if err != nil || c.notifyPolicy.MinSkipRatio < 0 || c.notifyPolicy.MinSkipRatio > 1 {
+			return nil, fmt.Errorf("Failed to convert NOTIFY_MIN_SKIP_RATIO to float: %v", ratio)
+		}
+	}
+	if duration := getenv("NOTIFY_MAX_DURATION"); duration != "" {
+		c.notifyPolicy.MaxDuration, err = time.ParseDuration(duration)
+		if err != nil || c.notifyPolicy.MaxDuration < 0 {
+			return nil, fmt.Errorf("Failed to parse NOTIFY_MAX_DURATION: %v", duration)
+		}
+	}
+	templateText := getenv("WEBHOOK_TEMPLATE")
+	if templatePath := getenv("WEBHOOK_TEMPLATE_PATH"); templatePath != "" {
+		content, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read WEBHOOK_TEMPLATE_PATH: %v", err)
+		}
+		templateText = string(content)
+	}
+	if templateText != "" {
+		c.webhookTemplate, err = parseWebhookTemplate(templateText)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse webhook template: %v", err)
+		}
+	}
+	c.palalellNum, err = strconv.ParseInt(getenv("PALALELL_NUM"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to convert PALALELL_NUM to int: %v", err)
+	}
+	if value := getenv("DOWNLOAD_PARALLEL_NUM"); value != "" {
+		c.downloadParallelNum, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.downloadParallelNum <= 0 {
+			return nil, fmt.Errorf("DOWNLOAD_PARALLEL_NUM must be a positive integer: %v", value)
+		}
+	}
+	if value := getenv("UPLOAD_PARALLEL_NUM"); value != "" {
+		c.uploadParallelNum, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.uploadParallelNum <= 0 {
+			return nil, fmt.Errorf("UPLOAD_PARALLEL_NUM must be a positive integer: %v", value)
+		}
+	}
+	c.spoolDir = getenv("SPOOL_DIR")
+	c.adaptiveConcurrency = getenv("ADAPTIVE_CONCURRENCY") == "true"
+	c.fullBackup = getenv("FULL_BACKUP") == "true"
+	c.dedupEnabled = getenv("DEDUP") == "true"
+	c.verifyUploads = getenv("VERIFY_UPLOADS")
+	if c.verifyUploads != "" && c.verifyUploads != verifyCRC32C && c.verifyUploads != verifyFull {
+		return nil, fmt.Errorf("Invalid VERIFY_UPLOADS: %v", c.verifyUploads)
+	}
+	if value := getenv("CHANGE_DETECTION"); value != "" {
+		if value != changeDetectionMD5 && value != changeDetectionCRC32C {
+			return nil, fmt.Errorf("Invalid CHANGE_DETECTION: %v", value)
+		}
+		c.changeDetection = value
+	}
+	if value := getenv("ARCHIVED_OBJECTS"); value != "" {
+		if value != archivedSkip && value != archivedRestore && value != archivedFail {
+			return nil, fmt.Errorf("Invalid ARCHIVED_OBJECTS: %v", value)
+		}
+		c.archivedObjectPolicy = value
+	}
+	if value := getenv("S3_DELETE_MARKERS"); value != "" {
+		if value != deleteMarkersIgnore && value != deleteMarkersRecord {
+			return nil, fmt.Errorf("Invalid S3_DELETE_MARKERS: %v", value)
+		}
+		c.deleteMarkerPolicy = value
+	}
+	if value := getenv("ARCHIVED_RESTORE_DAYS"); value != "" {
+		days, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("ARCHIVED_RESTORE_DAYS must be a positive integer: %v", value)
+		}
+		c.archivedRestoreDays = int32(days)
+	}
+	if value := getenv("ARCHIVED_RESTORE_TIER"); value != "" {
+		tier := types.Tier(value)
+		if tier != types.TierExpedited && tier != types.TierStandard && tier != types.TierBulk {
+			return nil, fmt.Errorf("Invalid ARCHIVED_RESTORE_TIER: %v", value)
+		}
+		c.archivedRestoreTier = tier
+	}
+	c.exportPath = getenv("EXPORT_PATH")
+	if value := getenv("COMPRESSION"); value != "" {
+		if !validCompression(value) {
+			return nil, fmt.Errorf("Invalid COMPRESSION: %v", value)
+		}
+		c.compression = value
+	}
+	c.gcsTranscoding = getenv("GCS_TRANSCODING") == "true"
+	if c.gcsTranscoding && c.compression != compressionGzip {
+		return nil, errors.New("GCS_TRANSCODING requires COMPRESSION=gzip")
+	}
+	if value := getenv("COMPRESSION_LEVEL"); value != "" {
+		c.compressionLevel, err = strconv.Atoi(value)
+		if err != nil || !validCompressionLevel(c.compression, c.compressionLevel) {
+			return nil, fmt.Errorf("Invalid COMPRESSION_LEVEL for %v: %v", c.compression, value)
+		}
+	}
+	c.summaryPath = getenv("SUMMARY_PATH")
+	c.summaryUpload = getenv("SUMMARY_UPLOAD") == "true"
+	c.auditLog = getenv("AUDIT_LOG") == "true"
+	c.objectReportPath = getenv("OBJECT_REPORT_PATH")
+	c.keyPrefixMap, err = parseKeyPrefixMap(getenv("KEY_PREFIX_MAP"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse KEY_PREFIX_MAP: %v", err)
+	}
+	for _, prefix := range strings.Split(getenv("BUNDLE_PREFIXES"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			c.bundlePrefixes = append(c.bundlePrefixes, prefix)
+		}
+	}
+	if len(c.bundlePrefixes) > 0 && c.exportPath != "" {
+		return nil, errors.New("BUNDLE_PREFIXES cannot be used with EXPORT_PATH")
+	}
+	if value := getenv("MAX_BYTES_PER_RUN"); value != "" {
+		c.maxBytesPerRun, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.maxBytesPerRun < 0 {
+			return nil, fmt.Errorf("Failed to convert MAX_BYTES_PER_RUN to int: %v", value)
+		}
+	}
+	// アーカイブは実行ごとに全てまとめ直すため、途中で停止すると残りのオブジェクトがアーカイブから消える
+	if c.maxBytesPerRun > 0 && (c.exportPath != "" || len(c.bundlePrefixes) > 0) {
+		return nil, errors.New("MAX_BYTES_PER_RUN cannot be used with EXPORT_PATH or BUNDLE_PREFIXES")
+	}
+	c.metadataOnly = getenv("METADATA_ONLY") == "true"
+	c.bucketConfigBackup = getenv("BACKUP_BUCKET_CONFIG") == "true"
+	if c.metadataOnly && c.exportPath != "" {
+		return nil, errors.New("METADATA_ONLY cannot be used with EXPORT_PATH")
+	}
+	if value := getenv("BUNDLE_MAX_BYTES"); value != "" {
+		c.bundleMaxBytes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.bundleMaxBytes <= 0 {
+			return nil, fmt.Errorf("Failed to convert BUNDLE_MAX_BYTES to int: %v", value)
+		}
+	}
+	c.precountObjects = getenv("PRECOUNT_OBJECTS") == "true"
+	if interval := getenv("PROGRESS_LOG_INTERVAL"); interval != "" {
+		c.progressLogInterval, err = time.ParseDuration(interval)
+		if err != nil || c.progressLogInterval <= 0 {
+			return nil, fmt.Errorf("Failed to parse PROGRESS_LOG_INTERVAL: %v", interval)
+		}
+	}
+	if interval := getenv("HEARTBEAT_INTERVAL"); interval != "" {
+		c.heartbeatInterval, err = time.ParseDuration(interval)
+		if err != nil || c.heartbeatInterval < 0 {
+			return nil, fmt.Errorf("Failed to parse HEARTBEAT_INTERVAL: %v", interval)
+		}
+	}
+	if value := getenv("MAX_ERRORS"); value != "" {
+		c.maxErrors, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert MAX_ERRORS to int: %v", err)
+		}
+	}
+	if value := getenv("LARGE_OBJECT_THRESHOLD"); value != "" {
+		c.largeObjectThreshold, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert LARGE_OBJECT_THRESHOLD to int: %v", err)
+		}
+	}
+	if value := getenv("COMPOSITE_UPLOAD_THRESHOLD"); value != "" {
+		c.compositeUploadThreshold, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert COMPOSITE_UPLOAD_THRESHOLD to int: %v", err)
+		}
+	}
+	if value := getenv("COMPOSITE_PART_SIZE"); value != "" {
+		c.compositePartSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.compositePartSize <= 0 {
+			return nil, fmt.Errorf("COMPOSITE_PART_SIZE must be a positive integer: %v", value)
+		}
+	}
+	if value := getenv("COMPOSITE_PARALLEL_NUM"); value != "" {
+		c.compositeParallelNum, err = strconv.Atoi(value)
+		if err != nil || c.compositeParallelNum <= 0 {
+			return nil, fmt.Errorf("COMPOSITE_PARALLEL_NUM must be a positive integer: %v", value)
+		}
+	}
+	if value := getenv("MIN_OBJECT_SIZE"); value != "" {
+		c.minObjectSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert MIN_OBJECT_SIZE to int: %v", err)
+		}
+	}
+	if value := getenv("MAX_OBJECT_SIZE"); value != "" {
+		c.maxObjectSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert MAX_OBJECT_SIZE to int: %v", err)
+		}
+	}
+	if value := getenv("LISTING_SHARD_DEPTH"); value != "" {
+		c.listingShardDepth, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert LISTING_SHARD_DEPTH to int: %v", err)
+		}
+	}
+	c.s3InventoryManifest = getenv("S3_INVENTORY_MANIFEST")
+	if c.s3InventoryManifest != "" {
+		if _, _, err := parseS3URL(c.s3InventoryManifest); err != nil {
+			return nil, fmt.Errorf("Invalid S3_INVENTORY_MANIFEST: %v", err)
+		}
+		if c.listingShardDepth > 0 {
+			return nil, errors.New("S3_INVENTORY_MANIFEST cannot be used with LISTING_SHARD_DEPTH")
+		}
+	}
+	if value := getenv("BACKUP_WINDOW"); value != "" {
+		timezone := getenv("BACKUP_WINDOW_TIMEZONE")
+		if timezone == "" {
+			timezone = "Asia/Tokyo"
+		}
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid BACKUP_WINDOW_TIMEZONE: %v", err)
+		}
+		c.backupWindow, err = parseTimeWindow(value, location)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse BACKUP_WINDOW: %v", err)
+		}
+		// 一時停止中に停止した位置を保存するため、MAX_BYTES_PER_RUNと同じ制限がある
+		if c.exportPath != "" || len(c.bundlePrefixes) > 0 || c.listingShardDepth > 0 {
+			return nil, errors.New("BACKUP_WINDOW cannot be used with EXPORT_PATH, BUNDLE_PREFIXES or LISTING_SHARD_DEPTH")
+		}
+	}
+	// 停止した位置より前は全て完了している必要があるため、一覧を決まった順に取得できる場合のみ使える
+	// インベントリはキーの順とは限らないが、インベントリの中の位置から再開する
+	if c.maxBytesPerRun > 0 && c.listingShardDepth > 0 {
+		return nil, errors.New("MAX_BYTES_PER_RUN cannot be used with LISTING_SHARD_DEPTH")
+	}
+	if value := getenv("LISTING_DELIMITER"); value != "" {
+		c.listingDelimiter = value
+	}
+	if value := getenv("LISTING_PARALLEL_NUM"); value != "" {
+		c.listingParallelNum, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert LISTING_PARALLEL_NUM to int: %v", err)
+		}
+	}
+	c.retryConfig.S3RetryMode = getenv("S3_RETRY_MODE")
+	if c.retryConfig.S3RetryMode != "" {
+		if _, err := aws.ParseRetryMode(c.retryConfig.S3RetryMode); err != nil {
+			return nil, fmt.Errorf("Invalid S3_RETRY_MODE: %v", err)
+		}
+	}
+	if value := getenv("S3_MAX_ATTEMPTS"); value != "" {
+		c.retryConfig.S3MaxAttempts, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert S3_MAX_ATTEMPTS to int: %v", err)
+		}
+	}
+	if value := getenv("GCS_RETRY_INITIAL_BACKOFF"); value != "" {
+		c.retryConfig.GCSInitialBackoff, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse GCS_RETRY_INITIAL_BACKOFF: %v", value)
+		}
+	}
+	if value := getenv("GCS_RETRY_MAX_BACKOFF"); value != "" {
+		c.retryConfig.GCSMaxBackoff, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse GCS_RETRY_MAX_BACKOFF: %v", value)
+		}
+	}
+	if value := getenv("GCS_RETRY_MULTIPLIER"); value != "" {
+		c.retryConfig.GCSMultiplier, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert GCS_RETRY_MULTIPLIER to float: %v", err)
+		}
+	}
+	if value := getenv("GCS_RETRY_MAX_ATTEMPTS"); value != "" {
+		c.retryConfig.GCSMaxAttempts, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to convert GCS_RETRY_MAX_ATTEMPTS to int: %v", err)
+		}
+	}
+	if timeout := getenv("OBJECT_TIMEOUT"); timeout != "" {
+		c.objectTimeout, err = time.ParseDuration(timeout)
+		if err != nil || c.objectTimeout < 0 {
+			return nil, fmt.Errorf("Failed to parse OBJECT_TIMEOUT: %v", timeout)
+		}
+	}
+	if ttl := getenv("RUN_LOCK_TTL"); ttl != "" {
+		c.runLockTTL, err = time.ParseDuration(ttl)
+		if err != nil || c.runLockTTL <= 0 {
+			return nil, fmt.Errorf("Failed to parse RUN_LOCK_TTL: %v", ttl)
+		}
+	}
+	if timeout := getenv("RUN_TIMEOUT"); timeout != "" {
+		c.runTimeout, err = time.ParseDuration(timeout)
+		if err != nil || c.runTimeout < 0 {
+			return nil, fmt.Errorf("Failed to parse RUN_TIMEOUT: %v", timeout)
+		}
+	}
+	if value := getenv("ESTIMATE_THROUGHPUT"); value != "" {
+		c.estimateThroughput, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.estimateThroughput < 0 {
+			return nil, fmt.Errorf("Failed to convert ESTIMATE_THROUGHPUT to int: %v", value)
+		}
+	}
+	if value := getenv("GCS_PRICE_PER_GB"); value != "" {
+		c.gcsPricePerGB, err = strconv.ParseFloat(value, 64)
+		if err != nil || c.gcsPricePerGB < 0 {
+			return nil, fmt.Errorf("Failed to convert GCS_PRICE_PER_GB to float: %v", value)
+		}
+	}
+	return c, nil
+}
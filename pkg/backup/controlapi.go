@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 実行中のバックアップの進捗
+type controlAPIStatus struct {
+	Running          bool    `json:"running"`
+	RunID            string  `json:"runId,omitempty"`
+	StartTime        string  `json:"startTime,omitempty"`
+	TotalObjects     int64   `json:"totalObjects"`
+	TotalBytes       int64   `json:"totalBytes"`
+	CompletedObjects int64   `json:"completedObjects"`
+	CompletedBytes   int64   `json:"completedBytes"`
+	ErrorObjects     int64   `json:"errorObjects"`
+	ETASeconds       float64 `json:"etaSeconds"`
+	LastError        string  `json:"lastError,omitempty"`
+}
+
+// 制御・状態取得用のHTTPサーバーを起動する
+//   - GET  /healthz: プロセスの死活確認
+//   - POST /backup:  バックアップを実行する（実行中の場合は409）
+//   - GET  /status:  実行中のバックアップの進捗
+//   - GET  /summary: 前回の実行結果（まだない場合は404）
+//
+// CONTROL_API_TOKENを指定した場合、/healthz以外は"Authorization: Bearer <トークン>"が必要（無い場合は401）
+func serveControlAPI(addr string, state *daemonState) error {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("POST /backup", func(w http.ResponseWriter, r *http.Request) {
+		if !state.trigger() {
+			http.Error(w, "backup is already running", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("accepted\n"))
+	})
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		status := controlAPIStatus{Running: state.running, LastError: state.lastError}
+		current := state.current
+		state.mu.Unlock()
+
+		if current == nil {
+			writeJSON(w, status)
+			return
+		}
+		status.RunID = current.runID
+		if progress := current.activeProgress.Load(); progress != nil {
+			status.StartTime = progress.startTime.Format(time.RFC3339)
+			status.TotalObjects = progress.totalObjects.Load()
+			status.TotalBytes = progress.totalBytes.Load()
+			status.CompletedObjects = progress.completedObjects.Load()
+			status.CompletedBytes = progress.completedBytes.Load()
+			status.ErrorObjects = progress.errorObjects.Load()
+			status.ETASeconds = progress.ETA().Seconds()
+		}
+		writeJSON(w, status)
+	})
+
+	mux.HandleFunc("GET /summary", func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		summary := state.lastSummary
+		state.mu.Unlock()
+
+		if summary == nil {
+			http.Error(w, "no backup has finished yet", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, summary)
+	})
+
+	logInfof("Control API listening on %v", addr)
+	return http.ListenAndServe(addr, requireControlAPIToken(mux))
+}
+
+// CONTROL_API_TOKENが指定されている場合、/healthz以外のリクエストのトークンを確認する
+// 指定されていない場合はループバックアドレスで待ち受けている（LoadConfigFromEnvで確認する）
+// 死活確認はKubernetesのprobeなどトークンを持たないところから呼ばれるため認証しない
+func requireControlAPIToken(next http.Handler) http.Handler {
+	if controlAPIToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(controlAPIToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ループバックアドレスのみで待ち受けるか（:8080のようにホストを省略した場合は全てのアドレスで待ち受ける）
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logErrorf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// 常駐中のバックアップの実行状況
+type daemonState struct {
+	mu      sync.Mutex
+	running bool
+	// 実行中のバックアップ（実行中でない場合はnil）
+	current     *backupRun
+	lastSummary *backupSummary
+	lastError   string
+
+	// 制御APIからの実行要求
+	triggers chan struct{}
+}
+
+// スケジュールまたは制御APIからの要求に従ってバックアップを繰り返し実行する
+// 各実行は独立しており、1回の実行が失敗しても次の実行は予定通り行う
+// 実行中に次の予定時刻を過ぎた場合、その回は飛ばして次の予定時刻を待つ
+// スケジュールが空の場合は制御APIからの要求があったときのみ実行する
+// 制御APIを待ち受けられなくなった場合のみエラーを返す
+func runDaemon(schedule string) error {
+	var cronSchedule cron.Schedule
+	if schedule != "" {
+		var err error
+		cronSchedule, err = cron.ParseStandard(schedule)
+		if err != nil {
+			return fmt.Errorf("%w: failed to parse BACKUP_SCHEDULE: %w", errInvalidConfig, err)
+		}
+	}
+
+	state := &daemonState{triggers: make(chan struct{}, 1)}
+	serveErr := make(chan error, 1)
+	if controlAPIAddr != "" {
+		go func() {
+			serveErr <- serveControlAPI(controlAPIAddr, state)
+		}()
+	}
+
+	for {
+		var timer <-chan time.Time
+		if cronSchedule != nil {
+			next := cronSchedule.Next(time.Now())
+			logInfof("Next backup scheduled at %v", next.Format("2006/01/02 15:04:05"))
+			timer = time.After(time.Until(next))
+		}
+
+		select {
+		case <-timer:
+			logInfof("Starting scheduled backup")
+		case <-state.triggers:
+			logInfof("Starting requested backup")
+		case err := <-serveErr:
+			return fmt.Errorf("failed to serve control API: %w", err)
+		}
+		state.run()
+	}
+}
+
+// バックアップを1回実行し、結果を記録する
+func (s *daemonState) run() {
+	// 実行ごとに設定を複製するため、前回の実行の状態は引き継がない
+	run := newBackupRun(defaultConfig.clone(), newRunID(), os.Stdout, os.Stderr)
+	s.mu.Lock()
+	s.running = true
+	s.current = run
+	s.mu.Unlock()
+
+	summary, err := run.runBackup(context.Background())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.current = nil
+	if summary != nil {
+		s.lastSummary = summary
+	}
+	s.lastError = ""
+	if err != nil {
+		s.lastError = err.Error()
+		logErrorf("Backup failed: %v", run.describeError(err))
+		return
+	}
+	logInfof("Backup finished")
+}
+
+// バックアップの実行を要求する
+// 既に実行中、または実行待ちの場合はfalseを返す
+func (s *daemonState) trigger() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return false
+	}
+	select {
+	case s.triggers <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+// 内容のハッシュを名前として本体を置くGCSバケット内のプレフィックス
+const blobObjectPrefix = backupformat.BlobPrefix
+
+// 重複排除した場合にキーのオブジェクトに記録する本体のSHA-256（16進数）
+const metadataContentSHA256 = backupformat.MetadataContentSHA256
+
+// 本体がこれより古くなった場合は書き直す
+// バケットのライフサイクル（90日で削除）により、参照されている本体が削除されないようにする
+const blobRefreshAge = 60 * 24 * time.Hour
+
+// 重複排除してバックアップする
+// 本体はSHA-256を名前としたオブジェクトに1度だけアップロードし、キーには本体のハッシュを記録した空のオブジェクトを置く
+// アバターやスタンプ画像のように同じ内容が多くのキーにある場合に、GCSに保存する量を減らすため
+// 本体の書き込みにGCSの条件付きの書き込みとコピーを使うため、バックアップ先はGCSのみ
+// バックアップ先と内容が同じでスキップした場合はtrueを返す
+func (r *backupRun) backupObjectDeduplicated(ctx context.Context, destination ObjectDestination, info *ObjectInfo, body io.Reader, destinationKey string) (bool, error) {
+	gcsBucketClient, err := gcsBucketOf(destination)
+	if err != nil {
+		return false, err
+	}
+
+	// ハッシュが分かるまでアップロード先が決まらないため、一時ファイルに書き出す
+	tmpFile, err := os.CreateTemp("", "s3-backup-helper-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	contentHash := sha256.New()
+	originalHash := md5.New()
+	originalCRC32C := crc32.New(crc32cTable)
+	originalSize, err := pooledCopy(io.MultiWriter(tmpFile, contentHash, originalHash, originalCRC32C), body)
+	if err != nil {
+		return false, err
+	}
+	contentSHA256 := hex.EncodeToString(contentHash.Sum(nil))
+
+	// キーのオブジェクトが同じ本体を指している場合はスキップ
+	if !r.fullBackup {
+		backupInfo, err := destination.Head(ctx, destinationKey)
+		if err == nil && backupInfo.Metadata[metadataContentSHA256] == contentSHA256 {
+			r.logDebugf("Skipped %v: already points to the same blob", destinationKey)
+			return true, r.ensureBlob(ctx, gcsBucketClient, contentSHA256, tmpFile)
+		}
+	}
+
+	if err := r.ensureBlob(ctx, gcsBucketClient, contentSHA256, tmpFile); err != nil {
+		return false, err
+	}
+
+	// キーのオブジェクト（本体のハッシュとメタデータのみ）を書き込む
+	writeInfo := backupObjectInfo(info)
+	writeInfo.Metadata[metadataContentSHA256] = contentSHA256
+	writeInfo.Metadata[metadataOriginalMD5] = hex.EncodeToString(originalHash.Sum(nil))
+	writeInfo.Metadata[metadataOriginalCRC32C] = encodeCRC32C(originalCRC32C.Sum32())
+	writeInfo.Metadata[metadataOriginalSize] = strconv.FormatInt(originalSize, 10)
+	writeInfo.Metadata[metadataBackupTime] = time.Now().UTC().Format(time.RFC3339)
+	if info.ETag != "" {
+		writeInfo.Metadata[metadataSourceETag] = info.ETag
+	}
+	if _, err := destination.NewWriter(ctx, destinationKey, writeInfo).Commit(); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// SHA-256を名前とした本体が無ければアップロードし、古くなっている場合は書き直す
+func (c *backupConfig) ensureBlob(ctx context.Context, gcsBucketClient *storage.BucketHandle, contentSHA256 string, content *os.File) error {
+	blob := gcsBucketClient.Object(c.managedObjectName(blobObjectPrefix + contentSHA256))
+	attrs, err := blob.Attrs(ctx)
+	if err == nil {
+		if time.Since(attrs.Created) < blobRefreshAge {
+			return nil
+		}
+		// 同じ内容で新しい世代を作り、作成日時を更新する
+		if _, err := blob.CopierFrom(blob).Run(ctx); err != nil {
+			return fmt.Errorf("failed to refresh blob %v: %w", contentSHA256, err)
+		}
+		return nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		return err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// 途中で失敗した場合は書き込みを中止する
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// 同時に同じ内容をアップロードした場合は、先にアップロードされた方を使う
+	writer := blob.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	writer.Metadata = map[string]string{metadataCompression: c.compression}
+	compressWriter, err := c.newCompressWriter(writer, c.compression)
+	if err != nil {
+		return err
+	}
+	if _, err := pooledCopy(compressWriter, content); err != nil {
+		return err
+	}
+	if err := compressWriter.Close(); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil && !isPreconditionFailed(err) {
+		return fmt.Errorf("failed to upload blob %v: %w", contentSHA256, err)
+	}
+	return nil
+}
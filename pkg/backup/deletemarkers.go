@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+// S3の削除マーカーの扱い
+const (
+	// 記録しない（削除されたキーのバックアップは復元される）
+	deleteMarkersIgnore = "ignore"
+	// 最新のバージョンが削除マーカーになっているキーを記録し、復元時に削除を再現できるようにする
+	deleteMarkersRecord = "record"
+)
+
+// 削除マーカーを記録するGCSバケット内のオブジェクト名
+// 実行ごとに上書きし、以前の状態はGCSの古い世代として残る（GCS_MAX_NONCURRENT_VERSIONSを指定した場合はその数まで）
+const deleteMarkersObjectName = backupformat.DeleteMarkersObjectName
+
+// 最新のバージョンが削除マーカーになっているキー
+type deleteMarker struct {
+	// バックアップ先でのキー（KEY_PREFIX_MAPを適用したもの、プレフィックスを除く）
+	Key       string    `json:"key"`
+	VersionID string    `json:"versionId,omitempty"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// 削除マーカーの記録
+// バックアップしたオブジェクトは削除せず、復元時にこの記録のキーを復元しないことで削除を再現する
+type deleteMarkerList struct {
+	Bucket     string         `json:"bucket"`
+	CapturedAt time.Time      `json:"capturedAt"`
+	RunID      string         `json:"runId"`
+	Markers    []deleteMarker `json:"markers"`
+}
+
+// S3バケットのバージョンを一覧し、最新のバージョンが削除マーカーになっているキーを返す
+// バージョニングを有効にしたことのないバケットには削除マーカーは無い
+func (c *backupConfig) listDeleteMarkers(ctx context.Context, s3Client *s3.Client) ([]deleteMarker, error) {
+	markers := []deleteMarker{}
+	input := &s3.ListObjectVersionsInput{
+		Bucket:       aws.String(c.s3Config.Bucket),
+		RequestPayer: c.s3RequestPayer(),
+	}
+	for {
+		output, err := s3Client.ListObjectVersions(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list object versions: %w", err)
+		}
+		for _, marker := range output.DeleteMarkers {
+			if !aws.ToBool(marker.IsLatest) {
+				continue
+			}
+			markers = append(markers, deleteMarker{
+				Key:       mapKeyPrefix(aws.ToString(marker.Key), c.keyPrefixMap),
+				VersionID: aws.ToString(marker.VersionId),
+				DeletedAt: aws.ToTime(marker.LastModified),
+			})
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			return markers, nil
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
+	}
+}
+
+// 削除マーカーを一覧してGCSに保存し、記録した数を返す
+func (r *backupRun) backupDeleteMarkers(ctx context.Context, s3Client *s3.Client, gcsBucket *storage.BucketHandle) (int, error) {
+	markers, err := r.listDeleteMarkers(ctx, s3Client)
+	if err != nil {
+		return 0, err
+	}
+	markersJSON, err := json.Marshal(deleteMarkerList{Bucket: r.s3Config.Bucket, CapturedAt: time.Now().UTC(), RunID: r.runID, Markers: markers})
+	if err != nil {
+		return 0, err
+	}
+	writer := gcsBucket.Object(r.managedObjectName(deleteMarkersObjectName)).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(markersJSON); err != nil {
+		writer.Close()
+		return 0, fmt.Errorf("failed to upload delete markers: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf("failed to upload delete markers: %w", err)
+	}
+	return len(markers), nil
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3のオブジェクトとバックアップの内容が異なる理由を返す（同じ場合は空）
+// 本体は転送せず、一覧のサイズとETag、バックアップ時に記録したメタデータのみで比較する
+// 元のデータのサイズとMD5が記録されていない古いバックアップは比較できないため、同じとみなす
+func compareBackupObject(object types.Object, attrs *storage.ObjectAttrs) string {
+	if recorded, ok := attrs.Metadata[metadataOriginalSize]; ok {
+		if size := backupObjectSize(attrs); size != aws.ToInt64(object.Size) {
+			return fmt.Sprintf("size: S3 %d, GCS %v", aws.ToInt64(object.Size), recorded)
+		}
+	}
+	// マルチパートアップロードされたオブジェクトのETag（"-パート数"を含む）はMD5ではないため比較しない
+	etag := strings.Trim(aws.ToString(object.ETag), `"`)
+	if recorded, ok := attrs.Metadata[metadataOriginalMD5]; ok && etag != "" && !strings.Contains(etag, "-") {
+		if etag != recorded {
+			return fmt.Sprintf("md5: S3 %v, GCS %v", etag, recorded)
+		}
+	}
+	return ""
+}
+
+// S3バケットとバックアップ先のGCSバケットを比較し、S3にのみあるもの、GCSにのみあるもの、内容が異なるものを出力する
+// 復元前やバックアップ後の確認のため
+func (r *backupRun) runDiff() error {
+	ctx := context.Background()
+	s3Client, err := r.newS3Client()
+	if err != nil {
+		return err
+	}
+	gcsClient, gcsBucketClient, gcsBucketName, err := r.openGCSBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer gcsClient.Close()
+
+	sourceObjects, err := r.listSourceObjects(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+
+	var onlyInGCS, differing []string
+	err = r.forEachBackupObject(ctx, gcsBucketClient, func(attrs *storage.ObjectAttrs) {
+		object, ok := sourceObjects[attrs.Name]
+		if !ok {
+			onlyInGCS = append(onlyInGCS, attrs.Name)
+			return
+		}
+		delete(sourceObjects, attrs.Name)
+		if reason := compareBackupObject(object, attrs); reason != "" {
+			differing = append(differing, fmt.Sprintf("%v (%v)", attrs.Name, reason))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// 残ったものはGCSに無いオブジェクト
+	onlyInS3 := make([]string, 0, len(sourceObjects))
+	for key := range sourceObjects {
+		onlyInS3 = append(onlyInS3, key)
+	}
+	sort.Strings(onlyInS3)
+
+	fmt.Fprintf(r.stdout, "Comparing %v with %v\n", r.s3Config.Bucket, gcsBucketName)
+	r.printKeyList("Only in S3", onlyInS3)
+	r.printKeyList("Only in GCS", onlyInGCS)
+	r.printKeyList("Differing", differing)
+	fmt.Fprintf(r.stdout, "%d only in S3, %d only in GCS, %d differing\n", len(onlyInS3), len(onlyInGCS), len(differing))
+	return nil
+}
+
+// 見出しとキーの一覧を出力する
+func (r *backupRun) printKeyList(title string, keys []string) {
+	fmt.Fprintf(r.stdout, "\n%v (%d):\n", title, len(keys))
+	for _, key := range keys {
+		fmt.Fprintf(r.stdout, " - %v\n", key)
+	}
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// カンマ区切りのバケット名のパターンを読み込む
+func parseBucketPatterns(value string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid bucket pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// バケット名がパターンのいずれかに一致するか
+func matchBucketPatterns(patterns []string, bucket string) bool {
+	for _, pattern := range patterns {
+		// パターンは読み込み時に確認済み
+		if matched, _ := path.Match(pattern, bucket); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// バケットを自動で見つけてバックアップする対象か
+func (c *backupConfig) isDiscoveredBucketIncluded(bucket string) bool {
+	if len(c.discoverBucketsInclude) > 0 && !matchBucketPatterns(c.discoverBucketsInclude, bucket) {
+		return false
+	}
+	return !matchBucketPatterns(c.discoverBucketsExclude, bucket)
+}
+
+// S3のバケットを一覧し、バックアップするバケットのそれぞれをバックアップ元とする
+func (c *backupConfig) discoverSources(ctx context.Context, s3Client *s3.Client) ([]sourceConfig, error) {
+	output, err := s3Client.ListBuckets(ctx, &s3.ListBucketsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list buckets: %w", err)
+	}
+	var discovered []sourceConfig
+	for _, bucket := range output.Buckets {
+		name := aws.ToString(bucket.Name)
+		if !c.isDiscoveredBucketIncluded(name) {
+			continue
+		}
+		source := sourceConfig{Name: name, Bucket: name}
+		// GCS_BUCKETにまとめる場合は、バケットごとにプレフィックスを分ける（GCS_BUCKET_MAPで指定したものを除く）
+		if c.gcpConfig.Bucket != "" && !c.hasBucketMapping(name) {
+			source.GCSPrefix = c.gcpConfig.Prefix + name + "/"
+		}
+		// 見つけたバケットのバックアップでさらにバケットを探さないようにする
+		source.Env = map[string]string{"DISCOVER_BUCKETS": ""}
+		discovered = append(discovered, source)
+	}
+	return discovered, nil
+}
+
+// アカウントのバケットを見つけ、それぞれをバックアップする
+// configはバケットを探す設定、getenvはそれぞれのバケットの設定を読み込む関数
+// 終了コードはrunSourcesと同じ
+func runDiscoveredBuckets(config *backupConfig, getenv func(string) string, stdout, stderr io.Writer) int {
+	run := newBackupRun(config, "", stdout, stderr)
+	s3Client, err := run.newS3Client()
+	if err != nil {
+		run.logErrorf("%v", err)
+		return exitCodeOf(err)
+	}
+	discovered, err := run.discoverSources(context.Background(), s3Client)
+	if err != nil {
+		run.logErrorf("%v", run.describeError(err))
+		return exitCodeAborted
+	}
+	if len(discovered) == 0 {
+		run.logWarnf("No buckets matched DISCOVER_BUCKETS_INCLUDE and DISCOVER_BUCKETS_EXCLUDE")
+		return 0
+	}
+	names := make([]string, len(discovered))
+	for i, source := range discovered {
+		names[i] = source.Name
+	}
+	run.logInfof("Discovered %d buckets: %v", len(discovered), strings.Join(names, ", "))
+	return runSources(discovered, getenv)
+}
@@ -0,0 +1,33 @@
+package backup
+
+import "testing"
+
+func TestIsDiscoveredBucketIncluded(t *testing.T) {
+	c := newBackupConfig()
+	var err error
+	c.discoverBucketsInclude, err = parseBucketPatterns("traq*, wiki")
+	if err != nil {
+		t.Fatalf("parseBucketPatterns returned error: %v", err)
+	}
+	c.discoverBucketsExclude, err = parseBucketPatterns("*-tmp")
+	if err != nil {
+		t.Fatalf("parseBucketPatterns returned error: %v", err)
+	}
+	tests := map[string]bool{
+		"traq":         true,
+		"traq-staging": true,
+		"traq-tmp":     false,
+		"wiki":         true,
+		"wiki-old":     false,
+		"other":        false,
+	}
+	for bucket, want := range tests {
+		if got := c.isDiscoveredBucketIncluded(bucket); got != want {
+			t.Errorf("isDiscoveredBucketIncluded(%q) = %v, want %v", bucket, got, want)
+		}
+	}
+
+	if _, err := parseBucketPatterns("traq["); err == nil {
+		t.Error("parseBucketPatterns returned no error for an invalid pattern")
+	}
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// 最上位のプレフィックスごとの使用量
+type prefixUsage struct {
+	objects       int64
+	storedBytes   int64
+	originalBytes int64
+	// バージョニングにより残っている古い世代
+	noncurrentObjects int64
+	noncurrentBytes   int64
+}
+
+// キーの最上位のプレフィックス（最初の"/"まで、含まない場合は"/"）
+func topLevelPrefix(key string) string {
+	if prefix, _, ok := strings.Cut(key, "/"); ok {
+		return prefix + "/"
+	}
+	return "/"
+}
+
+// バックアップ先のGCSバケットの使用量を、最上位のプレフィックスごとに出力する
+// どのサービスのデータがバックアップの料金の大部分を占めているか確認するため
+func (r *backupRun) runDiskUsage() error {
+	ctx := context.Background()
+	gcsClient, gcsBucketClient, gcsBucketName, err := r.openGCSBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer gcsClient.Close()
+
+	usages := make(map[string]*prefixUsage)
+	var total prefixUsage
+	// 古い世代も料金がかかるため、全ての世代を数える
+	objects := gcsBucketClient.Objects(ctx, &storage.Query{Versions: true})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to list backup objects: %w", err)
+		}
+		prefix := topLevelPrefix(attrs.Name)
+		usage, ok := usages[prefix]
+		if !ok {
+			usage = &prefixUsage{}
+			usages[prefix] = usage
+		}
+		for _, u := range []*prefixUsage{usage, &total} {
+			if !attrs.Deleted.IsZero() {
+				u.noncurrentObjects++
+				u.noncurrentBytes += attrs.Size
+				continue
+			}
+			u.objects++
+			u.storedBytes += attrs.Size
+			u.originalBytes += backupObjectSize(attrs)
+		}
+	}
+
+	fmt.Fprintf(r.stdout, "Usage of %v by top-level prefix:\n", gcsBucketName)
+	writer := tabwriter.NewWriter(r.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PREFIX\tOBJECTS\tSTORED\tORIGINAL\tRATIO\tNONCURRENT OBJECTS\tNONCURRENT STORED")
+	printUsage := func(prefix string, usage *prefixUsage) {
+		ratio := "-"
+		if usage.originalBytes > 0 {
+			ratio = fmt.Sprintf("%.2f", float64(usage.storedBytes)/float64(usage.originalBytes))
+		}
+		fmt.Fprintf(writer, "%v\t%d\t%v\t%v\t%v\t%d\t%v\n", prefix, usage.objects, formatBytes(usage.storedBytes), formatBytes(usage.originalBytes), ratio, usage.noncurrentObjects, formatBytes(usage.noncurrentBytes))
+	}
+	// 保存しているバイト数（古い世代を含む）の多い順
+	prefixes := slices.SortedFunc(maps.Keys(usages), func(a, b string) int {
+		return cmp.Or(cmp.Compare(usages[b].storedBytes+usages[b].noncurrentBytes, usages[a].storedBytes+usages[a].noncurrentBytes), cmp.Compare(a, b))
+	})
+	for _, prefix := range prefixes {
+		printUsage(prefix, usages[prefix])
+	}
+	printUsage("TOTAL", &total)
+	writer.Flush()
+	return nil
+}
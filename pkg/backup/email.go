@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// 実行結果をメールで送る場合のSMTPの設定（Hostが空の場合は送らない）
+type smtpConfigStruct struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	To       []string
+	// trueの場合は最初からTLSで接続する（465番ポート）
+	// falseの場合は、サーバーが対応していればSTARTTLSで暗号化する
+	ImplicitTLS bool
+}
+
+// traQへの通知と同じ内容を、traQを使っていない関係者にメールで送る
+// 失敗しても実行結果は変えず、ログに残すだけにする
+func (r *backupRun) sendEmail(message string) {
+	if r.smtpConfig.Host == "" || len(r.smtpConfig.To) == 0 {
+		return
+	}
+	if err := r.sendSMTP(emailSubject(message), message); err != nil {
+		r.logErrorf("Failed to send email: %v", err)
+		return
+	}
+	fmt.Fprintf(r.stdout, "Sent email to %v\n", strings.Join(r.smtpConfig.To, ", "))
+}
+
+// 通知文の最初の行（Markdownの見出し）を件名にする
+func emailSubject(message string) string {
+	subject, _, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	subject = strings.TrimSpace(strings.TrimLeft(subject, "#"))
+	if subject == "" {
+		subject = "s3-backup-helper"
+	}
+	return subject
+}
+
+func (c *backupConfig) sendSMTP(subject string, body string) error {
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", c.smtpConfig.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(c.smtpConfig.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	message.WriteString("\r\n")
+	for _, line := range strings.Split(body, "\n") {
+		// 通知文はインデントされているため、行頭の空白を取り除く
+		message.WriteString(strings.TrimLeft(line, "\t") + "\r\n")
+	}
+
+	address := net.JoinHostPort(c.smtpConfig.Host, c.smtpConfig.Port)
+	var auth smtp.Auth
+	if c.smtpConfig.Username != "" {
+		auth = smtp.PlainAuth("", c.smtpConfig.Username, c.smtpConfig.Password, c.smtpConfig.Host)
+	}
+	if !c.smtpConfig.ImplicitTLS {
+		return smtp.SendMail(address, auth, c.smtpConfig.From, c.smtpConfig.To, []byte(message.String()))
+	}
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: c.smtpConfig.Host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, c.smtpConfig.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.smtpConfig.From); err != nil {
+		return err
+	}
+	for _, to := range c.smtpConfig.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(message.String())); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"google.golang.org/api/iterator"
+)
+
+// ストレージクラスごとのGCSの保存料金（USD/GB/月、asia-northeast1）
+// Autoclassは最初にSTANDARDで保存されるため、STANDARDの料金で見積もる
+var gcsStorageClassPrices = map[string]float64{
+	"STANDARD":  0.023,
+	"NEARLINE":  0.016,
+	"COLDLINE":  0.006,
+	"ARCHIVE":   0.0025,
+	"AUTOCLASS": 0.023,
+}
+
+// 転送速度を求めるのに使う直近の実行結果の数
+const estimateRecentRuns = 5
+
+// 一覧のみを取得し（本体は読まない）、フルバックアップにかかる時間とGCSの保存料金を見積もる
+// フルバックアップを実行する時間帯を決めるため
+func (r *backupRun) runEstimate() error {
+	ctx := context.Background()
+	s3Client, err := r.newS3Client()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(r.stdout, "Listing objects in %v\n", r.s3Config.Bucket)
+	var totalObjects, totalBytes, filteredObjects int64
+	for listed := range r.listObjectPages(ctx, r.newS3Source(s3Client), s3Client, "") {
+		if listed.Err != nil {
+			return fmt.Errorf("failed to list objects: %w", listed.Err)
+		}
+		for _, object := range listed.Page.Contents {
+			if !r.objectSizeInRange(aws.ToInt64(object.Size)) {
+				filteredObjects++
+				continue
+			}
+			totalObjects++
+			totalBytes += aws.ToInt64(object.Size)
+		}
+	}
+
+	// 既存のバックアップから圧縮率を、実行結果から転送速度を求める（バックアップが無い場合は求めない）
+	compressionRatio := 1.0
+	compressionSource := "assumed, no existing backup"
+	throughput := float64(r.estimateThroughput)
+	throughputSource := "ESTIMATE_THROUGHPUT"
+	gcsClient, gcsBucketClient, gcsBucketName, err := r.openGCSBucket(ctx)
+	if err != nil {
+		r.logWarnf("Failed to open the backup bucket: %v", err)
+	} else {
+		defer gcsClient.Close()
+		if ratio, err := r.backupCompressionRatio(ctx, gcsBucketClient); err != nil {
+			r.logWarnf("Failed to read existing backups in %v: %v", gcsBucketName, err)
+		} else if ratio > 0 {
+			compressionRatio = ratio
+			compressionSource = "existing backup in " + gcsBucketName
+		}
+		if throughput == 0 {
+			recent, runs, err := r.recentThroughput(ctx, gcsBucketClient)
+			if err != nil {
+				r.logWarnf("Failed to read run summaries in %v: %v", gcsBucketName, err)
+			} else if runs > 0 {
+				throughput = recent
+				throughputSource = fmt.Sprintf("average of the last %d runs", runs)
+			}
+		}
+	}
+
+	storageClass := r.gcpConfig.StorageClass
+	price := r.gcsPricePerGB
+	if price == 0 {
+		price = gcsStorageClassPrices[storageClass]
+	}
+	backupBytes := int64(float64(totalBytes) * compressionRatio)
+	monthlyCost := float64(backupBytes) / (1 << 30) * price
+
+	fmt.Fprintf(r.stdout, "Objects: %d (%d filtered by size)\n", totalObjects, filteredObjects)
+	fmt.Fprintf(r.stdout, "Total size: %v\n", formatBytes(totalBytes))
+	fmt.Fprintf(r.stdout, "Estimated backup size: %v (compression ratio %.2f, %v)\n", formatBytes(backupBytes), compressionRatio, compressionSource)
+	if throughput > 0 {
+		duration := time.Duration(float64(totalBytes) / throughput * float64(time.Second))
+		fmt.Fprintf(r.stdout, "Throughput: %v/s (%v)\n", formatBytes(int64(throughput)), throughputSource)
+		fmt.Fprintf(r.stdout, "Estimated duration of a full backup: %v\n", duration.Round(time.Minute))
+	} else {
+		fmt.Fprintln(r.stdout, "Estimated duration of a full backup: unknown (no run summaries found; set ESTIMATE_THROUGHPUT or enable SUMMARY_UPLOAD)")
+	}
+	fmt.Fprintf(r.stdout, "Estimated storage cost: $%.2f/month (%v, $%v/GB/month, current generation only)\n", monthlyCost, storageClass, price)
+	return nil
+}
+
+// 既存のバックアップの圧縮後のサイズと元のデータのサイズの比（元のサイズが記録されていない場合は0）
+func (c *backupConfig) backupCompressionRatio(ctx context.Context, gcsBucketClient *storage.BucketHandle) (float64, error) {
+	var storedBytes, originalBytes int64
+	err := c.forEachBackupObject(ctx, gcsBucketClient, func(attrs *storage.ObjectAttrs) {
+		if _, ok := attrs.Metadata[metadataOriginalSize]; !ok {
+			return
+		}
+		storedBytes += attrs.Size
+		originalBytes += backupObjectSize(attrs)
+	})
+	if err != nil || originalBytes == 0 {
+		return 0, err
+	}
+	return float64(storedBytes) / float64(originalBytes), nil
+}
+
+// SUMMARY_UPLOADでアップロードされた直近の実行結果から、平均の転送速度（バイト/秒）を求める
+// 中断した実行と、転送量の無い実行は除く
+// フルバックアップの実行結果がある場合はそれのみを使う（スキップしたオブジェクトも転送量に含まれるため）
+func (c *backupConfig) recentThroughput(ctx context.Context, gcsBucketClient *storage.BucketHandle) (float64, int, error) {
+	var names []string
+	objects := gcsBucketClient.Objects(ctx, &storage.Query{Prefix: c.managedObjectName(summaryObjectPrefix)})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			if errors.Is(err, storage.ErrBucketNotExist) {
+				return 0, 0, nil
+			}
+			return 0, 0, err
+		}
+		if strings.HasSuffix(attrs.Name, ".json") {
+			names = append(names, attrs.Name)
+		}
+	}
+	// 実行IDは開始時刻から始まるため、名前の降順が新しい順
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	var fullRuns, otherRuns []*backupSummary
+	for _, name := range names {
+		if len(fullRuns) >= estimateRecentRuns {
+			break
+		}
+		summary, err := readSummary(ctx, gcsBucketClient.Object(name))
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read %v: %w", name, err)
+		}
+		if summary.AbortReason != "" || summary.TotalBytes == 0 || summary.DurationSeconds == 0 {
+			continue
+		}
+		if summary.Config.FullBackup {
+			fullRuns = append(fullRuns, summary)
+		} else if len(otherRuns) < estimateRecentRuns {
+			otherRuns = append(otherRuns, summary)
+		}
+	}
+	runs := fullRuns
+	if len(runs) == 0 {
+		runs = otherRuns
+	}
+	var bytes int64
+	var seconds float64
+	for _, summary := range runs {
+		bytes += summary.TotalBytes
+		seconds += summary.DurationSeconds - summary.PausedSeconds
+	}
+	if seconds == 0 {
+		return 0, 0, nil
+	}
+	return float64(bytes) / seconds, len(runs), nil
+}
+
+func readSummary(ctx context.Context, object *storage.ObjectHandle) (*backupSummary, error) {
+	reader, err := object.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var summary backupSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
@@ -0,0 +1,230 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// エクスポート先のインデックスファイル名
+const exportIndexFileName = "index.json"
+
+// エクスポートしたオブジェクトを置くディレクトリ名
+const exportObjectsDirName = "objects"
+
+// エクスポートしたオブジェクトのファイル名に付ける拡張子
+const exportObjectSuffix = ".sz"
+
+// インデックスに記録するオブジェクトの情報
+type exportIndexEntry struct {
+	Key                string            `json:"key"`
+	Path               string            `json:"path"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ContentLanguage    string            `json:"contentLanguage,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	// バックアップ元のS3のLastModified（RFC 3339）
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// インデックスに記録するLastModified（不明な場合は空）
+func formatLastModified(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// ローカルディレクトリ、またはtar.gzアーカイブへのエクスポート
+type localExporter struct {
+	mu    sync.Mutex
+	index []exportIndexEntry
+
+	// ディレクトリに書き出す場合
+	dir string
+
+	// tar.gzに書き出す場合
+	file      *os.File
+	gzWriter  *gzip.Writer
+	tarWriter *tar.Writer
+}
+
+// エクスポート先を作成する
+// パスが.tar.gzまたは.tgzで終わる場合はアーカイブ、それ以外はディレクトリに書き出す
+func newLocalExporter(exportPath string) (*localExporter, error) {
+	if strings.HasSuffix(exportPath, ".tar.gz") || strings.HasSuffix(exportPath, ".tgz") {
+		file, err := os.Create(exportPath)
+		if err != nil {
+			return nil, err
+		}
+		gzWriter := gzip.NewWriter(file)
+		return &localExporter{
+			file:      file,
+			gzWriter:  gzWriter,
+			tarWriter: tar.NewWriter(gzWriter),
+		}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(exportPath, exportObjectsDirName), 0o755); err != nil {
+		return nil, err
+	}
+	return &localExporter{dir: exportPath}, nil
+}
+
+// オブジェクトのキーからエクスポート先の相対パスを求める
+func exportObjectPath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || strings.HasPrefix(key, "/") || cleaned != "/"+strings.TrimSuffix(key, "/") {
+		return "", fmt.Errorf("key cannot be exported as a file path: %q", key)
+	}
+	return exportObjectsDirName + "/" + key + exportObjectSuffix, nil
+}
+
+// オブジェクトをSnappy圧縮して書き出し、インデックスに追加する
+func (e *localExporter) Export(key string, info *ObjectInfo, body io.Reader) error {
+	objectPath, err := exportObjectPath(key)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	if e.tarWriter != nil {
+		size, err = e.writeTarEntry(objectPath, body)
+	} else {
+		size, err = e.writeFile(objectPath, body)
+	}
+	if err != nil {
+		return err
+	}
+
+	// メタデータをインデックスに記録
+	entry := exportIndexEntry{
+		Key:                key,
+		Path:               objectPath,
+		Size:               size,
+		ContentType:        info.ContentType,
+		ContentEncoding:    info.ContentEncoding,
+		ContentDisposition: info.ContentDisposition,
+		ContentLanguage:    info.ContentLanguage,
+		CacheControl:       info.CacheControl,
+		Metadata:           info.Metadata,
+		LastModified:       formatLastModified(info.LastModified),
+	}
+
+	e.mu.Lock()
+	e.index = append(e.index, entry)
+	e.mu.Unlock()
+
+	return nil
+}
+
+// ディレクトリにSnappy圧縮したファイルを書き出す
+func (e *localExporter) writeFile(objectPath string, body io.Reader) (int64, error) {
+	filePath := filepath.Join(e.dir, filepath.FromSlash(objectPath))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return 0, err
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	snappyWriter := snappy.NewBufferedWriter(file)
+	size, err := pooledCopy(snappyWriter, body)
+	if err != nil {
+		return 0, err
+	}
+	if err := snappyWriter.Close(); err != nil {
+		return 0, err
+	}
+	return size, file.Close()
+}
+
+// tarのエントリはサイズが先に必要なため、一時ファイルに圧縮してから書き込む
+func (e *localExporter) writeTarEntry(objectPath string, body io.Reader) (int64, error) {
+	tmpFile, err := os.CreateTemp("", "s3-backup-helper-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	snappyWriter := snappy.NewBufferedWriter(tmpFile)
+	size, err := pooledCopy(snappyWriter, body)
+	if err != nil {
+		return 0, err
+	}
+	if err := snappyWriter.Close(); err != nil {
+		return 0, err
+	}
+	compressedSize, err := tmpFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.tarWriter.WriteHeader(&tar.Header{
+		Name:    objectPath,
+		Mode:    0o644,
+		Size:    compressedSize,
+		ModTime: time.Now(),
+	}); err != nil {
+		return 0, err
+	}
+	if _, err := pooledCopy(e.tarWriter, tmpFile); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// インデックスを書き出してエクスポートを終了する
+func (e *localExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	indexJSON, err := json.MarshalIndent(e.index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if e.tarWriter == nil {
+		return os.WriteFile(filepath.Join(e.dir, exportIndexFileName), indexJSON, 0o644)
+	}
+
+	if err := e.tarWriter.WriteHeader(&tar.Header{
+		Name:    exportIndexFileName,
+		Mode:    0o644,
+		Size:    int64(len(indexJSON)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := e.tarWriter.Write(indexJSON); err != nil {
+		return err
+	}
+	if err := e.tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := e.gzWriter.Close(); err != nil {
+		return err
+	}
+	return e.file.Close()
+}
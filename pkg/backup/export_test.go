@@ -0,0 +1,40 @@
+package backup
+
+import "testing"
+
+func TestExportObjectPath(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "a.txt", want: "objects/a.txt.sz"},
+		{key: "a/b/c.txt", want: "objects/a/b/c.txt.sz"},
+		{key: "dir/", want: "objects/dir/.sz"},
+		{key: "", wantErr: true},
+		{key: "/abs", wantErr: true},
+		{key: "..", wantErr: true},
+		{key: "../x", wantErr: true},
+		{key: "a/../../x", wantErr: true},
+		{key: "a/../b", wantErr: true},
+		{key: "a/./b", wantErr: true},
+		{key: "a//b", wantErr: true},
+		{key: "a/..", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := exportObjectPath(tt.key)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("exportObjectPath(%q) = %q, want error", tt.key, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("exportObjectPath(%q) returned error: %v", tt.key, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("exportObjectPath(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"google.golang.org/api/googleapi"
+)
+
+// 失敗の原因の分類
+// 1つのオブジェクトだけの問題か、認証などの全体の問題かを通知から見分けられるようにする
+const (
+	errorCategoryAuth     = "auth"
+	errorCategoryNotFound = "not_found"
+	errorCategoryThrottle = "throttled"
+	errorCategoryTimeout  = "timeout"
+	errorCategoryNetwork  = "network"
+	errorCategoryChecksum = "checksum"
+	errorCategoryArchived = "archived"
+	errorCategoryOther    = "other"
+)
+
+// S3のエラーコードごとの分類
+var s3ErrorCategories = map[string]string{
+	"AccessDenied":          errorCategoryAuth,
+	"InvalidAccessKeyId":    errorCategoryAuth,
+	"SignatureDoesNotMatch": errorCategoryAuth,
+	"ExpiredToken":          errorCategoryAuth,
+	"InvalidToken":          errorCategoryAuth,
+	"NoSuchKey":             errorCategoryNotFound,
+	"NoSuchBucket":          errorCategoryNotFound,
+	"NotFound":              errorCategoryNotFound,
+	"SlowDown":              errorCategoryThrottle,
+	"Throttling":            errorCategoryThrottle,
+	"RequestTimeout":        errorCategoryTimeout,
+	"InvalidObjectState":    errorCategoryArchived,
+}
+
+// エラーを分類する
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, errObjectArchived) {
+		return errorCategoryArchived
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorCategoryTimeout
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
+		return errorCategoryNotFound
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if category, ok := s3ErrorCategories[apiErr.ErrorCode()]; ok {
+			return category
+		}
+	}
+	statusCode := 0
+	var responseErr *smithyhttp.ResponseError
+	var googleErr *googleapi.Error
+	if errors.As(err, &responseErr) {
+		statusCode = responseErr.HTTPStatusCode()
+	} else if errors.As(err, &googleErr) {
+		statusCode = googleErr.Code
+	}
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return errorCategoryAuth
+	case statusCode == http.StatusNotFound:
+		return errorCategoryNotFound
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable:
+		return errorCategoryThrottle
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return errorCategoryTimeout
+		}
+		return errorCategoryNetwork
+	}
+	if strings.Contains(err.Error(), "mismatch") {
+		return errorCategoryChecksum
+	}
+	return errorCategoryOther
+}
+
+// 通知に載せる、失敗したオブジェクトの分類ごとの数と最初のいくつかのキー、全ての失敗の記録の場所
+// 既定の通知文に合わせて、各行の後にタブを付ける
+func (c *backupConfig) failedObjectsMessage(summary *backupSummary) string {
+	if len(summary.FailedObjects) == 0 || c.webhookMaxFailedObjects == 0 {
+		return ""
+	}
+	var message strings.Builder
+
+	counts := make(map[string]int)
+	for _, failed := range summary.FailedObjects {
+		counts[failed.Category]++
+	}
+	categories := make([]string, 0, len(counts))
+	for category := range counts {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if counts[categories[i]] != counts[categories[j]] {
+			return counts[categories[i]] > counts[categories[j]]
+		}
+		return categories[i] < categories[j]
+	})
+	var categoryCounts []string
+	for _, category := range categories {
+		categoryCounts = append(categoryCounts, fmt.Sprintf("%s: %d", category, counts[category]))
+	}
+	fmt.Fprintf(&message, "失敗の分類: %s\n\t", strings.Join(categoryCounts, ", "))
+
+	message.WriteString("失敗したオブジェクト:\n\t")
+	for i, failed := range summary.FailedObjects {
+		if i >= c.webhookMaxFailedObjects {
+			fmt.Fprintf(&message, "他%d件\n\t", len(summary.FailedObjects)-i)
+			break
+		}
+		// 権限の不足などの場合は、SDKのエラーの代わりに直し方を載せる
+		detail := failed.Error
+		if failed.Hint != "" {
+			detail = failed.Hint
+		}
+		fmt.Fprintf(&message, "- `%s` (%s): %s\n\t", failed.Key, failed.Category, detail)
+	}
+
+	var locations []string
+	if c.summaryUpload && summary.Destination != "" && c.exportPath == "" {
+		locations = append(locations, fmt.Sprintf("gs://%s/%s.json", summary.Destination, c.managedObjectName(summaryObjectPrefix+summary.RunID)))
+	}
+	if c.summaryPath != "" {
+		locations = append(locations, c.summaryPath)
+	}
+	if c.objectReportPath != "" {
+		locations = append(locations, c.objectReportPath)
+	}
+	if len(locations) > 0 {
+		fmt.Fprintf(&message, "全ての失敗: %s\n\t", strings.Join(locations, ", "))
+	}
+	return message.String()
+}
@@ -0,0 +1,12 @@
+package backup
+
+// オブジェクトのサイズがバックアップ対象の範囲内か
+func (c *backupConfig) objectSizeInRange(size int64) bool {
+	if c.minObjectSize > 0 && size < c.minObjectSize {
+		return false
+	}
+	if c.maxObjectSize > 0 && size > c.maxObjectSize {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// キーがパターンに一致するか判定する関数と、一覧を絞り込むためのパターンの固定部分を返す
+// regexがfalseの場合はglob（path.Matchの形式、*は/に一致しない）として扱う
+func keyMatcher(pattern string, regex bool) (func(key string) bool, string, error) {
+	if regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid regular expression: %w", err)
+		}
+		// 正規表現はキーの途中にも一致するため、一覧は絞り込まない
+		return re.MatchString, "", nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, "", fmt.Errorf("invalid glob pattern: %w", err)
+	}
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+	return func(key string) bool {
+		matched, _ := path.Match(pattern, key)
+		return matched
+	}, prefix, nil
+}
+
+// パターンに一致するキーを、古い世代も含めて検索し、バックアップした世代と日時を出力する
+// 「あのファイルは過去にバックアップされていたか」を調べるため
+func (r *backupRun) runFind(pattern string, regex bool) error {
+	match, prefix, err := keyMatcher(pattern, regex)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+	ctx := context.Background()
+	gcsClient, gcsBucketClient, gcsBucketName, err := r.openGCSBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer gcsClient.Close()
+
+	writer := tabwriter.NewWriter(r.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "LOCATION\tSIZE\tBACKED UP\tREPLACED OR DELETED")
+	var keys, generationCount int64
+	err = r.forEachBackupKey(ctx, gcsBucketClient, prefix, func(key string, generations []*storage.ObjectAttrs, current bool) {
+		if !match(key) {
+			return
+		}
+		keys++
+		generationCount += int64(len(generations))
+		for _, attrs := range generations {
+			// 現在の世代は空欄、古い世代は新しい世代で置き換えられたか、S3から削除された日時
+			replaced := ""
+			if !attrs.Deleted.IsZero() {
+				replaced = attrs.Deleted.Format(time.RFC3339)
+			}
+			fmt.Fprintf(writer, "gs://%v/%v#%d\t%d\t%v\t%v\n", gcsBucketName, attrs.Name, attrs.Generation, backupObjectSize(attrs), attrs.Updated.Format(time.RFC3339), replaced)
+		}
+	})
+	writer.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.stdout, "%d matching keys, %d generations\n", keys, generationCount)
+	return nil
+}
@@ -0,0 +1,39 @@
+package backup
+
+import "testing"
+
+func TestKeyMatcher(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		regex      bool
+		key        string
+		want       bool
+		wantPrefix string
+	}{
+		{pattern: "images/*.png", key: "images/a.png", want: true, wantPrefix: "images/"},
+		{pattern: "images/*.png", key: "images/2024/a.png", want: false, wantPrefix: "images/"},
+		{pattern: "images/*/a.png", key: "images/2024/a.png", want: true, wantPrefix: "images/"},
+		{pattern: "docs/readme.md", key: "docs/readme.md", want: true, wantPrefix: "docs/readme.md"},
+		{pattern: "docs/readme.md", key: "docs/readme.md.bak", want: false, wantPrefix: "docs/readme.md"},
+		{pattern: `\.png$`, regex: true, key: "images/2024/a.png", want: true},
+		{pattern: `^images/`, regex: true, key: "old/images/a.png", want: false},
+	}
+	for _, tt := range tests {
+		match, prefix, err := keyMatcher(tt.pattern, tt.regex)
+		if err != nil {
+			t.Fatalf("keyMatcher(%q) returned error: %v", tt.pattern, err)
+		}
+		if got := match(tt.key); got != tt.want {
+			t.Errorf("keyMatcher(%q) matched %q = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+		if prefix != tt.wantPrefix {
+			t.Errorf("keyMatcher(%q) prefix = %q, want %q", tt.pattern, prefix, tt.wantPrefix)
+		}
+	}
+
+	for _, pattern := range []string{"images/[", "("} {
+		if _, _, err := keyMatcher(pattern, pattern == "("); err == nil {
+			t.Errorf("keyMatcher(%q) returned no error", pattern)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// GCSバケット名の長さの上限（"."を含む場合は全体で222文字、"."で区切ったそれぞれが63文字まで）
+const (
+	maxGCSBucketNameLength       = 63
+	maxDottedGCSBucketNameLength = 222
+)
+
+// GCSバケット名として使えるか確認する
+// https://cloud.google.com/storage/docs/buckets#naming
+func validateGCSBucketName(name string) error {
+	if len(name) < 3 {
+		return fmt.Errorf("invalid GCS bucket name %q: must be at least 3 characters", name)
+	}
+	if strings.Contains(name, ".") {
+		if len(name) > maxDottedGCSBucketNameLength {
+			return fmt.Errorf("invalid GCS bucket name %q: must be at most %d characters", name, maxDottedGCSBucketNameLength)
+		}
+		for _, component := range strings.Split(name, ".") {
+			if component == "" || len(component) > maxGCSBucketNameLength {
+				return fmt.Errorf("invalid GCS bucket name %q: each dot-separated component must be 1 to %d characters", name, maxGCSBucketNameLength)
+			}
+		}
+	} else if len(name) > maxGCSBucketNameLength {
+		return fmt.Errorf("invalid GCS bucket name %q: must be at most %d characters", name, maxGCSBucketNameLength)
+	}
+	for _, r := range name {
+		if !isGCSBucketNameChar(r) {
+			return fmt.Errorf("invalid GCS bucket name %q: contains %q (use lowercase letters, digits, '-', '_' and '.')", name, r)
+		}
+	}
+	if !isLowerAlphanumeric(rune(name[0])) || !isLowerAlphanumeric(rune(name[len(name)-1])) {
+		return fmt.Errorf("invalid GCS bucket name %q: must start and end with a lowercase letter or digit", name)
+	}
+	if _, err := netip.ParseAddr(name); err == nil {
+		return fmt.Errorf("invalid GCS bucket name %q: must not be an IP address", name)
+	}
+	if strings.HasPrefix(name, "goog") || strings.Contains(name, "google") {
+		return fmt.Errorf("invalid GCS bucket name %q: must not start with \"goog\" or contain \"google\"", name)
+	}
+	return nil
+}
+
+func isLowerAlphanumeric(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= '0' && r <= '9'
+}
+
+func isGCSBucketNameChar(r rune) bool {
+	return isLowerAlphanumeric(r) || r == '-' || r == '_' || r == '.'
+}
+
+// S3バケット名から作ったGCSバケット名を、GCSで使える名前にする
+// 使えない文字を"-"に置き換え、長すぎる場合は切り詰める
+// 変更した場合は、元の名前が異なるバケットが同じ名前にならないよう、元の名前のハッシュを末尾に付ける
+// 使える名前はそのまま返す（既存のバケットの名前が変わらないようにする）
+func normalizeGCSBucketName(name string) string {
+	if validateGCSBucketName(name) == nil {
+		return name
+	}
+	normalized := []rune(strings.ToLower(name))
+	for i, r := range normalized {
+		// "."はドメインの確認が必要な上、区切りごとの長さの制限もあるため使わない
+		if !isGCSBucketNameChar(r) || r == '.' {
+			normalized[i] = '-'
+		}
+	}
+	base := strings.Trim(string(normalized), "-_")
+	hash := bucketNameHash(name)
+	// "-" + ハッシュを付けても上限に収まるよう切り詰める
+	base = strings.TrimRight(base[:min(len(base), maxGCSBucketNameLength-len(hash)-1)], "-_")
+	if base == "" {
+		return "b-" + hash
+	}
+	return base + "-" + hash
+}
+
+// 元のバケット名のハッシュ（正規化したバケット名とラベルに使う）
+func bucketNameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:4])
+}
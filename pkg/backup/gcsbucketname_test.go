@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeGCSBucketName(t *testing.T) {
+	// 使える名前はそのまま
+	for _, name := range []string{"traq-backup", "traq.bucket.tokyotech.org", "a_b-c"} {
+		if got := normalizeGCSBucketName(name); got != name {
+			t.Errorf("normalizeGCSBucketName(%q) = %q, want unchanged", name, got)
+		}
+	}
+
+	tests := []string{
+		"Traq_Backup",
+		"-traq-",
+		strings.Repeat("a", 100),
+		strings.Repeat("a", 70) + "." + "backup",
+		"日本語",
+	}
+	seen := make(map[string]string)
+	for _, name := range tests {
+		got := normalizeGCSBucketName(name)
+		if err := validateGCSBucketName(got); err != nil {
+			t.Errorf("normalizeGCSBucketName(%q) = %q, which is invalid: %v", name, got, err)
+		}
+		if again := normalizeGCSBucketName(name); again != got {
+			t.Errorf("normalizeGCSBucketName(%q) is not deterministic: %q, %q", name, got, again)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("normalizeGCSBucketName(%q) and (%q) both returned %q", name, other, got)
+		}
+		seen[got] = name
+	}
+	// 正規化すると同じになる名前も、ハッシュで区別する
+	if normalizeGCSBucketName("Traq") == normalizeGCSBucketName("TRAQ") {
+		t.Error("normalizeGCSBucketName returned the same name for different buckets")
+	}
+
+	for _, name := range []string{"ab", "192.168.0.1", "goog-backup", "my-google-backup", "a..b"} {
+		if err := validateGCSBucketName(name); err == nil {
+			t.Errorf("validateGCSBucketName(%q) returned no error", name)
+		}
+	}
+}
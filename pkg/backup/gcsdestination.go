@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// GCSのバケットをバックアップ先とする
+type gcsDestination struct {
+	config *backupConfig
+	bucket *storage.BucketHandle
+}
+
+func (c *backupConfig) newGCSDestination(bucket *storage.BucketHandle) *gcsDestination {
+	return &gcsDestination{config: c, bucket: bucket}
+}
+
+// バックアップの設定を使わずにGCSのバケットを読み書きする（復元など）
+// 書き込むオブジェクトには解凍トランスコーディング（GCS_TRANSCODING）を使わない
+func NewGCSDestination(bucket *storage.BucketHandle) ObjectDestination {
+	return newBackupConfig().newGCSDestination(bucket)
+}
+
+func (d *gcsDestination) List(ctx context.Context, prefix string, fn func(info *ObjectInfo) error) error {
+	objects := d.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(gcsObjectInfo(attrs)); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *gcsDestination) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	attrs, err := d.bucket.Object(key).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, fmt.Errorf("%w: %w", ErrObjectNotFound, err)
+		}
+		return nil, err
+	}
+	return gcsObjectInfo(attrs), nil
+}
+
+func (d *gcsDestination) Get(ctx context.Context, key string, generation int64) (io.ReadCloser, error) {
+	object := d.bucket.Object(key)
+	if generation != 0 {
+		object = object.Generation(generation)
+	}
+	// 古いバックアップでContent-Encodingが付いている場合も、GCSに解凍させずに保存したデータをそのまま読む
+	reader, err := object.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, fmt.Errorf("%w: %w", ErrObjectNotFound, err)
+		}
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (d *gcsDestination) NewWriter(ctx context.Context, key string, info ObjectInfo) ObjectWriter {
+	// Abortでcontextをキャンセルしてアップロードを取り消す
+	ctx, cancel := context.WithCancel(ctx)
+	writer := d.bucket.Object(key).NewWriter(ctx)
+	writer.ContentType = info.ContentType
+	writer.ContentEncoding = d.config.gcsContentEncodingOf(info)
+	writer.ContentDisposition = info.ContentDisposition
+	writer.ContentLanguage = info.ContentLanguage
+	writer.CacheControl = info.CacheControl
+	writer.Metadata = d.config.gcsMetadataOf(info)
+	return &gcsObjectWriter{writer: writer, cancel: cancel}
+}
+
+func (d *gcsDestination) UpdateMetadata(ctx context.Context, key string, generation int64, metadata map[string]string) error {
+	object := d.bucket.Object(key)
+	if generation != 0 {
+		object = object.If(storage.Conditions{GenerationMatch: generation})
+	}
+	_, err := object.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+	return err
+}
+
+func (d *gcsDestination) Delete(ctx context.Context, key string) error {
+	err := d.bucket.Object(key).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %w", ErrObjectNotFound, err)
+	}
+	return err
+}
+
+type gcsObjectWriter struct {
+	writer *storage.Writer
+	cancel context.CancelFunc
+}
+
+func (w *gcsObjectWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+func (w *gcsObjectWriter) Commit() (*ObjectInfo, error) {
+	defer w.cancel()
+	if err := w.writer.Close(); err != nil {
+		return nil, err
+	}
+	return gcsObjectInfo(w.writer.Attrs()), nil
+}
+
+func (w *gcsObjectWriter) Abort() {
+	w.cancel()
+	w.writer.Close()
+}
+
+// GCSのオブジェクトに付けるメタデータ
+// 元のContent-EncodingはGCSのContent-Encodingではなくメタデータに記録する
+// GCSのContent-Encodingがgzipの場合、GCSが解凍して返す（解凍トランスコーディング）ことがあり、このツールで圧縮した本体を正しく読めなくなるため
+func (c *backupConfig) gcsMetadataOf(info ObjectInfo) map[string]string {
+	transcoding := c.useGCSTranscoding(info)
+	if info.ContentEncoding == "" && !transcoding {
+		return info.Metadata
+	}
+	metadata := maps.Clone(info.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string, 2)
+	}
+	if info.ContentEncoding != "" {
+		metadata[metadataSourceContentEncoding] = info.ContentEncoding
+	}
+	if transcoding {
+		metadata[metadataGCSTranscoding] = "true"
+	}
+	return metadata
+}
+
+// 解凍トランスコーディングで読めるようにするか
+// 元のオブジェクトにContent-Encodingがある場合は、解凍しても元のContent-Encodingのデータになり、GCSのContent-Encodingで表せないため使わない
+func (c *backupConfig) useGCSTranscoding(info ObjectInfo) bool {
+	return c.gcsTranscoding && info.ContentEncoding == "" && info.Metadata[metadataCompression] == compressionGzip
+}
+
+// GCSのオブジェクトに付けるContent-Encoding（解凍トランスコーディングを使う場合のみgzip）
+func (c *backupConfig) gcsContentEncodingOf(info ObjectInfo) string {
+	if c.useGCSTranscoding(info) {
+		return compressionGzip
+	}
+	return ""
+}
+
+// 元のContent-Encoding
+// メタデータに記録されていない古いバックアップはGCSのContent-Encoding（解凍トランスコーディングのために付けたものを除く）
+func sourceContentEncoding(attrs *storage.ObjectAttrs) string {
+	if contentEncoding, ok := attrs.Metadata[metadataSourceContentEncoding]; ok {
+		return contentEncoding
+	}
+	if attrs.Metadata[metadataGCSTranscoding] == "true" {
+		return ""
+	}
+	return attrs.ContentEncoding
+}
+
+func gcsObjectInfo(attrs *storage.ObjectAttrs) *ObjectInfo {
+	return &ObjectInfo{
+		Key:                attrs.Name,
+		Size:               attrs.Size,
+		LastModified:       attrs.Updated,
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    sourceContentEncoding(attrs),
+		ContentDisposition: attrs.ContentDisposition,
+		ContentLanguage:    attrs.ContentLanguage,
+		CacheControl:       attrs.CacheControl,
+		Metadata:           attrs.Metadata,
+		StorageClass:       attrs.StorageClass,
+		MD5:                attrs.MD5,
+		CRC32C:             attrs.CRC32C,
+		Generation:         attrs.Generation,
+	}
+}
+
+// 合成やコピーなどGCSに固有の操作に使うバケットを返す
+func gcsBucketOf(destination ObjectDestination) (*storage.BucketHandle, error) {
+	gcs, ok := destination.(*gcsDestination)
+	if !ok {
+		return nil, fmt.Errorf("destination %T does not support this operation", destination)
+	}
+	return gcs.bucket, nil
+}
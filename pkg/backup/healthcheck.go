@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 監視サービスへのリクエストの時間の上限
+const healthcheckTimeout = 10 * time.Second
+
+// 実行の開始を知らせる
+func (r *backupRun) pingHealthcheckStart() {
+	if r.healthcheckGeneric {
+		return
+	}
+	r.pingHealthcheck("/start", "")
+}
+
+// 実行の終了を、実行結果とともに知らせる
+// 中断した場合やエラーがあった場合は失敗として知らせる
+func (r *backupRun) pingHealthcheckFinish(summary *backupSummary, runErr error) {
+	failed := runErr != nil || (summary != nil && summary.Errors > 0)
+	if failed && r.healthcheckGeneric {
+		return
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "run_id: %v\n", r.runID)
+	if summary != nil {
+		fmt.Fprintf(&body, "objects: %d\n", summary.TotalObjects)
+		fmt.Fprintf(&body, "bytes: %d\n", summary.TotalBytes)
+		fmt.Fprintf(&body, "skipped: %d\n", summary.SkippedObjects)
+		fmt.Fprintf(&body, "errors: %d\n", summary.Errors)
+		fmt.Fprintf(&body, "duration_seconds: %.0f\n", summary.DurationSeconds)
+	}
+	if runErr != nil {
+		fmt.Fprintf(&body, "error: %v\n", r.describeError(runErr))
+	}
+
+	suffix := ""
+	if failed {
+		suffix = "/fail"
+	}
+	r.pingHealthcheck(suffix, body.String())
+}
+
+// 監視サービスのURLにPOSTする
+// 失敗してもバックアップは続けるため、ログに残すだけにする
+func (r *backupRun) pingHealthcheck(suffix string, body string) {
+	if r.healthcheckURL == "" {
+		return
+	}
+	pingURL := strings.TrimSuffix(r.healthcheckURL, "/") + suffix
+
+	httpClient, err := r.newHTTPClient()
+	if err != nil {
+		r.logWarnf("Failed to ping healthcheck: %v", err)
+		return
+	}
+	client := *httpClient
+	client.Timeout = healthcheckTimeout
+	response, err := client.Post(pingURL, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		r.logWarnf("Failed to ping healthcheck: %v", err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		r.logWarnf("Healthcheck returned %v", response.Status)
+	}
+}
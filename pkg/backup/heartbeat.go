@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+)
+
+// 一定間隔で途中経過をWebhookで通知する
+// 返り値の関数を呼ぶと通知を停止する
+func (r *backupRun) startHeartbeat(progress *backupProgress, interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.sendHeartbeat(progress)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (r *backupRun) sendHeartbeat(progress *backupProgress) {
+	eta := "不明"
+	if d := progress.ETA(); d > 0 {
+		eta = d.String()
+	}
+
+	message := fmt.Sprintf(`### オブジェクトストレージのバックアップ実行中
+	実行ID: %s
+	S3バケット: %s
+	経過時間: %s
+	進捗: %d/%d オブジェクト (%s/%s)
+	エラー数: %d
+	残り時間の目安: %s
+	`, r.runID, r.s3Config.Bucket, time.Since(progress.startTime).Round(time.Second),
+		progress.completedObjects.Load(), progress.totalObjects.Load(),
+		formatBytes(progress.completedBytes.Load()), formatBytes(progress.totalBytes.Load()),
+		progress.errorObjects.Load(), eta)
+
+	r.logInfof("Heartbeat: %d/%d objects, %d errors, ETA %s",
+		progress.completedObjects.Load(), progress.totalObjects.Load(), progress.errorObjects.Load(), eta)
+	if err := r.postWebhook(message, r.webhookUrl, r.webhookId, r.webhookSecret); err != nil {
+		r.logErrorf("Failed to send heartbeat webhook: %v", err)
+	}
+}
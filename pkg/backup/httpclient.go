@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// 外部との通信の設定
+type httpConfigStruct struct {
+	ProxyURL           string
+	CABundlePath       string
+	InsecureSkipVerify bool
+}
+
+// 通信の設定が指定されているか
+func (c httpConfigStruct) customized() bool {
+	return c.ProxyURL != "" || c.CABundlePath != "" || c.InsecureSkipVerify
+}
+
+// プロキシとCAの設定を反映したTransportを作成する
+func (c *backupConfig) newHTTPTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.httpConfig.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.httpConfig.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP_PROXY_URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if c.httpConfig.CABundlePath != "" || c.httpConfig.InsecureSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: c.httpConfig.InsecureSkipVerify}
+		if c.httpConfig.CABundlePath != "" {
+			caBundle, err := os.ReadFile(c.httpConfig.CABundlePath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			// システムのCAに追加する
+			rootCAs, err := x509.SystemCertPool()
+			if err != nil {
+				rootCAs = x509.NewCertPool()
+			}
+			if !rootCAs.AppendCertsFromPEM(caBundle) {
+				return nil, fmt.Errorf("no certificates found in CA bundle: %v", c.httpConfig.CABundlePath)
+			}
+			tlsConfig.RootCAs = rootCAs
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+// 通信の設定を反映したHTTPクライアントを返す
+// Options.HTTPClientが指定されている場合はそれを、設定が無い場合はデフォルトのクライアントを返す
+func (c *backupConfig) newHTTPClient() (*http.Client, error) {
+	if c.clientOverrides.HTTPClient != nil {
+		return c.clientOverrides.HTTPClient, nil
+	}
+	if !c.httpConfig.customized() {
+		return http.DefaultClient, nil
+	}
+	transport, err := c.newHTTPTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// GCSクライアントのオプションを作成する
+// 通信の設定がある場合は、認証を含めたTransportを自前で組み立てる
+func (c *backupConfig) gcsClientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	return c.googleClientOptions(ctx, storage.ScopeFullControl)
+}
+
+// GCSと同じ認証情報と通信の設定で、Google CloudのAPIのクライアントのオプションを作成する
+// scopeは通信の設定がある場合に、自前で組み立てるTransportで使うスコープ
+func (c *backupConfig) googleClientOptions(ctx context.Context, scope string) ([]option.ClientOption, error) {
+	credentialsOption := option.WithCredentialsFile(c.gcpConfig.CredentialsPath)
+	if c.gcpConfig.CredentialsJSON != nil {
+		credentialsOption = option.WithCredentialsJSON(c.gcpConfig.CredentialsJSON)
+	}
+	authOptions := []option.ClientOption{credentialsOption}
+	// 実行者の認証情報でバックアップ用のサービスアカウントになりすます
+	if c.gcpConfig.ImpersonateServiceAccount != "" {
+		authOptions = append(authOptions, option.ImpersonateCredentials(c.gcpConfig.ImpersonateServiceAccount))
+	}
+	// エミュレーター（fake-gcs-serverなど）は認証しない
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		authOptions = []option.ClientOption{option.WithoutAuthentication()}
+	}
+	if !c.httpConfig.customized() {
+		return authOptions, nil
+	}
+
+	baseTransport, err := c.newHTTPTransport()
+	if err != nil {
+		return nil, err
+	}
+	authTransport, err := htransport.NewTransport(ctx, baseTransport, append(authOptions, option.WithScopes(scope))...)
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: authTransport})}, nil
+}
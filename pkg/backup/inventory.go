@@ -0,0 +1,213 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// インベントリから作るページのオブジェクト数（ListObjectsV2の1ページと同じ）
+const inventoryPageSize = 1000
+
+// S3インベントリのmanifest.json
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// S3インベントリのCSVを読み、ListObjectsV2と同じ形のページにして送る
+// オブジェクト数が非常に多いバケットでは、ListObjectsV2を繰り返すより安く速い
+// インベントリは作成された時点の一覧のため、その後に追加・変更されたオブジェクトは次のインベントリまでバックアップされない
+// インベントリのファイルはキーの順に並んでいるとは限らないため、startAfterを指定した場合はキーの大小ではなく、
+// インベントリの中でstartAfterのキーがある位置の次から送る（見つからない場合は最初から送る）
+func (r *backupRun) listInventory(ctx context.Context, s3Client *s3.Client, startAfter string, pages chan<- listedPage) (err error) {
+	ctx, span := tracer.Start(ctx, "listInventory", trace.WithAttributes(attribute.String("s3.inventory_manifest", r.s3InventoryManifest)))
+	defer func() { endSpan(span, err) }()
+
+	manifestBucket, manifestKey, err := parseS3URL(r.s3InventoryManifest)
+	if err != nil {
+		return err
+	}
+	manifest, err := readInventoryManifest(ctx, s3Client, manifestBucket, manifestKey)
+	if err != nil {
+		return err
+	}
+	if manifest.SourceBucket != "" && manifest.SourceBucket != r.s3Config.Bucket {
+		return fmt.Errorf("inventory is for bucket %v, not %v", manifest.SourceBucket, r.s3Config.Bucket)
+	}
+	// 読めるのはCSVのみ（ParquetとORCは対象外）のため、インベントリの設定の誤りとして扱う
+	if manifest.FileFormat != "CSV" {
+		return fmt.Errorf("%w: unsupported inventory format %v (only CSV is supported; configure the inventory to output CSV)", errInvalidConfig, manifest.FileFormat)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["Key"]; !ok {
+		return errors.New("inventory schema has no Key column")
+	}
+
+	// インベントリのファイルは出力先のバケットに置かれる
+	filesBucket := strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::")
+	if filesBucket == "" {
+		filesBucket = manifestBucket
+	}
+
+	var contents []types.Object
+	resuming := startAfter != ""
+	for _, file := range manifest.Files {
+		err := readInventoryFile(ctx, s3Client, filesBucket, file.Key, func(record []string) error {
+			object, ok, err := inventoryObject(record, columns)
+			if err != nil {
+				return fmt.Errorf("invalid inventory record in %v: %w", file.Key, err)
+			}
+			if !ok {
+				return nil
+			}
+			if resuming {
+				resuming = aws.ToString(object.Key) != startAfter
+				return nil
+			}
+			contents = append(contents, object)
+			if len(contents) >= inventoryPageSize {
+				if !sendPage(ctx, pages, listedPage{Page: &s3.ListObjectsV2Output{Contents: contents}}) {
+					return ctx.Err()
+				}
+				contents = nil
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if resuming {
+		// 別のインベントリに変わったなどで位置が分からない場合は、スキップの判定に任せて最初から送る
+		r.logWarnf("Resume point %v is not in the inventory, listing it from the beginning", startAfter)
+		return r.listInventory(ctx, s3Client, "", pages)
+	}
+	if len(contents) > 0 {
+		sendPage(ctx, pages, listedPage{Page: &s3.ListObjectsV2Output{Contents: contents}})
+	}
+	return nil
+}
+
+// s3://<バケット>/<キー>を分解する
+func parseS3URL(value string) (string, string, error) {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme != "s3" || parsed.Host == "" || parsed.Path == "" {
+		return "", "", fmt.Errorf("invalid S3 URL: %v", value)
+	}
+	return parsed.Host, strings.TrimPrefix(parsed.Path, "/"), nil
+}
+
+func readInventoryManifest(ctx context.Context, s3Client *s3.Client, bucket string, key string) (*inventoryManifest, error) {
+	output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inventory manifest: %w", err)
+	}
+	defer output.Body.Close()
+
+	var manifest inventoryManifest
+	if err := json.NewDecoder(output.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse inventory manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// gzipで圧縮されたインベントリのCSVを1行ずつ読む
+func readInventoryFile(ctx context.Context, s3Client *s3.Client, bucket string, key string, fn func(record []string) error) error {
+	output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get inventory file %v: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	gzipReader, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read inventory file %v: %w", key, err)
+	}
+	defer gzipReader.Close()
+
+	csvReader := csv.NewReader(gzipReader)
+	csvReader.FieldsPerRecord = -1
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read inventory file %v: %w", key, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// インベントリの1行をオブジェクトにする
+// 古いバージョンと削除マーカー（全てのバージョンを含むインベントリの場合）はfalseを返す
+func inventoryObject(record []string, columns map[string]int) (types.Object, bool, error) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	if field("IsLatest") == "false" || field("IsDeleteMarker") == "true" {
+		return types.Object{}, false, nil
+	}
+
+	// キーはURLエンコードされている
+	key, err := url.QueryUnescape(field("Key"))
+	if err != nil {
+		return types.Object{}, false, err
+	}
+	object := types.Object{Key: aws.String(key)}
+	if value := field("Size"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return types.Object{}, false, err
+		}
+		object.Size = aws.Int64(size)
+	}
+	if value := field("LastModifiedDate"); value != "" {
+		lastModified, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return types.Object{}, false, err
+		}
+		object.LastModified = aws.Time(lastModified)
+	}
+	if value := field("ETag"); value != "" {
+		object.ETag = aws.String(`"` + value + `"`)
+	}
+	if value := field("StorageClass"); value != "" {
+		object.StorageClass = types.ObjectStorageClass(value)
+	}
+	return object, true, nil
+}
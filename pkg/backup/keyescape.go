@@ -0,0 +1,42 @@
+package backup
+
+import "github.com/traPtitech/s3-backup-helper/pkg/keyencoding"
+
+// GCSのオブジェクト名として使えないキーをエスケープしたオブジェクトを置くプレフィックス（バックアップ先のプレフィックスからの相対）
+const escapedObjectPrefix = keyencoding.EscapedPrefix
+
+// エスケープしたオブジェクトに付ける、元のキー（KEY_PREFIX_MAPで書き換えたもの）をエンコードしたもの
+const metadataOriginalKey = keyencoding.MetadataKey
+
+// キーをエスケープしたオブジェクト名（プレフィックスからの相対）にする
+// エスケープが不要な場合はそのまま返し、falseを返す
+func escapeObjectName(prefix, key string) (string, bool) {
+	return keyencoding.EscapeObjectName(prefix, key)
+}
+
+// 元のキーをメタデータに記録する
+func recordOriginalKey(info *ObjectInfo, key string) {
+	if info.Metadata == nil {
+		info.Metadata = make(map[string]string)
+	}
+	info.Metadata[metadataOriginalKey] = keyencoding.EncodeMetadata(key)
+}
+
+// メタデータに記録された元のキー（エスケープしていないオブジェクトの場合はfalse）
+func originalKeyOf(metadata map[string]string) (string, bool) {
+	value, ok := metadata[metadataOriginalKey]
+	if !ok {
+		return "", false
+	}
+	key, err := keyencoding.DecodeMetadata(value)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// S3のキーに対応するバックアップ先のオブジェクト名（KEY_PREFIX_MAPで書き換え、プレフィックスを付け、必要ならエスケープしたもの）
+func (c *backupConfig) backupObjectName(key string) string {
+	name, _ := escapeObjectName(c.destinationPrefix(), mapKeyPrefix(key, c.keyPrefixMap))
+	return c.destinationPrefix() + name
+}
@@ -0,0 +1,44 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscapeObjectName(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		key     string
+		want    string
+		escaped bool
+	}{
+		{key: "dir/file.txt", want: "dir/file.txt"},
+		{key: "日本語/ファイル", want: "日本語/ファイル"},
+		{key: "line\r\nbreak", want: escapedObjectPrefix + "key/line%0D%0Abreak", escaped: true},
+		{key: ".well-known/acme-challenge/token", want: escapedObjectPrefix + "key/.well-known/acme-challenge/token", escaped: true},
+		{key: "..", want: escapedObjectPrefix + "key/%2E%2E", escaped: true},
+		// プレフィックスの下では".."も使える
+		{prefix: "cluster-a/", key: "..", want: ".."},
+		{key: escapedObjectPrefix + "key/a", want: escapedObjectPrefix + "key/.s3-backup-escaped/key/a", escaped: true},
+	}
+	for _, tt := range tests {
+		got, escaped := escapeObjectName(tt.prefix, tt.key)
+		if got != tt.want || escaped != tt.escaped {
+			t.Errorf("escapeObjectName(%q, %q) = %q, %v, want %q, %v", tt.prefix, tt.key, got, escaped, tt.want, tt.escaped)
+		}
+	}
+
+	// 長すぎるキーはハッシュを名前にする
+	long := strings.Repeat("a", 1000)
+	got, escaped := escapeObjectName("prefix-longer-than-24-bytes/", long)
+	if !escaped || !strings.HasPrefix(got, escapedObjectPrefix+"sha256/") {
+		t.Errorf("escapeObjectName for a long key = %q, %v", got, escaped)
+	}
+
+	// 元のキーはメタデータから戻せる
+	info := &ObjectInfo{}
+	recordOriginalKey(info, "line\r\nbreak")
+	if key, ok := originalKeyOf(info.Metadata); !ok || key != "line\r\nbreak" {
+		t.Errorf("originalKeyOf = %q, %v", key, ok)
+	}
+}
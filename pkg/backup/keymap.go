@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// キーのプレフィックスの書き換え
+type keyPrefixMapping struct {
+	From string
+	To   string
+}
+
+// "<元のプレフィックス>=<新しいプレフィックス>"をカンマ区切りで並べた書き換え規則を読み込む
+// 新しいプレフィックスを空にした場合はプレフィックスを取り除き、元のプレフィックスを空にした場合は全てのキーに付け加える
+func parseKeyPrefixMap(value string) ([]keyPrefixMapping, error) {
+	var mappings []keyPrefixMapping
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		from, to, found := strings.Cut(entry, "=")
+		if !found || from == to {
+			return nil, fmt.Errorf("invalid key prefix mapping: %q", entry)
+		}
+		mappings = append(mappings, keyPrefixMapping{From: from, To: to})
+	}
+	return mappings, nil
+}
+
+// 書き換え規則をKEY_PREFIX_MAPの形式に戻す
+func formatKeyPrefixMap(mappings []keyPrefixMapping) string {
+	entries := make([]string, len(mappings))
+	for i, mapping := range mappings {
+		entries[i] = mapping.From + "=" + mapping.To
+	}
+	return strings.Join(entries, ",")
+}
+
+// 最初に一致した規則でキーのプレフィックスを書き換える
+// 一致する規則がない場合はそのまま返す
+func mapKeyPrefix(key string, mappings []keyPrefixMapping) string {
+	for _, mapping := range mappings {
+		if rest, ok := strings.CutPrefix(key, mapping.From); ok {
+			return mapping.To + rest
+		}
+	}
+	return key
+}
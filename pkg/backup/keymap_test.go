@@ -0,0 +1,40 @@
+package backup
+
+import "testing"
+
+func TestMapKeyPrefix(t *testing.T) {
+	mappings, err := parseKeyPrefixMap("prod/=,staging/=old/staging/")
+	if err != nil {
+		t.Fatalf("parseKeyPrefixMap returned error: %v", err)
+	}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "prod/a.txt", want: "a.txt"},
+		{key: "prod/dir/b.txt", want: "dir/b.txt"},
+		{key: "staging/c.txt", want: "old/staging/c.txt"},
+		{key: "production/d.txt", want: "production/d.txt"},
+		{key: "e.txt", want: "e.txt"},
+	}
+	for _, tt := range tests {
+		if got := mapKeyPrefix(tt.key, mappings); got != tt.want {
+			t.Errorf("mapKeyPrefix(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	// 元のプレフィックスが空の場合は全てのキーに付け加える
+	mappings, err = parseKeyPrefixMap("=restored/")
+	if err != nil {
+		t.Fatalf("parseKeyPrefixMap returned error: %v", err)
+	}
+	if got := mapKeyPrefix("a/b.txt", mappings); got != "restored/a/b.txt" {
+		t.Errorf("mapKeyPrefix(%q) = %q, want %q", "a/b.txt", got, "restored/a/b.txt")
+	}
+
+	for _, value := range []string{"prod/", "a/=a/"} {
+		if _, err := parseKeyPrefixMap(value); err == nil {
+			t.Errorf("parseKeyPrefixMap(%q) returned no error", value)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 一覧取得の結果
+type listedPage struct {
+	Page *s3.ListObjectsV2Output
+	Err  error
+}
+
+// バックグラウンドで一覧を取得し、ページを順に送る
+// 現在のページを処理している間に次のページを先読みしておくため、ワーカーが一覧取得を待たずに済む
+// LISTING_SHARD_DEPTHが指定されている場合は、プレフィックスごとに分割して並列に一覧を取得する
+// S3_INVENTORY_MANIFESTが指定されている場合は、一覧を取得せずにS3インベントリを読む
+// startAfterを指定した場合は、そのキーより後のオブジェクトのみを取得する
+// シャードは並列に取得するため再開する位置を1つのキーで表せず、シャードに分割する場合はstartAfterを指定できない（設定の読み込み時に組み合わせを拒否する）
+// 一覧はObjectSource.Listで取得する
+// インベントリとシャードの分割はS3のAPIを直接使うため、s3Clientがnil（Options.Sourceを指定した場合）のときは行わない
+// エラーが発生した場合はそれを最後に送って終了する
+func (r *backupRun) listObjectPages(ctx context.Context, source ObjectSource, s3Client *s3.Client, startAfter string) <-chan listedPage {
+	pages := make(chan listedPage, max(r.listingParallelNum, 1))
+
+	go func() {
+		defer close(pages)
+
+		if s3Client != nil && r.s3InventoryManifest != "" {
+			if err := r.listInventory(ctx, s3Client, startAfter, pages); err != nil {
+				sendPage(ctx, pages, listedPage{Err: err})
+			}
+			return
+		}
+
+		if s3Client == nil || r.listingShardDepth <= 0 {
+			if err := listSource(ctx, source, "", startAfter, pages); err != nil {
+				sendPage(ctx, pages, listedPage{Err: err})
+			}
+			return
+		}
+
+		if startAfter != "" {
+			sendPage(ctx, pages, listedPage{Err: fmt.Errorf("%w: cannot resume after %v with LISTING_SHARD_DEPTH", errInvalidConfig, startAfter)})
+			return
+		}
+
+		// 1つのシャードでエラーが発生したら他のシャードも止める
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		prefixes, err := r.discoverPrefixes(ctx, s3Client, pages)
+		if err != nil {
+			sendPage(ctx, pages, listedPage{Err: err})
+			return
+		}
+
+		// シャードごとに並列で一覧を取得
+		shards := make(chan string)
+		var wg sync.WaitGroup
+		var errOnce sync.Once
+		for range max(r.listingParallelNum, 1) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for prefix := range shards {
+					if err := listSource(ctx, source, prefix, "", pages); err != nil {
+						errOnce.Do(func() {
+							sendPage(ctx, pages, listedPage{Err: err})
+							cancel()
+						})
+						return
+					}
+				}
+			}()
+		}
+	feed:
+		for _, prefix := range prefixes {
+			select {
+			case shards <- prefix:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(shards)
+		wg.Wait()
+	}()
+
+	return pages
+}
+
+// ページを送る
+// 中断された場合はfalseを返す
+func sendPage(ctx context.Context, pages chan<- listedPage, page listedPage) bool {
+	select {
+	case pages <- page:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// バックアップ元のプレフィックス以下の全てのオブジェクト（startAfterを指定した場合はそのキーより後のもの）の一覧を取得し、S3の一覧と同じ形にして送る
+func listSource(ctx context.Context, source ObjectSource, prefix string, startAfter string, pages chan<- listedPage) (err error) {
+	ctx, span := tracer.Start(ctx, "listObjects", trace.WithAttributes(attribute.String("s3.prefix", prefix)))
+	defer func() { endSpan(span, err) }()
+
+	return source.List(ctx, prefix, startAfter, func(page []ObjectInfo) error {
+		contents := make([]types.Object, 0, len(page))
+		for _, info := range page {
+			contents = append(contents, types.Object{
+				Key:          aws.String(info.Key),
+				Size:         aws.Int64(info.Size),
+				LastModified: aws.Time(info.LastModified),
+				ETag:         aws.String(`"` + info.ETag + `"`),
+				StorageClass: types.ObjectStorageClass(info.StorageClass),
+			})
+		}
+		if !sendPage(ctx, pages, listedPage{Page: &s3.ListObjectsV2Output{Contents: contents}}) {
+			return ctx.Err()
+		}
+		return nil
+	})
+}
+
+// 区切り文字でLISTING_SHARD_DEPTHの深さまでプレフィックスを辿り、シャードとなるプレフィックスを返す
+// 途中の階層で見つかったオブジェクトはそのまま送る
+func (c *backupConfig) discoverPrefixes(ctx context.Context, s3Client *s3.Client, pages chan<- listedPage) ([]string, error) {
+	prefixes := []string{""}
+	for range c.listingShardDepth {
+		var nextPrefixes []string
+		for _, prefix := range prefixes {
+			objectPaginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+				Bucket:       aws.String(c.s3Config.Bucket),
+				Prefix:       aws.String(prefix),
+				Delimiter:    aws.String(c.listingDelimiter),
+				RequestPayer: c.s3RequestPayer(),
+			})
+			for objectPaginator.HasMorePages() {
+				page, err := objectPaginator.NextPage(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if len(page.Contents) > 0 {
+					if !sendPage(ctx, pages, listedPage{Page: &s3.ListObjectsV2Output{Contents: page.Contents}}) {
+						return nil, ctx.Err()
+					}
+				}
+				for _, commonPrefix := range page.CommonPrefixes {
+					nextPrefixes = append(nextPrefixes, aws.ToString(commonPrefix.Prefix))
+				}
+			}
+		}
+		prefixes = nextPrefixes
+	}
+	return prefixes, nil
+}
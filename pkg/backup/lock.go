@@ -0,0 +1,213 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+	"google.golang.org/api/googleapi"
+)
+
+// 実行中のロックとしてGCSバケットに置くオブジェクト名
+const runLockObjectName = backupformat.LockObjectName
+
+// ロックの期限（RFC 3339）を記録するメタデータのキー
+// バケットはバージョニングされているため、延長のたびに本体を書き込むと古い世代が増え続ける
+// メタデータの更新は世代を増やさないため、延長では期限のメタデータのみ更新する
+const metadataRunLockExpiresAt = backupformat.MetadataPrefix + "lock-expires-at"
+
+// ロックの内容
+type runLockInfo struct {
+	RunID      string    `json:"runId"`
+	Host       string    `json:"host"`
+	PID        int       `json:"pid"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// GCSバケットに置いた実行中のロック
+// 世代番号の前提条件を付けて書き込むため、同時に取得しようとしても1つだけが成功する
+type runLock struct {
+	run    *backupRun
+	object *storage.ObjectHandle
+	info   runLockInfo
+
+	mu         sync.Mutex
+	generation int64
+
+	stopRenew chan struct{}
+	renewDone chan struct{}
+	// 延長できずにロックを失った場合に呼ばれる
+	onLost func(error)
+}
+
+// ロックを取得する
+// 他の実行がロックを持っている場合はエラーを返す
+// 期限切れのロック（異常終了した実行のもの）は奪い取る
+// 取得したロックは期限の1/3ごとに延長し、延長できないまま期限が切れる場合や他の実行に奪われた場合はonLostを呼ぶ
+func (r *backupRun) acquireRunLock(ctx context.Context, bucket *storage.BucketHandle, onLost func(error)) (*runLock, error) {
+	host, _ := os.Hostname()
+	now := time.Now()
+	lock := &runLock{run: r,
+		object: bucket.Object(r.managedObjectName(runLockObjectName)),
+		info: runLockInfo{
+			RunID:      r.runID,
+			Host:       host,
+			PID:        os.Getpid(),
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(r.runLockTTL),
+		},
+		onLost: onLost,
+	}
+
+	generation, err := lock.write(ctx, storage.Conditions{DoesNotExist: true})
+	if isPreconditionFailed(err) {
+		// 既にロックがある場合は期限切れかどうかを確認する
+		var holder runLockInfo
+		var holderGeneration int64
+		holder, holderGeneration, err = readRunLock(ctx, lock.object)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read run lock: %w", err)
+		}
+		if now.Before(holder.ExpiresAt) {
+			return nil, fmt.Errorf("another backup is running (run ID: %v, host: %v, pid: %d, acquired at: %v, expires at: %v)",
+				holder.RunID, holder.Host, holder.PID, holder.AcquiredAt.Format("2006/01/02 15:04:05"), holder.ExpiresAt.Format("2006/01/02 15:04:05"))
+		}
+		r.logInfof("Taking over expired run lock (run ID: %v, host: %v, pid: %d)", holder.RunID, holder.Host, holder.PID)
+		generation, err = lock.write(ctx, storage.Conditions{GenerationMatch: holderGeneration})
+		if isPreconditionFailed(err) {
+			return nil, errors.New("another backup acquired the run lock at the same time")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire run lock: %w", err)
+	}
+	lock.generation = generation
+
+	lock.stopRenew = make(chan struct{})
+	lock.renewDone = make(chan struct{})
+	go lock.renewLoop()
+	return lock, nil
+}
+
+// ロックを書き込み、書き込んだ世代番号を返す
+func (l *runLock) write(ctx context.Context, conditions storage.Conditions) (int64, error) {
+	content, err := json.Marshal(l.info)
+	if err != nil {
+		return 0, err
+	}
+	writer := l.object.If(conditions).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	writer.Metadata = map[string]string{metadataRunLockExpiresAt: l.info.ExpiresAt.Format(time.RFC3339Nano)}
+	// 解放した後に古い世代として残るため、最低保存期間のないクラスにする
+	writer.StorageClass = l.run.temporaryStorageClass()
+	if _, err := writer.Write(content); err != nil {
+		writer.Close()
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	return writer.Attrs().Generation, nil
+}
+
+// 期限が切れないように一定間隔でロックを延長する
+// 一時的な失敗は次の延長で取り戻せるため、次の延長までに期限が切れる場合のみロックを失ったとする
+func (l *runLock) renewLoop() {
+	defer close(l.renewDone)
+	interval := max(l.run.runLockTTL/3, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := l.renew(context.Background())
+			if err == nil {
+				continue
+			}
+			if isPreconditionFailed(err) || !time.Now().Add(interval).Before(l.expiresAt()) {
+				l.run.logErrorf("Lost run lock: %v", err)
+				if l.onLost != nil {
+					l.onLost(fmt.Errorf("%w: %w", errRunLockLost, err))
+				}
+				return
+			}
+			l.run.logWarnf("Failed to renew run lock, retrying in %v: %v", interval, err)
+		case <-l.stopRenew:
+			return
+		}
+	}
+}
+
+// ロックの期限のメタデータを更新する
+// 自分が書き込んだ世代のままの場合のみ更新する
+func (l *runLock) renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expiresAt := time.Now().Add(l.run.runLockTTL)
+	_, err := l.object.If(storage.Conditions{GenerationMatch: l.generation}).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: map[string]string{metadataRunLockExpiresAt: expiresAt.Format(time.RFC3339Nano)},
+	})
+	if err != nil {
+		return err
+	}
+	l.info.ExpiresAt = expiresAt
+	return nil
+}
+
+// 最後に延長できたロックの期限
+func (l *runLock) expiresAt() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.info.ExpiresAt
+}
+
+// ロックを解放する
+// 自分が書き込んだ世代のままの場合のみ削除する
+func (l *runLock) Release() error {
+	close(l.stopRenew)
+	<-l.renewDone
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.object.If(storage.Conditions{GenerationMatch: l.generation}).Delete(context.Background())
+	if isPreconditionFailed(err) {
+		return errors.New("run lock was taken over by another backup")
+	}
+	return err
+}
+
+// ロックの内容と世代番号を読み込む
+// 延長した期限はメタデータにあるため、本体の期限より優先する
+func readRunLock(ctx context.Context, object *storage.ObjectHandle) (runLockInfo, int64, error) {
+	var info runLockInfo
+	reader, err := object.NewReader(ctx)
+	if err != nil {
+		return info, 0, err
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(&info); err != nil {
+		return info, 0, err
+	}
+	attrs, err := object.Generation(reader.Attrs.Generation).Attrs(ctx)
+	if err != nil {
+		return info, 0, err
+	}
+	if expiresAt, err := time.Parse(time.RFC3339Nano, attrs.Metadata[metadataRunLockExpiresAt]); err == nil {
+		info.ExpiresAt = expiresAt
+	}
+	return info, reader.Attrs.Generation, nil
+}
+
+// 前提条件を満たさなかったことによるエラーかどうか
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
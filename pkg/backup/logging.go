@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// ログの出力レベル
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+// このレベル以上のログのみ出力する（LOG_LEVEL、--verboseでdebug、--quietでwarn）
+var logLevel = logLevelInfo
+
+// --quietが指定された場合true（実行ごとの設定のquietModeの初期値にする）
+var quietFlag bool
+
+func parseLogLevel(value string) (int, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return logLevelDebug, nil
+	case "info":
+		return logLevelInfo, nil
+	case "warn", "warning":
+		return logLevelWarn, nil
+	case "error":
+		return logLevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %v", value)
+}
+
+// コマンドラインから--quietと--verboseを取り除いて反映する（サブコマンドの前後どちらにも書ける）
+func parseLogFlags() {
+	args := os.Args[:1]
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "--quiet", "-q":
+			quietFlag = true
+			logLevel = max(logLevel, logLevelWarn)
+		case "--verbose", "-v":
+			// スキップの判定とその理由も全て出力する
+			logLevel = logLevelDebug
+		default:
+			args = append(args, arg)
+		}
+	}
+	os.Args = args
+}
+
+func logDebugf(format string, v ...any) {
+	logAt(logLevelDebug, "Debug: ", format, v...)
+}
+
+func logInfof(format string, v ...any) {
+	logAt(logLevelInfo, "", format, v...)
+}
+
+func logWarnf(format string, v ...any) {
+	logAt(logLevelWarn, "Warning: ", format, v...)
+}
+
+func logErrorf(format string, v ...any) {
+	logAt(logLevelError, "Error: ", format, v...)
+}
+
+func logAt(level int, prefix string, format string, v ...any) {
+	if level < logLevel {
+		return
+	}
+	log.Printf(prefix+format, v...)
+}
+
+// 実行ごとのログ（各行の先頭に実行IDを付ける）
+func (r *backupRun) logDebugf(format string, v ...any) {
+	r.logAt(logLevelDebug, "Debug: ", format, v...)
+}
+
+func (r *backupRun) logInfof(format string, v ...any) {
+	r.logAt(logLevelInfo, "", format, v...)
+}
+
+func (r *backupRun) logWarnf(format string, v ...any) {
+	r.logAt(logLevelWarn, "Warning: ", format, v...)
+}
+
+func (r *backupRun) logErrorf(format string, v ...any) {
+	r.logAt(logLevelError, "Error: ", format, v...)
+}
+
+func (r *backupRun) logAt(level int, prefix string, format string, v ...any) {
+	if level < logLevel {
+		return
+	}
+	r.logger.Printf(prefix+format, v...)
+}
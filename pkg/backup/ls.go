@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// バックアップ先のGCSバケットのオブジェクトを、キーごとに全ての世代とともに順に処理する
+// generationsは古い順で、現在の世代がある場合は最後の要素（current=true）
+func (c *backupConfig) forEachBackupKey(ctx context.Context, gcsBucketClient *storage.BucketHandle, prefix string, fn func(key string, generations []*storage.ObjectAttrs, current bool)) error {
+	// プレフィックスはバックアップ先のプレフィックスからの相対
+	objects := gcsBucketClient.Objects(ctx, &storage.Query{Prefix: c.destinationPrefix() + prefix, Versions: true})
+	var key string
+	var generations []*storage.ObjectAttrs
+	flush := func() {
+		if len(generations) == 0 {
+			return
+		}
+		fn(key, generations, generations[len(generations)-1].Deleted.IsZero())
+		generations = nil
+	}
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			flush()
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to list backup objects: %w", err)
+		}
+		// 管理用のオブジェクトは、プレフィックスで明示した場合のみ含める
+		if c.isManagedObject(attrs.Name) && !strings.HasPrefix(prefix, managedObjectPrefix) {
+			continue
+		}
+		// 同じキーの世代は続けて、世代の古い順に返される
+		if attrs.Name != key {
+			flush()
+			key = attrs.Name
+		}
+		generations = append(generations, attrs)
+	}
+}
+
+// バックアップしたオブジェクトを、元のデータのサイズ、バックアップした日時、圧縮形式、世代数とともに一覧する
+// メタデータのみを読み、本体は読まない
+func (r *backupRun) runList(prefix string) error {
+	ctx := context.Background()
+	gcsClient, gcsBucketClient, _, err := r.openGCSBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer gcsClient.Close()
+
+	writer := tabwriter.NewWriter(r.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "KEY\tSIZE\tBACKED UP\tCOMPRESSION\tGENERATIONS")
+	var keys, generationCount int64
+	err = r.forEachBackupKey(ctx, gcsBucketClient, prefix, func(key string, generations []*storage.ObjectAttrs, current bool) {
+		keys++
+		generationCount += int64(len(generations))
+		latest := generations[len(generations)-1]
+		// エスケープしたオブジェクトは、元のキーを表示する
+		if originalKey, ok := originalKeyOf(latest.Metadata); ok {
+			key = strconv.Quote(r.destinationPrefix()+originalKey) + " (escaped)"
+		}
+		// S3から削除され、古い世代のみが残っているもの
+		if !current {
+			key += " (deleted)"
+		}
+		fmt.Fprintf(writer, "%v\t%d\t%v\t%v\t%d\n", key, backupObjectSize(latest), latest.Updated.Format(time.RFC3339), objectCompression(latest.Metadata), len(generations))
+	})
+	writer.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.stdout, "%d keys, %d generations\n", keys, generationCount)
+	return nil
+}
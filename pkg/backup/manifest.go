@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+// メタデータのみのバックアップのマニフェストを置くGCSバケット内のプレフィックス
+// <プレフィックス><実行ID>.jsonlに1行1オブジェクトで記録する
+const manifestObjectPrefix = backupformat.ManifestPrefix
+
+// マニフェストに記録する1オブジェクトのメタデータ
+type manifestEntry struct {
+	Key                string            `json:"key"`
+	Size               int64             `json:"size"`
+	ETag               string            `json:"etag"`
+	LastModified       time.Time         `json:"lastModified"`
+	StorageClass       string            `json:"storageClass,omitempty"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ContentLanguage    string            `json:"contentLanguage,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Tags               map[string]string `json:"tags,omitempty"`
+}
+
+// オブジェクトのメタデータをJSON LinesのマニフェストとしてGCSにアップロードする
+type manifestWriter struct {
+	config *backupConfig
+	name   string
+	// アップロードを中止する
+	cancel context.CancelFunc
+
+	mu             sync.Mutex
+	writer         *storage.Writer
+	compressWriter io.WriteCloser
+	encoder        *json.Encoder
+	// 書き込みに失敗した場合、以降のオブジェクトは記録しない
+	err error
+}
+
+// 今回の実行のマニフェストの書き込みを始める
+// ワーカーのコンテキストは全てのワーカーが終わるとキャンセルされるため、実行全体のコンテキストを渡す
+func (r *backupRun) newManifestWriter(ctx context.Context, bucket *storage.BucketHandle) (*manifestWriter, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	name := r.managedObjectName(manifestObjectPrefix + r.runID + ".jsonl")
+	writer := bucket.Object(name).NewWriter(ctx)
+	writer.ContentType = "application/x-ndjson"
+	writer.Metadata = map[string]string{metadataCompression: r.compression}
+	compressWriter, err := r.newCompressWriter(writer, r.compression)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &manifestWriter{config: r.backupConfig,
+		name:           name,
+		cancel:         cancel,
+		writer:         writer,
+		compressWriter: compressWriter,
+		encoder:        json.NewEncoder(compressWriter),
+	}, nil
+}
+
+// オブジェクトのメタデータとタグを取得してマニフェストに加える
+func (m *manifestWriter) Add(ctx context.Context, s3Client *s3.Client, object types.Object) error {
+	key := aws.ToString(object.Key)
+	headOutput, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(m.config.s3Config.Bucket),
+		Key:          aws.String(key),
+		RequestPayer: m.config.s3RequestPayer(),
+	})
+	if err != nil {
+		return err
+	}
+	taggingOutput, err := s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:       aws.String(m.config.s3Config.Bucket),
+		Key:          aws.String(key),
+		RequestPayer: m.config.s3RequestPayer(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get tags: %w", err)
+	}
+
+	entry := manifestEntry{
+		Key:                key,
+		Size:               aws.ToInt64(headOutput.ContentLength),
+		ETag:               aws.ToString(headOutput.ETag),
+		LastModified:       aws.ToTime(headOutput.LastModified),
+		StorageClass:       string(headOutput.StorageClass),
+		ContentType:        aws.ToString(headOutput.ContentType),
+		ContentEncoding:    aws.ToString(headOutput.ContentEncoding),
+		ContentDisposition: aws.ToString(headOutput.ContentDisposition),
+		ContentLanguage:    aws.ToString(headOutput.ContentLanguage),
+		CacheControl:       aws.ToString(headOutput.CacheControl),
+		Metadata:           headOutput.Metadata,
+	}
+	if len(taggingOutput.TagSet) > 0 {
+		entry.Tags = make(map[string]string, len(taggingOutput.TagSet))
+		for _, tag := range taggingOutput.TagSet {
+			entry.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return fmt.Errorf("manifest %v is broken: %w", m.name, m.err)
+	}
+	if err := m.encoder.Encode(entry); err != nil {
+		m.err = err
+		return err
+	}
+	return nil
+}
+
+// マニフェストのアップロードを完了する
+func (m *manifestWriter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.cancel()
+	if m.err != nil {
+		return fmt.Errorf("manifest %v is broken: %w", m.name, m.err)
+	}
+	if err := m.compressWriter.Close(); err != nil {
+		return err
+	}
+	if err := m.writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload manifest %v: %w", m.name, err)
+	}
+	return nil
+}
+
+// 中断した場合に、途中までのマニフェストを残さないようアップロードを中止する
+func (m *manifestWriter) Abort() {
+	m.cancel()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compressWriter.Close()
+	m.writer.Close()
+}
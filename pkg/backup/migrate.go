@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+// バックアップツールが管理用に置くオブジェクト（ロック、実行結果）の接頭辞
+const managedObjectPrefix = backupformat.ManagedPrefix
+
+// バックアップ先のオブジェクトが管理用のオブジェクト（.s3-backup-helper/の下と、ロック）か
+func (c *backupConfig) isManagedObject(name string) bool {
+	relative, ok := strings.CutPrefix(name, c.destinationPrefix())
+	return ok && backupformat.IsManagedObject(relative)
+}
+
+// バックアップ先のGCSバケットの全てのオブジェクトを、COMPRESSIONで指定された形式で圧縮し直す
+// 圧縮形式を切り替えても古い形式のオブジェクトが残らないようにするため
+// バケットはバージョニングされているため、元の形式の世代は古い世代として残る
+// ロックに記録するため、実行IDを付けた実行から呼ぶ
+func (r *backupRun) runMigrate() error {
+	ctx := context.Background()
+	gcsClient, gcsBucketClient, gcsBucketName, err := r.openGCSBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer gcsClient.Close()
+
+	// バックアップと同時に書き換えないようにロックを取り、ロックを失った場合は残りを中断する
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	lock, err := r.acquireRunLock(ctx, gcsBucketClient, cancel)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(r.stdout, "Migrating objects in %v to %v\n", gcsBucketName, r.compression)
+
+	var migratedObjects, skippedObjects, totalErrors atomic.Int64
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(int(r.palalellNum))
+
+	objects := gcsBucketClient.Objects(ctx, nil)
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			r.logErrorf("Failed to list objects: %v", err)
+			totalErrors.Add(1)
+			break
+		}
+		// 重複排除した本体は圧縮し直すが、それ以外の管理用のオブジェクトは対象外
+		if r.isManagedObject(attrs.Name) && !strings.HasPrefix(attrs.Name, r.managedObjectName(blobObjectPrefix)) {
+			continue
+		}
+		// 重複排除したキーのオブジェクトは本体を持たない
+		if _, ok := attrs.Metadata[metadataContentSHA256]; ok {
+			continue
+		}
+		// 既に指定された形式の場合は何もしない（GCS_TRANSCODINGの有無だけが異なる場合は付け直す）
+		transcoding := r.gcsContentEncodingOf(ObjectInfo{ContentEncoding: sourceContentEncoding(attrs), Metadata: map[string]string{metadataCompression: r.compression}}) != ""
+		if objectCompression(attrs.Metadata) == r.compression && (attrs.Metadata[metadataGCSTranscoding] == "true") == transcoding {
+			skippedObjects.Add(1)
+			continue
+		}
+
+		group.Go(func() error {
+			if err := r.migrateObject(groupCtx, gcsBucketClient, attrs); err != nil {
+				r.logErrorf("Failed to migrate object %v: %v", attrs.Name, err)
+				totalErrors.Add(1)
+				return nil
+			}
+			migratedObjects.Add(1)
+			fmt.Fprintf(r.stdout, " - %v (%v -> %v)\n", attrs.Name, objectCompression(attrs.Metadata), r.compression)
+			return nil
+		})
+	}
+	group.Wait()
+
+	if err := lock.Release(); err != nil {
+		r.logErrorf("Failed to release run lock: %v", err)
+	}
+
+	fmt.Fprintf(r.stdout, "Migrate completed: %d migrated, %d already %v, %d errors\n", migratedObjects.Load(), skippedObjects.Load(), r.compression, totalErrors.Load())
+	if totalErrors.Load() > 0 {
+		return fmt.Errorf("%w: %d objects could not be migrated", errObjectsFailed, totalErrors.Load())
+	}
+	return nil
+}
+
+// 1つのオブジェクトを解凍し、COMPRESSIONの形式で圧縮し直して書き込む
+// メタデータは引き継ぎ、読み込んだ世代が最新のままの場合のみ書き込む
+func (c *backupConfig) migrateObject(ctx context.Context, gcsBucketClient *storage.BucketHandle, attrs *storage.ObjectAttrs) error {
+	object := gcsBucketClient.Object(attrs.Name)
+	// 途中で失敗した場合は書き込みを中止する
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	reader, err := object.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decompressReader, err := newDecompressReader(reader, objectCompression(attrs.Metadata))
+	if err != nil {
+		return err
+	}
+	defer decompressReader.Close()
+
+	writer := object.If(storage.Conditions{GenerationMatch: attrs.Generation}).NewWriter(ctx)
+	writer.ContentType = attrs.ContentType
+	writer.ContentDisposition = attrs.ContentDisposition
+	writer.ContentLanguage = attrs.ContentLanguage
+	writer.CacheControl = attrs.CacheControl
+	writer.Metadata = make(map[string]string, len(attrs.Metadata)+1)
+	for metaKey, value := range attrs.Metadata {
+		writer.Metadata[metaKey] = value
+	}
+	writer.Metadata[metadataCompression] = c.compression
+	// 古いバックアップでGCSのContent-Encodingに付けていた元のContent-Encodingは、メタデータに移す
+	contentEncoding := sourceContentEncoding(attrs)
+	if contentEncoding != "" {
+		writer.Metadata[metadataSourceContentEncoding] = contentEncoding
+	}
+	// 解凍トランスコーディングの設定は、圧縮し直す形式に合わせて付け直す
+	delete(writer.Metadata, metadataGCSTranscoding)
+	writer.ContentEncoding = c.gcsContentEncodingOf(ObjectInfo{ContentEncoding: contentEncoding, Metadata: writer.Metadata})
+	if writer.ContentEncoding != "" {
+		writer.Metadata[metadataGCSTranscoding] = "true"
+	}
+
+	compressWriter, err := c.newCompressWriter(writer, c.compression)
+	if err != nil {
+		return err
+	}
+	originalHash := md5.New()
+	originalCRC32C := crc32.New(crc32cTable)
+	originalSize, err := pooledCopy(compressWriter, io.TeeReader(decompressReader, io.MultiWriter(originalHash, originalCRC32C)))
+	if err != nil {
+		return err
+	}
+	if err := compressWriter.Close(); err != nil {
+		return err
+	}
+
+	// 元のデータのMD5が記録されている場合は、書き込みを確定する前に一致を確認する
+	if recorded, ok := attrs.Metadata[metadataOriginalMD5]; ok {
+		if expected, err := hex.DecodeString(recorded); err != nil || !bytes.Equal(expected, originalHash.Sum(nil)) {
+			return fmt.Errorf("original MD5 mismatch: recorded %v, got %x", recorded, originalHash.Sum(nil))
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	// 元のデータのハッシュとサイズが記録されていない古いバックアップの場合は追加する
+	_, hasMD5 := attrs.Metadata[metadataOriginalMD5]
+	_, hasCRC32C := attrs.Metadata[metadataOriginalCRC32C]
+	if !hasMD5 || !hasCRC32C {
+		return recordOriginalHash(ctx, c.newGCSDestination(gcsBucketClient), attrs.Name, gcsObjectInfo(writer.Attrs()), originalHash.Sum(nil), originalCRC32C.Sum32(), originalSize)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// 通知先の種類
+const (
+	// traQのWebhook（WEBHOOK_URL、WEBHOOK_ID、WEBHOOK_SECRETと同じ形式）
+	notifierTypeTraQ = "traq"
+	// SlackのIncoming Webhook
+	notifierTypeSlack = "slack"
+	// 通知文と実行結果のJSONをPOSTする
+	notifierTypeJSON = "json"
+)
+
+// 通知する実行結果の条件
+const (
+	// 通知する全ての実行（NOTIFY_ONLY_ON_ISSUESなどで絞り込んだ後）
+	notifyOnAll = "all"
+	// エラーがあった、または中断した実行
+	notifyOnErrors = "errors"
+	// 中断した実行
+	notifyOnAborted = "aborted"
+)
+
+// 追加の通知先（NOTIFIERSまたはNOTIFIERS_FILEのJSONの配列で指定する）
+type notifierConfig struct {
+	Type string `json:"type"`
+	// 表示用の名前（ログに出力する）
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	On     string `json:"on"`
+}
+
+// NOTIFIERSのJSONを読み込む
+// URLとシークレットにはシークレットの参照（gcp-secret://、vault://）を指定できる
+func (c *backupConfig) parseNotifiers(ctx context.Context, value string) ([]notifierConfig, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var configs []notifierConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, err
+	}
+	for i := range configs {
+		config := &configs[i]
+		switch config.Type {
+		case notifierTypeTraQ, notifierTypeSlack, notifierTypeJSON:
+		default:
+			return nil, fmt.Errorf("unknown notifier type: %v", config.Type)
+		}
+		switch config.On {
+		case "":
+			config.On = notifyOnAll
+		case notifyOnAll, notifyOnErrors, notifyOnAborted:
+		default:
+			return nil, fmt.Errorf("unknown notifier condition: %v", config.On)
+		}
+		if config.URL == "" {
+			return nil, fmt.Errorf("notifier %d has no url", i)
+		}
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("%v#%d", config.Type, i)
+		}
+		var err error
+		if config.URL, err = c.resolveSecret(ctx, config.URL); err != nil {
+			return nil, fmt.Errorf("failed to resolve url of %v: %w", config.Name, err)
+		}
+		if config.Secret, err = c.resolveSecret(ctx, config.Secret); err != nil {
+			return nil, fmt.Errorf("failed to resolve secret of %v: %w", config.Name, err)
+		}
+	}
+	return configs, nil
+}
+
+// 実行結果がこの通知先の条件に当てはまるか
+func (n notifierConfig) matches(summary *backupSummary) bool {
+	switch n.On {
+	case notifyOnErrors:
+		return summary.Errors > 0 || summary.AbortReason != ""
+	case notifyOnAborted:
+		return summary.AbortReason != ""
+	}
+	return true
+}
+
+// 通知先に送る
+func (r *backupRun) sendNotifier(n notifierConfig, summary *backupSummary, message string) error {
+	switch n.Type {
+	case notifierTypeTraQ:
+		return r.postWebhook(message, n.URL, n.ID, n.Secret)
+	case notifierTypeSlack:
+		return r.postJSONWebhook(n.URL, n.Name, map[string]any{"text": message})
+	case notifierTypeJSON:
+		return r.postJSONWebhook(n.URL, n.Name, map[string]any{"text": message, "summary": summary})
+	}
+	return fmt.Errorf("unknown notifier type: %v", n.Type)
+}
+
+// JSONをPOSTする（traQへの通知と同じく、再送できる失敗の場合は再送する）
+func (r *backupRun) postJSONWebhook(url string, name string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return r.retryWebhook(func() (bool, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return r.sendWebhookRequest(req, name)
+	})
+}
+
+// 条件に当てはまる全ての通知先に送り、1つも送れなかった場合はエラーを返す
+// 送り先がない場合はnilを返す
+func (r *backupRun) notifyAll(summary *backupSummary, message string) error {
+	var sent int
+	var errs []string
+	if r.webhookUrl != "" {
+		if err := r.postWebhook(message, r.webhookUrl, r.webhookId, r.webhookSecret); err != nil {
+			r.logErrorf("Failed to send webhook to traQ: %v", err)
+			errs = append(errs, "traQ: "+err.Error())
+		} else {
+			sent++
+		}
+	}
+	for _, notifier := range r.notifiers {
+		if !notifier.matches(summary) {
+			continue
+		}
+		if err := r.sendNotifier(notifier, summary, message); err != nil {
+			r.logErrorf("Failed to send notification to %v: %v", notifier.Name, err)
+			errs = append(errs, notifier.Name+": "+err.Error())
+		} else {
+			sent++
+		}
+	}
+	if sent == 0 && len(errs) > 0 {
+		return fmt.Errorf("all notifications failed: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
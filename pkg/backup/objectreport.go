@@ -0,0 +1,97 @@
+package backup
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// オブジェクトごとの処理結果
+type objectRecord struct {
+	Key             string  `json:"key"`
+	Action          string  `json:"action"`
+	Bytes           int64   `json:"bytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// 処理結果の種類
+const (
+	objectActionUploaded = "uploaded"
+	objectActionExported = "exported"
+	objectActionSkipped  = "skipped"
+	objectActionRecorded = "recorded"
+	objectActionArchived = "archived"
+	objectActionError    = "error"
+)
+
+// オブジェクトごとの処理結果をCSVまたはJSON Linesで書き出す
+type objectReporter struct {
+	mu        sync.Mutex
+	file      *os.File
+	csvWriter *csv.Writer
+	encoder   *json.Encoder
+}
+
+// レポートのファイルを作成する
+// パスが.csvで終わる場合はCSV、それ以外はJSON Linesで書き出す
+func newObjectReporter(reportPath string) (*objectReporter, error) {
+	file, err := os.Create(reportPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(reportPath, ".csv") {
+		return &objectReporter{file: file, encoder: json.NewEncoder(file)}, nil
+	}
+
+	csvWriter := csv.NewWriter(file)
+	if err := csvWriter.Write([]string{"key", "action", "bytes", "duration_seconds", "error"}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &objectReporter{file: file, csvWriter: csvWriter}, nil
+}
+
+// 1オブジェクトの処理結果を書き出す
+func (r *objectReporter) Record(key string, action string, size int64, duration time.Duration, err error) error {
+	record := objectRecord{
+		Key:             key,
+		Action:          action,
+		Bytes:           size,
+		DurationSeconds: duration.Seconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.encoder != nil {
+		return r.encoder.Encode(record)
+	}
+	return r.csvWriter.Write([]string{
+		record.Key,
+		record.Action,
+		strconv.FormatInt(record.Bytes, 10),
+		strconv.FormatFloat(record.DurationSeconds, 'f', 3, 64),
+		record.Error,
+	})
+}
+
+func (r *objectReporter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.csvWriter != nil {
+		r.csvWriter.Flush()
+		if err := r.csvWriter.Error(); err != nil {
+			r.file.Close()
+			return err
+		}
+	}
+	return r.file.Close()
+}
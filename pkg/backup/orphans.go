@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"google.golang.org/api/iterator"
+)
+
+// S3バケットの全てのオブジェクトを、バックアップ先のオブジェクト名（KEY_PREFIX_MAPとエスケープを適用したもの）ごとに取得する
+func (r *backupRun) listSourceObjects(ctx context.Context, s3Client *s3.Client) (map[string]types.Object, error) {
+	objects := make(map[string]types.Object)
+	for listed := range r.listObjectPages(ctx, r.newS3Source(s3Client), s3Client, "") {
+		if listed.Err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", listed.Err)
+		}
+		for _, object := range listed.Page.Contents {
+			objects[r.backupObjectName(aws.ToString(object.Key))] = object
+		}
+	}
+	return objects, nil
+}
+
+// バックアップ先のGCSバケット（プレフィックスがある場合はその下）の、バックアップしたオブジェクト（管理用のオブジェクトを除く）を順に処理する
+func (c *backupConfig) forEachBackupObject(ctx context.Context, gcsBucketClient *storage.BucketHandle, fn func(attrs *storage.ObjectAttrs)) error {
+	objects := gcsBucketClient.Objects(ctx, &storage.Query{Prefix: c.destinationPrefix()})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to list backup objects: %w", err)
+		}
+		if c.isManagedObject(attrs.Name) {
+			continue
+		}
+		fn(attrs)
+	}
+}
+
+// バックアップしたオブジェクトの元のデータのサイズ（記録されていない古いバックアップは圧縮後のサイズ）
+func backupObjectSize(attrs *storage.ObjectAttrs) int64 {
+	if size, err := strconv.ParseInt(attrs.Metadata[metadataOriginalSize], 10, 64); err == nil {
+		return size
+	}
+	return attrs.Size
+}
+
+// GCSにのみ残っていて、S3にキーが存在しないオブジェクトの一覧を出力する
+// バックアップからしか復元できないオブジェクトを、残すか削除するか判断するため
+func (r *backupRun) runOrphanReport() error {
+	ctx := context.Background()
+	s3Client, err := r.newS3Client()
+	if err != nil {
+		return err
+	}
+	gcsClient, gcsBucketClient, gcsBucketName, err := r.openGCSBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer gcsClient.Close()
+
+	sourceObjects, err := r.listSourceObjects(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(r.stdout, "Objects in %v that no longer exist in %v:\n", gcsBucketName, r.s3Config.Bucket)
+	writer := tabwriter.NewWriter(r.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "KEY\tSIZE\tLAST BACKUP\tAGE (DAYS)")
+	var orphanObjects, orphanBytes int64
+	err = r.forEachBackupObject(ctx, gcsBucketClient, func(attrs *storage.ObjectAttrs) {
+		if _, ok := sourceObjects[attrs.Name]; ok {
+			return
+		}
+		orphanObjects++
+		orphanBytes += backupObjectSize(attrs)
+		// 最後にバックアップしてからの経過日数（S3から削除されてからの日数の目安）
+		age := time.Since(attrs.Updated)
+		fmt.Fprintf(writer, "%v\t%d\t%v\t%d\n", attrs.Name, backupObjectSize(attrs), attrs.Updated.Format(time.RFC3339), int(age.Hours()/24))
+	})
+	writer.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.stdout, "%d orphan objects, %d bytes\n", orphanObjects, orphanBytes)
+	return nil
+}
@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"google.golang.org/api/googleapi"
+)
+
+// 権限の不足によるエラーを、どのリソースにどの権限が足りないかの説明にする
+// SDKのエラーをそのまま出しても、IAMやバケットポリシーのどこを直せばよいか分かりにくいため
+
+// S3の操作ごとに必要なIAMのアクション
+var s3OperationActions = map[string]string{
+	"ListBuckets":                     "s3:ListAllMyBuckets",
+	"ListObjectsV2":                   "s3:ListBucket",
+	"HeadObject":                      "s3:GetObject",
+	"GetObject":                       "s3:GetObject",
+	"GetObjectTagging":                "s3:GetObjectTagging",
+	"RestoreObject":                   "s3:RestoreObject",
+	"DeleteObject":                    "s3:DeleteObject",
+	"GetBucketPolicy":                 "s3:GetBucketPolicy",
+	"GetBucketCors":                   "s3:GetBucketCORS",
+	"GetBucketLifecycleConfiguration": "s3:GetLifecycleConfiguration",
+	"GetBucketVersioning":             "s3:GetBucketVersioning",
+	"ListObjectVersions":              "s3:ListBucketVersions",
+}
+
+// オブジェクトではなくバケットに対する操作
+var s3BucketOperations = map[string]bool{
+	"ListObjectsV2":                   true,
+	"GetBucketPolicy":                 true,
+	"GetBucketCors":                   true,
+	"GetBucketLifecycleConfiguration": true,
+	"GetBucketVersioning":             true,
+	"ListObjectVersions":              true,
+}
+
+// AWSのエラーメッセージに含まれる、拒否されたアクションとリソース（KMSの鍵など、S3以外のものも含む）
+var awsDeniedActionPattern = regexp.MustCompile(`not authorized to perform: (\S+) on resource: "?([^"\s]+)"?`)
+
+// GCSのエラーメッセージに含まれる、足りない権限と主体
+var (
+	gcsPermissionPattern = regexp.MustCompile(`storage\.[a-zA-Z]+\.[a-zA-Z]+`)
+	gcsPrincipalPattern  = regexp.MustCompile(`(\S+) does not have`)
+)
+
+// GCSの権限ごとに、それを含む最小のロール
+var gcsPermissionRoles = map[string]string{
+	"storage.objects.get":    "roles/storage.objectViewer",
+	"storage.objects.list":   "roles/storage.objectViewer",
+	"storage.objects.create": "roles/storage.objectCreator",
+	"storage.objects.delete": "roles/storage.objectUser",
+	"storage.objects.update": "roles/storage.objectUser",
+	"storage.buckets.create": "roles/storage.admin",
+	"storage.buckets.get":    "roles/storage.admin",
+	"storage.buckets.update": "roles/storage.admin",
+}
+
+// 権限の不足や認証情報の誤りによるエラーの場合に、直し方の説明を返す（それ以外は空）
+func (c *backupConfig) permissionHint(err error) string {
+	if err == nil {
+		return ""
+	}
+	if hint := c.s3PermissionHint(err); hint != "" {
+		return hint
+	}
+	return c.gcsPermissionHint(err)
+}
+
+// エラーをログや通知に出す形にする
+// 権限の不足などの場合は、直し方の説明の後に元のエラーを付ける
+func (c *backupConfig) describeError(err error) string {
+	if hint := c.permissionHint(err); hint != "" {
+		return fmt.Sprintf("%v (%v)", hint, err)
+	}
+	return err.Error()
+}
+
+func (c *backupConfig) s3PermissionHint(err error) string {
+	var opErr *smithy.OperationError
+	if !errors.As(err, &opErr) || opErr.Service() != "S3" {
+		return ""
+	}
+	var code, message string
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code, message = apiErr.ErrorCode(), apiErr.ErrorMessage()
+	}
+	switch code {
+	case "InvalidAccessKeyId":
+		return "S3 does not recognize S3_ACCESS_KEY; check the access key and S3_ENDPOINT"
+	case "SignatureDoesNotMatch":
+		return "S3_SECRET_KEY does not match S3_ACCESS_KEY; check the secret key"
+	case "ExpiredToken", "InvalidToken":
+		return "S3_SESSION_TOKEN is expired or invalid; renew the temporary credentials"
+	}
+	statusCode := 0
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) {
+		statusCode = responseErr.HTTPStatusCode()
+	}
+	if code != "AccessDenied" && statusCode != http.StatusForbidden {
+		return ""
+	}
+
+	operation := opErr.Operation()
+	action, resource := s3OperationActions[operation], c.s3ResourceOf(operation)
+	if action == "" {
+		action = "s3:" + operation
+	}
+	if match := awsDeniedActionPattern.FindStringSubmatch(message); match != nil {
+		action, resource = match[1], match[2]
+	}
+	if strings.Contains(message, "explicit deny") {
+		return fmt.Sprintf("S3 %v was denied by an explicit Deny in a bucket policy, IAM policy or SCP; remove the Deny of %v on %v for %v", operation, action, resource, c.s3Principal())
+	}
+	hint := fmt.Sprintf("S3 %v was denied; grant %v on %v to %v", operation, action, resource, c.s3Principal())
+	// ListBucketが無い場合、存在しないオブジェクトにも404ではなく403が返る
+	if operation == "HeadObject" || operation == "GetObject" {
+		hint += " (a missing object also returns 403 without s3:ListBucket)"
+	}
+	return hint
+}
+
+// S3の操作の対象のリソース（ARN）
+func (c *backupConfig) s3ResourceOf(operation string) string {
+	switch {
+	case operation == "ListBuckets":
+		return "*"
+	case s3BucketOperations[operation]:
+		return "arn:aws:s3:::" + c.s3Config.Bucket
+	}
+	return "arn:aws:s3:::" + c.s3Config.Bucket + "/*"
+}
+
+// S3へのリクエストに使った主体
+func (c *backupConfig) s3Principal() string {
+	if c.s3Config.RoleARN != "" {
+		return "S3_ROLE_ARN " + c.s3Config.RoleARN
+	}
+	if c.s3Config.AccessKey != "" {
+		return "S3_ACCESS_KEY " + c.s3Config.AccessKey
+	}
+	return "the S3 credentials"
+}
+
+func (c *backupConfig) gcsPermissionHint(err error) string {
+	var googleErr *googleapi.Error
+	if !errors.As(err, &googleErr) {
+		return ""
+	}
+	bucket, _ := c.gcsDestinationOf(c.s3Config.Bucket)
+	message := googleErr.Message
+	switch {
+	case googleErr.Code == http.StatusUnauthorized:
+		return "GCS rejected the credentials; check GOOGLE_CREDENTIALS_JSON or GOOGLE_APPLICATION_CREDENTIALS"
+	case strings.Contains(strings.ToLower(message), "requester pays"):
+		return fmt.Sprintf("gs://%v is a Requester Pays bucket; set GCS_USER_PROJECT to the project to bill", bucket)
+	case googleErr.Code != http.StatusForbidden:
+		return ""
+	case strings.Contains(message, "cannot be deleted"):
+		// 権限ではなく、保持ポリシーや保持の設定で削除・上書きが拒否された
+		return fmt.Sprintf("the object in gs://%v is protected by a retention policy or hold and cannot be overwritten or deleted yet", bucket)
+	}
+
+	principal := c.gcsServiceAccount()
+	if match := gcsPrincipalPattern.FindStringSubmatch(message); match != nil {
+		principal = match[1]
+	}
+	if principal == "" {
+		principal = "the GCS service account"
+	}
+	permission := gcsPermissionPattern.FindString(message)
+	if permission == "" {
+		return fmt.Sprintf("GCS denied access to gs://%v for %v; grant roles/storage.objectAdmin on the bucket", bucket, principal)
+	}
+	role, ok := gcsPermissionRoles[permission]
+	if !ok {
+		role = "a role with " + permission
+	}
+	// バケットの作成はプロジェクトに対する権限
+	if permission == "storage.buckets.create" {
+		return fmt.Sprintf("%v lacks %v on project %v; grant %v", principal, permission, c.gcpConfig.ProjectID, role)
+	}
+	return fmt.Sprintf("%v lacks %v on gs://%v; grant %v on the bucket", principal, permission, bucket, role)
+}
@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"google.golang.org/api/googleapi"
+)
+
+func TestPermissionHint(t *testing.T) {
+	c := newBackupConfig()
+	c.s3Config.Bucket, c.s3Config.AccessKey = "traq", "AKIAEXAMPLE"
+	c.gcpConfig.Bucket = "backups"
+
+	s3Error := func(operation, code, message string) error {
+		return fmt.Errorf("failed to get object: %w", &smithy.OperationError{
+			ServiceID:     "S3",
+			OperationName: operation,
+			Err:           &smithy.GenericAPIError{Code: code, Message: message},
+		})
+	}
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{"s3 object", s3Error("GetObject", "AccessDenied", "Access Denied"), []string{"grant s3:GetObject on arn:aws:s3:::traq/*", "AKIAEXAMPLE"}},
+		{"s3 list", s3Error("ListObjectsV2", "AccessDenied", "Access Denied"), []string{"grant s3:ListBucket on arn:aws:s3:::traq "}},
+		{"s3 explicit deny", s3Error("GetBucketPolicy", "AccessDenied", "User: arn:aws:iam::123:user/backup is not authorized to perform: s3:GetBucketPolicy on resource: \"arn:aws:s3:::traq\" with an explicit deny in a resource-based policy"), []string{"explicit Deny", "s3:GetBucketPolicy on arn:aws:s3:::traq "}},
+		{"kms", s3Error("GetObject", "AccessDenied", "User: arn:aws:iam::123:user/backup is not authorized to perform: kms:Decrypt on resource: arn:aws:kms:ap-northeast-1:123:key/abc because no identity-based policy allows the kms:Decrypt action"), []string{"grant kms:Decrypt on arn:aws:kms:ap-northeast-1:123:key/abc"}},
+		{"s3 credentials", s3Error("ListObjectsV2", "SignatureDoesNotMatch", ""), []string{"S3_SECRET_KEY"}},
+		{"gcs", &googleapi.Error{Code: 403, Message: "backup@project.iam.gserviceaccount.com does not have storage.objects.create access to the Google Cloud Storage object. Permission 'storage.objects.create' denied on resource (or it may not exist)."}, []string{"backup@project.iam.gserviceaccount.com lacks storage.objects.create on gs://backups", "roles/storage.objectCreator"}},
+		{"gcs retention", &googleapi.Error{Code: 403, Message: "Object 'backups/a' is subject to bucket's retention policy or object retention and cannot be deleted or overwritten until 2024-01-01"}, []string{"retention policy"}},
+	}
+	for _, tt := range tests {
+		hint := c.permissionHint(tt.err)
+		for _, want := range tt.want {
+			if !strings.Contains(hint+" ", want) {
+				t.Errorf("%v: permissionHint() = %q, want to contain %q", tt.name, hint, want)
+			}
+		}
+	}
+
+	// 権限以外のエラーには説明を付けない
+	for _, err := range []error{s3Error("GetObject", "NoSuchKey", ""), &googleapi.Error{Code: 500}, fmt.Errorf("connection reset")} {
+		if hint := c.permissionHint(err); hint != "" {
+			t.Errorf("permissionHint(%v) = %q, want empty", err, hint)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/mattn/go-isatty"
+)
+
+// バイト数で進捗を表示し、完了したオブジェクト数も併せて表示する
+const progressBarTemplate pb.ProgressBarTemplate = `{{string . "objects"}} {{counters . }} {{bar . }} {{percent . }} {{speed . "%s/s" "? MiB/s"}} {{rtime . "ETA %s"}}`
+
+// バケット全体のバックアップの進捗
+type backupProgress struct {
+	run *backupRun
+
+	// 標準出力が端末でない場合はnil
+	bar *pb.ProgressBar
+
+	startTime time.Time
+	// 事前に数えない場合は、一覧の取得に合わせて増える
+	totalObjects     atomic.Int64
+	totalBytes       atomic.Int64
+	completedObjects atomic.Int64
+	completedBytes   atomic.Int64
+	errorObjects     atomic.Int64
+
+	// 進捗ログの停止用
+	stopLog chan struct{}
+	logDone chan struct{}
+}
+
+// 事前に数えたオブジェクト数とバイト数から進捗表示を開始する
+// 標準出力が端末でない場合（CronJobのログなど）は、プログレスバーの代わりに一定間隔で1行ずつ進捗を出力する
+func (r *backupRun) newBackupProgress(totalObjects int64, totalBytes int64) *backupProgress {
+	progress := &backupProgress{run: r, startTime: time.Now()}
+	progress.totalObjects.Store(totalObjects)
+	progress.totalBytes.Store(totalBytes)
+
+	// --quietの場合は進捗を出力しない
+	if r.quietMode {
+		return progress
+	}
+
+	// SOURCESの各行に名前を付けた出力なども、端末でないものとして扱う
+	stdout, ok := r.stdout.(*os.File)
+	if !ok || !isatty.IsTerminal(stdout.Fd()) && !isatty.IsCygwinTerminal(stdout.Fd()) {
+		progress.stopLog = make(chan struct{})
+		progress.logDone = make(chan struct{})
+		go progress.logLoop(r.progressLogInterval)
+		return progress
+	}
+
+	progress.bar = pb.New64(totalBytes)
+	progress.bar.Set(pb.Bytes, true)
+	progress.bar.SetTemplate(progressBarTemplate)
+	progress.updateObjects(0)
+	progress.bar.Start()
+	return progress
+}
+
+// オブジェクトの転送（またはスキップ、エラー）が完了したときに呼ぶ
+func (p *backupProgress) Done(size int64, err error) {
+	completed := p.completedObjects.Add(1)
+	p.completedBytes.Add(size)
+	if err != nil {
+		p.errorObjects.Add(1)
+	}
+	if p.bar != nil {
+		p.updateObjects(completed)
+		p.bar.Add64(size)
+	}
+	p.notify()
+}
+
+// 一覧の取得で見つかったオブジェクトを合計に加える（事前に数えない場合）
+func (p *backupProgress) AddTotal(objects int64, bytes int64) {
+	p.totalObjects.Add(objects)
+	total := p.totalBytes.Add(bytes)
+	if p.bar != nil {
+		p.bar.SetTotal(total)
+	}
+	p.notify()
+}
+
+func (p *backupProgress) updateObjects(completed int64) {
+	p.bar.Set("objects", fmt.Sprintf("%d/%d objects", completed, p.totalObjects.Load()))
+}
+
+// 一定間隔で進捗を1行出力する
+func (p *backupProgress) logLoop(interval time.Duration) {
+	defer close(p.logDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.logLine()
+		case <-p.stopLog:
+			p.logLine()
+			return
+		}
+	}
+}
+
+func (p *backupProgress) logLine() {
+	p.run.logInfof("Progress: %d/%d objects, %s/%s, %d errors",
+		p.completedObjects.Load(), p.totalObjects.Load(),
+		formatBytes(p.completedBytes.Load()), formatBytes(p.totalBytes.Load()),
+		p.errorObjects.Load())
+}
+
+// 完了したバイト数から残り時間を見積もる
+// まだ見積もれない場合は0を返す
+func (p *backupProgress) ETA() time.Duration {
+	completedBytes := p.completedBytes.Load()
+	if completedBytes <= 0 {
+		return 0
+	}
+	elapsed := time.Since(p.startTime)
+	remaining := p.totalBytes.Load() - completedBytes
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(elapsed) * float64(remaining) / float64(completedBytes)).Round(time.Second)
+}
+
+func (p *backupProgress) Finish() {
+	if p.bar != nil {
+		p.bar.Finish()
+		return
+	}
+	if p.stopLog == nil {
+		return
+	}
+	close(p.stopLog)
+	<-p.logDone
+}
+
+// バイト数を人が読みやすい形式にする
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// バケット内のオブジェクト数と合計バイト数を数える（startAfterを指定した場合はそのキーより後のもの）
+func (r *backupRun) countObjects(ctx context.Context, source ObjectSource, s3Client *s3.Client, startAfter string) (int64, int64, error) {
+	var totalObjects, totalBytes int64
+	for listed := range r.listObjectPages(ctx, source, s3Client, startAfter) {
+		if listed.Err != nil {
+			return 0, 0, listed.Err
+		}
+		for _, object := range listed.Page.Contents {
+			if !r.objectSizeInRange(aws.ToInt64(object.Size)) {
+				continue
+			}
+			totalObjects++
+			totalBytes += aws.ToInt64(object.Size)
+		}
+	}
+	return totalObjects, totalBytes, nil
+}
@@ -0,0 +1,37 @@
+package backup
+
+import (
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+)
+
+// リトライ設定
+// 0または空の場合はライブラリのデフォルトを使う
+type retryConfigStruct struct {
+	// S3: standardまたはadaptive
+	S3RetryMode   string
+	S3MaxAttempts int
+
+	GCSInitialBackoff time.Duration
+	GCSMaxBackoff     time.Duration
+	GCSMultiplier     float64
+	GCSMaxAttempts    int
+}
+
+// GCSバケットに設定するリトライのオプション
+func (c *backupConfig) gcsRetryOptions() []storage.RetryOption {
+	var options []storage.RetryOption
+	if c.retryConfig.GCSInitialBackoff > 0 || c.retryConfig.GCSMaxBackoff > 0 || c.retryConfig.GCSMultiplier > 0 {
+		options = append(options, storage.WithBackoff(gax.Backoff{
+			Initial:    c.retryConfig.GCSInitialBackoff,
+			Max:        c.retryConfig.GCSMaxBackoff,
+			Multiplier: c.retryConfig.GCSMultiplier,
+		}))
+	}
+	if c.retryConfig.GCSMaxAttempts > 0 {
+		options = append(options, storage.WithMaxAttempts(c.retryConfig.GCSMaxAttempts))
+	}
+	return options
+}
@@ -0,0 +1,591 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/traPtitech/s3-backup-helper/pkg/buildinfo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// 1回のバックアップの実行（設定と、実行中の状態）
+// 実行ごとに作成するため、1つのプロセスで複数のバックアップを同時に実行できる
+type backupRun struct {
+	*backupConfig
+
+	// 実行ID（ログ、レポート、通知に含めて複数の実行を区別する、サブコマンドの場合は空）
+	runID string
+	// ログの出力先（各行の先頭に実行IDを付ける）
+	logger *log.Logger
+	// 結果やプログレスバーの出力先
+	stdout io.Writer
+
+	// S3がスロットリング（SlowDown、503）を返した回数（リトライして成功したものも含む）
+	s3ThrottleCount atomic.Int64
+	// 実行中のバックアップの進捗（実行中でない場合はnil）
+	activeProgress atomic.Pointer[backupProgress]
+	// Runの間に進捗を知らせる関数（Runnerから実行していない場合はnil）
+	progressCallback func(Progress)
+	// 実行中のバックアップのダウンロードとアップロードの枠（分けない場合や、実行中でない場合はnil）
+	downloadSlots, uploadSlots *semaphore.Weighted
+}
+
+// 設定から実行を作成する
+// idはnewRunIDで生成した実行ID（常駐する場合に制御APIから参照できるよう、呼び出し側で生成する）
+func newBackupRun(config *backupConfig, id string, stdout, stderr io.Writer) *backupRun {
+	prefix := ""
+	if id != "" {
+		prefix = "[" + id + "] "
+	}
+	return &backupRun{
+		backupConfig: config,
+		runID:        id,
+		logger:       log.New(stderr, prefix, log.LstdFlags),
+		stdout:       stdout,
+	}
+}
+
+// バケット全体のバックアップを1回実行する
+// 中断した場合や続行できないエラーが発生した場合はエラーを返す
+// 開始前に失敗した場合を除き、中断した場合も途中までの結果を返す
+func (r *backupRun) runBackup(ctx context.Context) (summary *backupSummary, err error) {
+	r.logInfof("Starting backup run %v (s3-backup-helper %v)", r.runID, buildinfo.Get())
+
+	// 監視サービスに開始と終了を知らせる
+	r.pingHealthcheckStart()
+	defer func() { r.pingHealthcheckFinish(summary, err) }()
+
+	ctx, span := tracer.Start(ctx, "backup", trace.WithAttributes(
+		attribute.String("backup.run_id", r.runID),
+		attribute.String("s3.bucket", r.s3Config.Bucket),
+	))
+	defer span.End()
+
+	// Options.Sourceが指定されている場合は、S3のAPIを直接使う機能は使わない
+	var s3Client *s3.Client
+	var source ObjectSource
+	if r.clientOverrides.Source != nil {
+		source = r.clientOverrides.Source
+	} else {
+		s3Client, err = r.newS3Client()
+		if err != nil {
+			return nil, err
+		}
+		source = r.newS3Source(s3Client)
+	}
+
+	fmt.Fprintln(r.stdout, "Target buckets:")
+	destination, err := r.prepareDestination(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer destination.Close()
+	exporter, objectDestination, gcsBucketClient, destinationName := destination.Exporter, destination.Objects, destination.GCSBucket, destination.Name
+
+	// 監査記録は中断した場合も含めて残す
+	if r.auditLog && gcsBucketClient != nil {
+		auditStartTime := time.Now()
+		defer func() {
+			record := r.newBackupAuditRecord(auditStartTime, destinationName, summary, err)
+			if err := r.writeAuditRecord(context.Background(), gcsBucketClient, record); err != nil {
+				r.logErrorf("%v", err)
+			}
+		}()
+	}
+
+	// 同時に複数の実行がスキップの判定や負荷を乱さないようにロックを取る
+	// ロックを失った場合は、他の実行と重ならないように残りの処理を中断する
+	if gcsBucketClient != nil {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		lock, err := r.acquireRunLock(ctx, gcsBucketClient, cancel)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := lock.Release(); err != nil {
+				r.logErrorf("Failed to release run lock: %v", err)
+			}
+		}()
+	}
+
+	// BUNDLE_PREFIXES以下のオブジェクトはアーカイブにまとめる
+	var bundlers []*bundler
+	// メタデータのみの場合は、本体を転送せずにマニフェストに記録する
+	var manifest *manifestWriter
+	if gcsBucketClient != nil && s3Client != nil {
+		if r.metadataOnly {
+			manifest, err = r.newManifestWriter(ctx, gcsBucketClient)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create manifest: %w", err)
+			}
+		} else {
+			bundlers = r.newBundlers(ctx, gcsBucketClient)
+		}
+	}
+
+	// アップロードするバイト数の上限か実行する時間帯がある場合は、前回停止した位置から再開する
+	// 停止した位置はGCSに保存するため、Options.Destinationを指定した場合は再開できず、毎回先頭から上限まで転送し直すことになる
+	if (r.maxBytesPerRun > 0 || r.backupWindow != nil) && gcsBucketClient == nil {
+		return nil, fmt.Errorf("%w: MAX_BYTES_PER_RUN and BACKUP_WINDOW cannot be used with Options.Destination", errInvalidConfig)
+	}
+	var startAfter string
+	if r.maxBytesPerRun > 0 || r.backupWindow != nil {
+		startAfter, err = r.loadResumePoint(ctx, gcsBucketClient)
+		if err != nil {
+			return nil, err
+		}
+		if startAfter != "" {
+			r.logInfof("Resuming after %v", startAfter)
+		}
+	}
+
+	// 実行時間の上限に達した場合に残りの処理を中断する
+	if r.runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, r.runTimeout, errRunTimeout)
+		defer cancel()
+	}
+
+	// 改行
+	fmt.Fprintln(r.stdout)
+
+	// バックアップ計測用変数
+	backupStartTime := time.Now()
+	totalObjects := 0
+	var skippedObjects atomic.Int64
+	var archivedObjects atomic.Int64
+	filteredObjects := 0
+	totalErrors := 0
+
+	// バックアップ
+	fmt.Fprintf(r.stdout, "Bucking up objects in %v to %v\n", r.s3Config.Bucket, destinationName)
+
+	// プログレスバー用にオブジェクト数とバイト数を数える
+	// 数えない場合は、一覧の取得に合わせて合計を増やす
+	var countedObjects, countedBytes int64
+	if r.precountObjects {
+		var err error
+		countedObjects, countedBytes, err = r.countObjects(ctx, source, s3Client, startAfter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+	}
+	progress := r.newBackupProgress(countedObjects, countedBytes)
+	r.activeProgress.Store(progress)
+	defer r.activeProgress.Store(nil)
+
+	// 途中経過の通知
+	stopHeartbeat := func() {}
+	if r.heartbeatInterval > 0 {
+		stopHeartbeat = r.startHeartbeat(progress, r.heartbeatInterval)
+	}
+
+	// オブジェクトごとの処理結果のレポート
+	var reporter *objectReporter
+	if r.objectReportPath != "" {
+		reporter, err = newObjectReporter(r.objectReportPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create object report: %w", err)
+		}
+		defer func() {
+			if err := reporter.Close(); err != nil {
+				r.logErrorf("Failed to write object report: %v", err)
+			}
+		}()
+	}
+
+	// 並列処理用
+	// いずれかのゴルーチンが致命的なエラーを返したら、残りの処理を全て中断する
+	group, groupCtx := errgroup.WithContext(ctx)
+	// 各オブジェクトについて、エラーを格納する
+	var errs []objectError
+	var errsMu sync.Mutex
+
+	// アップロードしたバイト数が上限に達したか
+	var uploadedBytes atomic.Int64
+	var budgetReached atomic.Bool
+	// 上限に達して停止した場合に、最後にキューに入れたキー（次の実行はこのキーより後から始める）
+	stoppedAfter := startAfter
+	// 時間帯の外で一時停止していた時間
+	var pausedDuration time.Duration
+
+	// 転送するオブジェクトのキュー
+	// 大きいオブジェクトが全てのワーカーを埋めて小さいオブジェクトが待たされないよう、
+	// 大きいオブジェクトは別のキューに入れ、ワーカーの半分だけが処理する
+	smallObjects := make(chan types.Object, r.palalellNum)
+	largeObjects := make(chan types.Object, r.palalellNum)
+
+	// ダウンロードとアップロードを分ける場合は、両方の枠を埋められるだけのオブジェクトを同時に処理する
+	workerNum := r.palalellNum
+	if r.splitTransferLimits() {
+		workerNum = max(r.palalellNum, r.transferSlotLimit(r.downloadParallelNum)+r.transferSlotLimit(r.uploadParallelNum))
+	}
+
+	// 同時に処理する数を自動で調整する場合は、ワーカーをPALALELL_NUMだけ起動し、処理する数を制限する
+	var controller *concurrencyController
+	if r.adaptiveConcurrency {
+		controller = r.newConcurrencyController(int(workerNum))
+		controller.Start(progress)
+	}
+
+	// 1つのオブジェクトをバックアップする
+	// オブジェクト単位のエラーは記録して続行し、処理全体を中断すべき場合のみエラーを返す
+	processObject := func(object types.Object) error {
+		if controller != nil {
+			controller.Acquire()
+			defer controller.Release()
+		}
+		// 中断された後はキューに残ったオブジェクトを処理しない
+		if groupCtx.Err() != nil {
+			return nil
+		}
+
+		objectStartTime := time.Now()
+		var skipped bool
+		var err error
+		if manifest != nil {
+			err = manifest.Add(groupCtx, s3Client, object)
+		} else if bundle := findBundler(bundlers, *object.Key); bundle != nil {
+			err = bundle.Add(groupCtx, s3Client, object)
+		} else {
+			skipped, err = r.backupObject(groupCtx, source, objectDestination, exporter, *object.Key, aws.ToInt64(object.Size))
+		}
+		// アーカイブ層にあって読めないオブジェクトは、ARCHIVED_OBJECTS=failでなければエラーにせず報告する
+		archived := errors.Is(err, errObjectArchived) && r.archivedObjectPolicy != archivedFail
+		if archived {
+			r.logInfof("Skipped archived object %v (ARCHIVED_OBJECTS=%v)", *object.Key, r.archivedObjectPolicy)
+			archivedObjects.Add(1)
+			err = nil
+		}
+		if reporter != nil {
+			action := objectActionUploaded
+			switch {
+			case err != nil:
+				action = objectActionError
+			case skipped:
+				action = objectActionSkipped
+			case archived:
+				action = objectActionArchived
+			case manifest != nil:
+				action = objectActionRecorded
+			case exporter != nil:
+				action = objectActionExported
+			}
+			if recordErr := reporter.Record(*object.Key, action, aws.ToInt64(object.Size), time.Since(objectStartTime), err); recordErr != nil {
+				r.logErrorf("Failed to record object %v: %v", *object.Key, recordErr)
+			}
+		}
+		if skipped {
+			skippedObjects.Add(1)
+		} else if err == nil && !archived && r.maxBytesPerRun > 0 && uploadedBytes.Add(aws.ToInt64(object.Size)) >= r.maxBytesPerRun {
+			budgetReached.Store(true)
+		}
+		if err != nil {
+			r.logErrorf("Failed to backup object %v: %v", *object.Key, r.describeError(err))
+			errsMu.Lock()
+			errs = append(errs, r.newObjectError(*object.Key, err))
+			errsMu.Unlock()
+		}
+		progress.Done(aws.ToInt64(object.Size), err)
+
+		// エラー数の上限を超えたら中断
+		if r.maxErrors > 0 && progress.errorObjects.Load() > r.maxErrors {
+			return errTooManyErrors
+		}
+		return nil
+	}
+
+	// ワーカーの起動
+	defer r.startTransferSlots()()
+	largeObjectWorkers := max(workerNum/2, 1)
+	for i := range workerNum {
+		group.Go(func() error {
+			// 小さいオブジェクトのみを処理するワーカー
+			if i >= largeObjectWorkers {
+				for object := range smallObjects {
+					if err := processObject(object); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			// 大きいオブジェクトも処理するワーカー
+			small, large := smallObjects, largeObjects
+			for small != nil || large != nil {
+				var object types.Object
+				var ok bool
+				select {
+				case object, ok = <-small:
+					if !ok {
+						small = nil
+						continue
+					}
+				case object, ok = <-large:
+					if !ok {
+						large = nil
+						continue
+					}
+				}
+				if err := processObject(object); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// 一覧を取得してキューに入れる
+	group.Go(func() error {
+		defer close(smallObjects)
+		defer close(largeObjects)
+
+		for listed := range r.listObjectPages(groupCtx, source, s3Client, startAfter) {
+			if listed.Err != nil {
+				return fmt.Errorf("failed to list objects: %w", listed.Err)
+			}
+
+			for _, object := range listed.Page.Contents {
+				// 時間帯の外では、キューに入れたオブジェクトの処理が終わるのを待って一時停止する
+				if r.backupWindow != nil && !r.backupWindow.Contains(time.Now()) {
+					inFlight := func() bool { return progress.completedObjects.Load() < int64(totalObjects) }
+					savePosition := func() error {
+						return r.saveResumePoint(groupCtx, gcsBucketClient, stoppedAfter)
+					}
+					pausedDuration += r.pauseUntilWindow(groupCtx, r.backupWindow, inFlight, savePosition)
+					if groupCtx.Err() != nil {
+						return nil
+					}
+				}
+
+				// アップロードしたバイト数が上限に達したら、以降のオブジェクトは次の実行に回す
+				// キューに入れたオブジェクトは全て処理されるため、最後に入れたキーまでは完了している
+				if budgetReached.Load() {
+					return nil
+				}
+				stoppedAfter = aws.ToString(object.Key)
+
+				// サイズが範囲外のオブジェクトは対象外
+				if !r.objectSizeInRange(aws.ToInt64(object.Size)) {
+					r.logDebugf("Skipped %v: size %d is outside MIN_OBJECT_SIZE/MAX_OBJECT_SIZE", aws.ToString(object.Key), aws.ToInt64(object.Size))
+					filteredObjects++
+					continue
+				}
+
+				// オブジェクト数をカウント
+				totalObjects++
+				if !r.precountObjects {
+					progress.AddTotal(1, aws.ToInt64(object.Size))
+				}
+
+				queue := smallObjects
+				if r.largeObjectThreshold > 0 && aws.ToInt64(object.Size) >= r.largeObjectThreshold {
+					queue = largeObjects
+				}
+				select {
+				case queue <- object:
+				case <-groupCtx.Done():
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+
+	runErr := group.Wait()
+	if runErr == nil {
+		// 実行時間の上限に達した場合
+		runErr = context.Cause(ctx)
+	}
+	stopHeartbeat()
+	if controller != nil {
+		controller.Stop()
+	}
+	progress.Finish()
+
+	// マニフェストのアップロードを完了する
+	if manifest != nil {
+		if runErr != nil {
+			manifest.Abort()
+		} else if err := manifest.Close(); err != nil {
+			r.logErrorf("Failed to finish manifest: %v", err)
+			errs = append(errs, r.newObjectError(manifest.name, err))
+		}
+	}
+
+	// アーカイブの残りとインデックスを書き込む
+	for _, bundle := range bundlers {
+		if runErr != nil {
+			bundle.Abort()
+		} else if err := bundle.Close(ctx); err != nil {
+			r.logErrorf("Failed to finish bundle %v: %v", bundle.prefix, err)
+			errs = append(errs, r.newObjectError(bundle.dir, err))
+		}
+	}
+
+	// S3バケットの設定を保存する
+	if runErr == nil && r.bucketConfigBackup && gcsBucketClient != nil && s3Client != nil {
+		if err := r.backupBucketConfig(ctx, s3Client, gcsBucketClient); err != nil {
+			r.logErrorf("Failed to backup bucket config: %v", err)
+			errs = append(errs, r.newObjectError(bucketConfigObjectName, err))
+		}
+	}
+
+	// 削除マーカーを記録する
+	if runErr == nil && r.deleteMarkerPolicy == deleteMarkersRecord && gcsBucketClient != nil && s3Client != nil {
+		count, err := r.backupDeleteMarkers(ctx, s3Client, gcsBucketClient)
+		if err != nil {
+			r.logErrorf("Failed to backup delete markers: %v", err)
+			errs = append(errs, r.newObjectError(deleteMarkersObjectName, err))
+		} else {
+			r.logInfof("Recorded %d delete markers", count)
+		}
+	}
+
+	// 停止した位置を保存する（最後まで処理した場合は削除する）
+	if runErr == nil && (r.maxBytesPerRun > 0 || r.backupWindow != nil) {
+		var err error
+		if budgetReached.Load() {
+			err = r.saveResumePoint(ctx, gcsBucketClient, stoppedAfter)
+		} else {
+			err = r.clearResumePoint(ctx, gcsBucketClient)
+		}
+		if err != nil {
+			r.logErrorf("%v", err)
+			errs = append(errs, r.newObjectError(resumePointObjectName, err))
+		}
+	}
+
+	// エラー数をカウント
+	totalErrors += len(errs)
+
+	summary = &backupSummary{
+		RunID:           r.runID,
+		Version:         buildinfo.Get(),
+		Bucket:          r.s3Config.Bucket,
+		Destination:     destinationName,
+		StartTime:       backupStartTime,
+		DurationSeconds: time.Since(backupStartTime).Seconds(),
+		PausedSeconds:   pausedDuration.Seconds(),
+		TotalObjects:    int64(totalObjects),
+		TotalBytes:      progress.completedBytes.Load(),
+		SkippedObjects:  skippedObjects.Load(),
+		ArchivedObjects: archivedObjects.Load(),
+		FilteredObjects: int64(filteredObjects),
+		Errors:          int64(totalErrors),
+		FailedObjects:   errs,
+		Config:          r.currentConfigSnapshot(),
+	}
+	if budgetReached.Load() {
+		summary.ResumeAfter = stoppedAfter
+		// 事前に数えた場合は残りも分かる
+		if r.precountObjects {
+			summary.RemainingObjects = countedObjects - progress.completedObjects.Load()
+			summary.RemainingBytes = countedBytes - progress.completedBytes.Load()
+		}
+	}
+	defer func() {
+		if err := r.saveSummary(context.Background(), summary, gcsBucketClient); err != nil {
+			r.logErrorf("Failed to save summary: %v", err)
+		}
+	}()
+
+	// 中断した場合は途中までの結果を通知して終了
+	if runErr != nil {
+		var reason string
+		switch {
+		case errors.Is(runErr, errTooManyErrors):
+			reason = fmt.Sprintf("エラー数が上限(%d)を超えました", r.maxErrors)
+		case errors.Is(runErr, errRunTimeout):
+			reason = fmt.Sprintf("実行時間が上限(%v)に達しました", r.runTimeout)
+		case errors.Is(runErr, errRunLockLost):
+			reason = fmt.Sprintf("ロックを延長できませんでした: %v", r.describeError(runErr))
+		case errors.Is(runErr, context.Canceled):
+			// Runner.Runを呼び出した側が中断した場合
+			reason = "実行がキャンセルされました"
+		default:
+			reason = fmt.Sprintf("一覧の取得に失敗しました: %v", r.describeError(runErr))
+		}
+		summary.AbortReason = reason
+		span.SetStatus(codes.Error, reason)
+		r.logErrorf("Backup aborted: %v", runErr)
+		webhookMessage := fmt.Sprintf(`### :warning: オブジェクトストレージのバックアップが中断されました
+	実行ID: %s
+	S3バケット: %s
+	バックアップ先: %s
+	バックアップ開始時刻: %s
+	理由: %s
+	処理済みオブジェクト数: %d/%d
+	スキップされたオブジェクト数: %d
+	エラー数: %d
+	バージョン: %s
+	`, r.runID, r.s3Config.Bucket, destinationName, backupStartTime.Format("2006/01/02 15:04:05"), reason, progress.completedObjects.Load(), progress.totalObjects.Load(), skippedObjects.Load(), progress.errorObjects.Load(), summary.Version)
+		webhookMessage += r.failedObjectsMessage(summary)
+		r.notifyResult(summary, r.renderWebhookMessage(summary, webhookMessage))
+		return summary, fmt.Errorf("backup aborted: %w", runErr)
+	}
+
+	// エクスポートのインデックスを書き出す
+	if exporter != nil {
+		if err := exporter.Close(); err != nil {
+			return summary, fmt.Errorf("failed to finish export: %w", err)
+		}
+	}
+
+	// バックアップ終了
+	backupEndTime := time.Now()
+	backupDuration := backupEndTime.Sub(backupStartTime)
+
+	fmt.Fprintf(r.stdout, "Backup %v completed: %d objects, %d skipped, %d filtered by size, %d errors, %v\n", r.runID, totalObjects, skippedObjects.Load(), filteredObjects, totalErrors, backupDuration)
+
+	// Webhook送信
+	webhookMessage := fmt.Sprintf(`### オブジェクトストレージのバックアップが保存されました
+	実行ID: %s
+	S3バケット: %s
+	バックアップ先: %s
+	バックアップ開始時刻: %s
+	バックアップ所要時間: %f時間
+	オブジェクト数: %d
+	スキップされたオブジェクト数: %d
+	サイズで除外されたオブジェクト数: %d
+	エラー数: %d
+	バージョン: %s
+	`, r.runID, r.s3Config.Bucket, destinationName, backupStartTime.Format("2006/01/02 15:04:05"), backupDuration.Hours(), totalObjects, skippedObjects.Load(), filteredObjects, totalErrors, summary.Version)
+	if archivedObjects.Load() > 0 {
+		fmt.Fprintf(r.stdout, "Skipped %d archived objects (ARCHIVED_OBJECTS=%v)\n", archivedObjects.Load(), r.archivedObjectPolicy)
+		webhookMessage += fmt.Sprintf(`アーカイブ層にあって読めないためスキップしたオブジェクト数: %d
+	`, archivedObjects.Load())
+	}
+	if budgetReached.Load() {
+		remaining := "不明（PRECOUNT_OBJECTS=trueでないため）"
+		if r.precountObjects {
+			remaining = fmt.Sprintf("%dオブジェクト、%s", summary.RemainingObjects, formatBytes(summary.RemainingBytes))
+		}
+		fmt.Fprintf(r.stdout, "Stopped after %v: MAX_BYTES_PER_RUN (%v) reached, remaining %v\n", stoppedAfter, formatBytes(r.maxBytesPerRun), remaining)
+		webhookMessage += fmt.Sprintf(`アップロード量が上限(%s)に達したため停止しました。次回は続きから再開します
+	残り: %s
+	`, formatBytes(r.maxBytesPerRun), remaining)
+	}
+	webhookMessage += r.failedObjectsMessage(summary)
+	if !r.shouldNotify(summary) {
+		r.logInfof("Webhook skipped by notification policy")
+		return summary, nil
+	}
+	r.notifyResult(summary, r.renderWebhookMessage(summary, webhookMessage))
+	return summary, nil
+}
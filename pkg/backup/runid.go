@@ -0,0 +1,14 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// 開始時刻とランダムな値から実行IDを生成する
+func newRunID() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(random)
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// 他のサービスに組み込んでバックアップを実行する場合の設定
+// 空の項目（boolの場合はfalse）は、LoadConfigFromEnvで読み込んだ設定（読み込んでいない場合はデフォルト）をそのまま使う
+type Options struct {
+	S3Endpoint       string
+	S3Region         string
+	S3Bucket         string
+	S3AccessKey      string
+	S3SecretKey      string
+	S3SessionToken   string
+	S3ForcePathStyle bool
+
+	GCPProjectID        string
+	GCSRegion           string
+	GCSBucketNameSuffix string
+	// 指定した場合、GCSBucketNameSuffixを使わずにこのバケットのGCSPrefixの下にバックアップする
+	GCSBucket string
+	GCSPrefix string
+	// サービスアカウントのJSON
+	GCPCredentialsJSON []byte
+
+	// snappy、gzip、zstd、none
+	Compression string
+	ParallelNum int64
+	// trueの場合、変更されていないオブジェクトもスキップせずにアップロードする
+	FullBackup bool
+	// trueの場合、プログレスバーと進捗のログを出力しない
+	Quiet bool
+
+	// オブジェクトの処理が終わるたびと、一覧の取得で合計が増えるたびに呼ばれる（複数のゴルーチンから呼ばれる）
+	OnProgress func(Progress)
+
+	// 指定した場合、S3の代わりにこれから一覧を取得してオブジェクトを読む（テスト用の偽物など）
+	// S3のAPIを直接使う機能（METADATA_ONLY、BUNDLE_PREFIXES、BACKUP_BUCKET_CONFIG、S3_INVENTORY_MANIFEST、LISTING_SHARD_DEPTH）は使えない
+	Source ObjectSource
+	// 指定した場合、GCSの代わりにこれに書き込む
+	// GCSの機能を使うもの（ロック、再開位置、監査記録、実行結果のアップロードなど）は行わない
+	Destination ObjectDestination
+	// 指定した場合、Webhook、ヘルスチェック、シークレットの取得、S3との通信にこのクライアントを使う
+	HTTPClient *http.Client
+}
+
+// バックアップの進捗
+type Progress struct {
+	TotalObjects     int64
+	TotalBytes       int64
+	CompletedObjects int64
+	CompletedBytes   int64
+	ErrorObjects     int64
+}
+
+// バックアップの実行結果（実行結果のJSONと同じ）
+type Result = backupSummary
+
+// バックアップを実行する
+// 実行ごとに設定を複製するため、同じプロセスで複数のRunを同時に実行できる
+type Runner struct {
+	options Options
+}
+
+func NewRunner(options Options) (*Runner, error) {
+	if options.Compression != "" && !validCompression(options.Compression) {
+		return nil, fmt.Errorf("invalid compression: %v", options.Compression)
+	}
+	if options.ParallelNum < 0 {
+		return nil, fmt.Errorf("invalid parallel num: %v", options.ParallelNum)
+	}
+	return &Runner{options: options}, nil
+}
+
+// バケット全体のバックアップを1回実行する
+// 通知、監視、監査記録などはLoadConfigFromEnvで読み込んだ設定に従う
+// 中断した場合も途中までの結果を返す
+func (r *Runner) Run(ctx context.Context) (*Result, error) {
+	run := newBackupRun(r.config(), newRunID(), os.Stdout, os.Stderr)
+	run.progressCallback = r.options.OnProgress
+	return run.runBackup(ctx)
+}
+
+// LoadConfigFromEnvで読み込んだ設定を複製し、空でない項目で上書きする
+// 複製した設定はこの実行でのみ使うため、他の実行や次の実行には影響しない
+func (r *Runner) config() *backupConfig {
+	o := r.options
+	config := defaultConfig.clone()
+	setIfNotEmpty(&config.s3Config.EndPoint, o.S3Endpoint)
+	setIfNotEmpty(&config.s3Config.Region, o.S3Region)
+	setIfNotEmpty(&config.s3Config.Bucket, o.S3Bucket)
+	setIfNotEmpty(&config.s3Config.AccessKey, o.S3AccessKey)
+	setIfNotEmpty(&config.s3Config.SecretKey, o.S3SecretKey)
+	setIfNotEmpty(&config.s3Config.SessionToken, o.S3SessionToken)
+	config.s3Config.ForcePathStyle = config.s3Config.ForcePathStyle || o.S3ForcePathStyle
+	setIfNotEmpty(&config.gcpConfig.ProjectID, o.GCPProjectID)
+	setIfNotEmpty(&config.gcpConfig.Region, o.GCSRegion)
+	setIfNotEmpty(&config.gcpConfig.BucketNameSuffix, o.GCSBucketNameSuffix)
+	setIfNotEmpty(&config.gcpConfig.Bucket, o.GCSBucket)
+	if o.GCSPrefix != "" {
+		config.gcpConfig.Prefix = normalizeDestinationPrefix(o.GCSPrefix)
+	}
+	if o.GCPCredentialsJSON != nil {
+		config.gcpConfig.CredentialsJSON = o.GCPCredentialsJSON
+	}
+	setIfNotEmpty(&config.compression, o.Compression)
+	if o.ParallelNum > 0 {
+		config.palalellNum = o.ParallelNum
+	}
+	config.fullBackup = config.fullBackup || o.FullBackup
+	config.quietMode = config.quietMode || o.Quiet
+	config.clientOverrides.Source = o.Source
+	config.clientOverrides.Destination = o.Destination
+	config.clientOverrides.HTTPClient = o.HTTPClient
+	return config
+}
+
+func setIfNotEmpty(target *string, value string) {
+	if value != "" {
+		*target = value
+	}
+}
+
+// 進捗を知らせる
+func (p *backupProgress) notify() {
+	if p.run.progressCallback == nil {
+		return
+	}
+	p.run.progressCallback(Progress{
+		TotalObjects:     p.totalObjects.Load(),
+		TotalBytes:       p.totalBytes.Load(),
+		CompletedObjects: p.completedObjects.Load(),
+		CompletedBytes:   p.completedBytes.Load(),
+		ErrorObjects:     p.errorObjects.Load(),
+	})
+}
@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3のバケットをバックアップ元とする
+type s3Source struct {
+	config *backupConfig
+	client *s3.Client
+	bucket string
+}
+
+func (c *backupConfig) newS3Source(client *s3.Client) *s3Source {
+	return &s3Source{config: c, client: client, bucket: c.s3Config.Bucket}
+}
+
+// バックアップの設定を使わずにS3のバケットを読み書きする（復元など）
+func NewS3Source(client *s3.Client, bucket string, requesterPays bool) ObjectSource {
+	c := newBackupConfig()
+	c.s3Config.Bucket = bucket
+	c.s3Config.RequesterPays = requesterPays
+	return c.newS3Source(client)
+}
+
+func (s *s3Source) List(ctx context.Context, prefix string, startAfter string, fn func(page []ObjectInfo) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket:       aws.String(s.bucket),
+		RequestPayer: s.config.s3RequestPayer(),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		page := make([]ObjectInfo, 0, len(output.Contents))
+		for _, object := range output.Contents {
+			page = append(page, ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+				ETag:         trimETag(object.ETag),
+				StorageClass: string(object.StorageClass),
+			})
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Source) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	output, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		RequestPayer: s.config.s3RequestPayer(),
+	})
+	if err != nil {
+		return nil, s3SourceError(err)
+	}
+	return &ObjectInfo{
+		Key:                key,
+		Size:               aws.ToInt64(output.ContentLength),
+		LastModified:       aws.ToTime(output.LastModified),
+		ContentType:        aws.ToString(output.ContentType),
+		ContentEncoding:    aws.ToString(output.ContentEncoding),
+		ContentDisposition: aws.ToString(output.ContentDisposition),
+		ContentLanguage:    aws.ToString(output.ContentLanguage),
+		CacheControl:       aws.ToString(output.CacheControl),
+		Metadata:           output.Metadata,
+		ETag:               trimETag(output.ETag),
+		StorageClass:       string(output.StorageClass),
+	}, nil
+}
+
+func (s *s3Source) Get(ctx context.Context, key string, options GetOptions) (*ObjectInfo, io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		RequestPayer: s.config.s3RequestPayer(),
+	}
+	if options.IfNoneMatch != "" {
+		input.IfNoneMatch = aws.String(`"` + options.IfNoneMatch + `"`)
+	}
+	if options.IfMatch != "" {
+		input.IfMatch = aws.String(`"` + options.IfMatch + `"`)
+	}
+	if options.RangeLength > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", options.RangeOffset, options.RangeOffset+options.RangeLength-1))
+	}
+	if options.Checksum {
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+	output, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		if options.IfNoneMatch != "" && isNotModified(err) {
+			return nil, nil, ErrNotModified
+		}
+		return nil, nil, s3SourceError(err)
+	}
+	info := &ObjectInfo{
+		Key:                key,
+		Size:               aws.ToInt64(output.ContentLength),
+		LastModified:       aws.ToTime(output.LastModified),
+		ContentType:        aws.ToString(output.ContentType),
+		ContentEncoding:    aws.ToString(output.ContentEncoding),
+		ContentDisposition: aws.ToString(output.ContentDisposition),
+		ContentLanguage:    aws.ToString(output.ContentLanguage),
+		CacheControl:       aws.ToString(output.CacheControl),
+		Metadata:           output.Metadata,
+		ETag:               trimETag(output.ETag),
+		StorageClass:       string(output.StorageClass),
+	}
+	// マルチパートアップロードされたオブジェクトのパートごとのチェックサム（末尾が"-パート数"）は元のデータと比較できないため使わない
+	if checksum := aws.ToString(output.ChecksumCRC32C); !strings.Contains(checksum, "-") {
+		info.ChecksumCRC32C = checksum
+	}
+	return info, output.Body, nil
+}
+
+func (s *s3Source) Put(ctx context.Context, key string, info ObjectInfo, body io.Reader) error {
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		Body:         body,
+		Metadata:     info.Metadata,
+		RequestPayer: s.config.s3RequestPayer(),
+	}
+	if info.ContentType != "" {
+		input.ContentType = aws.String(info.ContentType)
+	}
+	if info.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(info.ContentEncoding)
+	}
+	if info.ContentDisposition != "" {
+		input.ContentDisposition = aws.String(info.ContentDisposition)
+	}
+	if info.ContentLanguage != "" {
+		input.ContentLanguage = aws.String(info.ContentLanguage)
+	}
+	if info.CacheControl != "" {
+		input.CacheControl = aws.String(info.CacheControl)
+	}
+	// 長さの分からないストリームも書き込めるように、マルチパートアップロードを使う
+	_, err := manager.NewUploader(s.client).Upload(ctx, input)
+	return err
+}
+
+func (s *s3Source) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		RequestPayer: s.config.s3RequestPayer(),
+	})
+	return err
+}
+
+// アーカイブ層にあるオブジェクトの復元をリクエストする（ARCHIVED_OBJECTS=restore）
+func (s *s3Source) RestoreArchived(ctx context.Context, key string) error {
+	return s.config.requestArchiveRestore(ctx, s.client, key)
+}
+
+// S3のエラーを、バックアップ元に共通のエラーとして判定できるようにする
+func s3SourceError(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	switch {
+	case errors.As(err, &noSuchKey) || errors.As(err, &notFound):
+		return fmt.Errorf("%w: %w", ErrObjectNotFound, err)
+	case isArchivedObjectError(err):
+		return fmt.Errorf("%w: %w", errObjectArchived, err)
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package backup
+
+import (
+	"context"
+
+	"github.com/traPtitech/s3-backup-helper/pkg/secrets"
+)
+
+// 環境変数の値を取得する（<name>_FILEの場合はファイルから読み込む）
+// getenvはos.Getenvか、SOURCESのバックアップ元ごとに環境変数を上書きしたもの
+func getenvOrFile(getenv func(string) string, name string) (string, error) {
+	return secrets.GetenvOrFileFunc(getenv, name)
+}
+
+// 設定値がシークレットの参照（gcp-secret://、vault://）の場合は、参照先から値を取得する
+// 参照でない場合はそのまま返す
+func (c *backupConfig) resolveSecret(ctx context.Context, value string) (string, error) {
+	if !secrets.IsReference(value) {
+		return value, nil
+	}
+	httpClient, err := c.newHTTPClient()
+	if err != nil {
+		return "", err
+	}
+	return secrets.Resolve(ctx, value, httpClient)
+}
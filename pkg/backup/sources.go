@@ -0,0 +1,208 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// 1回の起動でバックアップする複数のS3（SOURCESまたはSOURCES_FILEのJSONの配列で指定する）
+// ストレージのクラスタごとにコンテナを分けずに済むようにするため
+// 空の項目は環境変数の設定（S3_ENDPOINTなど）をそのまま使う
+type sourceConfig struct {
+	// 表示用の名前（ログの各行に付ける、省略した場合はバケット名）
+	Name           string `json:"name"`
+	Endpoint       string `json:"endpoint"`
+	Region         string `json:"region"`
+	Bucket         string `json:"bucket"`
+	AccessKey      string `json:"accessKey"`
+	SecretKey      string `json:"secretKey"`
+	SessionToken   string `json:"sessionToken"`
+	ForcePathStyle *bool  `json:"forcePathStyle"`
+	RoleARN        string `json:"roleArn"`
+	ExternalID     string `json:"externalId"`
+	// バックアップ先（GCS_BUCKET、GCS_PREFIX）
+	GCSBucket string `json:"gcsBucket"`
+	GCSPrefix string `json:"gcsPrefix"`
+	// その他に上書きする環境変数（PALALELL_NUM、GCS_BUCKET_NAME_SUFFIXなど）
+	Env map[string]string `json:"env"`
+}
+
+var sources []sourceConfig
+
+// 同時にバックアップするS3の数（1の場合は順番に実行する）
+var sourcesParallelNum = 1
+
+// SOURCESのJSONを読み込む
+// 認証情報にはシークレットの参照（gcp-secret://、vault://）を指定でき、それぞれの実行で解決する
+// discoverBucketsはDISCOVER_BUCKETSの設定（バケットを省略できる）
+// getenvは共通のS3_BUCKETを読む関数（バケットを省略したバックアップ元はこれを使う）
+func parseSources(getenv func(string) string, value string, discoverBuckets bool) ([]sourceConfig, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var configs []sourceConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range configs {
+		config := &configs[i]
+		// DISCOVER_BUCKETSの場合は、それぞれのバックアップ元でバケットを見つける
+		if config.Bucket == "" && getenv("S3_BUCKET") == "" && !discoverBuckets {
+			return nil, fmt.Errorf("source %d has no bucket", i)
+		}
+		if config.Name == "" {
+			config.Name = config.Bucket
+		}
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("source#%d", i)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate source name: %v", config.Name)
+		}
+		names[config.Name] = true
+	}
+	return configs, nil
+}
+
+// バックアップ元の設定で環境変数を上書きして読む関数（上書きしないものはparentから読む）
+func (s sourceConfig) getenv(parent func(string) string) func(string) string {
+	overrides := make(map[string]string)
+	set := func(name, value string) {
+		if value == "" {
+			return
+		}
+		overrides[name] = value
+		// <名前>_FILEは環境変数より優先されるため、上書きする場合は消す
+		overrides[name+"_FILE"] = ""
+	}
+	set("S3_ENDPOINT", s.Endpoint)
+	set("S3_REGION", s.Region)
+	set("S3_BUCKET", s.Bucket)
+	set("S3_ACCESS_KEY", s.AccessKey)
+	set("S3_SECRET_KEY", s.SecretKey)
+	set("S3_SESSION_TOKEN", s.SessionToken)
+	set("S3_ROLE_ARN", s.RoleARN)
+	set("S3_EXTERNAL_ID", s.ExternalID)
+	set("GCS_BUCKET", s.GCSBucket)
+	set("GCS_PREFIX", s.GCSPrefix)
+	if s.ForcePathStyle != nil {
+		overrides["S3_FORCE_PATH_STYLE"] = fmt.Sprint(*s.ForcePathStyle)
+	}
+	for name, value := range s.Env {
+		overrides[name] = value
+	}
+
+	return func(name string) string {
+		if value, ok := overrides[name]; ok {
+			return value
+		}
+		return parent(name)
+	}
+}
+
+// SOURCESのそれぞれを、バックアップ元ごとに設定を読み込んでバックアップする
+// 設定と状態は実行ごとに分かれているため、同じプロセスで並列に実行できる
+// それぞれの実行のロック、通知、実行結果は別々に扱われる
+// getenvはバックアップ元で上書きしない環境変数を読む関数
+// 終了コードは、全ての実行の終了コードのうち最も大きいもの
+func runSources(sources []sourceConfig, getenv func(string) string) int {
+	var group errgroup.Group
+	group.SetLimit(sourcesParallelNum)
+	var mu sync.Mutex
+	exitCode := 0
+	for _, source := range sources {
+		group.Go(func() error {
+			code := runSource(source, getenv)
+			mu.Lock()
+			exitCode = max(exitCode, code)
+			mu.Unlock()
+			return nil
+		})
+	}
+	group.Wait()
+	return exitCode
+}
+
+// 1つのバックアップ元をバックアップし、終了コードを返す
+func runSource(source sourceConfig, getenv func(string) string) int {
+	logInfof("Starting backup of source %v", source.Name)
+	// 並列に実行した場合も区別できるよう、出力の各行に名前を付ける
+	stdout := newLinePrefixWriter(os.Stdout, "["+source.Name+"] ")
+	stderr := newLinePrefixWriter(os.Stderr, "["+source.Name+"] ")
+	exitCode := backupSource(source.getenv(getenv), stdout, stderr)
+	stdout.Close()
+	stderr.Close()
+
+	if exitCode != 0 {
+		logErrorf("Backup of source %v failed with exit code %d", source.Name, exitCode)
+		return exitCode
+	}
+	logInfof("Backup of source %v completed", source.Name)
+	return 0
+}
+
+// getenvから設定を読み込んでバックアップし、終了コードを返す
+// DISCOVER_BUCKETSが指定されている場合は、見つけたバケットのそれぞれをバックアップする
+func backupSource(getenv func(string) string, stdout, stderr io.Writer) int {
+	config, err := loadConfig(context.Background(), getenv)
+	if err != nil {
+		log.New(stderr, "", log.LstdFlags).Printf("Error: %v", err)
+		return exitCodeConfigError
+	}
+	if config.discoverBuckets {
+		return runDiscoveredBuckets(config, getenv, stdout, stderr)
+	}
+
+	run := newBackupRun(config, newRunID(), stdout, stderr)
+	summary, err := run.runBackup(context.Background())
+	if err != nil {
+		run.logErrorf("%v", run.describeError(err))
+		return exitCodeAborted
+	}
+	if summary.Errors > 0 {
+		return exitCodeTransferError
+	}
+	return 0
+}
+
+// 書き込まれた出力の各行の先頭に文字列を付けて書き出す
+type linePrefixWriter struct {
+	pipe *io.PipeWriter
+	done chan struct{}
+}
+
+func newLinePrefixWriter(output io.Writer, prefix string) *linePrefixWriter {
+	reader, writer := io.Pipe()
+	w := &linePrefixWriter{pipe: writer, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			fmt.Fprintln(output, prefix+scanner.Text())
+		}
+		// 長すぎる行などで読めなくなった場合も、プロセスが書き込みで止まらないよう読み捨てる
+		io.Copy(io.Discard, reader)
+	}()
+	return w
+}
+
+func (w *linePrefixWriter) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
+}
+
+// 残りの出力を書き出し終わるまで待つ
+func (w *linePrefixWriter) Close() error {
+	w.pipe.Close()
+	<-w.done
+	return nil
+}
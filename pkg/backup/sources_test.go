@@ -0,0 +1,47 @@
+package backup
+
+import "testing"
+
+func TestParseSources(t *testing.T) {
+	getenv := func(env map[string]string) func(string) string {
+		return func(name string) string { return env[name] }
+	}
+	tests := []struct {
+		name            string
+		env             map[string]string
+		value           string
+		discoverBuckets bool
+		wantNames       []string
+		wantErr         bool
+	}{
+		{name: "empty", value: "", wantNames: nil},
+		{name: "named by bucket", value: `[{"bucket":"a"},{"name":"b2","bucket":"b"}]`, wantNames: []string{"a", "b2"}},
+		{name: "missing bucket", value: `[{"name":"a"}]`, wantErr: true},
+		// 共通のS3_BUCKETを使う
+		{name: "bucket from S3_BUCKET", env: map[string]string{"S3_BUCKET": "shared"}, value: `[{"name":"a"}]`, wantNames: []string{"a"}},
+		{name: "discovered bucket", value: `[{}]`, discoverBuckets: true, wantNames: []string{"source#0"}},
+		{name: "duplicate name", value: `[{"bucket":"a"},{"bucket":"a"}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, err := parseSources(getenv(tt.env), tt.value, tt.discoverBuckets)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSources(%q) returned no error", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSources(%q) returned error: %v", tt.value, err)
+			}
+			if len(sources) != len(tt.wantNames) {
+				t.Fatalf("parseSources(%q) returned %d sources, want %d", tt.value, len(sources), len(tt.wantNames))
+			}
+			for i, source := range sources {
+				if source.Name != tt.wantNames[i] {
+					t.Errorf("source %d name = %q, want %q", i, source.Name, tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
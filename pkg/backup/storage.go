@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// オブジェクトが存在しない場合のエラー
+var ErrObjectNotFound = errors.New("object not found")
+
+// GetOptions.IfNoneMatchと同じETagで、本体が返らなかった場合のエラー
+var ErrNotModified = errors.New("object not modified")
+
+// バックアップ元・バックアップ先のオブジェクトの属性
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	CacheControl       string
+	Metadata           map[string]string
+
+	// バックアップ元のETag（前後の"を除く）
+	ETag string
+	// バックアップ元に記録されたCRC32C（S3のChecksumCRC32Cと同じ形式、GetOptions.Checksumを指定した場合のみ）
+	ChecksumCRC32C string
+	StorageClass   string
+
+	// バックアップ先に保存されたデータ（圧縮後）のMD5とCRC32C
+	MD5    []byte
+	CRC32C uint32
+	// バックアップ先の世代（条件付きの更新に使う、世代のない場合は0）
+	Generation int64
+}
+
+// 読み込みの条件
+type GetOptions struct {
+	// 指定した場合、このETagと同じであればErrNotModifiedを返す
+	IfNoneMatch string
+	// 指定した場合、このETagと異なれば失敗する
+	IfMatch string
+	// RangeLengthが0より大きい場合、RangeOffsetからRangeLengthバイトだけを読む
+	RangeOffset int64
+	RangeLength int64
+	// バックアップ元に記録されたチェックサムも取得する
+	Checksum bool
+}
+
+// バックアップ元のストレージ（S3）
+// 新しいバックアップ元やテスト用の偽物は、これを実装すれば転送の処理を変えずに使える
+// 復元では復元先として書き込みにも使う
+type ObjectSource interface {
+	// prefix以下のオブジェクトを、キーの順にstartAfterより後から1ページずつfnに渡す
+	List(ctx context.Context, prefix string, startAfter string, fn func(page []ObjectInfo) error) error
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	Get(ctx context.Context, key string, options GetOptions) (*ObjectInfo, io.ReadCloser, error)
+	// infoのヘッダーとメタデータを付けて書き込む（長さの分からないbodyも書き込める）
+	Put(ctx context.Context, key string, info ObjectInfo, body io.Reader) error
+	Delete(ctx context.Context, key string) error
+}
+
+// バックアップ先に書き込む
+type ObjectWriter interface {
+	io.Writer
+	// 書き込みを完了し、書き込んだオブジェクトの属性を返す
+	Commit() (*ObjectInfo, error)
+	// 書き込みを取り消す（書き込んだデータは保存されない）
+	Abort()
+}
+
+// バックアップ先のストレージ（GCS）
+// 復元では復元元として読み込みに使う
+type ObjectDestination interface {
+	// prefix以下のオブジェクトを1つずつfnに渡す
+	List(ctx context.Context, prefix string, fn func(info *ObjectInfo) error) error
+	// 存在しない場合はErrObjectNotFoundを返す
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	// 保存されたデータを読む（generationが0の場合は最新の世代）
+	Get(ctx context.Context, key string, generation int64) (io.ReadCloser, error)
+	// infoのヘッダーとメタデータを付けて書き込む
+	NewWriter(ctx context.Context, key string, info ObjectInfo) ObjectWriter
+	// メタデータを置き換える（generationが0でない場合は、その世代が最新のときのみ）
+	UpdateMetadata(ctx context.Context, key string, generation int64, metadata map[string]string) error
+	// 存在しない場合はErrObjectNotFoundを返す
+	Delete(ctx context.Context, key string) error
+}
+
+// バックアップ元のオブジェクトのヘッダーとメタデータを、バックアップ先に書き込む属性にする
+// バックアップ用のメタデータを追加するため、メタデータは複製する
+func backupObjectInfo(source *ObjectInfo) ObjectInfo {
+	info := ObjectInfo{
+		Key:                source.Key,
+		ContentType:        source.ContentType,
+		ContentEncoding:    source.ContentEncoding,
+		ContentDisposition: source.ContentDisposition,
+		ContentLanguage:    source.ContentLanguage,
+		CacheControl:       source.CacheControl,
+		Metadata:           make(map[string]string, len(source.Metadata)+4),
+	}
+	for metaKey, value := range source.Metadata {
+		info.Metadata[metaKey] = value
+	}
+	if lastModified := formatLastModified(source.LastModified); lastModified != "" {
+		info.Metadata[metadataSourceLastModified] = lastModified
+	}
+	return info
+}
@@ -0,0 +1,306 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// テスト用のメモリ上のバックアップ元
+type memorySource struct {
+	mu      sync.Mutex
+	objects map[string]*memoryObject
+	// キーごとにGetで返すエラー
+	getErrors map[string]error
+	heads     int
+	gets      int
+}
+
+type memoryObject struct {
+	info ObjectInfo
+	body []byte
+}
+
+func newMemorySource() *memorySource {
+	return &memorySource{objects: map[string]*memoryObject{}, getErrors: map[string]error{}}
+}
+
+// オブジェクトを追加する（ETagは本体のMD5）
+func (s *memorySource) add(key string, body string, info ObjectInfo) {
+	hash := md5.Sum([]byte(body))
+	info.Key = key
+	info.Size = int64(len(body))
+	info.LastModified = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if info.ETag == "" {
+		info.ETag = fmt.Sprintf("%x", hash)
+	}
+	s.objects[key] = &memoryObject{info: info, body: []byte(body)}
+}
+
+func (s *memorySource) List(ctx context.Context, prefix string, startAfter string, fn func(page []ObjectInfo) error) error {
+	s.mu.Lock()
+	keys := slices.Sorted(maps.Keys(s.objects))
+	var page []ObjectInfo
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) && key > startAfter {
+			page = append(page, s.objects[key].info)
+		}
+	}
+	s.mu.Unlock()
+	return fn(page)
+}
+
+func (s *memorySource) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heads++
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	info := object.info
+	info.ChecksumCRC32C = ""
+	return &info, nil
+}
+
+func (s *memorySource) Get(ctx context.Context, key string, options GetOptions) (*ObjectInfo, io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	if err := s.getErrors[key]; err != nil {
+		return nil, nil, err
+	}
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, nil, ErrObjectNotFound
+	}
+	if options.IfNoneMatch != "" && options.IfNoneMatch == object.info.ETag {
+		return nil, nil, ErrNotModified
+	}
+	if options.IfMatch != "" && options.IfMatch != object.info.ETag {
+		return nil, nil, fmt.Errorf("precondition failed: %v", key)
+	}
+	info := object.info
+	if !options.Checksum {
+		info.ChecksumCRC32C = ""
+	}
+	body := object.body
+	if options.RangeLength > 0 {
+		body = body[options.RangeOffset:min(options.RangeOffset+options.RangeLength, int64(len(body)))]
+	}
+	return &info, io.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (s *memorySource) Put(ctx context.Context, key string, info ObjectInfo, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(key, string(data), info)
+	return nil
+}
+
+func (s *memorySource) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// テスト用のメモリ上のバックアップ先
+type memoryDestination struct {
+	mu         sync.Mutex
+	objects    map[string]*memoryObject
+	generation int64
+	aborted    int
+	// UpdateMetadataが呼ばれた回数
+	updates int
+}
+
+func newMemoryDestination() *memoryDestination {
+	return &memoryDestination{objects: map[string]*memoryObject{}}
+}
+
+func (d *memoryDestination) List(ctx context.Context, prefix string, fn func(info *ObjectInfo) error) error {
+	d.mu.Lock()
+	keys := slices.Sorted(maps.Keys(d.objects))
+	var infos []ObjectInfo
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, d.objects[key].info)
+		}
+	}
+	d.mu.Unlock()
+	for _, info := range infos {
+		if err := fn(&info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *memoryDestination) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	object, ok := d.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	info := object.info
+	info.Metadata = maps.Clone(object.info.Metadata)
+	return &info, nil
+}
+
+func (d *memoryDestination) Get(ctx context.Context, key string, generation int64) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	object, ok := d.objects[key]
+	if !ok || (generation != 0 && object.info.Generation != generation) {
+		return nil, ErrObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(object.body)), nil
+}
+
+func (d *memoryDestination) NewWriter(ctx context.Context, key string, info ObjectInfo) ObjectWriter {
+	info.Key = key
+	return &memoryWriter{destination: d, info: info}
+}
+
+func (d *memoryDestination) UpdateMetadata(ctx context.Context, key string, generation int64, metadata map[string]string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	object, ok := d.objects[key]
+	if !ok {
+		return ErrObjectNotFound
+	}
+	if generation != 0 && object.info.Generation != generation {
+		return fmt.Errorf("generation mismatch: %v", key)
+	}
+	object.info.Metadata = maps.Clone(metadata)
+	d.updates++
+	return nil
+}
+
+func (d *memoryDestination) Delete(ctx context.Context, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.objects[key]; !ok {
+		return ErrObjectNotFound
+	}
+	delete(d.objects, key)
+	return nil
+}
+
+type memoryWriter struct {
+	destination *memoryDestination
+	info        ObjectInfo
+	buf         bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Commit() (*ObjectInfo, error) {
+	d := w.destination
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.generation++
+	hash := md5.Sum(w.buf.Bytes())
+	info := w.info
+	info.Size = int64(w.buf.Len())
+	info.MD5 = hash[:]
+	info.CRC32C = crc32.Checksum(w.buf.Bytes(), crc32cTable)
+	info.Generation = d.generation
+	info.Metadata = maps.Clone(w.info.Metadata)
+	d.objects[info.Key] = &memoryObject{info: info, body: bytes.Clone(w.buf.Bytes())}
+	return &info, nil
+}
+
+func (w *memoryWriter) Abort() {
+	w.destination.mu.Lock()
+	defer w.destination.mu.Unlock()
+	w.destination.aborted++
+}
+
+func TestBackupObjectInfo(t *testing.T) {
+	source := &ObjectInfo{
+		Key:                "a.txt",
+		Size:               10,
+		ContentType:        "text/plain",
+		ContentEncoding:    "identity",
+		ContentDisposition: "attachment",
+		ContentLanguage:    "ja",
+		CacheControl:       "no-cache",
+		Metadata:           map[string]string{"owner": "traP"},
+		ETag:               "abc",
+		Generation:         3,
+	}
+	got := backupObjectInfo(source)
+	want := ObjectInfo{
+		Key:                "a.txt",
+		ContentType:        "text/plain",
+		ContentEncoding:    "identity",
+		ContentDisposition: "attachment",
+		ContentLanguage:    "ja",
+		CacheControl:       "no-cache",
+	}
+	gotHeaders := got
+	gotHeaders.Metadata = nil
+	if fmt.Sprint(gotHeaders) != fmt.Sprint(want) {
+		t.Errorf("backupObjectInfo() = %+v, want %+v", gotHeaders, want)
+	}
+	if !maps.Equal(got.Metadata, source.Metadata) {
+		t.Errorf("backupObjectInfo().Metadata = %v, want %v", got.Metadata, source.Metadata)
+	}
+	// バックアップ用のメタデータを追加しても元のメタデータは変わらない
+	got.Metadata[metadataCompression] = compressionSnappy
+	if _, ok := source.Metadata[metadataCompression]; ok {
+		t.Errorf("backupObjectInfo() shares metadata with the source")
+	}
+
+	// LastModifiedがある場合はメタデータに記録する
+	source.LastModified = time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("JST", 9*60*60))
+	if got := backupObjectInfo(source).Metadata[metadataSourceLastModified]; got != "2024-01-01T18:04:05Z" {
+		t.Errorf("backupObjectInfo().Metadata[%v] = %q", metadataSourceLastModified, got)
+	}
+}
+
+func TestGCSMetadataOf(t *testing.T) {
+	c := newBackupConfig()
+	info := ObjectInfo{ContentEncoding: "gzip", Metadata: map[string]string{"owner": "traP"}}
+	got := c.gcsMetadataOf(info)
+	if got[metadataSourceContentEncoding] != "gzip" || got["owner"] != "traP" {
+		t.Errorf("gcsMetadataOf() = %v", got)
+	}
+	// 元のメタデータは変わらない
+	if _, ok := info.Metadata[metadataSourceContentEncoding]; ok {
+		t.Errorf("gcsMetadataOf() modified the source metadata")
+	}
+
+	if got := c.gcsMetadataOf(ObjectInfo{ContentEncoding: "br"}); got[metadataSourceContentEncoding] != "br" {
+		t.Errorf("gcsMetadataOf() without metadata = %v", got)
+	}
+
+	// 解凍トランスコーディングは、元のContent-Encodingが無いgzipのオブジェクトのみ
+	c.gcsTranscoding = true
+	gzipped := ObjectInfo{Metadata: map[string]string{metadataCompression: compressionGzip}}
+	if c.gcsContentEncodingOf(gzipped) != "gzip" || c.gcsMetadataOf(gzipped)[metadataGCSTranscoding] != "true" {
+		t.Errorf("gcsContentEncodingOf() = %q, want gzip", c.gcsContentEncodingOf(gzipped))
+	}
+	gzipped.ContentEncoding = "br"
+	if got := c.gcsContentEncodingOf(gzipped); got != "" {
+		t.Errorf("gcsContentEncodingOf() with source Content-Encoding = %q, want empty", got)
+	}
+}
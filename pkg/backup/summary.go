@@ -0,0 +1,174 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+	"github.com/traPtitech/s3-backup-helper/pkg/buildinfo"
+)
+
+// 実行結果のJSONをアップロードするGCSバケット内のプレフィックス
+const summaryObjectPrefix = backupformat.SummaryPrefix
+
+// 実行結果の概要
+type backupSummary struct {
+	RunID string `json:"runId"`
+	// バックアップしたバイナリのバージョン
+	Version         buildinfo.Info `json:"version"`
+	Bucket          string         `json:"bucket"`
+	Destination     string         `json:"destination"`
+	StartTime       time.Time      `json:"startTime"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	// BACKUP_WINDOWの外で一時停止していた時間（DurationSecondsに含む）
+	PausedSeconds   float64 `json:"pausedSeconds,omitempty"`
+	TotalObjects    int64   `json:"totalObjects"`
+	TotalBytes      int64   `json:"totalBytes"`
+	SkippedObjects  int64   `json:"skippedObjects"`
+	FilteredObjects int64   `json:"filteredObjects"`
+	ArchivedObjects int64   `json:"archivedObjects,omitempty"`
+	Errors          int64   `json:"errors"`
+	// 中断した場合はその理由
+	AbortReason string `json:"abortReason,omitempty"`
+	// MAX_BYTES_PER_RUNに達して停止した場合に、次の実行を始めるキーの直前のキーと、残り（事前に数えた場合のみ）
+	ResumeAfter      string         `json:"resumeAfter,omitempty"`
+	RemainingObjects int64          `json:"remainingObjects,omitempty"`
+	RemainingBytes   int64          `json:"remainingBytes,omitempty"`
+	FailedObjects    []objectError  `json:"failedObjects,omitempty"`
+	Config           configSnapshot `json:"config"`
+}
+
+// バックアップに失敗したオブジェクト
+type objectError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+	// 失敗の原因の分類（auth、not_found、throttled、timeout、network、checksum、archived、other）
+	Category string `json:"category"`
+	// 権限の不足などの場合の直し方
+	Hint string `json:"hint,omitempty"`
+}
+
+func (c *backupConfig) newObjectError(key string, err error) objectError {
+	return objectError{Key: key, Error: err.Error(), Category: classifyError(err), Hint: c.permissionHint(err)}
+}
+
+// 実行時の設定（認証情報は含めない）
+type configSnapshot struct {
+	S3Endpoint            string   `json:"s3Endpoint"`
+	S3Region              string   `json:"s3Region"`
+	S3Bucket              string   `json:"s3Bucket"`
+	S3ConditionalGet      bool     `json:"s3ConditionalGet"`
+	GCPProjectID          string   `json:"gcpProjectId"`
+	GCSRegion             string   `json:"gcsRegion"`
+	GCSStorageClass       string   `json:"gcsStorageClass"`
+	GCSDataLocations      []string `json:"gcsDataLocations,omitempty"`
+	NoncurrentDeleteDays  int64    `json:"noncurrentDeleteDays,omitempty"`
+	MaxNoncurrentVersions int64    `json:"maxNoncurrentVersions,omitempty"`
+	ExportPath            string   `json:"exportPath,omitempty"`
+	AdaptiveConcurrency   bool     `json:"adaptiveConcurrency"`
+	ParallelNum           int64    `json:"parallelNum"`
+	DownloadParallelNum   int64    `json:"downloadParallelNum,omitempty"`
+	UploadParallelNum     int64    `json:"uploadParallelNum,omitempty"`
+	FullBackup            bool     `json:"fullBackup"`
+	Compression           string   `json:"compression"`
+	CompressionLevel      int      `json:"compressionLevel,omitempty"`
+	GCSTranscoding        bool     `json:"gcsTranscoding,omitempty"`
+	MaxBytesPerRun        int64    `json:"maxBytesPerRun,omitempty"`
+	CompositeThreshold    int64    `json:"compositeUploadThreshold,omitempty"`
+	Dedup                 bool     `json:"dedup"`
+	MetadataOnly          bool     `json:"metadataOnly"`
+	BucketConfig          bool     `json:"bucketConfig"`
+	VerifyUploads         string   `json:"verifyUploads,omitempty"`
+	ChangeDetection       string   `json:"changeDetection"`
+	ArchivedObjects       string   `json:"archivedObjects"`
+	DeleteMarkers         string   `json:"deleteMarkers"`
+	MaxErrors             int64    `json:"maxErrors"`
+	ObjectTimeout         string   `json:"objectTimeout"`
+	RunTimeout            string   `json:"runTimeout"`
+	MinObjectSize         int64    `json:"minObjectSize"`
+	MaxObjectSize         int64    `json:"maxObjectSize"`
+	ListingShardDepth     int      `json:"listingShardDepth"`
+	S3InventoryManifest   string   `json:"s3InventoryManifest,omitempty"`
+	KeyPrefixMap          string   `json:"keyPrefixMap,omitempty"`
+	BundlePrefixes        []string `json:"bundlePrefixes,omitempty"`
+	BackupWindow          string   `json:"backupWindow,omitempty"`
+}
+
+func (c *backupConfig) currentConfigSnapshot() configSnapshot {
+	return configSnapshot{
+		S3Endpoint:            c.s3Config.EndPoint,
+		S3Region:              c.s3Config.Region,
+		S3Bucket:              c.s3Config.Bucket,
+		S3ConditionalGet:      c.s3Config.ConditionalGet,
+		GCPProjectID:          c.gcpConfig.ProjectID,
+		GCSRegion:             c.gcpConfig.Region,
+		GCSStorageClass:       c.gcpConfig.StorageClass,
+		GCSDataLocations:      c.gcpConfig.DataLocations,
+		NoncurrentDeleteDays:  c.noncurrentDeleteDays,
+		MaxNoncurrentVersions: c.maxNoncurrentVersions,
+		ExportPath:            c.exportPath,
+		AdaptiveConcurrency:   c.adaptiveConcurrency,
+		ParallelNum:           c.palalellNum,
+		DownloadParallelNum:   c.downloadParallelNum,
+		UploadParallelNum:     c.uploadParallelNum,
+		FullBackup:            c.fullBackup,
+		Compression:           c.compression,
+		CompressionLevel:      c.compressionLevel,
+		GCSTranscoding:        c.gcsTranscoding,
+		MaxBytesPerRun:        c.maxBytesPerRun,
+		CompositeThreshold:    c.compositeUploadThreshold,
+		Dedup:                 c.dedupEnabled,
+		MetadataOnly:          c.metadataOnly,
+		BucketConfig:          c.bucketConfigBackup,
+		VerifyUploads:         c.verifyUploads,
+		ChangeDetection:       c.changeDetection,
+		ArchivedObjects:       c.archivedObjectPolicy,
+		DeleteMarkers:         c.deleteMarkerPolicy,
+		MaxErrors:             c.maxErrors,
+		ObjectTimeout:         c.objectTimeout.String(),
+		RunTimeout:            c.runTimeout.String(),
+		MinObjectSize:         c.minObjectSize,
+		MaxObjectSize:         c.maxObjectSize,
+		ListingShardDepth:     c.listingShardDepth,
+		S3InventoryManifest:   c.s3InventoryManifest,
+		KeyPrefixMap:          formatKeyPrefixMap(c.keyPrefixMap),
+		BundlePrefixes:        c.bundlePrefixes,
+		BackupWindow:          formatTimeWindow(c.backupWindow),
+	}
+}
+
+// SUMMARY_PATHが指定されている場合はファイルに書き出し、
+// SUMMARY_UPLOADが有効な場合はGCSバケットに<実行ID>.jsonとしてアップロードする
+func (c *backupConfig) saveSummary(ctx context.Context, summary *backupSummary, gcsBucket *storage.BucketHandle) error {
+	if c.summaryPath == "" && !c.summaryUpload {
+		return nil
+	}
+
+	summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if c.summaryPath != "" {
+		if err := os.WriteFile(c.summaryPath, summaryJSON, 0o644); err != nil {
+			return err
+		}
+	}
+
+	if c.summaryUpload && gcsBucket != nil {
+		writer := gcsBucket.Object(c.managedObjectName(summaryObjectPrefix + summary.RunID + ".json")).NewWriter(ctx)
+		writer.ContentType = "application/json"
+		if _, err := writer.Write(summaryJSON); err != nil {
+			writer.Close()
+			return fmt.Errorf("failed to upload summary: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return fmt.Errorf("failed to upload summary: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// トレースをOTLPで送る場合true（OTEL_EXPORTER_OTLP_ENDPOINTまたはOTEL_EXPORTER_OTLP_TRACES_ENDPOINTが指定されている場合）
+var tracingEnabled bool
+
+// 一覧の取得、ダウンロード、圧縮、アップロードの各段階のスパンを作る
+// トレースを送らない場合は何もしない
+var tracer = otel.Tracer("github.com/traPtitech/s3-backup-helper")
+
+// OTLPでトレースを送るように設定し、終了時に残りを送る関数を返す
+// 送り先やヘッダーはOTEL_EXPORTER_OTLP_*の環境変数で指定する
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	tracingEnabled = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+	if !tracingEnabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAMEやOTEL_RESOURCE_ATTRIBUTESが指定されていればそちらを優先する
+	serviceResource, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "s3-backup-helper")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(serviceResource),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// リクエストごとにスパンを作るHTTPクライアントにする（接続先ごとの遅さを調べるため）
+func tracedHTTPClient(client *http.Client) *http.Client {
+	if !tracingEnabled {
+		return client
+	}
+	traced := *client
+	transport := traced.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	traced.Transport = otelhttp.NewTransport(transport)
+	return &traced
+}
+
+// エラーがあればスパンに記録してから終了する
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// ダウンロードとアップロードの同時実行数を分けるか
+func (c *backupConfig) splitTransferLimits() bool {
+	return c.downloadParallelNum > 0 || c.uploadParallelNum > 0
+}
+
+// 実行の間、ダウンロードとアップロードの枠を用意する
+// 戻り値の関数で元に戻す
+func (r *backupRun) startTransferSlots() func() {
+	if !r.splitTransferLimits() {
+		return func() {}
+	}
+	r.downloadSlots = semaphore.NewWeighted(r.transferSlotLimit(r.downloadParallelNum))
+	r.uploadSlots = semaphore.NewWeighted(r.transferSlotLimit(r.uploadParallelNum))
+	return func() {
+		r.downloadSlots, r.uploadSlots = nil, nil
+	}
+}
+
+// 同時に行う数の上限（指定されていない場合はPALALELL_NUM）
+func (c *backupConfig) transferSlotLimit(n int64) int64 {
+	if n > 0 {
+		return n
+	}
+	return c.palalellNum
+}
+
+// 枠を1つ取得し、空くまで待つ（枠がnilの場合は待たない）
+// 戻り値の関数で枠を返す（複数回呼んでもよい）
+func acquireSlot(ctx context.Context, slots *semaphore.Weighted) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+	if err := slots.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return sync.OnceFunc(func() { slots.Release(1) }), nil
+}
+
+// アップロードを待つ間、圧縮したデータを置く一時ファイルを作る
+func (c *backupConfig) createSpoolFile() (*os.File, error) {
+	file, err := os.CreateTemp(c.spoolDir, "s3-backup-helper-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	return file, nil
+}
+
+// 一時ファイルを閉じて削除する
+func (r *backupRun) removeSpoolFile(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		r.logWarnf("Failed to remove spool file %v: %v", file.Name(), err)
+	}
+}
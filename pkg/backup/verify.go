@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// アップロードの検証方法
+const (
+	// アップロードした圧縮データのCRC32CをGCSが計算したものと比較する
+	verifyCRC32C = "crc32c"
+	// CRC32Cに加えて、アップロードしたオブジェクトを読み直して解凍し、元のデータのMD5と比較する
+	verifyFull = "full"
+)
+
+// GCSのCRC32Cの計算に使う表
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// アップロードしたオブジェクトを検証する
+// 検証に失敗した場合は、バックアップに成功したとみなさないようにエラーを返す
+func (c *backupConfig) verifyUpload(ctx context.Context, destination ObjectDestination, key string, written *ObjectInfo, compressedCRC32C uint32, originalMD5 []byte) error {
+	return c.verifyWrittenObject(ctx, destination, key, written, compressedCRC32C, "MD5", md5.New(), originalMD5)
+}
+
+// パートに分けてアップロードしたオブジェクトを検証する
+// 元のデータ全体のMD5は求めていないため、解凍したデータは元のデータのCRC32Cと比較する
+func (c *backupConfig) verifyCompositeUpload(ctx context.Context, destination ObjectDestination, key string, written *ObjectInfo, compressedCRC32C uint32, originalCRC32C uint32) error {
+	return c.verifyWrittenObject(ctx, destination, key, written, compressedCRC32C, "CRC32C", crc32.New(crc32cTable), binary.BigEndian.AppendUint32(nil, originalCRC32C))
+}
+
+// 圧縮データのCRC32Cを比較し、VERIFY_UPLOADS=fullの場合は読み直して解凍したデータのハッシュをoriginalと比較する
+func (c *backupConfig) verifyWrittenObject(ctx context.Context, destination ObjectDestination, key string, written *ObjectInfo, compressedCRC32C uint32, hashName string, hash hash.Hash, original []byte) error {
+	if c.verifyUploads == "" {
+		return nil
+	}
+	if written.CRC32C != compressedCRC32C {
+		return fmt.Errorf("upload verification failed: CRC32C mismatch: uploaded %08x, stored %08x", compressedCRC32C, written.CRC32C)
+	}
+	if c.verifyUploads != verifyFull {
+		return nil
+	}
+
+	// 書き込んだ世代を読み直して解凍する
+	reader, err := destination.Get(ctx, key, written.Generation)
+	if err != nil {
+		return fmt.Errorf("upload verification failed: %w", err)
+	}
+	defer reader.Close()
+	decompressReader, err := newDecompressReader(reader, objectCompression(written.Metadata))
+	if err != nil {
+		return fmt.Errorf("upload verification failed: %w", err)
+	}
+	defer decompressReader.Close()
+	if _, err := io.Copy(hash, decompressReader); err != nil {
+		return fmt.Errorf("upload verification failed: %w", err)
+	}
+	if !bytes.Equal(hash.Sum(nil), original) {
+		return fmt.Errorf("upload verification failed: %v mismatch after decompression: original %x, stored %x", hashName, original, hash.Sum(nil))
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// テンプレートから使える関数
+var webhookTemplateFuncs = template.FuncMap{
+	"formatBytes": formatBytes,
+	"formatTime": func(t time.Time) string {
+		return t.Format("2006/01/02 15:04:05")
+	},
+}
+
+// 通知のテンプレートを読み込む
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(webhookTemplateFuncs).Parse(text)
+}
+
+// 実行結果の通知文を作る
+// テンプレートが指定されている場合はそれを使い、失敗した場合は既定の通知文を使う
+func (r *backupRun) renderWebhookMessage(summary *backupSummary, defaultMessage string) string {
+	if r.webhookTemplate == nil {
+		return defaultMessage
+	}
+	var message strings.Builder
+	if err := r.webhookTemplate.Execute(&message, summary); err != nil {
+		r.logErrorf("Failed to render webhook template: %v", err)
+		return defaultMessage
+	}
+	return message.String()
+}
+
+// 通知の条件
+type notifyPolicyStruct struct {
+	// trueの場合、完了した実行はエラーがあるか、以下の条件のいずれかに当てはまるときのみ通知する
+	// （中断した場合は常に通知する）
+	OnlyOnIssues bool
+	// スキップされたオブジェクトの割合がこの値未満（0の場合は判定しない）
+	MinSkipRatio float64
+	// 所要時間がこの値を超えた（0の場合は判定しない）
+	MaxDuration time.Duration
+}
+
+// 完了した実行を通知すべきかどうか
+func (c *backupConfig) shouldNotify(summary *backupSummary) bool {
+	if !c.notifyPolicy.OnlyOnIssues || summary.AbortReason != "" {
+		return true
+	}
+	if summary.Errors > 0 {
+		return true
+	}
+	if c.notifyPolicy.MinSkipRatio > 0 && summary.TotalObjects > 0 &&
+		float64(summary.SkippedObjects)/float64(summary.TotalObjects) < c.notifyPolicy.MinSkipRatio {
+		return true
+	}
+	if c.notifyPolicy.MaxDuration > 0 && summary.DurationSeconds > c.notifyPolicy.MaxDuration.Seconds() {
+		return true
+	}
+	return false
+}
+
+// Webhookを再送するまでの待ち時間の初期値と上限（失敗するごとに2倍にする）
+const (
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = 30 * time.Second
+)
+
+// Webhookの1回の送信（応答の本文の読み込みまで）の時間の上限
+// 送信先が応答しない場合に、通知で実行が終わらなくなるのを防ぐ
+const webhookTimeout = 30 * time.Second
+
+// 実行結果をtraQと追加の通知先、設定されている場合はメールで通知する
+// どこにも送れなかった場合は予備の送信先に送り、「バックアップが終わった」という通知が黙って失われないようにする
+func (r *backupRun) notifyResult(summary *backupSummary, message string) {
+	if err := r.notifyAll(summary, message); err != nil {
+		r.logErrorf("%v", err)
+		if r.webhookFallbackURL != "" {
+			if err := r.postFallbackWebhook(message); err != nil {
+				r.logErrorf("Failed to send webhook to fallback URL: %v", err)
+			} else {
+				r.logInfof("Sent webhook to fallback URL instead")
+			}
+		}
+	}
+	r.sendEmail(message)
+}
+
+// traQにWebhookを送信する
+// 通信エラー、429、5xxの場合は待ち時間を延ばしながら再送し、最後まで失敗した場合はエラーを返す
+func (r *backupRun) postWebhook(message string, webhookUrl string, webhookId string, webhookSecret string) error {
+	webhookFullUrl := webhookUrl + webhookId
+
+	// Webhookの署名を生成
+	mac := hmac.New(sha1.New, []byte(webhookSecret))
+	_, _ = mac.Write([]byte(message))
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	return r.retryWebhook(func() (bool, error) {
+		req, err := http.NewRequest("POST", webhookFullUrl, strings.NewReader(message))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		req.Header.Set("X-TRAQ-Signature", sig)
+		return r.sendWebhookRequest(req, "traQ")
+	})
+}
+
+// 予備の送信先に通知文をそのままPOSTする
+func (r *backupRun) postFallbackWebhook(message string) error {
+	return r.retryWebhook(func() (bool, error) {
+		req, err := http.NewRequest("POST", r.webhookFallbackURL, strings.NewReader(message))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		return r.sendWebhookRequest(req, "fallback URL")
+	})
+}
+
+// リクエストを1回送る
+// 失敗した場合は、再送すれば成功する可能性があるかどうかも返す
+func (r *backupRun) sendWebhookRequest(req *http.Request, name string) (bool, error) {
+	httpClient, err := r.newHTTPClient()
+	if err != nil {
+		return false, err
+	}
+	// 共有のクライアントはS3の転送にも使うため、Timeoutではなくリクエストごとの期限で打ち切る
+	ctx, cancel := context.WithTimeout(req.Context(), webhookTimeout)
+	defer cancel()
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return true, err
+	}
+
+	fmt.Fprintf(r.stdout, "Sent webhook to %s: statusCode: %d, body: %s\n", name, res.StatusCode, body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		retryable := res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		return retryable, fmt.Errorf("webhook returned %v", res.Status)
+	}
+	return false, nil
+}
+
+// 再送できる失敗の間、WEBHOOK_MAX_ATTEMPTS回まで送信を試みる
+func (r *backupRun) retryWebhook(send func() (bool, error)) error {
+	backoff := webhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		retryable, err := send()
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= r.webhookMaxAttempts {
+			return fmt.Errorf("giving up after %d attempt(s): %w", attempt, err)
+		}
+		r.logWarnf("Failed to send webhook (attempt %d/%d), retrying in %v: %v", attempt, r.webhookMaxAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
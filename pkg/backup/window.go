@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	// コンテナにタイムゾーンのデータが無くてもBACKUP_WINDOW_TIMEZONEを使えるようにする
+	_ "time/tzdata"
+)
+
+// 1日のうちの時間帯（終了が開始より前の場合は日付をまたぐ）
+type timeWindow struct {
+	// 0時からの経過時間
+	start, end time.Duration
+	location   *time.Location
+}
+
+// "HH:MM-HH:MM"の形式の時間帯を読み込む
+func parseTimeWindow(value string, location *time.Location) (*timeWindow, error) {
+	startValue, endValue, found := strings.Cut(value, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid time window: %q", value)
+	}
+	start, err := parseTimeOfDay(startValue)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(endValue)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid time window: %q (start equals end)", value)
+	}
+	return &timeWindow{start: start, end: end, location: location}, nil
+}
+
+// "HH:MM"を0時からの経過時間に変換する
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// その日の0時
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// 時刻が時間帯に含まれるか
+func (w *timeWindow) Contains(t time.Time) bool {
+	t = t.In(w.location)
+	offset := t.Sub(startOfDay(t))
+	if w.start < w.end {
+		return w.start <= offset && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// 時刻以降で、次に時間帯が始まる時刻
+func (w *timeWindow) NextStart(t time.Time) time.Time {
+	t = t.In(w.location)
+	next := startOfDay(t).Add(w.start)
+	if !next.After(t) {
+		next = startOfDay(t).AddDate(0, 0, 1).Add(w.start)
+	}
+	return next
+}
+
+func (w *timeWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%v-%v %v", format(w.start), format(w.end), w.location)
+}
+
+// 時間帯をBACKUP_WINDOWの形式とタイムゾーンで表す（制限しない場合は空）
+func formatTimeWindow(window *timeWindow) string {
+	if window == nil {
+		return ""
+	}
+	return window.String()
+}
+
+// 時間帯の外の場合に、時間帯が始まるまで一時停止する
+// 処理中のオブジェクトが終わるのを待ってから停止した位置を保存し、停止中にプロセスが終了しても次の実行で続きから再開できるようにする
+// 一時停止した時間を返す
+func (r *backupRun) pauseUntilWindow(ctx context.Context, window *timeWindow, inFlight func() bool, savePosition func() error) time.Duration {
+	pauseStartTime := time.Now()
+	r.logInfof("Outside BACKUP_WINDOW (%v), pausing", window)
+	ticker := time.NewTicker(time.Second)
+	for inFlight() {
+		select {
+		case <-ctx.Done():
+			ticker.Stop()
+			return time.Since(pauseStartTime)
+		case <-ticker.C:
+		}
+	}
+	ticker.Stop()
+	if err := savePosition(); err != nil {
+		r.logErrorf("%v", err)
+	}
+
+	resumeTime := window.NextStart(time.Now())
+	r.logInfof("Paused until %v", resumeTime.Format(time.RFC3339))
+	timer := time.NewTimer(time.Until(resumeTime))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+		r.logInfof("Resuming backup")
+	}
+	return time.Since(pauseStartTime)
+}
@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, jst)
+	}
+	tests := []struct {
+		window        string
+		now           time.Time
+		wantContains  bool
+		wantNextStart time.Time
+	}{
+		{window: "01:00-07:00", now: at(1, 0, 59), wantContains: false, wantNextStart: at(1, 1, 0)},
+		{window: "01:00-07:00", now: at(1, 1, 0), wantContains: true, wantNextStart: at(2, 1, 0)},
+		{window: "01:00-07:00", now: at(1, 7, 0), wantContains: false, wantNextStart: at(2, 1, 0)},
+		// 日付をまたぐ時間帯
+		{window: "22:00-05:30", now: at(1, 23, 0), wantContains: true, wantNextStart: at(2, 22, 0)},
+		{window: "22:00-05:30", now: at(2, 5, 29), wantContains: true, wantNextStart: at(2, 22, 0)},
+		{window: "22:00-05:30", now: at(2, 12, 0), wantContains: false, wantNextStart: at(2, 22, 0)},
+		// 別のタイムゾーンの時刻も時間帯のタイムゾーンで判定する
+		{window: "01:00-07:00", now: time.Date(2023, 12, 31, 17, 0, 0, 0, time.UTC), wantContains: true, wantNextStart: at(2, 1, 0)},
+	}
+	for _, tt := range tests {
+		window, err := parseTimeWindow(tt.window, jst)
+		if err != nil {
+			t.Fatalf("parseTimeWindow(%q) returned error: %v", tt.window, err)
+		}
+		if got := window.Contains(tt.now); got != tt.wantContains {
+			t.Errorf("%v: Contains(%v) = %v, want %v", tt.window, tt.now, got, tt.wantContains)
+		}
+		if got := window.NextStart(tt.now); !got.Equal(tt.wantNextStart) {
+			t.Errorf("%v: NextStart(%v) = %v, want %v", tt.window, tt.now, got, tt.wantNextStart)
+		}
+	}
+
+	for _, value := range []string{"01:00", "25:00-07:00", "01:00-01:00", "1-7"} {
+		if _, err := parseTimeWindow(value, jst); err == nil {
+			t.Errorf("parseTimeWindow(%q) returned no error", value)
+		}
+	}
+}
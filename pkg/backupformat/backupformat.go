@@ -0,0 +1,70 @@
+// バックアップとリストアで共通の、バックアップ先に置くオブジェクトの名前とメタデータのキー
+// 片方だけ変えるとリストアできなくなるため、名前はここでのみ定義する
+package backupformat
+
+import "strings"
+
+// バックアップツールが管理用に置くオブジェクトの接頭辞（バックアップ先のプレフィックスからの相対）
+const ManagedPrefix = ".s3-backup-helper"
+
+// 管理用のオブジェクト（バックアップ先のプレフィックスからの相対）
+const (
+	// 実行中のバックアップのロック
+	LockObjectName = ManagedPrefix + ".lock"
+	// 中断したバックアップの再開位置
+	ResumePointObjectName = ManagedPrefix + "/resume.json"
+	// 内容のハッシュを名前にした重複排除用のオブジェクト
+	BlobPrefix = ManagedPrefix + "/blobs/"
+	// 小さいオブジェクトをまとめたもの
+	BundlePrefix = ManagedPrefix + "/bundles/"
+	// S3のバケットの設定
+	BucketConfigObjectName = ManagedPrefix + "/bucket-config.json"
+	// S3で最新のバージョンが削除マーカーになっているキーの一覧
+	DeleteMarkersObjectName = ManagedPrefix + "/delete-markers.json"
+	// 実行ごとのマニフェスト
+	ManifestPrefix = ManagedPrefix + "/manifests/"
+	// 実行ごとの結果
+	SummaryPrefix = ManagedPrefix + "/summaries/"
+	// 監査ログ
+	AuditPrefix = ManagedPrefix + "/audit/"
+	// 大きいオブジェクトを分割してアップロードした部分
+	CompositePartPrefix = ManagedPrefix + "/parts/"
+	// 分割してアップロードした部分の一覧
+	CompositeIndexPrefix = ManagedPrefix + "/part-indexes/"
+)
+
+// バックアップしたオブジェクトに付けるメタデータのキー
+const (
+	// このツールが付けるメタデータのキーの接頭辞
+	MetadataPrefix = "x-backup-"
+	// 圧縮前のデータのMD5（16進数）
+	MetadataOriginalMD5 = MetadataPrefix + "original-md5"
+	// 圧縮前のデータのCRC32C（S3のChecksumCRC32Cと同じ形式）
+	MetadataOriginalCRC32C = MetadataPrefix + "original-crc32c"
+	// 圧縮前のデータのサイズ（バイト）
+	MetadataOriginalSize = MetadataPrefix + "original-size"
+	// 圧縮形式（snappy、gzip、zstd、none）
+	MetadataCompression = MetadataPrefix + "compression"
+	// バックアップした時刻（RFC 3339）
+	MetadataBackupTime = MetadataPrefix + "time"
+	// バックアップしたS3のオブジェクトのETag（前後の"を除く）
+	MetadataSourceETag = MetadataPrefix + "source-etag"
+	// バックアップしたS3のオブジェクトのLastModified（RFC 3339）
+	// S3のLastModifiedは復元時に指定できないため、復元したオブジェクトのメタデータやファイルの更新日時に使う
+	MetadataSourceLastModified = MetadataPrefix + "source-last-modified"
+	// バックアップしたS3のオブジェクトのContent-Encoding
+	// 本体はさらにこのツールで圧縮しているため、GCSのContent-Encodingには付けない
+	MetadataSourceContentEncoding = MetadataPrefix + "source-content-encoding"
+	// GCSのContent-Encodingにgzipを付け、解凍トランスコーディングで読めるようにしたもの（"true"）
+	MetadataGCSTranscoding = MetadataPrefix + "gcs-transcoding"
+	// 重複排除したオブジェクトの内容のSHA-256（16進数）
+	MetadataContentSHA256 = MetadataPrefix + "content-sha256"
+	// 分割してアップロードしたオブジェクトの部分の数
+	MetadataCompositeParts = MetadataPrefix + "composite-parts"
+)
+
+// 管理用のオブジェクトか
+// 名前はバックアップ先のプレフィックスからの相対で、.s3-backup-helper-notes.txtのようなオブジェクトは含まない
+func IsManagedObject(name string) bool {
+	return strings.HasPrefix(name, ManagedPrefix+"/") || name == LockObjectName
+}
@@ -0,0 +1,91 @@
+// バイナリのバージョンとビルド情報
+// どのバイナリがバックアップを作ったか、実行結果や通知から分かるようにする
+//
+// ビルド時に埋め込む場合:
+//
+//	go build -ldflags "-X github.com/traPtitech/s3-backup-helper/pkg/buildinfo.version=v1.2.3 -X github.com/traPtitech/s3-backup-helper/pkg/buildinfo.commit=$(git rev-parse HEAD) -X github.com/traPtitech/s3-backup-helper/pkg/buildinfo.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// 埋め込まなかった場合は、Goがバイナリに記録したモジュールのバージョンとVCSの情報を使う
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// -ldflags "-X ..."で埋め込む値
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// バージョンとビルド情報
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// 実行中のバイナリのバージョンとビルド情報
+func Get() Info {
+	info := Info{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		// go installでバージョンを指定してインストールした場合はモジュールのバージョンが記録される
+		if info.Version == "" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+			info.Version = build.Main.Version
+		}
+		// リポジトリ内でビルドした場合はコミットとその日時が記録される
+		modified := false
+		vcsTime := ""
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				vcsTime = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if info.BuildDate == "" {
+			info.BuildDate = vcsTime
+		}
+		if modified && commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+// 1行で表示する形式（"v1.2.3 (commit abcdef0, built 2024-01-01T00:00:00Z, go1.23.2)"）
+func (i Info) String() string {
+	s := i.Version + " ("
+	if i.Commit != "" {
+		s += fmt.Sprintf("commit %v, ", shortCommit(i.Commit))
+	}
+	if i.BuildDate != "" {
+		s += fmt.Sprintf("built %v, ", i.BuildDate)
+	}
+	return s + i.GoVersion + ")"
+}
+
+// コミットハッシュの先頭7文字（"-dirty"は残す）
+func shortCommit(commit string) string {
+	hash, dirty := strings.CutSuffix(commit, "-dirty")
+	if len(hash) > 7 {
+		hash = hash[:7]
+	}
+	if dirty {
+		hash += "-dirty"
+	}
+	return hash
+}
@@ -0,0 +1,29 @@
+package buildinfo
+
+import "testing"
+
+func TestInfoString(t *testing.T) {
+	tests := []struct {
+		info Info
+		want string
+	}{
+		{Info{Version: "v1.2.3", Commit: "0123456789abcdef", BuildDate: "2024-01-01T00:00:00Z", GoVersion: "go1.23.2"}, "v1.2.3 (commit 0123456, built 2024-01-01T00:00:00Z, go1.23.2)"},
+		{Info{Version: "dev", Commit: "0123456789abcdef-dirty", GoVersion: "go1.23.2"}, "dev (commit 0123456-dirty, go1.23.2)"},
+		{Info{Version: "dev", GoVersion: "go1.23.2"}, "dev (go1.23.2)"},
+	}
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	// 埋め込んだ値を優先する
+	version, commit, buildDate = "v9.9.9", "abcdef0123", "2024-01-01T00:00:00Z"
+	defer func() { version, commit, buildDate = "", "", "" }()
+	info := Get()
+	if info.Version != "v9.9.9" || info.Commit != "abcdef0123" || info.BuildDate != "2024-01-01T00:00:00Z" || info.GoVersion == "" {
+		t.Errorf("Get() = %+v", info)
+	}
+}
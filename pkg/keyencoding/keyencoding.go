@@ -0,0 +1,122 @@
+// バックアップとリストアで共通の、S3のキーとGCSのオブジェクト名の変換
+// GCSのオブジェクト名として使えないキーはエスケープし、元のキーをメタデータに記録する
+// どのようなキー（Unicode、空白、+、%、制御文字、UTF-8として不正なバイト列）も、バックアップして復元すると同じバイト列に戻る
+package keyencoding
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+// エスケープしたオブジェクトを置くプレフィックス（バックアップ先のプレフィックスからの相対）
+// このプレフィックスで始まるキーも、エスケープしたオブジェクトと区別できるようエスケープする
+const EscapedPrefix = ".s3-backup-escaped/"
+
+// 区切りごとにURLエンコードした名前と、キーのハッシュを名前にしたもの
+const (
+	escapedKeyPrefix  = EscapedPrefix + "key/"
+	escapedHashPrefix = EscapedPrefix + "sha256/"
+)
+
+// エスケープしたオブジェクトに元のキーを記録するメタデータのキー
+const MetadataKey = "x-backup-original-key"
+
+// GCSのオブジェクト名の長さの上限（UTF-8のバイト数）
+const MaxObjectNameLength = 1024
+
+// バックアップ先のプレフィックスの長さの上限（ハッシュを名前にしたオブジェクトが上限に収まるようにする）
+const MaxPrefixLength = MaxObjectNameLength - len(escapedHashPrefix) - sha256.Size*2
+
+// GCSのオブジェクト名として使えないか、問題のあるキーか
+// プレフィックスはバックアップ先のバケット内のプレフィックス（空または/で終わる）
+// https://cloud.google.com/storage/docs/objects#naming
+func NeedsEscape(prefix, key string) bool {
+	name := prefix + key
+	if len(name) > MaxObjectNameLength || !utf8.ValidString(key) {
+		return true
+	}
+	if name == "." || name == ".." || strings.HasPrefix(name, ".well-known/acme-challenge/") {
+		return true
+	}
+	if strings.HasPrefix(key, EscapedPrefix) {
+		return true
+	}
+	// 管理用のオブジェクト（ロック、再開位置、重複排除した本体など）の名前と重ならないようにする
+	if backupformat.IsManagedObject(key) {
+		return true
+	}
+	// 改行は使えず、その他の制御文字もXML APIなどで扱えないため避ける
+	for _, r := range key {
+		if r < 0x20 || r >= 0x7f && r <= 0x9f {
+			return true
+		}
+	}
+	return false
+}
+
+// キーをオブジェクト名（プレフィックスからの相対）にする
+// エスケープが不要な場合はそのまま返し、falseを返す
+// 通常は区切りごとにURLエンコードした名前にし、長すぎる場合はキーのハッシュを名前にする
+// エスケープした場合は、EncodeMetadataで元のキーをメタデータに記録する
+func EscapeObjectName(prefix, key string) (string, bool) {
+	if !NeedsEscape(prefix, key) {
+		return key, false
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		switch segment {
+		case ".":
+			segments[i] = "%2E"
+		case "..":
+			segments[i] = "%2E%2E"
+		default:
+			segments[i] = url.PathEscape(segment)
+		}
+	}
+	name := escapedKeyPrefix + strings.Join(segments, "/")
+	if len(prefix+name) > MaxObjectNameLength {
+		sum := sha256.Sum256([]byte(key))
+		name = escapedHashPrefix + hex.EncodeToString(sum[:])
+	}
+	return name, true
+}
+
+// エスケープしたオブジェクト名（プレフィックスからの相対）から元のキーを求める
+// エスケープしていない名前はそのまま返す
+// ハッシュを名前にしたものは名前から戻せないため、メタデータを使う（falseを返す）
+func UnescapeObjectName(name string) (string, bool) {
+	if !strings.HasPrefix(name, EscapedPrefix) {
+		return name, true
+	}
+	rest, ok := strings.CutPrefix(name, escapedKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	key, err := url.PathUnescape(rest)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// 元のキーをメタデータに記録する値にする
+// メタデータはHTTPヘッダーで送られるため、制御文字や非ASCII文字を含まない形にする
+func EncodeMetadata(key string) string {
+	return url.PathEscape(key)
+}
+
+// メタデータに記録した値から元のキーを求める
+// "+"は空白にしない（url.QueryUnescapeとは異なる）
+func DecodeMetadata(value string) (string, error) {
+	key, err := url.PathUnescape(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid %v: %w", MetadataKey, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,156 @@
+package keyencoding
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+// 復元時に名前が変わってしまったことのあるキーなど
+var exoticKeys = []string{
+	"a b/c d.txt",
+	"a+b/c+d.txt",
+	"100%/50%25.txt",
+	"日本語/ファイル名.txt",
+	"emoji/🍣.png",
+	"line\r\nbreak",
+	"tab\there",
+	"nul\x00byte",
+	"del\x7f/c1\u0085",
+	"invalid\xff\xfeutf8",
+	"?query=1&x=y#fragment",
+	"trailing/",
+	"//double//slash",
+	".",
+	"..",
+	"./a/../b",
+	".well-known/acme-challenge/token",
+	EscapedPrefix + "key/a",
+	EscapedPrefix + "sha256/0000",
+	backupformat.LockObjectName,
+	backupformat.ResumePointObjectName,
+	backupformat.BlobPrefix + "0000",
+	backupformat.BundlePrefix + "run/index.json",
+	backupformat.AuditPrefix + "run.json",
+	backupformat.CompositePartPrefix + "key/0",
+	backupformat.ManagedPrefix + "/",
+	backupformat.ManagedPrefix + "-notes.txt",
+	strings.Repeat("長", 400),
+}
+
+// バックアップしたオブジェクト名とメタデータから、元のキーと同じバイト列に戻ることを確認する
+func checkRoundTrip(t *testing.T, prefix, key string) {
+	t.Helper()
+	name, escaped := EscapeObjectName(prefix, key)
+	if !escaped {
+		if name != key {
+			t.Fatalf("EscapeObjectName(%q, %q) = %q without escaping", prefix, key, name)
+		}
+		// エスケープしないキーは、エスケープしたオブジェクトや管理用のオブジェクトと区別できる
+		if strings.HasPrefix(name, EscapedPrefix) || backupformat.IsManagedObject(name) {
+			t.Fatalf("EscapeObjectName(%q, %q) = %q is not escaped", prefix, key, name)
+		}
+		return
+	}
+
+	// エスケープした名前はGCSのオブジェクト名として使える
+	if NeedsEscape(prefix, name) && !strings.HasPrefix(name, EscapedPrefix) {
+		t.Fatalf("EscapeObjectName(%q, %q) = %q is not a valid object name", prefix, key, name)
+	}
+	if len(prefix+name) > MaxObjectNameLength || !utf8.ValidString(name) {
+		t.Fatalf("EscapeObjectName(%q, %q) = %q is not a valid object name", prefix, key, name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r >= 0x7f {
+			t.Fatalf("EscapeObjectName(%q, %q) = %q contains %q", prefix, key, name, r)
+		}
+	}
+
+	// メタデータから元のキーに戻る
+	value := EncodeMetadata(key)
+	for _, r := range value {
+		if r < 0x20 || r >= 0x7f {
+			t.Fatalf("EncodeMetadata(%q) = %q contains %q", key, value, r)
+		}
+	}
+	decoded, err := DecodeMetadata(value)
+	if err != nil {
+		t.Fatalf("DecodeMetadata(%q) returned error: %v", value, err)
+	}
+	if decoded != key {
+		t.Fatalf("DecodeMetadata(EncodeMetadata(%q)) = %q", key, decoded)
+	}
+
+	// ハッシュにしたもの以外は名前からも戻る
+	if unescaped, ok := UnescapeObjectName(name); ok && unescaped != key {
+		t.Fatalf("UnescapeObjectName(%q) = %q, want %q", name, unescaped, key)
+	} else if !ok && !strings.HasPrefix(name, escapedHashPrefix) {
+		t.Fatalf("UnescapeObjectName(%q) failed", name)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, prefix := range []string{"", "cluster-a/", strings.Repeat("p", MaxPrefixLength-1) + "/"} {
+		for _, key := range exoticKeys {
+			checkRoundTrip(t, prefix, key)
+		}
+	}
+}
+
+func TestEscapeObjectName(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		key     string
+		want    string
+		escaped bool
+	}{
+		{key: "a b+c%d/日本語", want: "a b+c%d/日本語"},
+		{key: "line\r\nbreak", want: escapedKeyPrefix + "line%0D%0Abreak", escaped: true},
+		{key: "..", want: escapedKeyPrefix + "%2E%2E", escaped: true},
+		{prefix: "cluster-a/", key: "..", want: ".."},
+		{key: ".well-known/acme-challenge/token", want: escapedKeyPrefix + ".well-known/acme-challenge/token", escaped: true},
+		{key: ".s3-backup-helper.lock", want: escapedKeyPrefix + ".s3-backup-helper.lock", escaped: true},
+		{prefix: "cluster-a/", key: ".s3-backup-helper/resume.json", want: escapedKeyPrefix + ".s3-backup-helper/resume.json", escaped: true},
+		{key: ".s3-backup-helper-notes.txt", want: ".s3-backup-helper-notes.txt"},
+	}
+	for _, tt := range tests {
+		got, escaped := EscapeObjectName(tt.prefix, tt.key)
+		if got != tt.want || escaped != tt.escaped {
+			t.Errorf("EscapeObjectName(%q, %q) = %q, %v, want %q, %v", tt.prefix, tt.key, got, escaped, tt.want, tt.escaped)
+		}
+	}
+}
+
+// 異なるキーは異なるオブジェクト名になる
+func TestEscapeObjectNameIsInjective(t *testing.T) {
+	names := make(map[string]string)
+	var keys []string
+	for _, key := range exoticKeys {
+		// エスケープしたものとしていないもの、似た形のものを組み合わせる
+		name, _ := EscapeObjectName("", key)
+		keys = append(keys, key, name, strings.ReplaceAll(key, "%", "%25"), strings.ReplaceAll(key, " ", "+"))
+	}
+	for _, key := range keys {
+		name, _ := EscapeObjectName("", key)
+		if other, ok := names[name]; ok && other != key {
+			t.Errorf("EscapeObjectName returned %q for both %q and %q", name, key, other)
+		}
+		names[name] = key
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, key := range exoticKeys {
+		f.Add("", key)
+		f.Add("cluster-a/", key)
+	}
+	f.Fuzz(func(t *testing.T, prefix, key string) {
+		// プレフィックスは設定で正規化されたもの（空または/で終わる有効なもの）
+		if prefix != "" && (!strings.HasSuffix(prefix, "/") || len(prefix) > MaxPrefixLength || NeedsEscape("", prefix)) {
+			t.Skip()
+		}
+		checkRoundTrip(t, prefix, key)
+	})
+}
@@ -0,0 +1,1661 @@
+package restore
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/golang/snappy"
+	"github.com/joho/godotenv"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mattn/go-isatty"
+	"github.com/traPtitech/s3-backup-helper/pkg/backup"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+	"github.com/traPtitech/s3-backup-helper/pkg/buildinfo"
+	"github.com/traPtitech/s3-backup-helper/pkg/keyencoding"
+	"github.com/traPtitech/s3-backup-helper/pkg/secrets"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// S3設定（バケットも含む）
+type s3ConfigStruct struct {
+	Region    string
+	EndPoint  string
+	AccessKey string
+	SecretKey string
+	// 一時的な認証情報の場合のセッショントークン
+	SessionToken   string
+	Bucket         string
+	ForcePathStyle bool
+	// リクエスタ支払いバケットの場合true
+	RequesterPays bool
+	// 指定した場合、このロールを引き受けてからS3にアクセスする（クロスアカウントのバケット向け）
+	RoleARN    string
+	ExternalID string
+}
+
+// GCP設定
+type gcpConfigStruct struct {
+	CredentialsPath string
+	// サービスアカウントのJSON（指定された場合はCredentialsPathより優先する）
+	CredentialsJSON []byte
+	ProjectID       string
+	Region          string
+	Bucket          string
+	// リクエスタ支払いバケットの場合に課金先とするプロジェクト
+	UserProject string
+	// 指定した場合、このサービスアカウントになりすましてGCSにアクセスする
+	ImpersonateServiceAccount string
+}
+
+// 外部との通信の設定
+type httpConfigStruct struct {
+	ProxyURL           string
+	CABundlePath       string
+	InsecureSkipVerify bool
+}
+
+// バックアップ時に記録したS3の削除マーカーの扱い
+const (
+	// 削除されたキーは復元しない（S3の最新の状態を再現する）
+	deleteMarkersHonor = "honor"
+	// 削除マーカーを無視し、削除されたキーもバックアップから復元する
+	deleteMarkersIgnore = "ignore"
+)
+
+// 復元の設定
+// 実行ごとに複製して使い、実行中は変更しない
+type restoreConfig struct {
+	s3Config   s3ConfigStruct
+	gcpConfig  gcpConfigStruct
+	httpConfig httpConfigStruct
+
+	// ローカル復元先（指定した場合はS3の代わりに書き出す）
+	localRestorePath string
+
+	// 復元するバケットの対応
+	bucketMappings []BucketMapping
+
+	// 復元先のキーのプレフィックスの書き換え規則
+	keyPrefixMap []keyPrefixMapping
+
+	// 1秒あたりに復元するオブジェクト数の上限（制限しない場合は0）
+	maxOpsPerSec float64
+
+	// 1秒あたりに復元するバイト数の上限（制限しない場合は0）
+	maxBytesPerSec int64
+
+	// 復元済みのオブジェクトを記録するファイル（指定した場合は途中から再開できる）
+	restoreStatePath string
+
+	// 1オブジェクトずつキーを出力するか
+	verboseRestore bool
+
+	// 標準出力が端末でない場合に進捗を出力する間隔
+	restoreProgressLogInterval time.Duration
+
+	// 復元元のGCSバケットに監査記録をアップロードするか
+	auditLog bool
+
+	deleteMarkerPolicy string
+}
+
+// デフォルトの設定
+func newRestoreConfig() *restoreConfig {
+	return &restoreConfig{
+		// 復元は常にパス形式でアクセスする
+		s3Config:                   s3ConfigStruct{ForcePathStyle: true},
+		restoreProgressLogInterval: time.Minute,
+		deleteMarkerPolicy:         deleteMarkersHonor,
+	}
+}
+
+// 設定を複製する（Optionsで上書きしても元の設定は変わらない）
+func (c *restoreConfig) clone() *restoreConfig {
+	config := *c
+	return &config
+}
+
+// LoadConfigFromEnvで読み込んだ設定（読み込んでいない場合はデフォルト）
+var defaultConfig = newRestoreConfig()
+
+// 設定の誤りで終了する場合の終了コード（バックアップと同じ値）
+const exitCodeConfigError = 2
+
+// 設定の誤りをログに出力して終了する
+func configFatalf(format string, v ...any) {
+	log.Printf(format, v...)
+	os.Exit(exitCodeConfigError)
+}
+
+// restore/.envと環境変数から設定を読み込む
+// 設定が誤っている場合はログに出力して終了する
+func LoadConfigFromEnv() {
+	// restore/.envがない場合は環境変数のみから読み込む（Kubernetesなど）
+	err := godotenv.Load("restore/.env")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		configFatalf("Error: Failed to load .env file: %v", err)
+	}
+	defaultConfig, err = loadConfig(context.Background(), os.Getenv)
+	if err != nil {
+		configFatalf("Error: %v", err)
+	}
+}
+
+// 環境変数から設定を読み込む
+func loadConfig(ctx context.Context, getenv func(string) string) (*restoreConfig, error) {
+	c := newRestoreConfig()
+	var err error
+
+	// 環境変数の読み込み
+	c.s3Config.EndPoint = getenv("S3_ENDPOINT")
+	c.s3Config.Region = getenv("S3_REGION")
+	c.s3Config.Bucket = getenv("S3_BUCKET")
+	c.s3Config.AccessKey, err = secrets.GetenvOrFileFunc(getenv, "S3_ACCESS_KEY")
+	if err != nil {
+		return nil, err
+	}
+	c.s3Config.SecretKey, err = secrets.GetenvOrFileFunc(getenv, "S3_SECRET_KEY")
+	if err != nil {
+		return nil, err
+	}
+	c.s3Config.SessionToken, err = secrets.GetenvOrFileFunc(getenv, "S3_SESSION_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	c.s3Config.RequesterPays = getenv("S3_REQUESTER_PAYS") == "true"
+	c.s3Config.RoleARN = getenv("S3_ROLE_ARN")
+	c.s3Config.ExternalID = getenv("S3_EXTERNAL_ID")
+
+	c.gcpConfig.CredentialsPath = getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if credentialsJSON := getenv("GOOGLE_CREDENTIALS_JSON"); credentialsJSON != "" {
+		c.gcpConfig.CredentialsJSON = []byte(credentialsJSON)
+	}
+	c.gcpConfig.ProjectID = getenv("GCP_PROJECT_ID")
+	c.gcpConfig.Region = getenv("GCS_REGION")
+	c.gcpConfig.Bucket = getenv("GCS_BUCKET")
+	c.gcpConfig.UserProject = getenv("GCS_USER_PROJECT")
+	c.gcpConfig.ImpersonateServiceAccount = getenv("GCS_IMPERSONATE_SERVICE_ACCOUNT")
+
+	c.localRestorePath = getenv("RESTORE_LOCAL_PATH")
+
+	// 復元元と復元先のバケットの対応（指定されていない場合はGCS_BUCKETからS3_BUCKETに復元する）
+	c.bucketMappings = []BucketMapping{{GCSBucket: c.gcpConfig.Bucket, S3Bucket: c.s3Config.Bucket, GCSPrefix: normalizePrefix(getenv("GCS_PREFIX"))}}
+	if bucketMap := getenv("RESTORE_BUCKET_MAP"); bucketMap != "" {
+		c.bucketMappings, err = parseBucketMap(bucketMap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RESTORE_BUCKET_MAP: %w", err)
+		}
+	}
+	c.keyPrefixMap, err = parseKeyPrefixMap(getenv("RESTORE_KEY_PREFIX_MAP"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RESTORE_KEY_PREFIX_MAP: %w", err)
+	}
+
+	c.restoreStatePath = getenv("RESTORE_STATE_PATH")
+	if value := getenv("RESTORE_MAX_OPS_PER_SEC"); value != "" {
+		c.maxOpsPerSec, err = strconv.ParseFloat(value, 64)
+		if err != nil || c.maxOpsPerSec <= 0 {
+			return nil, fmt.Errorf("failed to convert RESTORE_MAX_OPS_PER_SEC to float: %v", value)
+		}
+	}
+	if value := getenv("RESTORE_MAX_BYTES_PER_SEC"); value != "" {
+		c.maxBytesPerSec, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || c.maxBytesPerSec <= 0 {
+			return nil, fmt.Errorf("failed to convert RESTORE_MAX_BYTES_PER_SEC to int: %v", value)
+		}
+	}
+	c.verboseRestore = getenv("RESTORE_VERBOSE") == "true"
+	c.auditLog = getenv("AUDIT_LOG") == "true"
+	if value := getenv("RESTORE_DELETE_MARKERS"); value != "" {
+		if value != deleteMarkersHonor && value != deleteMarkersIgnore {
+			return nil, fmt.Errorf("invalid RESTORE_DELETE_MARKERS: %v", value)
+		}
+		c.deleteMarkerPolicy = value
+	}
+	if interval := getenv("PROGRESS_LOG_INTERVAL"); interval != "" {
+		c.restoreProgressLogInterval, err = time.ParseDuration(interval)
+		if err != nil || c.restoreProgressLogInterval <= 0 {
+			return nil, fmt.Errorf("failed to parse PROGRESS_LOG_INTERVAL: %v", interval)
+		}
+	}
+
+	c.httpConfig.ProxyURL = getenv("HTTP_PROXY_URL")
+	c.httpConfig.CABundlePath = getenv("CA_BUNDLE_PATH")
+	c.httpConfig.InsecureSkipVerify = getenv("INSECURE_SKIP_VERIFY") == "true"
+
+	// シークレットの参照（gcp-secret://、vault://）の解決（バックアップと同じ形式）
+	// Vaultへのリクエストにプロキシの設定を反映するため、通信の設定の後に解決する
+	for name, value := range map[string]*string{
+		"S3_ACCESS_KEY":    &c.s3Config.AccessKey,
+		"S3_SECRET_KEY":    &c.s3Config.SecretKey,
+		"S3_SESSION_TOKEN": &c.s3Config.SessionToken,
+	} {
+		*value, err = c.resolveSecret(ctx, *value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %v: %w", name, err)
+		}
+	}
+	if credentialsSecret := getenv("GOOGLE_CREDENTIALS_SECRET"); credentialsSecret != "" {
+		credentialsJSON, err := c.resolveSecret(ctx, credentialsSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve GOOGLE_CREDENTIALS_SECRET: %w", err)
+		}
+		c.gcpConfig.CredentialsJSON = []byte(credentialsJSON)
+	}
+	return c, nil
+}
+
+// 設定値がシークレットの参照の場合は、参照先から値を取得する
+func (c *restoreConfig) resolveSecret(ctx context.Context, value string) (string, error) {
+	if !secrets.IsReference(value) {
+		return value, nil
+	}
+	transport, err := c.newHTTPTransport()
+	if err != nil {
+		return "", err
+	}
+	return secrets.Resolve(ctx, value, &http.Client{Transport: transport})
+}
+
+// コマンドラインから実行する
+func Main() {
+	// 復元先のS3バケットが存在しない場合に作成するか
+	// バケット名の誤りで意図しないバケットに復元しないよう、明示的に指定された場合のみ作成する
+	var createBucket bool
+	flag.BoolVar(&createBucket, "create-bucket", false, "create the S3 bucket if it does not exist")
+	flag.BoolVar(&createBucket, "yes", false, "alias of --create-bucket")
+	// バックアップ時に保存したS3バケットの設定（ポリシー、CORS、ライフサイクル、バージョニング）を復元先に適用するか
+	var applyBucketConfig bool
+	flag.BoolVar(&applyBucketConfig, "apply-bucket-config", false, "apply the S3 bucket configuration saved by BACKUP_BUCKET_CONFIG")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Printf("s3-backup-helper restore %v\n", buildinfo.Get())
+		return
+	}
+	// 設定が無くても表示できるよう、設定はバージョンの表示の後に読み込む
+	LoadConfigFromEnv()
+	log.Printf("s3-backup-helper restore %v", buildinfo.Get())
+
+	// サブコマンド
+	var restoreObjectKey string
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "restore-object":
+			if len(args) < 2 {
+				configFatalf("Usage: restore [--create-bucket] restore-object <key>")
+			}
+			restoreObjectKey = args[1]
+		default:
+			configFatalf("Error: Unknown command: %v", args[0])
+		}
+	}
+
+	runner := NewRunner(Options{CreateBucket: createBucket, ApplyBucketConfig: applyBucketConfig, ObjectKey: restoreObjectKey})
+	result, err := runner.Run(context.Background())
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if restoreObjectKey != "" {
+		fmt.Printf("Restored %v\n", restoreObjectKey)
+		return
+	}
+	fmt.Printf("Restore completed: %d objects, %d already restored, %d deleted in S3, %d errors\n", result.TotalObjects, result.SkippedObjects, result.DeletedObjects, result.Errors)
+	if len(result.Formats) > 0 {
+		fmt.Printf("Restored by format: %v\n", formatCounts(result.Formats))
+	}
+}
+
+// 形式ごとの復元したオブジェクト数を、形式の名前順に"形式=数"の形で並べる
+func formatCounts(formats map[string]int) string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf("%v=%d", name, formats[name])
+	}
+	return strings.Join(counts, ", ")
+}
+
+// 他のサービスに組み込んで復元する場合の設定
+// 認証情報、バケットの対応、復元先などはLoadConfigFromEnvで読み込んだ設定（読み込んでいない場合は空でない項目）を使う
+type Options struct {
+	S3Endpoint     string
+	S3Region       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3SessionToken string
+	// サービスアカウントのJSON
+	GCPCredentialsJSON []byte
+	// 復元元のGCSバケットと復元先のS3バケット
+	Buckets []BucketMapping
+	// 指定した場合、S3の代わりにこのディレクトリに復元する
+	LocalPath string
+
+	// 復元先のS3バケットが存在しない場合に作成するか
+	CreateBucket bool
+	// バックアップ時に保存したS3バケットの設定を復元先に適用するか
+	ApplyBucketConfig bool
+	// 指定した場合、このオブジェクトだけを復元する
+	ObjectKey string
+
+	// オブジェクトの復元が終わるたびに呼ばれる
+	OnProgress func(Progress)
+	// 指定した場合、復元先や進捗の出力を標準出力の代わりにこれに書き込む
+	Stdout io.Writer
+}
+
+// 復元の進捗
+type Progress struct {
+	TotalObjects     int64
+	CompletedObjects int64
+	ErrorObjects     int64
+}
+
+// 復元の結果
+type Result struct {
+	TotalObjects int
+	// 前回までに復元済みでスキップしたオブジェクト数
+	SkippedObjects int
+	// S3で削除されていたため復元しなかったオブジェクト数（TotalObjectsには含まない）
+	DeletedObjects int
+	Errors         int
+	// 復元したオブジェクトの形式ごとの数（formatLabelの形式）
+	// 古い形式と新しい形式が混在するバケットで、それぞれがいくつ復元されたか確認できるようにする
+	Formats map[string]int
+}
+
+// 復元を実行する
+// 実行ごとに設定を複製するため、同じプロセスで複数のRunを同時に実行できる
+type Runner struct {
+	options Options
+}
+
+func NewRunner(options Options) *Runner {
+	return &Runner{options: options}
+}
+
+// 復元を1回実行する
+// 復元できなかったオブジェクトがあってもエラーは返さず、Result.Errorsに数える
+func (r *Runner) Run(ctx context.Context) (*Result, error) {
+	stdout := r.options.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	run := newRestoreRun(r.config(), stdout)
+	run.progressCallback = r.options.OnProgress
+	return run.restore(ctx, r.options.CreateBucket, r.options.ApplyBucketConfig, r.options.ObjectKey)
+}
+
+// LoadConfigFromEnvで読み込んだ設定を複製し、空でない項目で上書きする
+// 複製した設定はこの実行でのみ使うため、他の実行や次の実行には影響しない
+func (r *Runner) config() *restoreConfig {
+	o := r.options
+	config := defaultConfig.clone()
+	setIfNotEmpty(&config.s3Config.EndPoint, o.S3Endpoint)
+	setIfNotEmpty(&config.s3Config.Region, o.S3Region)
+	setIfNotEmpty(&config.s3Config.AccessKey, o.S3AccessKey)
+	setIfNotEmpty(&config.s3Config.SecretKey, o.S3SecretKey)
+	setIfNotEmpty(&config.s3Config.SessionToken, o.S3SessionToken)
+	if o.GCPCredentialsJSON != nil {
+		config.gcpConfig.CredentialsJSON = o.GCPCredentialsJSON
+	}
+	if len(o.Buckets) > 0 {
+		config.bucketMappings = o.Buckets
+	}
+	setIfNotEmpty(&config.localRestorePath, o.LocalPath)
+	return config
+}
+
+func setIfNotEmpty(target *string, value string) {
+	if value != "" {
+		*target = value
+	}
+}
+
+// 1回の復元の実行（設定と、実行中の状態）
+type restoreRun struct {
+	*restoreConfig
+
+	// 復元先や進捗の出力先
+	stdout io.Writer
+	// 1秒あたりに復元するオブジェクト数とバイト数の制限（制限しない場合はnil）
+	opsLimiter   *rate.Limiter
+	bytesLimiter *rate.Limiter
+	// 進捗を知らせる関数（Runnerに指定されていない場合はnil）
+	progressCallback func(Progress)
+}
+
+// 設定から実行を作成する
+// 速度の制限は実行ごとに数える
+func newRestoreRun(config *restoreConfig, stdout io.Writer) *restoreRun {
+	r := &restoreRun{restoreConfig: config, stdout: stdout}
+	if config.maxOpsPerSec > 0 {
+		r.opsLimiter = rate.NewLimiter(rate.Limit(config.maxOpsPerSec), 1)
+	}
+	if config.maxBytesPerSec > 0 {
+		// 1秒分をバーストとして許す
+		r.bytesLimiter = rate.NewLimiter(rate.Limit(config.maxBytesPerSec), int(min(config.maxBytesPerSec, math.MaxInt32)))
+	}
+	return r
+}
+
+// 設定に従って復元する
+func (r *restoreRun) restore(ctx context.Context, createBucket bool, applyBucketConfig bool, restoreObjectKey string) (*Result, error) {
+
+	// S3クライアントの作成
+	s3Credential := credentials.NewStaticCredentialsProvider(r.s3Config.AccessKey, r.s3Config.SecretKey, r.s3Config.SessionToken)
+	httpTransport, err := r.newHTTPTransport()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP transport: %w", err)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithCredentialsProvider(s3Credential),
+		config.WithRegion(r.s3Config.Region),
+		config.WithHTTPClient(&http.Client{Transport: httpTransport}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	// ロールを引き受ける場合は、上の認証情報で一時的な認証情報を取得して使う
+	if r.s3Config.RoleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), r.s3Config.RoleARN, func(opt *stscreds.AssumeRoleOptions) {
+			opt.RoleSessionName = "s3-backup-helper"
+			if r.s3Config.ExternalID != "" {
+				opt.ExternalID = aws.String(r.s3Config.ExternalID)
+			}
+		}))
+	}
+	s3Client := s3.NewFromConfig(cfg, func(opt *s3.Options) {
+		opt.UsePathStyle = r.s3Config.ForcePathStyle
+		opt.BaseEndpoint = aws.String(r.s3Config.EndPoint)
+	})
+
+	// GCSクライアントの作成
+	// 通信の設定を反映するため、認証を含めたTransportを組み立てる
+	credentialsOption := option.WithCredentialsFile(r.gcpConfig.CredentialsPath)
+	if r.gcpConfig.CredentialsJSON != nil {
+		credentialsOption = option.WithCredentialsJSON(r.gcpConfig.CredentialsJSON)
+	}
+	gcsOptions := []option.ClientOption{credentialsOption, option.WithScopes(storage.ScopeFullControl)}
+	if r.gcpConfig.ImpersonateServiceAccount != "" {
+		gcsOptions = append(gcsOptions, option.ImpersonateCredentials(r.gcpConfig.ImpersonateServiceAccount))
+	}
+	// エミュレーター（fake-gcs-serverなど）は認証しない
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		gcsOptions = []option.ClientOption{option.WithoutAuthentication()}
+	}
+	gcsTransport, err := htransport.NewTransport(ctx, httpTransport, gcsOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS transport: %w", err)
+	}
+	gcsClient, err := storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: gcsTransport}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+	defer gcsClient.Close()
+
+	// 1つのオブジェクトだけを復元する場合は、復元元のバケットが1つに決まっている必要がある
+	if restoreObjectKey != "" && len(r.bucketMappings) != 1 {
+		return nil, errors.New("restore-object cannot be used with multiple buckets in RESTORE_BUCKET_MAP")
+	}
+
+	// 復元先の用意
+	fmt.Fprintln(r.stdout, "Target bucket:")
+	var targets []*restoreTarget
+	for _, mapping := range r.bucketMappings {
+		target, err := r.prepareRestoreTarget(ctx, s3Client, gcsClient, mapping, createBucket)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	// 改行
+	fmt.Fprintln(r.stdout)
+
+	// 監査記録の設定のハッシュに含める設定（認証情報は含めない）
+	auditConfig := map[string]any{
+		"s3Endpoint":        r.s3Config.EndPoint,
+		"s3Region":          r.s3Config.Region,
+		"bucketMappings":    r.bucketMappings,
+		"keyPrefixMap":      r.keyPrefixMap,
+		"localPath":         r.localRestorePath,
+		"applyBucketConfig": applyBucketConfig,
+		"restoreObject":     restoreObjectKey,
+	}
+	auditStartTime := time.Now()
+
+	// 1つのオブジェクトだけを復元
+	if restoreObjectKey != "" {
+		// GCSのオブジェクト名として使えないキーは、バックアップ時と同じようにエスケープした名前で探す
+		name, _ := keyencoding.EscapeObjectName(targets[0].GCSPrefix, restoreObjectKey)
+		format, err := r.restoreObject(ctx, targets[0], targets[0].GCSPrefix+name)
+		if r.auditLog {
+			record := r.newRestoreAuditRecord(targets[0], auditStartTime, auditConfig, 1, 0, err)
+			if err := writeAuditRecord(ctx, targets[0].GCSBucket, record); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		}
+		if err != nil {
+			return &Result{TotalObjects: 1, Errors: 1}, fmt.Errorf("failed to restore object %v: %w", restoreObjectKey, err)
+		}
+		return &Result{TotalObjects: 1, Formats: map[string]int{format: 1}}, nil
+	}
+
+	// 復元計測用変数
+	//restoreStartTime := time.Now()
+
+	// オブジェクト数
+	totalObjects := 0
+	// エラー数
+	totalError := 0
+	// TODO: 並列処理
+
+	// プログレスバー用に復元するオブジェクト数を数える
+	var countedObjects int64
+	for _, target := range targets {
+		count, err := countRestoreObjects(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count objects in %v: %w", target.GCSBucketName, err)
+		}
+		countedObjects += count
+	}
+	progress := r.newRestoreProgress(countedObjects)
+
+	// 途中から再開する場合は、前回までに復元したオブジェクトを読み込む
+	var state *restoreState
+	if r.restoreStatePath != "" {
+		state, err = openRestoreState(r.restoreStatePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open restore state: %w", err)
+		}
+		defer state.Close()
+	}
+	// 前回までに復元済みでスキップしたオブジェクト数
+	skippedObjects := 0
+	// S3で削除されていたため復元しなかったオブジェクト数
+	deletedObjects := 0
+	// 形式ごとの復元したオブジェクト数
+	formats := make(map[string]int)
+
+	for _, target := range targets {
+		log.Printf("Restoring objects in %s", target.GCSBucketName)
+		targetStartTime := time.Now()
+		targetStartObjects, targetStartSkipped, targetStartErrors := totalObjects, skippedObjects, totalError
+
+		// バックアップ時にS3で削除されていたキー
+		if r.deleteMarkerPolicy == deleteMarkersHonor {
+			target.DeletedKeys, err = readDeletedKeys(ctx, target)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read delete markers of %v: %w", target.GCSBucketName, err)
+			}
+		}
+
+		// オブジェクトを1つずつ復元する
+		// 一覧を取得できない場合（キャンセルされた場合を含む）は復元を中断する
+		err = target.Objects.List(ctx, target.GCSPrefix, func(object *backup.ObjectInfo) error {
+			// バックアップツールが管理用に置いたオブジェクト（ロック、実行結果、アーカイブ）はそのまま復元しない
+			if isManagedObject(target, object.Key) {
+				return nil
+			}
+			stateEntry := restoreStateEntry{Bucket: target.GCSBucketName, Name: object.Key, Generation: object.Generation}
+			if state.Restored(stateEntry) {
+				totalObjects++
+				skippedObjects++
+				progress.Done(object.Key, nil)
+				return nil
+			}
+			format, err := r.restoreObject(ctx, target, object.Key)
+			if errors.Is(err, errDeletedKey) {
+				progress.Done(object.Key, nil)
+				return nil
+			}
+			totalObjects++
+			if err != nil {
+				log.Printf("Error: Failed to restore object %v: %v", object.Key, err)
+				totalError++
+			} else {
+				formats[format]++
+				if err := state.Record(stateEntry); err != nil {
+					log.Printf("Error: Failed to record restore state: %v", err)
+				}
+			}
+			progress.Done(object.Key, err)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in %v: %w", target.GCSBucketName, err)
+		}
+
+		// アーカイブにまとめられたオブジェクト
+		bundledObjects, bundleSkipped, bundleErrors := r.restoreBundles(ctx, target, state, progress, formats)
+		totalObjects += bundledObjects
+		skippedObjects += bundleSkipped
+		totalError += bundleErrors
+		deletedObjects += target.DeletedObjects
+		if target.DeletedObjects > 0 {
+			log.Printf("Skipped %d objects deleted in S3 at the time of the backup in %s", target.DeletedObjects, target.GCSBucketName)
+		}
+
+		// バケットの設定はオブジェクトを書き込んだ後に適用する（ポリシーで書き込みが拒否されないように）
+		if applyBucketConfig && target.LocalPath == "" {
+			if err := r.restoreBucketConfig(ctx, s3Client, target); err != nil {
+				log.Printf("Error: Failed to apply bucket config to %v: %v", target.S3Bucket, err)
+				totalError++
+			}
+		}
+
+		// 復元元のバケットごとに監査記録を残す
+		if r.auditLog {
+			record := r.newRestoreAuditRecord(target, targetStartTime, auditConfig, totalObjects-targetStartObjects, skippedObjects-targetStartSkipped, nil)
+			record.Errors = int64(totalError - targetStartErrors)
+			if record.Errors > 0 {
+				record.Result = "failed"
+			}
+			if err := writeAuditRecord(ctx, target.GCSBucket, record); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		}
+	}
+
+	// 復元終了
+	//restoreEndTime := time.Now()
+	//restoreDuration := restoreEndTime.Sub(restoreStartTime)
+
+	progress.Finish()
+	return &Result{TotalObjects: totalObjects, SkippedObjects: skippedObjects, DeletedObjects: deletedObjects, Errors: totalError, Formats: formats}, nil
+}
+
+// 復元元のGCSバケットと復元先のS3バケットの対応
+type BucketMapping struct {
+	GCSBucket string
+	S3Bucket  string
+	// GCSバケット内のプレフィックス（バックアップ時にGCS_PREFIXやGCS_BUCKET_MAPで指定したもの、空の場合はバケット全体）
+	GCSPrefix string
+}
+
+// "<GCSバケット名>[/<プレフィックス>]=<S3バケット名>"をカンマ区切りで並べた対応表を読み込む
+func parseBucketMap(value string) ([]BucketMapping, error) {
+	var mappings []BucketMapping
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		gcsBucket, s3Bucket, found := strings.Cut(entry, "=")
+		gcsBucket, s3Bucket = strings.TrimSpace(gcsBucket), strings.TrimSpace(s3Bucket)
+		gcsBucket, gcsPrefix, _ := strings.Cut(gcsBucket, "/")
+		if !found || gcsBucket == "" || s3Bucket == "" {
+			return nil, fmt.Errorf("invalid bucket mapping: %q", entry)
+		}
+		mappings = append(mappings, BucketMapping{GCSBucket: gcsBucket, S3Bucket: s3Bucket, GCSPrefix: normalizePrefix(gcsPrefix)})
+	}
+	if len(mappings) == 0 {
+		return nil, errors.New("bucket mapping is empty")
+	}
+	return mappings, nil
+}
+
+// プレフィックスを/で終わるようにする（空の場合は空のまま）
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// キーのプレフィックスの書き換え
+type keyPrefixMapping struct {
+	From string
+	To   string
+}
+
+// "<元のプレフィックス>=<新しいプレフィックス>"をカンマ区切りで並べた書き換え規則を読み込む
+// 新しいプレフィックスを空にした場合はプレフィックスを取り除き、元のプレフィックスを空にした場合は全てのキーに付け加える
+func parseKeyPrefixMap(value string) ([]keyPrefixMapping, error) {
+	var mappings []keyPrefixMapping
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		from, to, found := strings.Cut(entry, "=")
+		if !found || from == to {
+			return nil, fmt.Errorf("invalid key prefix mapping: %q", entry)
+		}
+		mappings = append(mappings, keyPrefixMapping{From: from, To: to})
+	}
+	return mappings, nil
+}
+
+// 最初に一致した規則でキーのプレフィックスを書き換える
+// 一致する規則がない場合はそのまま返す
+func mapKeyPrefix(key string, mappings []keyPrefixMapping) string {
+	for _, mapping := range mappings {
+		if rest, ok := strings.CutPrefix(key, mapping.From); ok {
+			return mapping.To + rest
+		}
+	}
+	return key
+}
+
+// 1つのGCSバケットの復元先
+type restoreTarget struct {
+	GCSBucketName string
+	// 監査記録の書き込みなど、GCSに固有の操作に使う
+	GCSBucket *storage.BucketHandle
+	// 復元元のオブジェクトの一覧と読み込み
+	Objects backup.ObjectDestination
+	// GCSバケット内のプレフィックス（オブジェクトのキーと管理用のオブジェクトの名前に付いている）
+	GCSPrefix string
+	S3Bucket  string
+	// 復元先のS3バケットへの書き込み（ローカルに復元する場合はnil）
+	S3Objects backup.ObjectSource
+	// ローカルに復元する場合のディレクトリ（S3に復元する場合は空）
+	LocalPath string
+	// バックアップ時にS3で削除されていたため復元しないキー（RESTORE_KEY_PREFIX_MAPを適用する前のもの）
+	DeletedKeys map[string]bool
+	// DeletedKeysにあったため復元しなかったオブジェクト数
+	DeletedObjects int
+}
+
+// 復元元のGCSバケットの存在を確認し、復元先を用意する
+// 復元先のS3バケットが存在しない場合は、createBucketがtrueのときのみ作成する
+func (r *restoreRun) prepareRestoreTarget(ctx context.Context, s3Client *s3.Client, gcsClient *storage.Client, mapping BucketMapping, createBucket bool) (*restoreTarget, error) {
+	// GCSバケットの取得、存在判定
+	gcsBucket := gcsClient.Bucket(mapping.GCSBucket)
+	if r.gcpConfig.UserProject != "" {
+		gcsBucket = gcsBucket.UserProject(r.gcpConfig.UserProject)
+	}
+	if _, err := gcsBucket.Attrs(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get attributes of bucket %v. Please check that the bucket exists: %w", mapping.GCSBucket, err)
+	}
+	target := &restoreTarget{GCSBucketName: mapping.GCSBucket, GCSBucket: gcsBucket, Objects: backup.NewGCSDestination(gcsBucket), GCSPrefix: mapping.GCSPrefix, S3Bucket: mapping.S3Bucket}
+
+	if r.localRestorePath != "" {
+		// ローカルに復元する場合はS3を使わない
+		// 複数のバケットを復元する場合は、S3バケット名のディレクトリに分ける
+		target.LocalPath = r.localRestorePath
+		if len(r.bucketMappings) > 1 {
+			target.LocalPath = filepath.Join(r.localRestorePath, mapping.S3Bucket)
+		}
+		if err := os.MkdirAll(target.LocalPath, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create restore directory: %w", err)
+		}
+		fmt.Fprintf(r.stdout, " - %s -> %s(Local)\n", mapping.GCSBucket, target.LocalPath)
+		return target, nil
+	}
+
+	// バケットが存在しない場合は、--create-bucketが指定されているときのみ作成
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(mapping.S3Bucket),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		if !createBucket {
+			return nil, fmt.Errorf("S3 bucket %v does not exist. Check the bucket name, or run with --create-bucket to create it", mapping.S3Bucket)
+		}
+		_, err = s3Client.CreateBucket(ctx, &s3.CreateBucketInput{
+			Bucket: aws.String(mapping.S3Bucket),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bucket %v: %w", mapping.S3Bucket, err)
+		}
+		fmt.Fprintf(r.stdout, " - %s -> %s(Created)\n", mapping.GCSBucket, mapping.S3Bucket)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get S3 bucket %v: %w", mapping.S3Bucket, err)
+	} else {
+		fmt.Fprintf(r.stdout, " - %s -> %s\n", mapping.GCSBucket, mapping.S3Bucket)
+	}
+	target.S3Objects = backup.NewS3Source(s3Client, mapping.S3Bucket, r.s3Config.RequesterPays)
+	return target, nil
+}
+
+// プロキシとCAの設定を反映したTransportを作成する
+func (c *restoreConfig) newHTTPTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.httpConfig.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.httpConfig.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP_PROXY_URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if c.httpConfig.CABundlePath != "" || c.httpConfig.InsecureSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: c.httpConfig.InsecureSkipVerify}
+		if c.httpConfig.CABundlePath != "" {
+			caBundle, err := os.ReadFile(c.httpConfig.CABundlePath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			rootCAs, err := x509.SystemCertPool()
+			if err != nil {
+				rootCAs = x509.NewCertPool()
+			}
+			if !rootCAs.AppendCertsFromPEM(caBundle) {
+				return nil, fmt.Errorf("no certificates found in CA bundle: %v", c.httpConfig.CABundlePath)
+			}
+			tlsConfig.RootCAs = rootCAs
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+// 1つのオブジェクトを解凍して復元する
+// 圧縮形式はオブジェクトごとに、メタデータのx-backup-compressionか先頭のマジックバイトから判定する
+// 復元したオブジェクトの形式（formatLabel）を返す
+func (r *restoreRun) restoreObject(ctx context.Context, target *restoreTarget, name string) (string, error) {
+	info, err := target.Objects.Head(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to get object attributes: %w", err)
+	}
+
+	// 重複排除されている場合は、本体をハッシュを名前としたオブジェクトから読み込む
+	bodyName, bodyInfo := name, info
+	if contentSHA256 := info.Metadata[backupformat.MetadataContentSHA256]; contentSHA256 != "" {
+		bodyName = target.GCSPrefix + backupformat.BlobPrefix + contentSHA256
+		bodyInfo, err = target.Objects.Head(ctx, bodyName)
+		if err != nil {
+			return "", fmt.Errorf("failed to get blob %v: %w", contentSHA256, err)
+		}
+	}
+	// 古いバックアップでContent-Encodingが付いている場合も、GCSに解凍させずに保存したデータをそのまま読む
+	gcsObjectReader, err := target.Objects.Get(ctx, bodyName, bodyInfo.Generation)
+	if err != nil {
+		return "", fmt.Errorf("failed to get object reader: %w", err)
+	}
+	defer gcsObjectReader.Close()
+
+	recorded := bodyInfo.Metadata[backupformat.MetadataCompression]
+	decompressReader, detected, err := newDetectingDecompressReader(gcsObjectReader, recorded)
+	if err != nil {
+		return "", err
+	}
+	defer decompressReader.Close()
+
+	// 復元先のキーにはGCSバケット内のプレフィックスを含めない
+	// GCSのオブジェクト名として使えずエスケープしたオブジェクトは、記録された元のキーに復元する
+	key := strings.TrimPrefix(name, target.GCSPrefix)
+	if encodedKey, ok := info.Metadata[keyencoding.MetadataKey]; ok {
+		key, err = keyencoding.DecodeMetadata(encodedKey)
+		if err != nil {
+			return "", err
+		}
+	}
+	if target.DeletedKeys[key] {
+		target.DeletedObjects++
+		return "", errDeletedKey
+	}
+	// ObjectInfo.ContentEncodingは、メタデータに記録された元のContent-Encoding
+	err = r.restoreBody(ctx, target, key, decompressReader, restoreObjectMeta{
+		ContentType:        info.ContentType,
+		ContentEncoding:    info.ContentEncoding,
+		ContentDisposition: info.ContentDisposition,
+		ContentLanguage:    info.ContentLanguage,
+		CacheControl:       info.CacheControl,
+		Metadata:           info.Metadata,
+		LastModified:       info.Metadata[backupformat.MetadataSourceLastModified],
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatLabel(recorded, detected), nil
+}
+
+// 復元するオブジェクトの属性
+type restoreObjectMeta struct {
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ContentLanguage    string            `json:"contentLanguage,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	// バックアップ元のS3のLastModified（RFC 3339、記録されていない古いバックアップは空）
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// 復元したS3のオブジェクトに、元のLastModifiedを記録するメタデータのキー
+// S3のLastModifiedは指定できないため、アップロード日時を使う処理を復元後に直せるようにする
+const metadataOriginalLastModified = "original-last-modified"
+
+// 解凍したオブジェクトの本体を、S3またはローカルのディレクトリに書き出す
+func (r *restoreRun) restoreBody(ctx context.Context, target *restoreTarget, name string, body io.Reader, meta restoreObjectMeta) error {
+	// 復元先のキー（RESTORE_KEY_PREFIX_MAPで書き換える）
+	key := mapKeyPrefix(name, r.keyPrefixMap)
+	if key == "" {
+		return errors.New("key is empty after RESTORE_KEY_PREFIX_MAP is applied")
+	}
+
+	// 稼働中のS3に負荷をかけすぎないよう、復元の速度を制限する
+	if r.opsLimiter != nil {
+		if err := r.opsLimiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if r.bytesLimiter != nil {
+		body = &rateLimitedReader{ctx: ctx, reader: body, limiter: r.bytesLimiter}
+	}
+
+	// バックアップ時に元のデータのMD5が記録されている場合は、読み終わったときに一致を確認する
+	// パートに分けてアップロードしたものなど、MD5が無くCRC32Cのみ記録されている場合はCRC32Cで確認する
+	// 一致しない場合は読み込みがエラーになり、壊れたデータは復元されない
+	if originalMD5 := meta.Metadata[backupformat.MetadataOriginalMD5]; originalMD5 != "" {
+		body = newMD5VerifyingReader(body, originalMD5)
+	} else if originalCRC32C := meta.Metadata[backupformat.MetadataOriginalCRC32C]; originalCRC32C != "" {
+		body = newCRC32CVerifyingReader(body, originalCRC32C)
+	}
+
+	// ローカルに復元
+	if target.LocalPath != "" {
+		// ファイルの場合は、更新日時を元のLastModifiedにする
+		modTime, _ := time.Parse(time.RFC3339Nano, meta.LastModified)
+		if err := restoreToLocal(target.LocalPath, key, body, modTime); err != nil {
+			return fmt.Errorf("failed to write object to local file: %w", err)
+		}
+		return nil
+	}
+
+	// メタデータの配列を作成
+	// バックアップツールが付けたメタデータ（x-backup-*）は元のオブジェクトのものではないため除く
+	metadataList := make(map[string]string, 0)
+	for metaKey, value := range meta.Metadata {
+		if strings.HasPrefix(metaKey, backupformat.MetadataPrefix) {
+			continue
+		}
+		metadataList[metaKey] = value
+	}
+	if _, ok := metadataList[metadataOriginalLastModified]; !ok && meta.LastModified != "" {
+		metadataList[metadataOriginalLastModified] = meta.LastModified
+	}
+
+	// 解凍してS3にアップロード
+	info := backup.ObjectInfo{
+		ContentType:        meta.ContentType,
+		ContentEncoding:    meta.ContentEncoding,
+		ContentDisposition: meta.ContentDisposition,
+		ContentLanguage:    meta.ContentLanguage,
+		CacheControl:       meta.CacheControl,
+	}
+	if len(metadataList) > 0 {
+		info.Metadata = metadataList
+	}
+	if err := target.S3Objects.Put(ctx, key, info, body); err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+	return nil
+}
+
+// 読み込む速度を制限するReader
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// 1回に待てるのはバースト分までのため、読み込む量を抑える
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// 読み込んだデータのハッシュを求め、最後まで読んだときに記録されたハッシュと比較するReader
+type verifyingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	// ハッシュの名前と、記録された形式にする関数
+	algorithm string
+	encode    func([]byte) string
+	expected  string
+}
+
+// 16進数で記録されたMD5と比較する
+func newMD5VerifyingReader(reader io.Reader, expected string) *verifyingReader {
+	return &verifyingReader{reader: reader, hash: md5.New(), algorithm: "MD5", encode: hex.EncodeToString, expected: expected}
+}
+
+// S3のChecksumCRC32Cと同じ形式（ビッグエンディアンのBase64）で記録されたCRC32Cと比較する
+func newCRC32CVerifyingReader(reader io.Reader, expected string) *verifyingReader {
+	return &verifyingReader{reader: reader, hash: crc32.New(crc32.MakeTable(crc32.Castagnoli)), algorithm: "CRC32C", encode: base64.StdEncoding.EncodeToString, expected: expected}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := r.encode(r.hash.Sum(nil)); actual != r.expected {
+			return n, fmt.Errorf("integrity check failed: original %v is %v, but restored data is %v", r.algorithm, r.expected, actual)
+		}
+	}
+	return n, err
+}
+
+// バックアップ時にtarアーカイブにまとめられたオブジェクトのインデックス
+type bundleIndexEntry struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	restoreObjectMeta
+}
+
+// バックアップ時にアーカイブにまとめられたオブジェクト（BUNDLE_PREFIXES）を復元する
+// オブジェクト数、前回までに復元済みでスキップした数、エラー数を返す
+// 復元したオブジェクトはアーカイブの形式でformatsに数える
+func (r *restoreRun) restoreBundles(ctx context.Context, target *restoreTarget, state *restoreState, progress *restoreProgress, formats map[string]int) (int, int, int) {
+	totalObjects, skippedObjects, totalErrors := 0, 0, 0
+	err := target.Objects.List(ctx, target.GCSPrefix+backupformat.BundlePrefix, func(info *backup.ObjectInfo) error {
+		if path.Base(info.Key) != "index.json" {
+			return nil
+		}
+
+		var index []bundleIndexEntry
+		if err := readJSONObject(ctx, target.Objects, info.Key, &index); err != nil {
+			log.Printf("Error: Failed to read bundle index %v: %v", info.Key, err)
+			totalErrors++
+			return nil
+		}
+
+		// アーカイブごとにエントリをまとめる
+		var parts []string
+		entries := make(map[string]map[string]bundleIndexEntry)
+		for _, entry := range index {
+			if entries[entry.Path] == nil {
+				parts = append(parts, entry.Path)
+				entries[entry.Path] = make(map[string]bundleIndexEntry)
+			}
+			entries[entry.Path][entry.Key] = entry
+		}
+		for _, part := range parts {
+			partObjects, partSkipped, partErrors := r.restoreBundlePart(ctx, target, part, entries[part], state, progress, formats)
+			totalObjects += partObjects
+			skippedObjects += partSkipped
+			totalErrors += partErrors
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error: Failed to list bundles: %v", err)
+		totalErrors++
+	}
+	return totalObjects, skippedObjects, totalErrors
+}
+
+// 1つのアーカイブを解凍し、含まれるオブジェクトを復元する
+func (r *restoreRun) restoreBundlePart(ctx context.Context, target *restoreTarget, part string, entries map[string]bundleIndexEntry, state *restoreState, progress *restoreProgress, formats map[string]int) (int, int, int) {
+	attrs, err := target.Objects.Head(ctx, part)
+	if err != nil {
+		log.Printf("Error: Failed to get bundle %v: %v", part, err)
+		return 0, 0, len(entries)
+	}
+	reader, err := target.Objects.Get(ctx, part, attrs.Generation)
+	if err != nil {
+		log.Printf("Error: Failed to read bundle %v: %v", part, err)
+		return 0, 0, len(entries)
+	}
+	defer reader.Close()
+	recorded := attrs.Metadata[backupformat.MetadataCompression]
+	decompressReader, detected, err := newDetectingDecompressReader(reader, recorded)
+	if err != nil {
+		log.Printf("Error: Failed to read bundle %v: %v", part, err)
+		return 0, 0, len(entries)
+	}
+	defer decompressReader.Close()
+	format := formatLabel(recorded, detected)
+
+	totalObjects, skippedObjects, totalErrors := 0, 0, 0
+	tarReader := tar.NewReader(decompressReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Error: Failed to read bundle %v: %v", part, err)
+			return totalObjects, skippedObjects, totalErrors + 1
+		}
+		entry, ok := entries[header.Name]
+		if !ok {
+			log.Printf("Error: Object %v in bundle %v is not in the index", header.Name, part)
+			totalErrors++
+			continue
+		}
+		if target.DeletedKeys[header.Name] {
+			target.DeletedObjects++
+			progress.Done(header.Name, nil)
+			continue
+		}
+		totalObjects++
+		stateEntry := restoreStateEntry{Bucket: target.GCSBucketName, Name: header.Name, Part: part, Generation: attrs.Generation}
+		if state.Restored(stateEntry) {
+			skippedObjects++
+			progress.Done(header.Name, nil)
+			continue
+		}
+		err = r.restoreBody(ctx, target, header.Name, tarReader, entry.restoreObjectMeta)
+		if err != nil {
+			log.Printf("Error: Failed to restore object %v: %v", header.Name, err)
+			totalErrors++
+		} else {
+			formats[format]++
+			if err := state.Record(stateEntry); err != nil {
+				log.Printf("Error: Failed to record restore state: %v", err)
+			}
+		}
+		progress.Done(header.Name, err)
+	}
+	return totalObjects, skippedObjects, totalErrors
+}
+
+// バックアップ時に保存したS3バケットの設定
+type s3BucketConfig struct {
+	Bucket         string                `json:"bucket"`
+	Policy         string                `json:"policy,omitempty"`
+	CORSRules      []types.CORSRule      `json:"corsRules,omitempty"`
+	LifecycleRules []types.LifecycleRule `json:"lifecycleRules,omitempty"`
+	Versioning     string                `json:"versioning,omitempty"`
+}
+
+// バックアップ時に保存したS3バケットの設定を復元先のバケットに適用する
+func (r *restoreRun) restoreBucketConfig(ctx context.Context, s3Client *s3.Client, target *restoreTarget) error {
+	var bucketConfig s3BucketConfig
+	if err := readJSONObject(ctx, target.Objects, target.GCSPrefix+backupformat.BucketConfigObjectName, &bucketConfig); err != nil {
+		return fmt.Errorf("failed to read bucket config: %w", err)
+	}
+	bucket := aws.String(target.S3Bucket)
+
+	if bucketConfig.Versioning != "" {
+		if _, err := s3Client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket:                  bucket,
+			VersioningConfiguration: &types.VersioningConfiguration{Status: types.BucketVersioningStatus(bucketConfig.Versioning)},
+		}); err != nil {
+			return fmt.Errorf("failed to put versioning status: %w", err)
+		}
+	}
+	if len(bucketConfig.CORSRules) > 0 {
+		if _, err := s3Client.PutBucketCors(ctx, &s3.PutBucketCorsInput{
+			Bucket:            bucket,
+			CORSConfiguration: &types.CORSConfiguration{CORSRules: bucketConfig.CORSRules},
+		}); err != nil {
+			return fmt.Errorf("failed to put CORS configuration: %w", err)
+		}
+	}
+	if len(bucketConfig.LifecycleRules) > 0 {
+		if _, err := s3Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 bucket,
+			LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: bucketConfig.LifecycleRules},
+		}); err != nil {
+			return fmt.Errorf("failed to put lifecycle configuration: %w", err)
+		}
+	}
+	if bucketConfig.Policy != "" {
+		// 別の名前のバケットに復元する場合は、ポリシー中のバケットのARNを書き換える
+		policy := bucketConfig.Policy
+		if bucketConfig.Bucket != "" && bucketConfig.Bucket != target.S3Bucket {
+			for _, suffix := range []string{`"`, "/"} {
+				policy = strings.ReplaceAll(policy, "arn:aws:s3:::"+bucketConfig.Bucket+suffix, "arn:aws:s3:::"+target.S3Bucket+suffix)
+			}
+		}
+		if _, err := s3Client.PutBucketPolicy(ctx, &s3.PutBucketPolicyInput{
+			Bucket: bucket,
+			Policy: aws.String(policy),
+		}); err != nil {
+			return fmt.Errorf("failed to put bucket policy: %w", err)
+		}
+	}
+	fmt.Fprintf(r.stdout, "Applied bucket config of %v to %v\n", bucketConfig.Bucket, target.S3Bucket)
+	return nil
+}
+
+// 復元済みのオブジェクトの記録（RESTORE_STATE_PATH）
+// 復元に失敗した後に再実行した場合に、復元済みのオブジェクトをスキップして途中から再開するため
+type restoreState struct {
+	file     *os.File
+	encoder  *json.Encoder
+	restored map[restoreStateEntry]bool
+}
+
+// 復元済みのオブジェクト
+// バックアップが更新された場合は復元し直すよう、世代も記録する
+type restoreStateEntry struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	// アーカイブにまとめられている場合はアーカイブのオブジェクト名（世代はアーカイブのもの）
+	Part       string `json:"part,omitempty"`
+	Generation int64  `json:"generation"`
+}
+
+// 記録を読み込み、追記できるように開く
+func openRestoreState(statePath string) (*restoreState, error) {
+	file, err := os.OpenFile(statePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	state := &restoreState{file: file, encoder: json.NewEncoder(file), restored: make(map[restoreStateEntry]bool)}
+	decoder := json.NewDecoder(file)
+	for {
+		var entry restoreStateEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			// 書き込み中に中断された最後の行は無視する
+			log.Printf("Warning: Ignoring broken restore state after %d entries: %v", len(state.restored), err)
+			break
+		}
+		state.restored[entry] = true
+	}
+	if len(state.restored) > 0 {
+		log.Printf("Resuming restore: %d objects already restored", len(state.restored))
+	}
+	return state, nil
+}
+
+// 前回までに復元済みか判定する（記録しない場合はfalse）
+func (s *restoreState) Restored(entry restoreStateEntry) bool {
+	return s != nil && s.restored[entry]
+}
+
+// 復元したオブジェクトを記録する
+func (s *restoreState) Record(entry restoreStateEntry) error {
+	if s == nil {
+		return nil
+	}
+	s.restored[entry] = true
+	return s.encoder.Encode(entry)
+}
+
+func (s *restoreState) Close() error {
+	return s.file.Close()
+}
+
+// 復元の進捗
+type restoreProgress struct {
+	run *restoreRun
+	// 標準出力が端末でない場合はnil
+	bar *pb.ProgressBar
+
+	totalObjects     int64
+	completedObjects int64
+	errorObjects     int64
+	lastLog          time.Time
+}
+
+// 復元するオブジェクト数から進捗表示を開始する
+// 標準出力が端末でない場合は、1オブジェクトずつではなく一定間隔で1行ずつ進捗を出力する
+func (r *restoreRun) newRestoreProgress(totalObjects int64) *restoreProgress {
+	progress := &restoreProgress{run: r, totalObjects: totalObjects, lastLog: time.Now()}
+	stdout, ok := r.stdout.(*os.File)
+	if !ok || !isatty.IsTerminal(stdout.Fd()) && !isatty.IsCygwinTerminal(stdout.Fd()) {
+		return progress
+	}
+	progress.bar = pb.Full.Start64(totalObjects)
+	return progress
+}
+
+// オブジェクトの復元が完了したときに呼ぶ
+func (p *restoreProgress) Done(name string, err error) {
+	p.completedObjects++
+	if err != nil {
+		p.errorObjects++
+	}
+	if p.run.progressCallback != nil {
+		p.run.progressCallback(Progress{TotalObjects: p.totalObjects, CompletedObjects: p.completedObjects, ErrorObjects: p.errorObjects})
+	}
+	if p.run.verboseRestore {
+		fmt.Fprintf(p.run.stdout, " - %s\n", name)
+	}
+	if p.bar != nil {
+		p.bar.Increment()
+		return
+	}
+	if time.Since(p.lastLog) >= p.run.restoreProgressLogInterval {
+		p.logLine()
+	}
+}
+
+func (p *restoreProgress) logLine() {
+	p.lastLog = time.Now()
+	log.Printf("Progress: %d/%d objects, %d errors", p.completedObjects, p.totalObjects, p.errorObjects)
+}
+
+func (p *restoreProgress) Finish() {
+	if p.bar != nil {
+		p.bar.Finish()
+		return
+	}
+	p.logLine()
+}
+
+// 復元するオブジェクト数を数える（アーカイブにまとめられたオブジェクトはインデックスから数える）
+func countRestoreObjects(ctx context.Context, target *restoreTarget) (int64, error) {
+	var count int64
+	err := target.Objects.List(ctx, target.GCSPrefix, func(info *backup.ObjectInfo) error {
+		if strings.HasPrefix(info.Key, target.GCSPrefix+backupformat.BundlePrefix) && path.Base(info.Key) == "index.json" {
+			var index []bundleIndexEntry
+			if err := readJSONObject(ctx, target.Objects, info.Key, &index); err != nil {
+				return fmt.Errorf("failed to read bundle index %v: %w", info.Key, err)
+			}
+			count += int64(len(index))
+			return nil
+		}
+		if !isManagedObject(target, info.Key) {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// バックアップツールが管理用に置いたオブジェクト（.s3-backup-helper/の下と、ロック）か
+// ".s3-backup-helper-notes.txt"のように名前が似ているだけのものはバックアップしたオブジェクトとして復元する
+func isManagedObject(target *restoreTarget, name string) bool {
+	relative, ok := strings.CutPrefix(name, target.GCSPrefix)
+	return ok && backupformat.IsManagedObject(relative)
+}
+
+// バックアップ時にS3で最新のバージョンが削除マーカーになっていたキー（S3_DELETE_MARKERS=record）
+type deleteMarkerList struct {
+	Markers []struct {
+		Key string `json:"key"`
+	} `json:"markers"`
+}
+
+// 削除マーカーの記録にあるため復元しなかった
+var errDeletedKey = errors.New("object was deleted in S3 at the time of the backup")
+
+// バックアップ時に記録した削除マーカーから、復元しないキーを読み込む
+// 記録されていない（S3_DELETE_MARKERSを指定していない）場合は空
+func readDeletedKeys(ctx context.Context, target *restoreTarget) (map[string]bool, error) {
+	var markers deleteMarkerList
+	err := readJSONObject(ctx, target.Objects, target.GCSPrefix+backupformat.DeleteMarkersObjectName, &markers)
+	if errors.Is(err, backup.ErrObjectNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(markers.Markers))
+	for _, marker := range markers.Markers {
+		keys[marker.Key] = true
+	}
+	return keys, nil
+}
+
+// GCSのJSONオブジェクトを読み込む
+func readJSONObject(ctx context.Context, objects backup.ObjectDestination, name string, v any) error {
+	reader, err := objects.Get(ctx, name, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return json.NewDecoder(reader).Decode(v)
+}
+
+// 圧縮形式ごとのマジックバイト
+var compressionMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{name: "snappy", magic: []byte("\xff\x06\x00\x00sNaPpY")},
+	{name: "gzip", magic: []byte{0x1f, 0x8b}},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// オブジェクトの圧縮形式を判定し、解凍するReaderを作成する
+// メタデータ（x-backup-compression）に記録されている場合はその形式で、記録されていない古いバックアップは先頭のマジックバイトから判定する
+// 形式を少しずつ移行している途中で、オブジェクトごとに形式が異なっていても復元できるようにする
+// 判定した圧縮形式も返す
+func newDetectingDecompressReader(r io.Reader, recorded string) (io.ReadCloser, string, error) {
+	if recorded != "" {
+		reader, err := newDecompressReader(r, recorded)
+		return reader, recorded, err
+	}
+	bufReader := bufio.NewReader(r)
+	for _, format := range compressionMagics {
+		header, err := bufReader.Peek(len(format.magic))
+		if err != nil && err != io.EOF {
+			return nil, "", err
+		}
+		if bytes.Equal(header, format.magic) {
+			reader, err := newDecompressReader(bufReader, format.name)
+			return reader, format.name, err
+		}
+	}
+	// 空のオブジェクトはsnappyでもヘッダーが書き込まれないため、空のまま復元する
+	if _, err := bufReader.Peek(1); err == io.EOF {
+		return io.NopCloser(bufReader), "snappy", nil
+	}
+	return nil, "", errors.New("unknown compression: x-backup-compression is not recorded and no known magic bytes were found")
+}
+
+// 復元結果に数えるオブジェクトの形式
+// x-backup-compressionを記録していない古いバックアップは、記録している新しいバックアップと区別して"legacy-"を付ける
+func formatLabel(recorded, detected string) string {
+	if recorded == "" {
+		return "legacy-" + detected
+	}
+	return recorded
+}
+
+// 指定された形式（snappy、gzip、zstd、none）で解凍するReaderを作成する
+func newDecompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "snappy":
+		return io.NopCloser(snappy.NewReader(r)), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case "none":
+		// 圧縮せずにバックアップしたもの
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %v", compression)
+	}
+}
+
+// 解凍したオブジェクトをローカルのディレクトリに書き出す（modTimeがゼロでない場合は更新日時にする）
+func restoreToLocal(dir string, key string, body io.Reader, modTime time.Time) error {
+	filePath, err := localFilePath(dir, key)
+	if err != nil {
+		return err
+	}
+
+	// "/"で終わるキーはディレクトリとして作成
+	if strings.HasSuffix(key, "/") {
+		return os.MkdirAll(filePath, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// 途中で失敗した場合は、壊れたファイルを残さない
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		return os.Chtimes(filePath, modTime, modTime)
+	}
+	return nil
+}
+
+// キーから書き出すファイルのパスを求める
+// ディレクトリ外への書き込みを防ぐため、".."や"."、連続した"/"を含むキーはエラーにする
+func localFilePath(dir string, key string) (string, error) {
+	if key == "" || path.Clean("/"+key) != "/"+strings.TrimSuffix(key, "/") {
+		return "", fmt.Errorf("key cannot be restored as a file path: %q", key)
+	}
+	return filepath.Join(dir, filepath.FromSlash(key)), nil
+}
+
+// 監査記録をアップロードするGCSバケット内のプレフィックス
+const auditObjectPrefix = backupformat.AuditPrefix
+
+// 誰が、いつ、何をコピーしたかの監査記録（バックアップの記録と同じ形式）
+type auditRecord struct {
+	RunID          string    `json:"runId"`
+	Action         string    `json:"action"`
+	User           string    `json:"user"`
+	Host           string    `json:"host"`
+	ServiceAccount string    `json:"serviceAccount,omitempty"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+	Source         string    `json:"source"`
+	Destination    string    `json:"destination"`
+	ConfigHash     string    `json:"configHash"`
+	TotalObjects   int64     `json:"totalObjects"`
+	SkippedObjects int64     `json:"skippedObjects"`
+	Errors         int64     `json:"errors"`
+	Result         string    `json:"result"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// 1つの復元元バケットの復元結果から監査記録を作る
+func (c *restoreConfig) newRestoreAuditRecord(target *restoreTarget, startTime time.Time, config any, totalObjects int, skippedObjects int, restoreErr error) auditRecord {
+	destination := target.S3Bucket
+	if target.LocalPath != "" {
+		destination = target.LocalPath
+	}
+	userName := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		userName = current.Username
+	}
+	host, _ := os.Hostname()
+	configJSON, _ := json.Marshal(config)
+	configHash := sha256.Sum256(configJSON)
+	random := make([]byte, 4)
+	rand.Read(random)
+
+	record := auditRecord{
+		RunID:          "restore-" + startTime.Format("20060102-150405") + "-" + hex.EncodeToString(random),
+		Action:         "restore",
+		User:           userName,
+		Host:           host,
+		ServiceAccount: c.gcsServiceAccount(),
+		StartTime:      startTime,
+		EndTime:        time.Now(),
+		Source:         target.GCSBucketName,
+		Destination:    destination,
+		ConfigHash:     hex.EncodeToString(configHash[:]),
+		TotalObjects:   int64(totalObjects),
+		SkippedObjects: int64(skippedObjects),
+		Result:         "succeeded",
+	}
+	if restoreErr != nil {
+		record.Errors = 1
+		record.Result = "failed"
+		record.Error = restoreErr.Error()
+	}
+	return record
+}
+
+// 監査記録を.s3-backup-helper/audit/<実行ID>.jsonとしてアップロードする（既にある場合は上書きしない）
+func writeAuditRecord(ctx context.Context, gcsBucket *storage.BucketHandle, record auditRecord) error {
+	recordJSON, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	writer := gcsBucket.Object(auditObjectPrefix + record.RunID + ".json").If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(recordJSON); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload audit record: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload audit record: %w", err)
+	}
+	return nil
+}
+
+// GCSへのアクセスに使うサービスアカウント（権限を借用する場合はそのアカウント、分からない場合は空）
+func (c *restoreConfig) gcsServiceAccount() string {
+	if c.gcpConfig.ImpersonateServiceAccount != "" {
+		return c.gcpConfig.ImpersonateServiceAccount
+	}
+	credentialsJSON := c.gcpConfig.CredentialsJSON
+	if credentialsJSON == nil && c.gcpConfig.CredentialsPath != "" {
+		var err error
+		credentialsJSON, err = os.ReadFile(c.gcpConfig.CredentialsPath)
+		if err != nil {
+			return ""
+		}
+	}
+	var credentials struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if json.Unmarshal(credentialsJSON, &credentials) != nil {
+		return ""
+	}
+	return credentials.ClientEmail
+}
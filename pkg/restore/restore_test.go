@@ -0,0 +1,343 @@
+package restore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/traPtitech/s3-backup-helper/pkg/backup"
+	"github.com/traPtitech/s3-backup-helper/pkg/backupformat"
+)
+
+func TestLocalFilePath(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "a.txt", want: filepath.Join(dir, "a.txt")},
+		{key: "a/b/c.txt", want: filepath.Join(dir, "a", "b", "c.txt")},
+		{key: "dir/", want: filepath.Join(dir, "dir")},
+		{key: "", wantErr: true},
+		{key: "/abs", wantErr: true},
+		{key: "..", wantErr: true},
+		{key: "../x", wantErr: true},
+		{key: "a/../../x", wantErr: true},
+		{key: "a/../b", wantErr: true},
+		{key: "a/./b", wantErr: true},
+		{key: "a//b", wantErr: true},
+		{key: "a/..", wantErr: true},
+		{key: "dir//", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := localFilePath(dir, tt.key)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("localFilePath(%q) = %q, want error", tt.key, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("localFilePath(%q) returned error: %v", tt.key, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("localFilePath(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestParseBucketMap(t *testing.T) {
+	got, err := parseBucketMap("traq.bucket.example.org=traq, wiki.bucket.example.org = wiki-restored,shared-backup/cluster-b/=traq-b")
+	if err != nil {
+		t.Fatalf("parseBucketMap returned error: %v", err)
+	}
+	want := []BucketMapping{
+		{GCSBucket: "traq.bucket.example.org", S3Bucket: "traq"},
+		{GCSBucket: "wiki.bucket.example.org", S3Bucket: "wiki-restored"},
+		{GCSBucket: "shared-backup", S3Bucket: "traq-b", GCSPrefix: "cluster-b/"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseBucketMap = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("parseBucketMap[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	for _, value := range []string{"", ",", "traq", "=traq", "/cluster-b=traq", "traq.bucket.example.org="} {
+		if _, err := parseBucketMap(value); err == nil {
+			t.Errorf("parseBucketMap(%q) returned no error", value)
+		}
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	sum := md5.Sum([]byte("hello"))
+	expected := hex.EncodeToString(sum[:])
+
+	reader := newMD5VerifyingReader(strings.NewReader("hello"), expected)
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Errorf("verifyingReader returned error for matching data: %v", err)
+	}
+
+	reader = newMD5VerifyingReader(strings.NewReader("hellO"), expected)
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Error("verifyingReader returned no error for corrupted data")
+	}
+
+	// パートに分けてアップロードしたオブジェクトはCRC32Cのみ記録されている
+	crc := crc32.Checksum([]byte("hello"), crc32.MakeTable(crc32.Castagnoli))
+	expectedCRC32C := base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc))
+	reader = newCRC32CVerifyingReader(strings.NewReader("hello"), expectedCRC32C)
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Errorf("verifyingReader returned error for matching CRC32C: %v", err)
+	}
+	reader = newCRC32CVerifyingReader(strings.NewReader("hellO"), expectedCRC32C)
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Error("verifyingReader returned no error for corrupted data with CRC32C")
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.jsonl")
+	entry := restoreStateEntry{Bucket: "bucket", Name: "a.txt", Generation: 1}
+
+	state, err := openRestoreState(statePath)
+	if err != nil {
+		t.Fatalf("openRestoreState returned error: %v", err)
+	}
+	if state.Restored(entry) {
+		t.Error("new state has restored entry")
+	}
+	if err := state.Record(entry); err != nil {
+		t.Fatalf("Record returned error: %v", err)
+	}
+	state.Close()
+
+	state, err = openRestoreState(statePath)
+	if err != nil {
+		t.Fatalf("openRestoreState returned error: %v", err)
+	}
+	defer state.Close()
+	if !state.Restored(entry) {
+		t.Error("reopened state does not have recorded entry")
+	}
+	// 世代が変わった場合は復元し直す
+	if state.Restored(restoreStateEntry{Bucket: "bucket", Name: "a.txt", Generation: 2}) {
+		t.Error("state has entry with different generation")
+	}
+}
+
+func TestNewDetectingDecompressReader(t *testing.T) {
+	original := strings.Repeat("s3-backup-helper ", 100)
+	compressed := map[string][]byte{}
+
+	var snappyBuffer bytes.Buffer
+	snappyWriter := snappy.NewBufferedWriter(&snappyBuffer)
+	snappyWriter.Write([]byte(original))
+	snappyWriter.Close()
+	compressed["snappy"] = snappyBuffer.Bytes()
+
+	var gzipBuffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipBuffer)
+	gzipWriter.Write([]byte(original))
+	gzipWriter.Close()
+	compressed["gzip"] = gzipBuffer.Bytes()
+
+	zstdEncoder, _ := zstd.NewWriter(nil)
+	compressed["zstd"] = zstdEncoder.EncodeAll([]byte(original), nil)
+
+	for name, data := range compressed {
+		// メタデータが無くてもマジックバイトから判定する
+		for _, recorded := range []string{name, ""} {
+			reader, detected, err := newDetectingDecompressReader(bytes.NewReader(data), recorded)
+			if err != nil {
+				t.Fatalf("%v (recorded %q): returned error: %v", name, recorded, err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil || string(got) != original || detected != name {
+				t.Errorf("%v (recorded %q): detected %v, err %v", name, recorded, detected, err)
+			}
+		}
+	}
+
+	// 空のオブジェクト
+	reader, _, err := newDetectingDecompressReader(bytes.NewReader(nil), "")
+	if err != nil {
+		t.Fatalf("empty object: returned error: %v", err)
+	}
+	if got, _ := io.ReadAll(reader); len(got) != 0 {
+		t.Errorf("empty object: got %q", got)
+	}
+	// 判定できないもの
+	if _, _, err := newDetectingDecompressReader(strings.NewReader("plain text"), ""); err == nil {
+		t.Error("unknown format: returned no error")
+	}
+}
+
+// メタデータの無い古いバックアップと新しいバックアップが混在していても、形式ごとに数える
+func TestFormatCounts(t *testing.T) {
+	formats := make(map[string]int)
+	for _, object := range []struct{ recorded, detected string }{
+		{"", "snappy"},
+		{"snappy", "snappy"},
+		{"", "snappy"},
+		{"zstd", "zstd"},
+		{"none", "none"},
+	} {
+		formats[formatLabel(object.recorded, object.detected)]++
+	}
+	if got, want := formatCounts(formats), "legacy-snappy=2, none=1, snappy=1, zstd=1"; got != want {
+		t.Errorf("formatCounts() = %q, want %q", got, want)
+	}
+}
+
+func TestIsManagedObject(t *testing.T) {
+	target := &restoreTarget{GCSPrefix: "cluster-a/"}
+	tests := map[string]bool{
+		"cluster-a/.s3-backup-helper/resume.json": true,
+		"cluster-a/.s3-backup-helper/blobs/abc":   true,
+		"cluster-a/.s3-backup-helper.lock":        true,
+		"cluster-a/.s3-backup-helper-notes.txt":   false,
+		"cluster-a/.s3-backup-helper.lock.bak":    false,
+		"cluster-a/docs/.s3-backup-helper/x":      false,
+		".s3-backup-helper/resume.json":           false,
+		"cluster-a/.s3-backup-escaped/key/%0A":    false,
+	}
+	for name, want := range tests {
+		if got := isManagedObject(target, name); got != want {
+			t.Errorf("isManagedObject(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// Optionsで上書きした設定は、その実行でのみ使う
+func TestRunnerConfig(t *testing.T) {
+	first := NewRunner(Options{S3AccessKey: "first", Buckets: []BucketMapping{{GCSBucket: "backup", S3Bucket: "traq"}}}).config()
+	if first.s3Config.AccessKey != "first" || len(first.bucketMappings) != 1 || first.bucketMappings[0].S3Bucket != "traq" {
+		t.Errorf("config() = %+v, want options applied", first)
+	}
+	second := NewRunner(Options{}).config()
+	if second.s3Config.AccessKey != "" || len(second.bucketMappings) != 0 {
+		t.Errorf("config() of another runner = %+v, want defaults", second)
+	}
+	if !second.s3Config.ForcePathStyle || second.deleteMarkerPolicy != deleteMarkersHonor {
+		t.Errorf("config() = %+v, want default path style and delete marker policy", second)
+	}
+}
+
+// テスト用のメモリ上の復元元（バックアップ先のGCSバケット）
+// 一覧と読み込みのみを使う
+type memoryBackup struct {
+	backup.ObjectDestination
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	info backup.ObjectInfo
+	body []byte
+}
+
+func (b *memoryBackup) Head(ctx context.Context, key string) (*backup.ObjectInfo, error) {
+	object, ok := b.objects[key]
+	if !ok {
+		return nil, backup.ErrObjectNotFound
+	}
+	return &object.info, nil
+}
+
+func (b *memoryBackup) Get(ctx context.Context, key string, generation int64) (io.ReadCloser, error) {
+	object, ok := b.objects[key]
+	if !ok {
+		return nil, backup.ErrObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(object.body)), nil
+}
+
+// テスト用のメモリ上の復元先（S3バケット）
+// 書き込みのみを使う
+type memoryRestored struct {
+	backup.ObjectSource
+	objects map[string]memoryObject
+}
+
+func (r *memoryRestored) Put(ctx context.Context, key string, info backup.ObjectInfo, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	r.objects[key] = memoryObject{info: info, body: data}
+	return nil
+}
+
+func TestRestoreObject(t *testing.T) {
+	original := []byte("hello")
+	sum := md5.Sum(original)
+	var compressed bytes.Buffer
+	writer := snappy.NewBufferedWriter(&compressed)
+	writer.Write(original)
+	writer.Close()
+
+	source := &memoryBackup{objects: map[string]memoryObject{
+		"cluster-a/a.txt": {
+			info: backup.ObjectInfo{Key: "cluster-a/a.txt", ContentType: "text/plain", ContentEncoding: "identity", Metadata: map[string]string{
+				"owner":                                 "traP",
+				backupformat.MetadataCompression:        "snappy",
+				backupformat.MetadataOriginalMD5:        hex.EncodeToString(sum[:]),
+				backupformat.MetadataSourceLastModified: "2024-01-01T00:00:00Z",
+			}},
+			body: compressed.Bytes(),
+		},
+	}}
+	restored := &memoryRestored{objects: map[string]memoryObject{}}
+	target := &restoreTarget{GCSPrefix: "cluster-a/", Objects: source, S3Objects: restored}
+
+	run := newRestoreRun(newRestoreConfig(), io.Discard)
+	format, err := run.restoreObject(context.Background(), target, "cluster-a/a.txt")
+	if err != nil {
+		t.Fatalf("restoreObject returned error: %v", err)
+	}
+	if format != "snappy" {
+		t.Errorf("restoreObject() format = %q, want snappy", format)
+	}
+	object, ok := restored.objects["a.txt"]
+	if !ok {
+		t.Fatalf("restored objects = %v, want a.txt", restored.objects)
+	}
+	if !bytes.Equal(object.body, original) {
+		t.Errorf("restored body = %q, want %q", object.body, original)
+	}
+	if object.info.ContentType != "text/plain" || object.info.ContentEncoding != "identity" {
+		t.Errorf("restored headers = %+v", object.info)
+	}
+	// バックアップ用のメタデータは除き、元のLastModifiedを記録する
+	want := map[string]string{"owner": "traP", metadataOriginalLastModified: "2024-01-01T00:00:00Z"}
+	if len(object.info.Metadata) != len(want) || object.info.Metadata["owner"] != want["owner"] || object.info.Metadata[metadataOriginalLastModified] != want[metadataOriginalLastModified] {
+		t.Errorf("restored metadata = %v, want %v", object.info.Metadata, want)
+	}
+
+	// 削除マーカーの記録にあるキーは復元しない
+	target.DeletedKeys = map[string]bool{"a.txt": true}
+	delete(restored.objects, "a.txt")
+	if _, err := run.restoreObject(context.Background(), target, "cluster-a/a.txt"); err != errDeletedKey {
+		t.Errorf("restoreObject() of a deleted key returned %v, want errDeletedKey", err)
+	}
+	if len(restored.objects) != 0 || target.DeletedObjects != 1 {
+		t.Errorf("deleted key was restored: %v", restored.objects)
+	}
+}
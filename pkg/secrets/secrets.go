@@ -0,0 +1,129 @@
+// バックアップとリストアで共通の、シークレットの読み込み
+// 環境変数の値は<名前>_FILEのファイルや、シークレットの参照（gcp-secret://、vault://）から読み込める
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/secretmanager/v1"
+)
+
+// シークレットの参照の接頭辞
+const (
+	// gcp-secret://projects/<project>/secrets/<name>/versions/<version>
+	gcpSecretPrefix = "gcp-secret://"
+	// vault://<path>#<key>（VAULT_ADDRとVAULT_TOKENが必要）
+	vaultSecretPrefix = "vault://"
+)
+
+// 環境変数の値を取得する
+// <name>_FILEが指定されている場合は、そのファイルの内容を値とする（Docker/Kubernetesのシークレット）
+func GetenvOrFile(name string) (string, error) {
+	return GetenvOrFileFunc(os.Getenv, name)
+}
+
+// GetenvOrFileと同じく値を取得する（環境変数の代わりにgetenvから読む）
+func GetenvOrFileFunc(getenv func(string) string, name string) (string, error) {
+	filePath := getenv(name + "_FILE")
+	if filePath == "" {
+		return getenv(name), nil
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v_FILE: %w", name, err)
+	}
+	// ファイル末尾の改行は値に含めない
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// 設定値がシークレットの参照か
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, gcpSecretPrefix) || strings.HasPrefix(value, vaultSecretPrefix)
+}
+
+// 設定値がシークレットの参照の場合は、参照先から値を取得する
+// 参照でない場合はそのまま返す
+// httpClientはVaultへのリクエストに使う（プロキシやCAの設定を反映したもの）
+func Resolve(ctx context.Context, value string, httpClient *http.Client) (string, error) {
+	switch {
+	case strings.HasPrefix(value, gcpSecretPrefix):
+		return fetchGCPSecret(ctx, strings.TrimPrefix(value, gcpSecretPrefix))
+	case strings.HasPrefix(value, vaultSecretPrefix):
+		return fetchVaultSecret(ctx, strings.TrimPrefix(value, vaultSecretPrefix), httpClient)
+	default:
+		return value, nil
+	}
+}
+
+// GCP Secret Managerからシークレットを取得する
+// 認証情報はApplication Default Credentialsから読み込む
+func fetchGCPSecret(ctx context.Context, name string) (string, error) {
+	service, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+	response, err := service.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to access secret %v: %w", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(response.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// HashiCorp Vaultからシークレットを取得する
+// KVシークレットエンジンのv1とv2の両方に対応する
+func fetchVaultSecret(ctx context.Context, ref string, httpClient *http.Client) (string, error) {
+	secretPath, key, found := strings.Cut(ref, "#")
+	if !found || secretPath == "" || key == "" {
+		return "", fmt.Errorf("invalid vault secret reference: %v", ref)
+	}
+	vaultAddr := os.Getenv("VAULT_ADDR")
+	if vaultAddr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is required to fetch vault secret: %v", ref)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(vaultAddr, "/")+"/v1/"+secretPath, nil)
+	if err != nil {
+		return "", err
+	}
+	vaultToken, err := GetenvOrFile("VAULT_TOKEN")
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", vaultToken)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch vault secret %v: status code %d", secretPath, res.StatusCode)
+	}
+
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	data := body.Data
+	// KV v2の場合はdata.dataに値が入っている
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("key %v not found in vault secret %v", key, secretPath)
+	}
+	return value, nil
+}